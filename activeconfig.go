@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// REDACTED replaces secrets in /config, matching what url.URL.Redacted
+// puts in place of a password.
+const REDACTED = "xxxxx"
+
+// ActiveConfig is the configuration the most recent cycle loaded, as served
+// by /config.
+type ActiveConfig struct {
+	Source   string `json:"source"`
+	Path     string `json:"path"`
+	LoadedAt string `json:"loaded_at,omitempty"`
+	Routers  Config `json:"routers"`
+}
+
+var (
+	activeConfigMutex  sync.Mutex
+	activeConfig       Config
+	activeConfigLoaded time.Time
+)
+
+// recordActiveConfig keeps the configuration a cycle loaded, so /config can
+// show what the collector is actually using.
+func recordActiveConfig(config Config) {
+	activeConfigMutex.Lock()
+	defer activeConfigMutex.Unlock()
+
+	activeConfig = config
+	activeConfigLoaded = time.Now()
+}
+
+// activeConfigSnapshot returns the recorded configuration with its secrets
+// redacted. Before the first cycle Routers is empty and LoadedAt unset.
+func activeConfigSnapshot() ActiveConfig {
+	activeConfigMutex.Lock()
+	defer activeConfigMutex.Unlock()
+
+	snapshot := ActiveConfig{Routers: Config{}}
+	if *configDB != "" {
+		snapshot.Source, snapshot.Path = "database", redactURL(*configDB)
+	} else {
+		snapshot.Source, snapshot.Path = "file", *configPath
+		if info, err := os.Stat(*configPath); err == nil && info.IsDir() {
+			snapshot.Source = "directory"
+		}
+	}
+	if !activeConfigLoaded.IsZero() {
+		snapshot.LoadedAt = displayTime(activeConfigLoaded)
+	}
+	for routerIP, urls := range activeConfig {
+		snapshot.Routers[routerIP] = redactRouterConfig(urls)
+	}
+	return snapshot
+}
+
+// redactRouterConfig returns a copy of urls without passwords in its URLs,
+// its ubus session token and password or the values of headers that look
+// like credentials.
+func redactRouterConfig(urls RouterConfig) RouterConfig {
+	urls.APStatsURL = redactURL(urls.APStatsURL)
+	urls.WANStatsURL = redactURL(urls.WANStatsURL)
+	urls.DHCPLeasesURL = redactURL(urls.DHCPLeasesURL)
+	if urls.FallbackURLs != nil {
+		fallbacks := map[string][]string{}
+		for endpoint, list := range urls.FallbackURLs {
+			for _, url := range list {
+				fallbacks[endpoint] = append(fallbacks[endpoint], redactURL(url))
+			}
+		}
+		urls.FallbackURLs = fallbacks
+	}
+	urls.CombinedURL = redactURL(urls.CombinedURL)
+	urls.Proxy = redactURL(urls.Proxy)
+	if urls.UbusSession != "" && urls.UbusSession != UBUS_ANONYMOUS_SESSION {
+		urls.UbusSession = REDACTED
+	}
+	if urls.UbusPassword != "" {
+		urls.UbusPassword = REDACTED
+	}
+	if urls.Headers != nil {
+		headers := make(map[string]string, len(urls.Headers))
+		for name, value := range urls.Headers {
+			if isSecretHeader(name) {
+				value = REDACTED
+			}
+			headers[name] = value
+		}
+		urls.Headers = headers
+	}
+	return urls
+}
+
+// redactURL hides the password of a URL with user info. Anything that
+// doesn't parse as such is returned unchanged.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	return u.Redacted()
+}
+
+func isSecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range []string{"auth", "cookie", "token", "key", "secret", "password"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": activeConfigSnapshot()})
+}
+
+// activeSubnetPools returns the merged subnets of the recorded
+// configuration, which every router carries. It is nil before the first
+// cycle.
+func activeSubnetPools() []subnetPool {
+	activeConfigMutex.Lock()
+	defer activeConfigMutex.Unlock()
+
+	for _, urls := range activeConfig {
+		return urls.subnets
+	}
+	return nil
+}
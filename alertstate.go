@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Alerts keep their state in alert_state, keyed by the alert and what it is
+// about (e.g. "upload_anomaly:aa:bb:cc:dd:ee:ff"), so a restart doesn't
+// send them again. An alert that fired is disarmed: it stays quiet while
+// its condition persists and is armed again once the condition clears, and
+// even then it fires at most once per -alert-cooldown.
+
+// alertKey is the alert_state key of event about id.
+func alertKey(event, id string) string {
+	return event + ":" + id
+}
+
+// fireAlertLocked reports whether the alert key may fire at now and, if so,
+// records that it did. A cooldown of 0 or less lets every occurrence fire.
+// dbMutex must be held.
+func fireAlertLocked(db *sql.DB, key string, now time.Time, cooldown time.Duration) (bool, error) {
+	if cooldown <= 0 {
+		return true, nil
+	}
+
+	var firedAt string
+	var armed bool
+	err := db.QueryRow("SELECT fired_at, armed FROM alert_state WHERE alert = ?", key).Scan(&firedAt, &armed)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("error reading alert state for %s: %w", key, err)
+	}
+	if err == nil {
+		if !armed {
+			return false, nil
+		}
+		last, err := parseStoredTime(firedAt)
+		if err == nil && now.Sub(last) < cooldown {
+			return false, nil
+		}
+	}
+
+	_, err = db.Exec(`
+		INSERT OR REPLACE INTO alert_state (alert, fired_at, armed)
+		VALUES (?, ?, 0)
+	`, key, storedTime(now))
+	if err != nil {
+		return false, fmt.Errorf("error recording alert state for %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// rearmAlertLocked notes that the condition of the alert key has cleared,
+// so it can fire again once its cooldown is over. dbMutex must be held.
+func rearmAlertLocked(db *sql.DB, key string) error {
+	_, err := db.Exec("UPDATE alert_state SET armed = 1 WHERE alert = ? AND armed = 0", key)
+	if err != nil {
+		return fmt.Errorf("error rearming alert %s: %w", key, err)
+	}
+	return nil
+}
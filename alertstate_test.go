@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFireAlertCooldown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "network_stats.db")
+	db, err := connectDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setupStatsDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	const cooldown = 24 * time.Hour
+	now := time.Now()
+	key := alertKey(UPLOAD_ANOMALY_EVENT, "aa:bb:cc:dd:ee:01")
+	fired := 0
+	for hour := 0; hour < 50; hour++ {
+		ok, err := fireAlertLocked(db, key, now.Add(time.Duration(hour)*time.Hour), cooldown)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			fired++
+		}
+	}
+	if fired != 1 {
+		t.Errorf("a condition lasting 50 hours fired %d alerts, want 1", fired)
+	}
+
+	// Clearing and recurring within the cooldown stays quiet, across a
+	// restart too.
+	if err := rearmAlertLocked(db, key); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := fireAlertLocked(db, key, now.Add(time.Hour), cooldown); ok {
+		t.Error("alert fired again within its cooldown")
+	}
+	db.Close()
+	db, err = connectDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if ok, _ := fireAlertLocked(db, key, now.Add(2*time.Hour), cooldown); ok {
+		t.Error("alert fired again within its cooldown after a restart")
+	}
+	if ok, _ := fireAlertLocked(db, key, now.Add(25*time.Hour), cooldown); !ok {
+		t.Error("rearmed alert didn't fire after its cooldown")
+	}
+}
+
+func TestSustainedAnomalyAlertsOnce(t *testing.T) {
+	old := *alertCooldown
+	*alertCooldown = 24 * time.Hour
+	defer func() { *alertCooldown = old }()
+
+	db := openTestStatsDB(t)
+	// Nothing delivers from the queue, so it holds every alert sent.
+	notify := &webhook{name: "test", queue: make(chan webhookMessage, 64)}
+	d := newUploadDetector(2, 0, 24, notify)
+	const mac = "aa:bb:cc:dd:ee:02"
+
+	var usual []trafficIncrement
+	for i := 0; i < ANOMALY_MIN_SAMPLES; i++ {
+		usual = append(usual, trafficIncrement{EntityID: mac, RXBytes: 1000, TXBytes: 100})
+	}
+	d.observe(db, usual)
+	for cycle := 0; cycle < 30; cycle++ {
+		d.observe(db, []trafficIncrement{{EntityID: mac, RXBytes: 10, TXBytes: 1 << 30}})
+	}
+	if sent := len(notify.queue); sent != 1 {
+		t.Errorf("30 anomalous cycles sent %d alerts, want 1", sent)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	UPLOAD_ANOMALY_EVENT = "upload_anomaly"
+
+	// ANOMALY_MIN_SAMPLES is how many cycles an entity needs in its
+	// baseline before it can be flagged.
+	ANOMALY_MIN_SAMPLES = 5
+)
+
+// UploadAnomaly is logged, and sent to -anomaly-webhook, when an entity's
+// TX/RX ratio for a cycle is far above its recent average.
+type UploadAnomaly struct {
+	Event       string  `json:"event"`
+	ID          string  `json:"id"`
+	RXBytes     int64   `json:"rx_bytes"`
+	TXBytes     int64   `json:"tx_bytes"`
+	Ratio       float64 `json:"ratio"`
+	BaselineMin float64 `json:"baseline_min"`
+	BaselineAvg float64 `json:"baseline_avg"`
+	BaselineMax float64 `json:"baseline_max"`
+	Timestamp   string  `json:"timestamp"`
+}
+
+// RatioBaseline summarizes the TX/RX ratios an entity is compared against.
+type RatioBaseline struct {
+	ID      string  `json:"id"`
+	Samples int     `json:"samples"`
+	Min     float64 `json:"min"`
+	Avg     float64 `json:"avg"`
+	Max     float64 `json:"max"`
+}
+
+// uploadDetector keeps each entity's TX/RX ratio over its last window
+// cycles in memory, so the baselines start again when the collector
+// restarts.
+type uploadDetector struct {
+	mutex    sync.Mutex
+	factor   float64
+	minBytes int64
+	window   int
+	notify   *webhook
+	ratios   map[string][]float64
+}
+
+// uploadAnomalies is nil unless -anomaly-factor is set; observing with a nil
+// detector does nothing.
+var uploadAnomalies *uploadDetector
+
+func newUploadDetector(factor float64, minBytes int64, window int, notify *webhook) *uploadDetector {
+	return &uploadDetector{
+		factor:   factor,
+		minBytes: minBytes,
+		window:   window,
+		notify:   notify,
+		ratios:   map[string][]float64{},
+	}
+}
+
+// uploadRatio is TX over RX for one cycle. Adding a byte to each side keeps
+// a cycle with nothing received finite.
+func uploadRatio(rx, tx int64) float64 {
+	return float64(tx+1) / float64(rx+1)
+}
+
+// observe compares each increment's ratio with the entity's baseline, then
+// adds it to the baseline. Baseline readings, rollups and idle cycles are
+// skipped. An anomaly is only reported when its alert may fire under
+// -alert-cooldown, whose state is kept in db; dbMutex must be held.
+func (d *uploadDetector) observe(db *sql.DB, increments []trafficIncrement) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	timestamp := displayTime(now)
+	for _, increment := range increments {
+		if increment.Baseline || strings.HasPrefix(increment.EntityID, SYNTHETIC_ID_PREFIX) || increment.RXBytes+increment.TXBytes == 0 {
+			continue
+		}
+		ratio := uploadRatio(increment.RXBytes, increment.TXBytes)
+		history := d.ratios[increment.EntityID]
+
+		baseline := summarizeRatios(increment.EntityID, history)
+		anomalous := baseline.Samples >= ANOMALY_MIN_SAMPLES && increment.TXBytes >= d.minBytes && ratio > d.factor*baseline.Avg
+		key := alertKey(UPLOAD_ANOMALY_EVENT, increment.EntityID)
+		fire := false
+		if anomalous {
+			var err error
+			// Without its state an alert is sent rather than lost.
+			if fire, err = fireAlertLocked(db, key, now, *alertCooldown); err != nil {
+				fmt.Println(err)
+				fire = true
+			}
+			if !fire {
+				debugf("%s: upload anomaly continues (ratio %.2f), alert already sent.\n", increment.EntityID, ratio)
+			}
+		} else if *alertCooldown > 0 {
+			if err := rearmAlertLocked(db, key); err != nil {
+				fmt.Println(err)
+			}
+		}
+		if fire {
+			anomaly := UploadAnomaly{
+				Event:       UPLOAD_ANOMALY_EVENT,
+				ID:          increment.EntityID,
+				RXBytes:     increment.RXBytes,
+				TXBytes:     increment.TXBytes,
+				Ratio:       ratio,
+				BaselineMin: baseline.Min,
+				BaselineAvg: baseline.Avg,
+				BaselineMax: baseline.Max,
+				Timestamp:   timestamp,
+			}
+			fmt.Printf("Warning: Upload anomaly for %s: sent %s and received %s this cycle, a TX/RX ratio of %.2f against a recent average of %.2f (min %.2f, max %.2f).\n",
+				anomaly.ID, humanizeBytes(anomaly.TXBytes), humanizeBytes(anomaly.RXBytes), anomaly.Ratio, anomaly.BaselineAvg, anomaly.BaselineMin, anomaly.BaselineMax)
+			d.notify.enqueue(anomaly, fmt.Sprintf("upload anomaly (%s)", anomaly.ID))
+		}
+
+		history = append(history, ratio)
+		if len(history) > d.window {
+			history = history[len(history)-d.window:]
+		}
+		d.ratios[increment.EntityID] = history
+	}
+}
+
+// baselines returns every entity's current baseline, sorted by id.
+func (d *uploadDetector) baselines() []RatioBaseline {
+	baselines := []RatioBaseline{}
+	if d == nil {
+		return baselines
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for id, history := range d.ratios {
+		baselines = append(baselines, summarizeRatios(id, history))
+	}
+	sort.Slice(baselines, func(i, j int) bool { return baselines[i].ID < baselines[j].ID })
+	return baselines
+}
+
+func summarizeRatios(id string, ratios []float64) RatioBaseline {
+	baseline := RatioBaseline{ID: id, Samples: len(ratios)}
+	if len(ratios) == 0 {
+		return baseline
+	}
+	baseline.Min, baseline.Max = ratios[0], ratios[0]
+	var sum float64
+	for _, ratio := range ratios {
+		sum += ratio
+		if ratio < baseline.Min {
+			baseline.Min = ratio
+		}
+		if ratio > baseline.Max {
+			baseline.Max = ratio
+		}
+	}
+	baseline.Avg = sum / float64(len(ratios))
+	return baseline
+}
+
+func handleDebugRatios(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": uploadAnomalies.baselines()})
+}
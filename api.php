@@ -67,6 +67,41 @@ function fetchAllData($db, $tableName) {
     return $data;
 }
 
+/**
+ * Tells client rows of monthly_stats from the collector's own entities:
+ * the WAN counters (main_wan, main_wan6, and main_wan:<router> and
+ * main_wan6:<router> when WAN is kept per router), tracked tunnels
+ * (tunnel:<label>) and rollups such as __total__ and __unparsed__:<router>.
+ * Counting those as clients would count the same traffic twice.
+ * @param string $entityId The id column of a monthly_stats row.
+ * @return bool True for a client device.
+ */
+function isClientId($entityId) {
+    if (strpos($entityId, '__') === 0 || strpos($entityId, 'tunnel:') === 0) {
+        return false;
+    }
+    foreach (['main_wan', 'main_wan6'] as $wanId) {
+        if ($entityId === $wanId || strpos($entityId, $wanId . ':') === 0) {
+            return false;
+        }
+    }
+    return true;
+}
+
+/**
+ * Formats a stored timestamp as local time in the zone set above. The
+ * collector stores RFC 3339 UTC ("2026-10-15T05:12:58Z"); rows written by
+ * older versions hold local time without a zone ("2026-10-15 13:12:58"),
+ * which DateTime already reads as local.
+ * @param string $timestamp A timestamp column.
+ * @return string The time as 'Y-m-d H:i:s'.
+ */
+function formatTimestamp($timestamp) {
+    $dateTime = new DateTime($timestamp);
+    $dateTime->setTimezone(new DateTimeZone(date_default_timezone_get()));
+    return $dateTime->format('Y-m-d H:i:s');
+}
+
 // --- API Endpoint Logic ---
 if (!isset($_GET['action'])) {
     http_response_code(400); // Bad Request
@@ -85,10 +120,12 @@ try {
                 echo json_encode(['error' => 'Could not connect to the stats database.']);
                 exit();
             }
-            $results = $db->query("SELECT id, rx_bytes, tx_bytes FROM monthly_stats WHERE id != 'main_wan'");
+            $results = $db->query("SELECT id, rx_bytes, tx_bytes FROM monthly_stats");
             $data = [];
             while ($row = $results->fetchArray(SQLITE3_ASSOC)) {
-                $data[] = $row;
+                if (isClientId($row['id'])) {
+                    $data[] = $row;
+                }
             }
             echo json_encode(['data' => $data]);
             $db->close();
@@ -104,8 +141,7 @@ try {
             $results = $db->query("SELECT id, rx_bytes, tx_bytes, timestamp FROM monthly_stats WHERE id = 'main_wan'");
             $data = [];
             if ($row = $results->fetchArray(SQLITE3_ASSOC)) {
-                 $dateTime = new DateTime($row['timestamp']);
-                 $row['last_update'] = $dateTime->format('Y-m-d H:i:s');
+                 $row['last_update'] = formatTimestamp($row['timestamp']);
                  unset($row['timestamp']);
                  $data[] = $row;
             }
@@ -156,13 +192,12 @@ try {
                 
                 // Separate WAN stats from client stats
                 if ($entityId === 'main_wan') {
-                    $dateTime = new DateTime($stat['timestamp']);
                     $wanStats = [
                         'rx_bytes' => $stat['rx_bytes'],
                         'tx_bytes' => $stat['tx_bytes'],
-                        'last_update' => $dateTime->format('Y-m-d H:i:s')
+                        'last_update' => formatTimestamp($stat['timestamp'])
                     ];
-                } else {
+                } elseif (isClientId($entityId)) {
                     $mac = $entityId;
                     $hostname = 'Unknown';
                     
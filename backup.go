@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// backupDB writes a consistent copy of db to destPath using VACUUM INTO.
+// VACUUM INTO reads from a single snapshot, so it is safe while other
+// connections are writing and works in both rollback and WAL journal modes.
+// The mutex is held so the copy never waits on one of our own writers.
+func backupDB(db *sql.DB, mutex *sync.Mutex, destPath string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("backup destination '%s' already exists", destPath)
+	}
+	if _, err := db.Exec("VACUUM INTO ?", destPath); err != nil {
+		return fmt.Errorf("error backing up database to '%s': %w", destPath, err)
+	}
+	return nil
+}
+
+// backupDatabases snapshots both databases into dir with a timestamped name
+// and then deletes the oldest snapshots beyond keep (0 keeps everything).
+func backupDatabases(dir string, keep int) ([]string, error) {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, fmt.Errorf("error creating backup directory '%s': %w", dir, err)
+	}
+
+	stamp := time.Now().Format("20060102-150405")
+	var written []string
+	for _, target := range []struct {
+		name string
+		path string
+	}{
+		{"network_stats", *statsDBPath},
+		{"dhcp_leases", *dhcpDBPath},
+	} {
+		if target.name == "dhcp_leases" && *dhcpDBPath == *statsDBPath {
+			// Single-database mode: the stats backup already has everything.
+			continue
+		}
+		db, err := connectDB(target.path)
+		if err != nil {
+			return written, err
+		}
+		destPath := filepath.Join(dir, target.name+"-"+stamp+".db")
+		err = backupDB(db, &dbMutex, destPath)
+		db.Close()
+		if err != nil {
+			return written, err
+		}
+		written = append(written, destPath)
+
+		if err := rotateBackups(dir, target.name, keep); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func rotateBackups(dir, name string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(filepath.Join(dir, name+"-*.db"))
+	if err != nil {
+		return fmt.Errorf("error listing backups in '%s': %w", dir, err)
+	}
+	// The timestamp format sorts chronologically.
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("error removing old backup '%s': %w", backups[0], err)
+		}
+		fmt.Printf("Removed old backup %s\n", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// startBackupSchedule backs up both databases every interval until the
+// process exits. It does nothing when interval is not positive.
+func startBackupSchedule(dir string, interval time.Duration, keep int) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			written, err := backupDatabases(dir, keep)
+			if err != nil {
+				fmt.Printf("Scheduled backup failed: %v\n", err)
+				continue
+			}
+			fmt.Printf("Scheduled backup written: %v\n", written)
+		}
+	}()
+}
+
+func registerBackupHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/backup", handleBackup)
+}
+
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	written, err := backupDatabases(*backupDir, *backupKeep)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	fmt.Printf("Backup written via API: %v\n", written)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"files": written})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// isBusyError reports whether err is SQLite's SQLITE_BUSY or SQLITE_LOCKED,
+// i.e. another connection held the lock for longer than the busy timeout.
+func isBusyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// retryBusy runs write, which must be a whole transaction, and runs it again
+// up to -db-busy-retries times while it fails with a busy or locked error,
+// doubling the wait from -db-busy-backoff each time. Other errors are
+// returned at once.
+func retryBusy(what string, write func() error) error {
+	backoff := *dbBusyBackoff
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil || !isBusyError(err) || attempt >= *dbBusyRetries {
+			return err
+		}
+		fmt.Printf("Database busy while writing %s, retrying in %s (%d/%d).\n", what, backoff, attempt+1, *dbBusyRetries)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// lockStatsDB starts a write on another connection to path, which holds
+// the database's write lock until the returned transaction ends.
+func lockStatsDB(t *testing.T, path, id string) *sql.Tx {
+	t.Helper()
+	other, err := connectDB(path + "?_busy_timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { other.Close() })
+	tx, err := other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO cumulative_stats (id, rx_bytes, tx_bytes) VALUES (?, 0, 0)", id); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestRetryBusy(t *testing.T) {
+	oldRetries, oldBackoff := *dbBusyRetries, *dbBusyBackoff
+	defer func() { *dbBusyRetries, *dbBusyBackoff = oldRetries, oldBackoff }()
+	*dbBusyRetries, *dbBusyBackoff = 3, 50*time.Millisecond
+
+	// No busy timeout, so a held lock fails writes with SQLITE_BUSY at once.
+	path := filepath.Join(t.TempDir(), "network_stats.db")
+	db, err := connectDB(path + "?_busy_timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := setupStatsDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is released before the retries run out.
+	lock := lockStatsDB(t, path, "lock1")
+	time.AfterFunc(100*time.Millisecond, func() { lock.Commit() })
+	update := TrafficUpdate{EntityID: "aa:bb:cc:dd:ee:01", Source: "r1", RXBytes: 1, TXBytes: 1}
+	if err := updateTrafficStatsBatch(db, &dbMutex, []TrafficUpdate{update}); err != nil {
+		t.Fatalf("write while briefly locked: %v", err)
+	}
+
+	// Without retries the busy error comes back.
+	*dbBusyRetries = 0
+	lock = lockStatsDB(t, path, "lock2")
+	defer lock.Rollback()
+	update.EntityID = "aa:bb:cc:dd:ee:02"
+	if err := updateTrafficStatsBatch(db, &dbMutex, []TrafficUpdate{update}); !isBusyError(err) {
+		t.Errorf("write while locked = %v, want a busy error", err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+// What a router's WiFi stats lines are keyed by; see
+// RouterConfig.ClientIdentity.
+const (
+	CLIENT_IDENTITY_MAC = "mac"
+	CLIENT_IDENTITY_IP  = "ip"
+)
+
+// clientKey normalizes the key field of a WiFi stats line: a MAC address,
+// or an IP address for layouts keyed by IP. ok is false when the field
+// isn't one.
+func (c wifiColumns) clientKey(field string) (mac, ip string, ok bool) {
+	if c.ipKey {
+		ip, ok = canonicalIP(field)
+		return "", ip, ok
+	}
+	mac, ok = normalizeMAC(field)
+	return mac, "", ok
+}
+
+// keyName names the key field for log messages.
+func (c wifiColumns) keyName() string {
+	if c.ipKey {
+		return "IP address"
+	}
+	return "MAC address"
+}
+
+// clientKey is the address a client is tracked by: its IP address for a
+// router with client_identity "ip", otherwise its MAC address.
+func (client ClientStats) clientKey() string {
+	if client.IPAddress != "" {
+		return client.IPAddress
+	}
+	return client.MACAddress
+}
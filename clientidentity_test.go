@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestIPKeyedClients(t *testing.T) {
+	config := Config{"r1": {APStatsURL: "http://192.168.1.1/wifi", ClientIdentity: "ip"}}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	urls := config["r1"]
+	clients, _, _ := parseWiFiStatsColumns("192.168.001.23 100 200\nfe80::1 5 6\naa:bb:cc:dd:ee:ff 1 2", urls.wifiColumns)
+	if len(clients) != 2 {
+		t.Fatalf("parsed %+v, want the two IP lines", clients)
+	}
+	if client := clients[0]; client.IPAddress != "192.168.1.23" || client.MACAddress != "" || urls.clientEntityID(client) != "192.168.1.23" {
+		t.Errorf("first client = %+v with id %q, want it keyed by its canonical IP", client, urls.clientEntityID(client))
+	}
+
+	for _, invalid := range []RouterConfig{
+		{ClientIdentity: "ip", Format: FORMAT_UBUS},
+		{ClientIdentity: "hostname"},
+	} {
+		if err := validateConfig(Config{"r1": invalid}); err == nil {
+			t.Errorf("validateConfig accepted %+v", invalid)
+		}
+	}
+}
+
+func TestHostnamesByIP(t *testing.T) {
+	db := openTestDHCPDB(t)
+	_, err := db.Exec(`INSERT INTO dhcp_leases (mac_address, lease_end_time, ip_address, hostname, client_id, timestamp) VALUES
+		('aa:bb:cc:dd:ee:ff', 0, '192.168.1.23', 'laptop', '*', ''),
+		('11:22:33:44:55:66', 0, '192.168.1.24', 'Unknown', '*', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := queryHostnames(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{
+		"192.168.1.23":      "laptop",
+		"192.168.1.24":      "11:22:33:44:55:66",
+		"aa:bb:cc:dd:ee:ff": "laptop",
+	} {
+		if names[id] != want {
+			t.Errorf("hostname of %s = %q, want %q", id, names[id], want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Default section markers for a combined response. Each marker sits on a
+// line of its own and starts the section for its endpoint.
+var defaultCombinedMarkers = map[string]string{
+	"wifi": "### WIFI ###",
+	"wan":  "### WAN ###",
+	"dhcp": "### DHCP ###",
+}
+
+// splitCombined divides a combined response into its sections, keyed by
+// endpoint. Text before the first marker is ignored, and an endpoint whose
+// marker never appears has no entry.
+func splitCombined(data string, markers map[string]string) map[string]string {
+	endpoints := make(map[string]string, len(markers))
+	for endpoint, marker := range markers {
+		endpoints[strings.TrimSpace(marker)] = endpoint
+	}
+
+	sections := map[string]string{}
+	current := ""
+	var lines []string
+	flush := func() {
+		if current != "" {
+			sections[current] = strings.Join(lines, "\n")
+		}
+	}
+	for _, line := range strings.Split(data, "\n") {
+		if endpoint, ok := endpoints[strings.TrimSpace(line)]; ok {
+			flush()
+			current = endpoint
+			lines = nil
+			continue
+		}
+		lines = append(lines, line)
+	}
+	flush()
+	return sections
+}
+
+// fetchCombined fetches the router's combined URL once and splits it.
+func fetchCombined(urls RouterConfig) (map[string]string, error) {
+	urls.endpoint = "combined"
+	data, err := fetchData(urls, urls.CombinedURL)
+	if err != nil {
+		return nil, err
+	}
+	return splitCombined(data, urls.combinedMarkers), nil
+}
+
+// fetchEndpoint returns the text output of the router's "wifi", "wan" or
+// "dhcp" endpoint. In combined mode it comes from the matching section of
+// the combined response, which is fetched here unless processRouter already
+// did; otherwise the endpoint's own URL or command is used.
+func fetchEndpoint(urls RouterConfig, endpoint string) (string, error) {
+	if urls.CombinedURL != "" {
+		sections := urls.sections
+		if sections == nil {
+			var err error
+			if sections, err = fetchCombined(urls); err != nil {
+				return "", err
+			}
+		}
+		data, ok := sections[endpoint]
+		if !ok {
+			return "", fmt.Errorf("combined response has no %s section (marker %q)", endpoint, urls.combinedMarkers[endpoint])
+		}
+		return data, nil
+	}
+
+	urls = urls.forEndpoint(endpoint)
+	var url, command string
+	switch endpoint {
+	case "wifi":
+		url, command = urls.APStatsURL, urls.APStatsCommand
+	case "wan":
+		url, command = urls.WANStatsURL, urls.WANStatsCommand
+	case "dhcp":
+		url, command = urls.DHCPLeasesURL, urls.DHCPLeasesCommand
+	default:
+		return "", fmt.Errorf("unknown endpoint '%s'", endpoint)
+	}
+	if fallbacks := urls.FallbackURLs[endpoint]; url != "" && len(fallbacks) > 0 {
+		return fetchFallbacks(urls, endpoint, append([]string{url}, fallbacks...))
+	}
+	return fetchSource(urls, url, command)
+}
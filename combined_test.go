@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSplitCombined(t *testing.T) {
+	data := "banner before any marker\n### WIFI ###\naa:bb:cc:dd:ee:01 100 200\n  ### WAN ###  \nwan: 5 6\n"
+	sections := splitCombined(data, defaultCombinedMarkers)
+
+	for endpoint, want := range map[string]string{
+		"wifi": "aa:bb:cc:dd:ee:01 100 200",
+		"wan":  "wan: 5 6\n",
+	} {
+		if got := sections[endpoint]; got != want {
+			t.Errorf("%s section = %q, want %q", endpoint, got, want)
+		}
+	}
+	if dhcp, ok := sections["dhcp"]; ok {
+		t.Errorf("dhcp section %q, want none without its marker", dhcp)
+	}
+
+	server := replyWith(t, http.StatusOK, data)
+	config := Config{"r1": {CombinedURL: server.URL}}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	urls := config["r1"]
+	if _, err := fetchEndpoint(urls, "dhcp"); err == nil || !strings.Contains(err.Error(), "no dhcp section") {
+		t.Errorf("fetchEndpoint for a missing section = %v", err)
+	}
+	if wan, _, _, err := collectWANStats("r1", urls); err != nil || wan.RXBytes != 5 || wan.TXBytes != 6 {
+		t.Errorf("collectWANStats = %+v, %v; want the wan section's reading", wan, err)
+	}
+}
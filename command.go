@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// fetchSource reads one endpoint's text output: over HTTP when url is set,
+// otherwise by running command on this machine. With neither it returns
+// ErrURLEmpty so the endpoint is skipped as before.
+func fetchSource(urls RouterConfig, url, command string) (string, error) {
+	if url != "" {
+		return fetchData(urls, url)
+	}
+	if command != "" {
+		return runCommand(urls, command)
+	}
+	return "", ErrURLEmpty
+}
+
+// runCommand runs command and returns its stdout. The command is split on
+// whitespace and executed directly, so quotes, pipes and variables have no
+// special meaning; set command_shell to run it through /bin/sh -c instead.
+// The router's timeout and -max-response-size apply as for HTTP fetches.
+func runCommand(urls RouterConfig, command string) (string, error) {
+	timeout := urls.timeout
+	if timeout <= 0 {
+		timeout = FETCH_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(urls.context(), timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if urls.CommandShell {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	} else {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return "", ErrURLEmpty
+		}
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("error running '%s': %w", command, err)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("error running '%s': %w", command, err)
+	}
+
+	output, readErr := readLimited(stdout)
+	if readErr != nil {
+		cmd.Process.Kill()
+	}
+	waitErr := cmd.Wait()
+	if readErr != nil {
+		return "", fmt.Errorf("error reading output of '%s': %w", command, readErr)
+	}
+	if waitErr != nil {
+		if urls.context().Err() != nil {
+			return "", fmt.Errorf("command '%s' aborted: %w", command, urls.context().Err())
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("command '%s' timed out after %s", command, timeout)
+		}
+		return "", fmt.Errorf("command '%s' failed: %w: %s", command, waitErr, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// loadConfig reads the router configuration from a single JSON file, or, when
+// path is a directory, from every *.json file in it. Each file in a directory
+// holds one or more routers; defining the same router twice is an error.
+func loadConfig(path string) (Config, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("error: Configuration file '%s' not found", path)
+		}
+		return nil, fmt.Errorf("error opening config file '%s': %w", path, err)
+	}
+
+	var config Config
+	if info.IsDir() {
+		config, err = loadConfigDir(path)
+	} else {
+		config, err = loadConfigFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func loadConfigFile(filename string) (Config, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("error: Configuration file '%s' not found", filename)
+		}
+		return nil, fmt.Errorf("error opening config file '%s': %w", filename, err)
+	}
+	defer file.Close()
+
+	byteValue, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file '%s': %w", filename, err)
+	}
+
+	// The file is parsed by content, whatever its name or extension. Only
+	// JSON is supported, so point out a YAML-looking file explicitly.
+	var config Config
+	if err := json.Unmarshal(byteValue, &config); err != nil {
+		if trimmed := bytes.TrimSpace(byteValue); len(trimmed) > 0 && trimmed[0] != '{' {
+			return nil, fmt.Errorf("error: '%s' is not a JSON object (YAML and other formats are not supported): %w", filename, err)
+		}
+		return nil, fmt.Errorf("error: Invalid JSON format in '%s': %w", filename, err)
+	}
+	return config, nil
+}
+
+func loadConfigDir(dir string) (Config, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing config directory '%s': %w", dir, err)
+	}
+	sort.Strings(files)
+
+	config := Config{}
+	sources := map[string]string{}
+	for _, file := range files {
+		fileConfig, err := loadConfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for routerIP, urls := range fileConfig {
+			if previous, ok := sources[routerIP]; ok {
+				return nil, fmt.Errorf("error: router '%s' is defined in both '%s' and '%s'", routerIP, previous, file)
+			}
+			sources[routerIP] = file
+			config[routerIP] = urls
+		}
+	}
+	return config, nil
+}
+
+// validateConfig checks every router entry and compiles any per-router
+// patterns, storing the compiled forms back into config.
+func validateConfig(config Config) error {
+	tunnelLabels := map[string]string{}
+	for routerIP, urls := range config {
+		switch urls.Format {
+		case "", FORMAT_TEXT:
+		case FORMAT_UBUS:
+			if urls.CombinedURL != "" {
+				return fmt.Errorf("error: router '%s' can't use a combined URL with ubus format", routerIP)
+			}
+			if urls.APStatsURL != "" && len(urls.UbusWiFiDevices) == 0 {
+				return fmt.Errorf("error: router '%s' uses ubus format but lists no ubus_wifi_devices", routerIP)
+			}
+			if urls.UbusUsername != "" && urls.UbusSession != "" {
+				return fmt.Errorf("error: router '%s' sets both ubus_username and ubus_session", routerIP)
+			}
+		default:
+			return fmt.Errorf("error: router '%s' has unknown format '%s'", routerIP, urls.Format)
+		}
+		if urls.Format != FORMAT_UBUS && (urls.UbusUsername != "" || urls.UbusPassword != "") {
+			return fmt.Errorf("error: router '%s' sets ubus credentials without ubus format", routerIP)
+		}
+
+		switch urls.DuplicateMACs {
+		case "", DUPLICATE_MACS_SUM, DUPLICATE_MACS_SEPARATE:
+		default:
+			return fmt.Errorf("error: router '%s' has unknown duplicate_macs '%s', expected sum or separate", routerIP, urls.DuplicateMACs)
+		}
+
+		switch urls.ResetPolicy {
+		case "", RESET_POLICY_COUNT_NEW, RESET_POLICY_IGNORE, RESET_POLICY_ESTIMATE:
+		default:
+			return fmt.Errorf("error: router '%s' has unknown reset_policy '%s', expected count_new, ignore or estimate", routerIP, urls.ResetPolicy)
+		}
+
+		switch urls.LeaseFormat {
+		case "", LEASE_FORMAT_DNSMASQ, LEASE_FORMAT_ODHCPD:
+		default:
+			return fmt.Errorf("error: router '%s' has unknown lease_format '%s'", routerIP, urls.LeaseFormat)
+		}
+		if urls.LeasePrefixes && urls.LeaseFormat != LEASE_FORMAT_ODHCPD {
+			return fmt.Errorf("error: router '%s' sets lease_prefixes, which needs lease_format '%s'", routerIP, LEASE_FORMAT_ODHCPD)
+		}
+
+		if urls.WANPattern != "" {
+			re, err := regexp.Compile(urls.WANPattern)
+			if err != nil {
+				return fmt.Errorf("error: router '%s' has an invalid wan_pattern: %w", routerIP, err)
+			}
+			if re.NumSubexp() != 2 {
+				return fmt.Errorf("error: router '%s' wan_pattern must have exactly two capture groups (RX, TX), found %d", routerIP, re.NumSubexp())
+			}
+			urls.wanPattern = re
+		}
+
+		if len(urls.WiFiColumns) > 0 {
+			columns, err := newWiFiColumns(urls.WiFiColumns)
+			if err != nil {
+				return fmt.Errorf("error: router '%s' wifi_columns: %w", routerIP, err)
+			}
+			urls.wifiColumns = columns
+		}
+		if urls.WiFiDelimiter != "" {
+			separator, ok := wifiDelimiters[urls.WiFiDelimiter]
+			if !ok {
+				return fmt.Errorf("error: router '%s' has unknown wifi_delimiter '%s', expected whitespace, comma or tab", routerIP, urls.WiFiDelimiter)
+			}
+			if urls.wifiColumns.maxFields == 0 {
+				urls.wifiColumns = defaultWiFiColumns
+			}
+			urls.wifiColumns.separator = separator
+		}
+		switch urls.ClientIdentity {
+		case "", CLIENT_IDENTITY_MAC:
+		case CLIENT_IDENTITY_IP:
+			if urls.Format == FORMAT_UBUS {
+				return fmt.Errorf("error: router '%s' can't key ubus clients by IP", routerIP)
+			}
+			if urls.wifiColumns.maxFields == 0 {
+				urls.wifiColumns = defaultWiFiColumns
+			}
+			urls.wifiColumns.ipKey = true
+		default:
+			return fmt.Errorf("error: router '%s' has unknown client_identity '%s', expected %s or %s", routerIP, urls.ClientIdentity, CLIENT_IDENTITY_MAC, CLIENT_IDENTITY_IP)
+		}
+
+		if urls.Timeout != "" {
+			timeout, err := time.ParseDuration(urls.Timeout)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("error: router '%s' has an invalid timeout '%s'", routerIP, urls.Timeout)
+			}
+			urls.timeout = timeout
+		}
+
+		for endpoint, value := range urls.Timeouts {
+			switch endpoint {
+			case "wifi", "wan", "dhcp":
+			default:
+				return fmt.Errorf("error: router '%s' has a timeout for unknown endpoint '%s', expected wifi, wan or dhcp", routerIP, endpoint)
+			}
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("error: router '%s' has an invalid %s timeout '%s'", routerIP, endpoint, value)
+			}
+			if urls.timeouts == nil {
+				urls.timeouts = map[string]time.Duration{}
+			}
+			urls.timeouts[endpoint] = timeout
+		}
+
+		for _, url := range []string{urls.APStatsURL, urls.WANStatsURL, urls.DHCPLeasesURL, urls.CombinedURL} {
+			if err := validateUnixURL(url); err != nil {
+				return fmt.Errorf("error: router '%s': %w", routerIP, err)
+			}
+		}
+		if err := validateFallbackURLs(routerIP, urls); err != nil {
+			return err
+		}
+
+		if urls.ClientCert != "" || urls.ClientKey != "" || urls.CACert != "" {
+			routerTLS, err := loadRouterTLS(urls.ClientCert, urls.ClientKey, urls.CACert)
+			if err != nil {
+				return fmt.Errorf("error: router '%s': %w", routerIP, err)
+			}
+			urls.tls = routerTLS
+		}
+
+		urls.name = routerIP
+
+		if urls.SSH != nil {
+			tunnel, err := loadSSHTunnel(routerIP, *urls.SSH)
+			if err != nil {
+				return fmt.Errorf("error: router '%s': %w", routerIP, err)
+			}
+			urls.ssh = tunnel
+		}
+
+		if urls.Proxy != "" {
+			if _, err := parseProxyURL(urls.Proxy); err != nil {
+				return fmt.Errorf("error: router '%s': %w", routerIP, err)
+			}
+		}
+
+		if urls.RequestGap != "" {
+			gap, err := time.ParseDuration(urls.RequestGap)
+			if err != nil || gap < 0 {
+				return fmt.Errorf("error: router '%s' has an invalid request_gap '%s'", routerIP, urls.RequestGap)
+			}
+			urls.requestGap = gap
+		}
+
+		for _, pattern := range urls.TrackOnly {
+			p, err := normalizeMACPattern(pattern)
+			if err != nil {
+				return fmt.Errorf("error: router '%s' track_only: %w", routerIP, err)
+			}
+			urls.trackOnly = append(urls.trackOnly, p)
+		}
+		for _, pattern := range urls.Ignore {
+			p, err := normalizeMACPattern(pattern)
+			if err != nil {
+				return fmt.Errorf("error: router '%s' ignore: %w", routerIP, err)
+			}
+			urls.ignore = append(urls.ignore, p)
+		}
+
+		if len(urls.Tags) > 0 {
+			tags, err := normalizeTags(urls.Tags)
+			if err != nil {
+				return fmt.Errorf("error: router '%s' tags: %w", routerIP, err)
+			}
+			urls.tags = tags
+		}
+
+		if len(urls.Tunnels) > 0 {
+			if urls.Format == FORMAT_UBUS {
+				return fmt.Errorf("error: router '%s' can't track tunnels with ubus format", routerIP)
+			}
+			tunnels, err := normalizeTunnels(urls.Tunnels)
+			if err != nil {
+				return fmt.Errorf("error: router '%s' tunnels: %w", routerIP, err)
+			}
+			// A tunnel entity is one router's counter, like a client that
+			// doesn't roam.
+			for _, label := range tunnels {
+				if other, ok := tunnelLabels[label]; ok {
+					return fmt.Errorf("error: routers '%s' and '%s' both have a tunnel labelled '%s'", other, routerIP, label)
+				}
+				tunnelLabels[label] = routerIP
+			}
+			urls.tunnels = tunnels
+		} else if urls.ExcludeTunnelsFromWAN {
+			return fmt.Errorf("error: router '%s' sets exclude_tunnels_from_wan but has no tunnels", routerIP)
+		}
+
+		if len(urls.Offsets) > 0 {
+			offsets, err := normalizeOffsets(urls.Offsets)
+			if err != nil {
+				return fmt.Errorf("error: router '%s' offsets: %w", routerIP, err)
+			}
+			urls.offsets = offsets
+		}
+
+		if len(urls.Hostnames) > 0 {
+			hostnames, err := normalizeHostnames(urls.Hostnames)
+			if err != nil {
+				return fmt.Errorf("error: router '%s' hostnames: %w", routerIP, err)
+			}
+			urls.hostnames = hostnames
+		}
+
+		if len(urls.Caps) > 0 {
+			caps, err := normalizeCaps(urls.Caps)
+			if err != nil {
+				return fmt.Errorf("error: router '%s' caps: %w", routerIP, err)
+			}
+			urls.caps = caps
+		}
+
+		if len(urls.Subnets) > 0 {
+			subnets, err := normalizeSubnets(urls.Subnets)
+			if err != nil {
+				return fmt.Errorf("error: router '%s' subnets: %w", routerIP, err)
+			}
+			urls.subnets = subnetPools(subnets)
+		}
+
+		for _, endpoint := range urls.Disable {
+			switch endpoint {
+			case "wifi", "wan", "dhcp":
+			default:
+				return fmt.Errorf("error: router '%s' disables unknown endpoint '%s', expected wifi, wan or dhcp", routerIP, endpoint)
+			}
+			if urls.disabled == nil {
+				urls.disabled = map[string]bool{}
+			}
+			urls.disabled[endpoint] = true
+		}
+
+		if urls.CombinedURL != "" {
+			urls.combinedMarkers = map[string]string{}
+			for endpoint, marker := range defaultCombinedMarkers {
+				urls.combinedMarkers[endpoint] = marker
+			}
+			for endpoint, marker := range urls.CombinedMarkers {
+				if _, ok := defaultCombinedMarkers[endpoint]; !ok {
+					return fmt.Errorf("error: router '%s' has a combined marker for unknown endpoint '%s', expected wifi, wan or dhcp", routerIP, endpoint)
+				}
+				if strings.TrimSpace(marker) == "" {
+					return fmt.Errorf("error: router '%s' has an empty combined marker for '%s'", routerIP, endpoint)
+				}
+				urls.combinedMarkers[endpoint] = marker
+			}
+		}
+
+		config[routerIP] = urls
+	}
+
+	// Without any gateway every router's WAN adds to main_wan, as before.
+	gateways := false
+	for _, urls := range config {
+		gateways = gateways || urls.WANGateway
+	}
+	hostnames, err := mergeHostnames(config)
+	if err != nil {
+		return err
+	}
+	subnets, err := mergeSubnets(config)
+	if err != nil {
+		return err
+	}
+	caps, err := mergeCaps(config)
+	if err != nil {
+		return err
+	}
+	for routerIP, urls := range config {
+		urls.sharedWAN = !gateways || urls.WANGateway
+		urls.perRouterWAN = gateways
+		urls.hostnames = hostnames
+		urls.subnets = subnets
+		urls.caps = caps
+		config[routerIP] = urls
+	}
+	return nil
+}
+
+// wanIDs returns the entity ids a router's WAN counters are stored under,
+// for base MAIN_WAN_ID or MAIN_WAN6_ID: the shared id when the router counts
+// towards the internet total, and its own per-router id once gateways are
+// configured. A zero RouterConfig uses the shared id.
+func (urls RouterConfig) wanIDs(base, routerIP string) []string {
+	var ids []string
+	if urls.sharedWAN || !urls.perRouterWAN {
+		ids = append(ids, base)
+	}
+	if urls.perRouterWAN {
+		ids = append(ids, base+WAN_ROUTER_SEPARATOR+routerIP)
+	}
+	return ids
+}
+
+// wanCondition is an SQL condition matching column against every WAN
+// entity: the shared ids and the per-router ones.
+func wanCondition(column string) string {
+	return "(" + column + " IN ('" + MAIN_WAN_ID + "', '" + MAIN_WAN6_ID + "') OR " +
+		column + " LIKE '" + MAIN_WAN_ID + WAN_ROUTER_SEPARATOR + "%' OR " +
+		column + " LIKE '" + MAIN_WAN6_ID + WAN_ROUTER_SEPARATOR + "%')"
+}
+
+// forEndpoint returns a copy of the router's config whose timeout is the one
+// for endpoint: the router's per-endpoint timeout, else its general timeout,
+// else the endpoint's -*-timeout flag.
+func (urls RouterConfig) forEndpoint(endpoint string) RouterConfig {
+	urls.endpoint = endpoint
+	if timeout, ok := urls.timeouts[endpoint]; ok {
+		urls.timeout = timeout
+		return urls
+	}
+	if urls.timeout > 0 {
+		return urls
+	}
+	switch endpoint {
+	case "wifi":
+		urls.timeout = *wifiTimeout
+	case "wan":
+		urls.timeout = *wanTimeout
+	case "dhcp":
+		urls.timeout = *dhcpTimeout
+	}
+	return urls
+}
+
+// withoutEndpoints returns a copy of the router's config with endpoints
+// disabled, leaving the original's disabled map untouched.
+func (urls RouterConfig) withoutEndpoints(endpoints ...string) RouterConfig {
+	disabled := map[string]bool{}
+	for endpoint := range urls.disabled {
+		disabled[endpoint] = true
+	}
+	for _, endpoint := range endpoints {
+		disabled[endpoint] = true
+	}
+	urls.disabled = disabled
+	return urls
+}
+
+// endpointEnabled reports whether the router's "wifi", "wan" or "dhcp"
+// endpoint should be fetched: it has a URL or command, or the router has a
+// combined URL, and it isn't disabled.
+func (urls RouterConfig) endpointEnabled(endpoint string) bool {
+	if urls.disabled[endpoint] {
+		return false
+	}
+	if urls.CombinedURL != "" {
+		return true
+	}
+	switch endpoint {
+	case "wifi":
+		return urls.APStatsURL != "" || urls.APStatsCommand != ""
+	case "wan":
+		return urls.WANStatsURL != "" || urls.WANStatsCommand != ""
+	case "dhcp":
+		return urls.DHCPLeasesURL != "" || urls.DHCPLeasesCommand != ""
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigWithoutExtension(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	config, err := loadConfig(write("routers", `{"192.168.1.1": {"wan_stats": "http://192.168.1.1/cgi-bin/wan.cgi"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config["192.168.1.1"].WANStatsURL; got != "http://192.168.1.1/cgi-bin/wan.cgi" {
+		t.Errorf("wan_stats = %q", got)
+	}
+
+	_, err = loadConfig(write("routers.yaml", "192.168.1.1:\n  wan_stats: http://192.168.1.1/cgi-bin/wan.cgi\n"))
+	if err == nil || !strings.Contains(err.Error(), "not a JSON object") {
+		t.Errorf("loading YAML = %v, want an error saying it isn't JSON", err)
+	}
+}
+
+func TestEndpointTimeouts(t *testing.T) {
+	slow := slowServer(t, 200*time.Millisecond, "1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 phone *\n")
+	config := Config{"r1": {APStatsURL: slow.URL, DHCPLeasesURL: slow.URL, Timeouts: map[string]string{"wifi": "50ms", "dhcp": "2s"}}}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	urls := config["r1"]
+
+	if _, err := fetchEndpoint(urls, "wifi"); err == nil {
+		t.Error("wifi fetch outlived its 50ms timeout")
+	}
+	if _, err := fetchEndpoint(urls, "dhcp"); err != nil {
+		t.Errorf("dhcp fetch within its 2s timeout: %v", err)
+	}
+	if got := urls.forEndpoint("wan").timeout; got != *wanTimeout {
+		t.Errorf("wan timeout = %s, want the -wan-timeout default %s", got, *wanTimeout)
+	}
+
+	if err := validateConfig(Config{"r1": {Timeouts: map[string]string{"bogus": "1s"}}}); err == nil {
+		t.Error("timeout for an unknown endpoint accepted")
+	}
+}
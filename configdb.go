@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// DEFAULT_CONFIG_QUERY reads the basic fields from a "routers" table. Other
+// column names map to the routers.json keys of the same name.
+const DEFAULT_CONFIG_QUERY = "SELECT router, ap_stats, wan_stats, dhcp_leases FROM routers"
+
+// loadRouters reads the router configuration from -config-db when it is
+// set, and from the -config file or directory otherwise.
+func loadRouters() (Config, error) {
+	if *configDB != "" {
+		return loadConfigDB(*configDBDriver, *configDB, *configQuery)
+	}
+	return loadConfig(*configPath)
+}
+
+// loadConfigDB runs query against the database and turns each row into a
+// router entry. The "router" column is the key used in routers.json; every
+// other column is the JSON key of the same name, and an optional "config"
+// column holds a JSON object with any further settings, which the other
+// columns override. NULL columns are left unset.
+func loadConfigDB(driver, dsn, query string) (Config, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config database: %w", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying config database: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("error reading config query columns: %w", err)
+	}
+	hasRouter := false
+	for _, column := range columns {
+		hasRouter = hasRouter || column == "router"
+	}
+	if !hasRouter {
+		return nil, fmt.Errorf("error: config query must return a 'router' column")
+	}
+
+	config := Config{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("error scanning config row: %w", err)
+		}
+		routerIP, urls, err := configRow(columns, values)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := config[routerIP]; ok {
+			return nil, fmt.Errorf("error: config query returned router '%s' twice", routerIP)
+		}
+		config[routerIP] = urls
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading config rows: %w", err)
+	}
+
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// configRow builds one router entry from a row of the config query by way
+// of its JSON form, so the columns decode exactly like routers.json.
+func configRow(columns []string, values []interface{}) (string, RouterConfig, error) {
+	var urls RouterConfig
+	var routerIP string
+	var extra interface{}
+	fields := map[string]interface{}{}
+	for i, column := range columns {
+		value := values[i]
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		if value == nil {
+			continue
+		}
+		switch column {
+		case "router":
+			routerIP = fmt.Sprint(value)
+		case "config":
+			extra = value
+		default:
+			fields[column] = value
+		}
+	}
+	if routerIP == "" {
+		return "", urls, fmt.Errorf("error: config query returned a row without a router")
+	}
+
+	if extra != nil {
+		text, ok := extra.(string)
+		var settings map[string]interface{}
+		if !ok || json.Unmarshal([]byte(text), &settings) != nil {
+			return "", urls, fmt.Errorf("error: router '%s' config column is not a JSON object", routerIP)
+		}
+		for key, value := range settings {
+			if _, ok := fields[key]; !ok {
+				fields[key] = value
+			}
+		}
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", urls, fmt.Errorf("error encoding config for router '%s': %w", routerIP, err)
+	}
+	if err := json.Unmarshal(data, &urls); err != nil {
+		return "", urls, fmt.Errorf("error: invalid config for router '%s': %w", routerIP, err)
+	}
+	return routerIP, urls, nil
+}
@@ -0,0 +1,946 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RouterResult summarizes what one router contributed to a collection cycle.
+type RouterResult struct {
+	Router  string   `json:"router"`
+	Clients int      `json:"clients"`
+	WAN     bool     `json:"wan"`
+	Leases  int      `json:"leases"`
+	Errors  []string `json:"errors,omitempty"`
+
+	// ErrorCounts counts Errors by category (ERROR_FETCH and so on).
+	ErrorCounts map[string]int `json:"error_counts,omitempty"`
+
+	// IPConflicts lists IP addresses claimed by more than one active lease
+	// in this router's DHCP data.
+	IPConflicts []IPConflict `json:"ip_conflicts,omitempty"`
+
+	// FailedFetches names the fetches ("wifi", "wan", "dhcp", "combined")
+	// that failed, or is "timeout" when the router didn't finish within
+	// -cycle-timeout.
+	FailedFetches []string `json:"failed_fetches,omitempty"`
+
+	// Endpoints says, per endpoint the router has, which stages succeeded.
+	Endpoints map[string]*EndpointResult `json:"endpoints,omitempty"`
+}
+
+type CycleSummary struct {
+	StartedAt string         `json:"started_at"`
+	Duration  string         `json:"duration"`
+	Routers   []RouterResult `json:"routers"`
+
+	DurationSeconds float64 `json:"duration_seconds"`
+	RoutersFailed   int     `json:"routers_failed"`
+
+	// UnavailableDatabases names the databases ("stats", "dhcp") that
+	// couldn't be opened this cycle, so their endpoints were skipped.
+	UnavailableDatabases []string `json:"unavailable_databases,omitempty"`
+
+	// Month-to-date WAN totals after the cycle.
+	WANMonthlyRX      int64  `json:"wan_monthly_rx_bytes"`
+	WANMonthlyTX      int64  `json:"wan_monthly_tx_bytes"`
+	WANMonthlyRXHuman string `json:"wan_monthly_rx_human"`
+	WANMonthlyTXHuman string `json:"wan_monthly_tx_human"`
+
+	// WAN RX+TX projected linearly to the end of the month.
+	WANProjected      int64  `json:"wan_projected_total_bytes"`
+	WANProjectedHuman string `json:"wan_projected_total_human"`
+
+	started time.Time
+}
+
+// records counts the rows the cycle stored: clients, WAN readings and leases.
+func (s *CycleSummary) records() int {
+	n := 0
+	for _, result := range s.Routers {
+		n += result.Clients + result.Leases
+		if result.WAN {
+			n++
+		}
+	}
+	return n
+}
+
+// failedRouters counts the routers with at least one failed fetch, the same
+// test /status uses.
+func (s *CycleSummary) failedRouters() int {
+	n := 0
+	for _, result := range s.Routers {
+		if len(result.FailedFetches) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// recordCycleStats stores one row per cycle in cycle_stats, for -record-cycles.
+func recordCycleStats(db *sql.DB, mutex *sync.Mutex, summary *CycleSummary) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	_, err := db.Exec(`
+		INSERT INTO cycle_stats (started_at, duration_ms, routers, routers_failed, records)
+		VALUES (?, ?, ?, ?, ?)
+	`, storedTime(summary.started), int64(summary.DurationSeconds*1000), len(summary.Routers), summary.RoutersFailed, summary.records())
+	if err != nil {
+		return fmt.Errorf("error recording cycle stats: %w", err)
+	}
+	return nil
+}
+
+// logLine renders the cycle as one log entry: the totals first, then every
+// router's result, errors included, as JSON.
+func (s *CycleSummary) logLine() string {
+	var clients, leases, wan int
+	errors := map[string]int{ERROR_FETCH: 0, ERROR_PARSE: 0, ERROR_STORE: 0}
+	for _, result := range s.Routers {
+		clients += result.Clients
+		leases += result.Leases
+		if result.WAN {
+			wan++
+		}
+		for category, n := range result.ErrorCounts {
+			errors[category] += n
+		}
+	}
+	categories := make([]string, 0, len(errors))
+	for category := range errors {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	counts := make([]string, len(categories))
+	for i, category := range categories {
+		counts[i] = fmt.Sprintf("%s=%d", category, errors[category])
+	}
+
+	detail, err := json.Marshal(s.Routers)
+	if err != nil {
+		detail = []byte(fmt.Sprintf("%q", err.Error()))
+	}
+	degraded := ""
+	if len(s.UnavailableDatabases) > 0 {
+		degraded = fmt.Sprintf(" (%s database unavailable)", strings.Join(s.UnavailableDatabases, " and "))
+	}
+	return fmt.Sprintf("Cycle summary: %d routers (%d failing) in %s%s; updated %d clients, %d WAN readings, %d leases; errors %s; WAN this month %s received, %s sent, on track for %s; routers %s",
+		len(s.Routers), s.RoutersFailed, s.Duration, degraded, clients, wan, leases, strings.Join(counts, " "),
+		s.WANMonthlyRXHuman, s.WANMonthlyTXHuman, s.WANProjectedHuman, detail)
+}
+
+var (
+	lastCycleMutex sync.Mutex
+	lastCycle      *CycleSummary
+)
+
+func lastCycleSummary() *CycleSummary {
+	lastCycleMutex.Lock()
+	defer lastCycleMutex.Unlock()
+	return lastCycle
+}
+
+// cycleLock is held for the whole of a collection cycle so a manually
+// triggered cycle never overlaps the scheduled one.
+var cycleLock = make(chan struct{}, 1)
+
+var (
+	manualCollectMutex sync.Mutex
+	lastManualCollect  time.Time
+)
+
+// Error categories counted in RouterResult.ErrorCounts.
+const (
+	ERROR_FETCH = "fetch"
+	ERROR_PARSE = "parse"
+	ERROR_STORE = "store"
+)
+
+// addError records an error under category. Each one is logged only with
+// -verbose; the end-of-cycle summary carries them all.
+func (r *RouterResult) addError(category, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	debugf("%s\n", message)
+	r.Errors = append(r.Errors, message)
+	if r.ErrorCounts == nil {
+		r.ErrorCounts = map[string]int{}
+	}
+	r.ErrorCounts[category]++
+}
+
+// processRouter fetches and stores each of the router's enabled endpoints;
+// see RouterConfig.endpointEnabled. They run one after another, spaced by
+// the router's request gap, unless the router sets parallel_fetch.
+func processRouter(routerIP string, urls RouterConfig, connStats, connDHCP *sql.DB) RouterResult {
+	result := RouterResult{Router: routerIP}
+	debugf("Processing router: %s\n", routerIP)
+
+	// In combined mode one request serves all three endpoints, so there
+	// is nothing to space out or parallelize.
+	if urls.CombinedURL != "" {
+		fetchStart := time.Now()
+		sections, err := fetchCombined(urls)
+		recordFetch(routerIP, "combined", time.Since(fetchStart), err)
+		result.endpoint("combined").fetched(err)
+		if err != nil {
+			recordQuality(routerIP, "combined", 0, 0, err)
+			result.addError(ERROR_FETCH, "Error fetching combined stats for %s: %v", routerIP, err)
+			result.FailedFetches = append(result.FailedFetches, "combined")
+			return result
+		}
+		urls.sections = sections
+		urls.ParallelFetch = false
+		urls.requestGap = 0
+	}
+
+	var steps []func(*RouterResult)
+	if urls.endpointEnabled("wifi") {
+		steps = append(steps, func(r *RouterResult) { processWiFi(r, urls, connStats) })
+	}
+	if urls.endpointEnabled("wan") {
+		steps = append(steps, func(r *RouterResult) { processWAN(r, urls, connStats) })
+	}
+	if urls.endpointEnabled("dhcp") {
+		steps = append(steps, func(r *RouterResult) { processDHCP(r, urls, connStats, connDHCP) })
+	}
+
+	if !urls.ParallelFetch {
+		for i, step := range steps {
+			if i > 0 {
+				urls.pause()
+			}
+			step(&result)
+		}
+		return result
+	}
+
+	// Each endpoint fills in its own result, merged in a fixed order
+	// afterwards. Their database writes still take dbMutex.
+	partial := make([]RouterResult, len(steps))
+	var wg sync.WaitGroup
+	for i, step := range steps {
+		wg.Add(1)
+		go func(i int, step func(*RouterResult)) {
+			defer wg.Done()
+			partial[i].Router = routerIP
+			step(&partial[i])
+		}(i, step)
+	}
+	wg.Wait()
+	for _, p := range partial {
+		result.merge(p)
+	}
+	return result
+}
+
+// merge adds the outcome of one endpoint, processed separately, to r.
+func (r *RouterResult) merge(other RouterResult) {
+	r.Clients += other.Clients
+	r.WAN = r.WAN || other.WAN
+	r.Leases += other.Leases
+	r.Errors = append(r.Errors, other.Errors...)
+	for category, n := range other.ErrorCounts {
+		if r.ErrorCounts == nil {
+			r.ErrorCounts = map[string]int{}
+		}
+		r.ErrorCounts[category] += n
+	}
+	r.IPConflicts = append(r.IPConflicts, other.IPConflicts...)
+	r.FailedFetches = append(r.FailedFetches, other.FailedFetches...)
+	for name, e := range other.Endpoints {
+		*r.endpoint(name) = *e
+	}
+}
+
+func processWiFi(result *RouterResult, urls RouterConfig, connStats *sql.DB) {
+	routerIP := result.Router
+
+	// A payload that mostly failed to parse is reported, but the clients
+	// that did parse are still recorded.
+	fetchStart := time.Now()
+	clients, summary, err := collectWiFiStats(routerIP, urls)
+	recordFetch(routerIP, "wifi", time.Since(fetchStart), err)
+	recordQuality(routerIP, "wifi", summary.Parsed, summary.Skipped, err)
+	endpoint := result.endpoint("wifi")
+	endpoint.fetched(err)
+	if err != nil {
+		result.addError(ERROR_FETCH, "Error collecting WiFi stats for %s: %v", routerIP, err)
+		result.FailedFetches = append(result.FailedFetches, "wifi")
+	}
+	if *unparsedEntity && summary.UnparsedLines > 0 {
+		storeUnparsed(result, connStats, urls.writer, summary)
+	}
+	if len(clients) == 0 {
+		if err == nil {
+			fmt.Printf("No WiFi client data found for %s.\n", routerIP)
+		}
+		return
+	}
+
+	var updates []TrafficUpdate
+	for _, client := range clients {
+		// The MAC filters have nothing to match in clients keyed by IP.
+		if client.MACAddress != "" && !urls.tracksMAC(client.MACAddress) {
+			debugf("%s: Ignoring WiFi client %s.\n", routerIP, client.MACAddress)
+			continue
+		}
+		debugf("%s: WiFi client %+v\n", routerIP, client)
+		snapshots.addClient(routerIP, client)
+		id := urls.clientEntityID(client)
+		updates = append(updates, TrafficUpdate{
+			EntityID:         id,
+			Source:           routerIP,
+			Interface:        client.Interface,
+			RXBytes:          client.RXBytes,
+			TXBytes:          client.TXBytes,
+			ConnectedTime:    client.ConnectedTime,
+			HasConnectedTime: client.HasConnectedTime,
+			Signal:           client.Signal,
+			HasSignal:        client.HasSignal,
+			Noise:            client.Noise,
+			HasNoise:         client.HasNoise,
+			ResetPolicy:      urls.ResetPolicy,
+			Offset:           urls.offsetFor(id),
+		})
+	}
+	updates = sumDuplicateUpdates(routerIP, updates)
+	if !*dryRun {
+		switch {
+		case pendingWrites.holdUpdates(routerIP, WRITE_CLIENTS, updates):
+			result.Clients = len(updates)
+			endpoint.stored(true)
+		case urls.writer.send(heldWrite{router: routerIP, kind: WRITE_CLIENTS, updates: updates}):
+		default:
+			result.Clients = storeClientUpdates(result, connStats, updates)
+			endpoint.stored(result.Clients == len(updates))
+		}
+	}
+}
+
+// storeUnparsed records the summed counters of a router's skipped WiFi
+// lines under its UNPARSED_ID entity. Each router has its own, since the
+// sums from different routers aren't one counter.
+func storeUnparsed(result *RouterResult, connStats *sql.DB, writer *recordWriter, summary WiFiParseSummary) {
+	routerIP := result.Router
+	id := UNPARSED_ID + WAN_ROUTER_SEPARATOR + routerIP
+	debugf("%s: %d unparsed WiFi lines, rx %d, tx %d\n", routerIP, summary.UnparsedLines, summary.UnparsedRX, summary.UnparsedTX)
+	if *dryRun {
+		return
+	}
+	updates := []TrafficUpdate{{EntityID: id, Source: routerIP, RXBytes: summary.UnparsedRX, TXBytes: summary.UnparsedTX}}
+	if pendingWrites.holdUpdates(routerIP, WRITE_UNPARSED, updates) {
+		result.endpoint("wifi").stored(true)
+		return
+	}
+	if writer.send(heldWrite{router: routerIP, kind: WRITE_UNPARSED, updates: updates}) {
+		return
+	}
+	err := updateTrafficStatsBatch(connStats, &dbMutex, updates)
+	if err != nil {
+		result.addError(ERROR_STORE, "Error updating traffic stats for %s (%s): %v", id, routerIP, err)
+	}
+	result.endpoint("wifi").stored(err == nil)
+}
+
+func processWAN(result *RouterResult, urls RouterConfig, connStats *sql.DB) {
+	routerIP := result.Router
+
+	fetchStart := time.Now()
+	wan, wan6, tunnels, err := collectWANStats(routerIP, urls)
+	recordFetch(routerIP, "wan", time.Since(fetchStart), err)
+	if err == nil {
+		recordQuality(routerIP, "wan", 1, 0, nil)
+	} else {
+		recordQuality(routerIP, "wan", 0, 0, err)
+	}
+	result.endpoint("wan").fetched(err)
+	if err != nil {
+		result.addError(ERROR_FETCH, "Error collecting WAN stats for %s: %v", routerIP, err)
+		result.FailedFetches = append(result.FailedFetches, "wan")
+		return
+	}
+	if wan == nil && wan6 == nil {
+		fmt.Printf("No WAN data found for %s.\n", routerIP)
+		return
+	}
+
+	storeWAN(result, connStats, urls, urls.wanIDs(MAIN_WAN_ID, routerIP), wan, tunnels)
+	storeWAN(result, connStats, urls, urls.wanIDs(MAIN_WAN6_ID, routerIP), wan6, nil)
+}
+
+// storeWAN records one address family's WAN counters under each of ids (see
+// RouterConfig.wanIDs), in one batch with the router's tunnels so the WAN
+// can be offset by them; a nil wan means the router didn't report that
+// family this cycle.
+func storeWAN(result *RouterResult, connStats *sql.DB, urls RouterConfig, ids []string, wan *WANStats, tunnels map[string]WANStats) {
+	if wan == nil && len(tunnels) == 0 {
+		return
+	}
+	routerIP := result.Router
+
+	updates, tunnelIDs := tunnelUpdates(routerIP, urls, tunnels)
+	if wan != nil {
+		debugf("%s: %s %+v\n", routerIP, ids[0], *wan)
+		snapshots.addWAN(routerIP, ids[0], *wan)
+		for _, id := range ids {
+			update := TrafficUpdate{EntityID: id, Source: routerIP, RXBytes: wan.RXBytes, TXBytes: wan.TXBytes, ResetPolicy: urls.ResetPolicy, Offset: urls.offsetFor(id)}
+			if urls.ExcludeTunnelsFromWAN {
+				update.OffsetBy = tunnelIDs
+			}
+			updates = append(updates, update)
+		}
+	}
+	if *dryRun {
+		return
+	}
+	stored := true
+	switch {
+	case pendingWrites.holdUpdates(routerIP, WRITE_WAN, updates):
+	case urls.writer.send(heldWrite{router: routerIP, kind: WRITE_WAN, updates: updates}):
+		return
+	default:
+		if err := updateTrafficStatsBatch(connStats, &dbMutex, updates); err != nil {
+			var failed []string
+			for _, u := range updates {
+				failed = append(failed, u.EntityID)
+			}
+			result.addError(ERROR_STORE, "Error updating traffic stats for %s (%s): %v", strings.Join(failed, ", "), routerIP, err)
+			stored = false
+		}
+	}
+	result.WAN = result.WAN || (stored && wan != nil)
+	result.endpoint("wan").stored(stored)
+}
+
+func processDHCP(result *RouterResult, urls RouterConfig, connStats, connDHCP *sql.DB) {
+	routerIP := result.Router
+
+	fetchStart := time.Now()
+	dhcpData, err := fetchEndpoint(urls, "dhcp")
+	recordFetch(routerIP, "dhcp", time.Since(fetchStart), err)
+	endpoint := result.endpoint("dhcp")
+	endpoint.fetched(err)
+	if err != nil {
+		recordQuality(routerIP, "dhcp", 0, 0, err)
+		result.addError(ERROR_FETCH, "Error fetching DHCP leases for %s: %v", routerIP, err)
+		result.FailedFetches = append(result.FailedFetches, "dhcp")
+		return
+	}
+
+	leases, prefixes, skipped, err := parseLeases(urls, dhcpData)
+	deadLetters.write(routerIP, "dhcp", skipped)
+	if err != nil {
+		recordParseErrors(routerIP, "dhcp", len(skipped)+1)
+		recordQuality(routerIP, "dhcp", len(leases)+len(prefixes), len(skipped), parseError{err})
+	} else {
+		recordParseErrors(routerIP, "dhcp", len(skipped))
+		recordQuality(routerIP, "dhcp", len(leases)+len(prefixes), len(skipped), nil)
+	}
+	if len(skipped) > 0 {
+		fmt.Printf("Warning: Skipped %d DHCP lease lines from %s.\n", len(skipped), routerIP)
+	}
+	if err != nil {
+		endpoint.Parse = STAGE_FAILED
+		result.addError(ERROR_PARSE, "Error parsing DHCP leases for %s: %v", routerIP, err)
+		result.FailedFetches = append(result.FailedFetches, "dhcp")
+		return
+	}
+	// Conflicts are checked before MAC filtering, since an ignored
+	// device can still take another's address.
+	result.IPConflicts = findIPConflicts(leases, time.Now())
+	for _, conflict := range result.IPConflicts {
+		fmt.Printf("Warning: IP address %s on %s is leased to %d devices: %s.\n", conflict.IPAddress, routerIP, len(conflict.MACAddresses), strings.Join(conflict.MACAddresses, ", "))
+	}
+	leases = filterLeases(urls, leases)
+	storePrefixes(result, urls, connDHCP, prefixes)
+	if len(leases) == 0 {
+		fmt.Printf("No DHCP lease data found for %s.\n", routerIP)
+		return
+	}
+	applyHostnames(urls, leases)
+
+	for _, lease := range leases {
+		debugf("%s: DHCP lease %+v\n", routerIP, lease)
+		snapshots.addLease(routerIP, lease)
+	}
+	if !*dryRun {
+		if pendingWrites.holdLeases(routerIP, leases) {
+			result.Leases = len(leases)
+			endpoint.stored(true)
+			return
+		}
+		if urls.writer.send(heldWrite{router: routerIP, kind: WRITE_LEASES, leases: leases}) {
+			return
+		}
+		storeLeases(result, connStats, connDHCP, leases)
+	}
+}
+
+// storeLeases writes a router's leases and resets the devices that, per
+// -device-change-reset, they show have changed.
+func storeLeases(result *RouterResult, connStats, connDHCP *sql.DB, leases []DHCPLease) {
+	routerIP := result.Router
+	changes, err := upsertDHCPLeases(connDHCP, &dbMutex, leases)
+	if err != nil {
+		result.addError(ERROR_STORE, "Error upserting DHCP leases for %s: %v", routerIP, err)
+	} else {
+		result.Leases = len(leases)
+	}
+	result.endpoint("dhcp").stored(err == nil)
+	for _, change := range changes {
+		if connStats == nil {
+			fmt.Printf("Warning: Not resetting %s on %s (%s): the stats database is unavailable.\n", change.MACAddress, routerIP, change.Reason)
+			continue
+		}
+		reset, err := resetChangedDevice(connStats, &dbMutex, change)
+		if err != nil {
+			result.endpoint("dhcp").stored(false)
+			result.addError(ERROR_STORE, "Error resetting %s on %s: %v", change.MACAddress, routerIP, err)
+			continue
+		}
+		fmt.Printf("Device change on %s (%s): %s; archived the totals of %d entities, counting starts afresh.\n", change.MACAddress, routerIP, change.Reason, reset)
+	}
+}
+
+// storeClientUpdates writes all of a router's client readings in one
+// transaction. If that fails, the readings are retried one by one so a single
+// bad row only loses that client. It returns the number stored.
+func storeClientUpdates(result *RouterResult, db *sql.DB, updates []TrafficUpdate) int {
+	if err := updateTrafficStatsBatch(db, &dbMutex, updates); err == nil {
+		return len(updates)
+	} else if len(updates) == 1 {
+		result.addError(ERROR_STORE, "Error updating traffic stats for client %s (%s): %v", updates[0].EntityID, result.Router, err)
+		return 0
+	}
+
+	stored := 0
+	for _, u := range updates {
+		if err := updateTrafficStatsBatch(db, &dbMutex, []TrafficUpdate{u}); err != nil {
+			result.addError(ERROR_STORE, "Error updating traffic stats for client %s (%s): %v", u.EntityID, result.Router, err)
+			continue
+		}
+		stored++
+	}
+	return stored
+}
+
+// storePrefixes writes the router's delegated prefixes when it sets
+// lease_prefixes, after the same MAC filtering as its leases.
+func storePrefixes(result *RouterResult, urls RouterConfig, connDHCP *sql.DB, prefixes []DelegatedPrefix) {
+	if len(prefixes) == 0 {
+		return
+	}
+	if !urls.LeasePrefixes {
+		debugf("%s: skipping %d delegated prefixes\n", result.Router, len(prefixes))
+		return
+	}
+	var kept []DelegatedPrefix
+	for _, prefix := range prefixes {
+		if urls.tracksMAC(prefix.MACAddress) {
+			debugf("%s: delegated prefix %+v\n", result.Router, prefix)
+			kept = append(kept, prefix)
+		}
+	}
+	if *dryRun {
+		return
+	}
+	err := upsertDelegatedPrefixes(connDHCP, &dbMutex, kept)
+	if err != nil {
+		result.addError(ERROR_STORE, "Error storing delegated prefixes for %s: %v", result.Router, err)
+	}
+	result.endpoint("dhcp").stored(err == nil)
+}
+
+// filterLeases drops the leases whose MAC address the router is configured
+// not to track.
+func filterLeases(urls RouterConfig, leases []DHCPLease) []DHCPLease {
+	var kept []DHCPLease
+	for _, lease := range leases {
+		if urls.tracksMAC(lease.MACAddress) {
+			kept = append(kept, lease)
+		}
+	}
+	return kept
+}
+
+// cycleDeadline is when -once's -deadline passes, zero without it. Cycles
+// are cut short there like at -cycle-timeout.
+var cycleDeadline time.Time
+
+// runCycle performs one full collection: it loads the configuration, opens
+// and prepares both databases, and processes every router concurrently.
+// Each router's fetches are delayed by a random amount up to routerDelay.
+// If only one database can be opened, the endpoints stored in the other are
+// skipped and the rest are collected as usual.
+func runCycle(routerDelay time.Duration) (*CycleSummary, error) {
+	cycleLock <- struct{}{}
+	defer func() { <-cycleLock }()
+
+	return runCycleLocked(routerDelay)
+}
+
+func runCycleLocked(routerDelay time.Duration) (*CycleSummary, error) {
+	start := time.Now()
+
+	// Nothing is fetched or stored while paused, so counters that reset
+	// during the maintenance are diffed cleanly once it is over.
+	if status := collectionPauseStatus(); status.Paused {
+		return nil, fmt.Errorf("%w (by %s since %s)", ErrCollectionPaused, status.By, status.Since)
+	}
+
+	routers, err := loadRouters()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConfigLoad, err)
+	}
+	if len(routers) == 0 {
+		return nil, ErrNoRouters
+	}
+	recordActiveConfig(routers)
+
+	connStats, connDHCP, err := openCycleDBs()
+	if err != nil {
+		return nil, err
+	}
+	if connStats != nil {
+		defer connStats.Close()
+	}
+	if connDHCP != nil && connDHCP != connStats {
+		defer connDHCP.Close()
+	}
+	var unavailable []string
+	if connStats == nil {
+		unavailable = append(unavailable, "stats")
+		for routerIP, urls := range routers {
+			routers[routerIP] = urls.withoutEndpoints("wifi", "wan")
+		}
+	}
+	if connDHCP == nil {
+		unavailable = append(unavailable, "dhcp")
+		for routerIP, urls := range routers {
+			routers[routerIP] = urls.withoutEndpoints("dhcp")
+		}
+	}
+
+	// With -flush-every, only every Nth cycle writes its own and the held
+	// readings, and does the upkeep that depends on them.
+	writing := pendingWrites.due()
+	if connStats != nil {
+		// Readings held from last month must land in it before it is
+		// archived.
+		now := time.Now()
+		if pendingWrites.heldBefore(time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)) {
+			pendingWrites.flush(connStats, connDHCP)
+		}
+		if err := resetMonthlyStats(connStats, &dbMutex); err != nil {
+			fmt.Printf("Failed to reset monthly stats: %v\n", err)
+		}
+		if !*dryRun && writing {
+			if err := syncEntityTags(connStats, &dbMutex, collectTags(routers)); err != nil {
+				fmt.Printf("Failed to store entity tags: %v\n", err)
+			}
+		}
+		if *pruneStaleDays > 0 && !*dryRun && writing {
+			if _, err := pruneStaleEntities(connStats, &dbMutex, *pruneStaleDays, *pruneStaleMonthly); err != nil {
+				fmt.Printf("Failed to prune stale entities: %v\n", err)
+			}
+		}
+		if *historyRetention > 0 && !*dryRun && writing {
+			if _, err := pruneTrafficHistory(connStats, &dbMutex, *historyRetention); err != nil {
+				fmt.Printf("Failed to prune traffic history: %v\n", err)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if *cycleTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), *cycleTimeout)
+	}
+	defer cancel()
+	if !cycleDeadline.IsZero() {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithDeadline(ctx, cycleDeadline)
+		defer cancelDeadline()
+	}
+
+	var writer *recordWriter
+	if *singleWriter && !*dryRun {
+		writer = startRecordWriter(connStats, connDHCP, *writerQueue)
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan RouterResult, len(routers))
+
+	for routerIP, urls := range routers {
+		wg.Add(1)
+		go func(routerIP string, urls RouterConfig) {
+			defer wg.Done()
+			if delay := jitter(routerDelay); delay > 0 {
+				debugf("Delaying router %s by %s.\n", routerIP, delay)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return
+				}
+			}
+			urls.cycleCtx = ctx
+			urls.writer = writer
+			result := processRouter(routerIP, urls, connStats, connDHCP)
+			if ctx.Err() != nil {
+				return
+			}
+			recordRouterStatus(result)
+			results <- result
+		}(routerIP, urls)
+	}
+
+	summary := &CycleSummary{StartedAt: displayTime(start), UnavailableDatabases: unavailable, started: start}
+	finished := waitForRouters(ctx, &wg, results, len(routers))
+	if ctx.Err() != nil {
+		limit := fmt.Sprintf("-cycle-timeout %s", *cycleTimeout)
+		if !cycleDeadline.IsZero() && !time.Now().Before(cycleDeadline) {
+			limit = fmt.Sprintf("-deadline %s", *deadline)
+		}
+		summary.Routers = abandonRouters(routers, finished, limit)
+	}
+	for _, result := range finished {
+		summary.Routers = append(summary.Routers, result)
+	}
+	stored := writer.stop()
+	for i := range summary.Routers {
+		if result, ok := stored[summary.Routers[i].Router]; ok {
+			summary.Routers[i].mergeStored(*result)
+		}
+	}
+	if writing {
+		pendingWrites.flush(connStats, connDHCP)
+	}
+	// Expiries are tracked even without -lease-webhook, so enabling it
+	// later doesn't replay every lease that ran out in the meantime.
+	if !*dryRun && writing && connDHCP != nil {
+		if err := notifyExpiredLeases(connDHCP, &dbMutex, time.Now()); err != nil {
+			fmt.Printf("Error checking for expired leases: %v\n", err)
+		}
+	}
+	if !*dryRun && writing && connStats != nil {
+		if err := updateTotalStats(connStats, &dbMutex, *totalSource); err != nil {
+			fmt.Printf("Error updating %s: %v\n", TOTAL_ID, err)
+		}
+	}
+	if !*dryRun && writing && connStats != nil {
+		if err := clientPresence.update(connStats, &dbMutex, summary, time.Now()); err != nil {
+			fmt.Println(err)
+		}
+		if err := localEvents.publishQuotaCrossings(connStats, &dbMutex, time.Now()); err != nil {
+			fmt.Println(err)
+		}
+	}
+	duration := time.Since(start)
+	summary.Duration = duration.Round(time.Millisecond).String()
+	summary.DurationSeconds = duration.Seconds()
+	summary.RoutersFailed = summary.failedRouters()
+	if *recordCycles && !*dryRun && connStats != nil {
+		if err := recordCycleStats(connStats, &dbMutex, summary); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	if err := snapshots.flush(); err != nil {
+		fmt.Printf("Error writing raw snapshot: %v\n", err)
+	}
+
+	if connStats != nil {
+		err = connStats.QueryRow("SELECT rx_bytes, tx_bytes FROM monthly_stats WHERE id = ?", MAIN_WAN_ID).Scan(&summary.WANMonthlyRX, &summary.WANMonthlyTX)
+		if err != nil && err != sql.ErrNoRows {
+			fmt.Printf("Error reading monthly WAN totals: %v\n", err)
+		}
+	}
+	summary.WANMonthlyRXHuman = humanizeBytes(summary.WANMonthlyRX)
+	summary.WANMonthlyTXHuman = humanizeBytes(summary.WANMonthlyTX)
+	now := time.Now()
+	periodStart, periodEnd := billingPeriod(now)
+	summary.WANProjected = projectUsage(summary.WANMonthlyRX+summary.WANMonthlyTX, periodStart, periodEnd, now)
+	summary.WANProjectedHuman = humanizeBytes(summary.WANProjected)
+	sort.Slice(summary.Routers, func(i, j int) bool { return summary.Routers[i].Router < summary.Routers[j].Router })
+	fmt.Println(summary.logLine())
+
+	lastCycleMutex.Lock()
+	lastCycle = summary
+	lastCycleMutex.Unlock()
+
+	exportCycle(connStats, summary)
+	return summary, nil
+}
+
+// openCycleDBs connects to and sets up both databases. One that can't be
+// opened is returned as nil, with a warning and its state recorded for
+// /status; it is only an error when neither can. In -single-db mode the two
+// share a connection, which is nil for the DHCP tables alone if only their
+// setup fails.
+func openCycleDBs() (connStats, connDHCP *sql.DB, err error) {
+	connStats, statsErr := openCycleDB(*statsDBPath, "stats", setupStatsDB)
+	var dhcpErr error
+	if *dhcpDBPath == *statsDBPath {
+		dhcpErr = statsErr
+		if connStats != nil {
+			if err := setupDHCPDB(connStats); err != nil {
+				dhcpErr = fmt.Errorf("failed to set up DHCP database: %w", err)
+			} else {
+				connDHCP = connStats
+			}
+		}
+	} else {
+		connDHCP, dhcpErr = openCycleDB(*dhcpDBPath, "DHCP", setupDHCPDB)
+	}
+	recordDatabaseStatus("stats", statsErr)
+	recordDatabaseStatus("dhcp", dhcpErr)
+
+	if statsErr != nil && dhcpErr != nil {
+		if statsErr == dhcpErr {
+			return nil, nil, fmt.Errorf("%w: %v", ErrNoDatabases, statsErr)
+		}
+		return nil, nil, fmt.Errorf("%w: %v; %v", ErrNoDatabases, statsErr, dhcpErr)
+	}
+	if statsErr != nil {
+		fmt.Printf("Warning: %v. Skipping WiFi and WAN stats this cycle.\n", statsErr)
+	}
+	if dhcpErr != nil {
+		fmt.Printf("Warning: %v. Skipping DHCP leases this cycle.\n", dhcpErr)
+	}
+	return connStats, connDHCP, nil
+}
+
+// openCycleDB connects to path and runs setup, retrying up to
+// -db-setup-retries times with a doubling wait from -db-setup-backoff, since
+// at boot the file can be briefly locked or its storage not yet mounted.
+// name is used in errors and log lines.
+func openCycleDB(path, name string, setup func(*sql.DB) error) (*sql.DB, error) {
+	backoff := *dbSetupBackoff
+	for attempt := 0; ; attempt++ {
+		db, err := tryOpenCycleDB(path, name, setup)
+		if err == nil || attempt >= *dbSetupRetries {
+			return db, err
+		}
+		fmt.Printf("Warning: %v. Retrying in %s (%d/%d).\n", err, backoff, attempt+1, *dbSetupRetries)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// tryOpenCycleDB connects to path and runs setup, closing the connection
+// again if setup fails.
+func tryOpenCycleDB(path, name string, setup func(*sql.DB) error) (*sql.DB, error) {
+	db, err := connectDB(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s database: %w", name, err)
+	}
+	if err := setup(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set up %s database: %w", name, err)
+	}
+	return db, nil
+}
+
+// waitForRouters collects router results until all n routers have finished
+// or ctx is done, whichever comes first.
+func waitForRouters(ctx context.Context, wg *sync.WaitGroup, results chan RouterResult, n int) []RouterResult {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var finished []RouterResult
+	for len(finished) < n {
+		select {
+		case result := <-results:
+			finished = append(finished, result)
+		case <-done:
+			// Routers that gave up on the cancelled context send nothing.
+			for len(results) > 0 {
+				finished = append(finished, <-results)
+			}
+			return finished
+		case <-ctx.Done():
+			return finished
+		}
+	}
+	return finished
+}
+
+// abandonRouters logs and records every router missing from finished after
+// the cycle timed out; limit names the flag that ended it. Their goroutines
+// are left to unwind on the cancelled context; whatever they already stored
+// stays stored.
+func abandonRouters(routers Config, finished []RouterResult, limit string) []RouterResult {
+	done := map[string]bool{}
+	for _, result := range finished {
+		done[result.Router] = true
+	}
+
+	var abandoned []RouterResult
+	var names []string
+	for routerIP := range routers {
+		if done[routerIP] {
+			continue
+		}
+		result := RouterResult{Router: routerIP, FailedFetches: []string{"timeout"}}
+		result.addError(ERROR_FETCH, "%s did not finish within %s", routerIP, limit)
+		recordRouterStatus(result)
+		abandoned = append(abandoned, result)
+		names = append(names, routerIP)
+	}
+	sort.Strings(names)
+	fmt.Printf("Cycle timed out (%s); routers that didn't finish: %s\n", limit, strings.Join(names, ", "))
+	return abandoned
+}
+
+func registerCollectHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/collect", handleCollect)
+}
+
+func handleCollect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	manualCollectMutex.Lock()
+	if wait := *collectMinInterval - time.Since(lastManualCollect); wait > 0 {
+		manualCollectMutex.Unlock()
+		w.Header().Set("Retry-After", fmt.Sprintf("%.0f", wait.Seconds()+0.5))
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("collection was triggered recently, retry in %s", wait.Round(time.Second)))
+		return
+	}
+	lastManualCollect = time.Now()
+	manualCollectMutex.Unlock()
+
+	select {
+	case cycleLock <- struct{}{}:
+	default:
+		writeError(w, http.StatusConflict, "a collection cycle is already running")
+		return
+	}
+	defer func() { <-cycleLock }()
+
+	fmt.Println("Starting manually triggered data collection cycle...")
+	summary, err := runCycleLocked(0)
+	if errors.Is(err, ErrCollectionPaused) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestRouters points -config at a file with routers and both databases
+// at a temporary directory until the test ends. It returns the stats
+// database's path.
+func useTestRouters(t *testing.T, routers map[string]map[string]interface{}) string {
+	t.Helper()
+	dir := t.TempDir()
+	data, err := json.Marshal(routers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "routers.json")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfig, oldStats, oldDHCP := *configPath, *statsDBPath, *dhcpDBPath
+	t.Cleanup(func() { *configPath, *statsDBPath, *dhcpDBPath = oldConfig, oldStats, oldDHCP })
+	*configPath = path
+	*statsDBPath = filepath.Join(dir, "network_stats.db")
+	*dhcpDBPath = filepath.Join(dir, "dhcp_leases.db")
+	return *statsDBPath
+}
+
+// slowServer answers every request with body after delay, or when the
+// request is cancelled.
+func slowServer(t *testing.T, delay time.Duration, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOnceDeadline(t *testing.T) {
+	slow := slowServer(t, 5*time.Second, "wan: 1 2\n")
+	statsPath := useTestRouters(t, map[string]map[string]interface{}{
+		"slow": {"wan_stats": slow.URL, "timeout": "30s", "disable": []string{"wifi", "dhcp"}},
+		"fast": {"wan_stats_command": "echo wan: 1 2", "disable": []string{"wifi", "dhcp"}},
+	})
+	*deadline = 400 * time.Millisecond
+	defer func() { *deadline = 0; cycleDeadline = time.Time{} }()
+
+	start := time.Now()
+	if code := runOnce(); code != EXIT_DEADLINE {
+		t.Fatalf("runOnce = %d, want %d", code, EXIT_DEADLINE)
+	}
+	if elapsed := time.Since(start); elapsed < *deadline || elapsed > 2*time.Second {
+		t.Errorf("runOnce returned after %s, want about %s", elapsed, *deadline)
+	}
+
+	db, err := connectDB(statsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var rx int64
+	if err := db.QueryRow("SELECT rx_bytes FROM cumulative_stats WHERE id = ?", MAIN_WAN_ID).Scan(&rx); err != nil || rx != 1 {
+		t.Errorf("fast router's WAN reading = %d, %v; want it stored", rx, err)
+	}
+	abandoned := false
+	for _, status := range routerStatusSnapshot() {
+		if status.Router == "slow" {
+			abandoned = status.LastError == "slow did not finish within -deadline 400ms"
+		}
+	}
+	if !abandoned {
+		t.Error("slow router wasn't recorded as abandoned at the deadline")
+	}
+}
+
+func TestCycleTimeout(t *testing.T) {
+	slow := slowServer(t, 5*time.Second, "wan: 1 2\n")
+	useTestRouters(t, map[string]map[string]interface{}{
+		"slow": {"wan_stats": slow.URL, "timeout": "30s", "disable": []string{"wifi", "dhcp"}},
+		"fast": {"wan_stats_command": "echo wan: 1 2", "disable": []string{"wifi", "dhcp"}},
+	})
+	old := *cycleTimeout
+	*cycleTimeout = 400 * time.Millisecond
+	defer func() { *cycleTimeout = old }()
+
+	start := time.Now()
+	summary, err := runCycle(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("cycle took %s, want it cut short at %s", elapsed, *cycleTimeout)
+	}
+
+	var slowAbandoned, fastStored bool
+	for _, result := range summary.Routers {
+		switch result.Router {
+		case "slow":
+			slowAbandoned = len(result.FailedFetches) == 1 && result.FailedFetches[0] == "timeout"
+		case "fast":
+			fastStored = result.WAN
+		}
+	}
+	if !slowAbandoned || !fastStored {
+		t.Errorf("slow router abandoned: %v, fast router stored: %v; results %+v", slowAbandoned, fastStored, summary.Routers)
+	}
+}
+
+func TestSkippedLinesFeedUnparsed(t *testing.T) {
+	_, summary, _ := parseWiFiStats("aa:bb:cc:00:00:01 10 20 wlan0 5\nzz:bb 100 200 wlan0 5\nxx 1 2 wlan0 bad\naa:bb:cc:00:00:02 1x 2\nonly two\n")
+	// Lines with numeric counters count; the unreadable ones can't.
+	if summary.UnparsedLines != 2 || summary.UnparsedRX != 101 || summary.UnparsedTX != 202 {
+		t.Fatalf("summary = %+v, want 2 lines of 101/202 bytes", summary)
+	}
+
+	old := *unparsedEntity
+	*unparsedEntity = true
+	defer func() { *unparsedEntity = old }()
+	db := openTestStatsDB(t)
+	result := &RouterResult{Router: "r1"}
+	storeUnparsed(result, db, nil, summary)
+	summary.UnparsedRX, summary.UnparsedTX = 151, 252
+	storeUnparsed(result, db, nil, summary)
+	if rx, tx := monthlyTotals(t, db, UNPARSED_ID+":r1"); rx != 151 || tx != 252 {
+		t.Errorf("%s:r1 monthly totals = %d/%d, want 151/252", UNPARSED_ID, rx, tx)
+	}
+
+	// It counts towards the clients' total.
+	storeReadings(t, db, TrafficUpdate{EntityID: "aa:bb:cc:00:00:01", Source: "r1", RXBytes: 1000, TXBytes: 1000})
+	if err := updateTotalStats(db, &dbMutex, TOTAL_SOURCE_CLIENTS); err != nil {
+		t.Fatal(err)
+	}
+	if rx, _ := monthlyTotals(t, db, TOTAL_ID); rx != 1151 {
+		t.Errorf("total rx = %d, want 1151", rx)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outcomes of one stage of an EndpointResult.
+const (
+	STAGE_OK      = "ok"
+	STAGE_FAILED  = "failed"
+	STAGE_SKIPPED = "skipped"
+)
+
+// Exit codes of -once.
+const (
+	EXIT_OK      = 0
+	EXIT_PARTIAL = 1
+	EXIT_FAILED  = 2
+	// EXIT_DEADLINE is -once running past -deadline.
+	EXIT_DEADLINE = 3
+
+	// ONCE_DEADLINE_GRACE is how long past -deadline a run may take to
+	// write what it collected before the process is ended outright.
+	ONCE_DEADLINE_GRACE = 5 * time.Second
+)
+
+// EndpointResult is how far one of a router's endpoints ("wifi", "wan",
+// "dhcp", "combined") got in a cycle. Each stage is STAGE_OK, STAGE_FAILED,
+// or STAGE_SKIPPED when an earlier stage failed or there was nothing to do,
+// e.g. nothing to store or -dry-run.
+type EndpointResult struct {
+	Fetch string `json:"fetch"`
+	Parse string `json:"parse"`
+	Store string `json:"store"`
+}
+
+// failed reports whether any stage failed.
+func (e *EndpointResult) failed() bool {
+	return e.Fetch == STAGE_FAILED || e.Parse == STAGE_FAILED || e.Store == STAGE_FAILED
+}
+
+// fetched records the outcome of fetching and parsing: err is nil, a
+// parseError for a response that arrived but couldn't be parsed, or a
+// failed fetch.
+func (e *EndpointResult) fetched(err error) {
+	switch {
+	case err == nil:
+		e.Fetch, e.Parse = STAGE_OK, STAGE_OK
+	case isParseError(err):
+		e.Fetch, e.Parse = STAGE_OK, STAGE_FAILED
+	default:
+		e.Fetch = STAGE_FAILED
+	}
+}
+
+// stored records the outcome of one write. A failure sticks, so an endpoint
+// that stores in several writes fails if any of them does.
+func (e *EndpointResult) stored(ok bool) {
+	if !ok {
+		e.Store = STAGE_FAILED
+	} else if e.Store != STAGE_FAILED {
+		e.Store = STAGE_OK
+	}
+}
+
+func (e *EndpointResult) String() string {
+	if !e.failed() {
+		return STAGE_OK
+	}
+	var failed []string
+	for _, stage := range []struct{ name, outcome string }{{"fetch", e.Fetch}, {"parse", e.Parse}, {"store", e.Store}} {
+		if stage.outcome == STAGE_FAILED {
+			failed = append(failed, stage.name)
+		}
+	}
+	return strings.Join(failed, "+") + " failed"
+}
+
+// endpoint returns r's result for endpoint, adding it with every stage
+// skipped.
+func (r *RouterResult) endpoint(name string) *EndpointResult {
+	if r.Endpoints == nil {
+		r.Endpoints = map[string]*EndpointResult{}
+	}
+	e, ok := r.Endpoints[name]
+	if !ok {
+		e = &EndpointResult{Fetch: STAGE_SKIPPED, Parse: STAGE_SKIPPED, Store: STAGE_SKIPPED}
+		r.Endpoints[name] = e
+	}
+	return e
+}
+
+// parseError marks an error from parsing a response rather than fetching
+// it.
+type parseError struct {
+	err error
+}
+
+func (e parseError) Error() string { return e.err.Error() }
+func (e parseError) Unwrap() error { return e.err }
+
+func isParseError(err error) bool {
+	var p parseError
+	return errors.As(err, &p)
+}
+
+// exitCode classifies the cycle for -once: EXIT_OK when every endpoint of
+// every router got through every stage, EXIT_FAILED when none did, and
+// EXIT_PARTIAL in between. A router that timed out, or a database that
+// couldn't be opened, counts as a failure.
+func (s *CycleSummary) exitCode() int {
+	var ok, failed int
+	for _, result := range s.Routers {
+		for _, fetch := range result.FailedFetches {
+			if fetch == "timeout" {
+				failed++
+			}
+		}
+		for _, e := range result.Endpoints {
+			if e.failed() {
+				failed++
+			} else {
+				ok++
+			}
+		}
+	}
+	failed += len(s.UnavailableDatabases)
+	switch {
+	case failed == 0:
+		return EXIT_OK
+	case ok == 0:
+		return EXIT_FAILED
+	default:
+		return EXIT_PARTIAL
+	}
+}
+
+// endpointReport lists every router's endpoints and how they did, one
+// router per line, e.g. "192.168.1.1: dhcp parse failed, wan ok, wifi ok".
+func (s *CycleSummary) endpointReport() string {
+	routers := append([]RouterResult(nil), s.Routers...)
+	sort.Slice(routers, func(i, j int) bool { return routers[i].Router < routers[j].Router })
+
+	var lines []string
+	for _, result := range routers {
+		var names []string
+		for name := range result.Endpoints {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var parts []string
+		for _, name := range names {
+			parts = append(parts, fmt.Sprintf("%s %s", name, result.Endpoints[name]))
+		}
+		for _, fetch := range result.FailedFetches {
+			if fetch == "timeout" {
+				parts = append(parts, "timed out")
+			}
+		}
+		if len(parts) == 0 {
+			parts = append(parts, "nothing collected")
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", result.Router, strings.Join(parts, ", ")))
+	}
+	for _, name := range s.UnavailableDatabases {
+		lines = append(lines, fmt.Sprintf("%s database: unavailable", name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runOnce is -once: it runs one collection cycle, prints endpointReport and
+// returns the exit code, for running from cron. A paused collection is not
+// a failure. With -deadline the cycle's routers are abandoned when it
+// passes, and EXIT_DEADLINE returned once what finished is written; a run
+// still going ONCE_DEADLINE_GRACE later, e.g. stuck opening a database, is
+// ended with EXIT_DEADLINE there and then, so runs from cron never pile up.
+func runOnce() int {
+	if *deadline > 0 {
+		cycleDeadline = time.Now().Add(*deadline)
+		watchdog := time.AfterFunc(*deadline+ONCE_DEADLINE_GRACE, func() {
+			fmt.Printf("Exceeded -deadline %s, exiting without finishing.\n", *deadline)
+			removePIDFile(*pidFile)
+			os.Exit(EXIT_DEADLINE)
+		})
+		defer watchdog.Stop()
+	}
+
+	summary, err := runCycle(*routerJitter)
+	late := !cycleDeadline.IsZero() && !time.Now().Before(cycleDeadline)
+	flushPendingWrites()
+	if errors.Is(err, ErrCollectionPaused) {
+		fmt.Printf("Skipping data collection cycle: %v.\n", err)
+		return EXIT_OK
+	}
+	if err != nil {
+		fmt.Printf("Data collection cycle failed: %v.\n", err)
+		if late {
+			return EXIT_DEADLINE
+		}
+		return EXIT_FAILED
+	}
+
+	fmt.Println(summary.endpointReport())
+	if late {
+		fmt.Printf("Data collection cycle exceeded -deadline %s.\n", *deadline)
+		return EXIT_DEADLINE
+	}
+	code := summary.exitCode()
+	switch code {
+	case EXIT_OK:
+		fmt.Println("Data collection cycle complete: everything succeeded.")
+	case EXIT_PARTIAL:
+		fmt.Println("Data collection cycle complete with failures.")
+	default:
+		fmt.Println("Data collection cycle failed: nothing succeeded.")
+	}
+	return code
+}
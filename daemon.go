@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+func writePIDFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("error writing PID file '%s': %w", path, err)
+	}
+	return nil
+}
+
+func removePIDFile(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error removing PID file '%s': %v\n", path, err)
+	}
+}
+
+// handleShutdownSignals removes the PID file and the event socket and exits
+// when the process is asked to stop by SIGINT or SIGTERM. A collection cycle
+// that is running is given up to timeout to finish, so the routers it has
+// already fetched are committed rather than rolled back; no new cycle starts
+// meanwhile.
+func handleShutdownSignals(pidPath string, timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Printf("Received %s, shutting down.\n", sig)
+
+		select {
+		case cycleLock <- struct{}{}:
+		default:
+			fmt.Printf("Waiting up to %s for the running collection cycle to finish...\n", timeout)
+			select {
+			case cycleLock <- struct{}{}:
+				if summary := lastCycleSummary(); summary != nil {
+					fmt.Printf("Collection cycle finished; %d records committed.\n", summary.records())
+				}
+			case <-time.After(timeout):
+				fmt.Println("Collection cycle did not finish in time; its uncommitted writes are lost.")
+			}
+		}
+
+		flushPendingWrites()
+		if err := snapshots.flush(); err != nil {
+			fmt.Printf("Error writing raw snapshot: %v\n", err)
+		}
+		localEvents.close()
+		removePIDFile(pidPath)
+		os.Exit(0)
+	}()
+}
+
+// sdNotify sends a state string such as "READY=1" or "WATCHDOG=1" to systemd
+// over the socket named by NOTIFY_SOCKET. It does nothing when the variable
+// is unset, i.e. when not running under a Type=notify unit.
+func sdNotify(state string) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return
+	}
+	// A leading '@' denotes a Linux abstract socket.
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		fmt.Printf("Error connecting to systemd notify socket: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		fmt.Printf("Error sending '%s' to systemd: %v\n", state, err)
+	}
+}
+
+// watchdogInterval is how often systemd wants "WATCHDOG=1": half the
+// WATCHDOG_USEC it passes, as sd_watchdog_enabled(3) recommends. It is 0
+// when the watchdog isn't enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdogSleep pings the systemd watchdog and sleeps for d, pinging again
+// every watchdogInterval meanwhile. The main loop sleeps through it after
+// every cycle, failed ones included, so only a cycle that hangs stops the
+// pings and gets the process restarted.
+func watchdogSleep(d time.Duration) {
+	sdNotify("WATCHDOG=1")
+	interval := watchdogInterval()
+	for interval > 0 && d > interval {
+		time.Sleep(interval)
+		d -= interval
+		sdNotify("WATCHDOG=1")
+	}
+	time.Sleep(d)
+}
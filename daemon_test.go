@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchdogSleep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for name, value := range map[string]string{"NOTIFY_SOCKET": path, "WATCHDOG_USEC": "40000", "WATCHDOG_PID": ""} {
+		old, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	if got := watchdogInterval(); got != 20*time.Millisecond {
+		t.Errorf("watchdogInterval = %s, want half of WATCHDOG_USEC", got)
+	}
+	// Once on entry and after each of three 20ms intervals.
+	watchdogSleep(70 * time.Millisecond)
+	pings := 0
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		if string(buf[:n]) != "WATCHDOG=1" {
+			t.Errorf("sent %q, want WATCHDOG=1", buf[:n])
+		}
+		pings++
+	}
+	if pings != 4 {
+		t.Errorf("%d watchdog pings while sleeping 70ms, want 4", pings)
+	}
+
+	os.Setenv("WATCHDOG_PID", "1")
+	if got := watchdogInterval(); got != 0 {
+		t.Errorf("watchdogInterval for another process's watchdog = %s, want 0", got)
+	}
+}
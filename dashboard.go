@@ -0,0 +1,35 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+// The dashboard is a single self-contained page that reads the JSON API from
+// the browser, so it works on a LAN without internet access.
+//
+//go:embed static/index.html
+var dashboardFS embed.FS
+
+func registerDashboardHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/", handleDashboard)
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	page, err := dashboardFS.ReadFile("static/index.html")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetter is one line of input a parser could not use.
+type DeadLetter struct {
+	Timestamp string `json:"timestamp"`
+	Router    string `json:"router"`
+	Endpoint  string `json:"endpoint"`
+	Line      string `json:"line"`
+}
+
+// deadLetterWriter appends DeadLetters as JSON Lines to path.
+type deadLetterWriter struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// deadLetters is nil unless -dead-letter-file is set; writing to a nil
+// writer does nothing.
+var deadLetters *deadLetterWriter
+
+func newDeadLetterWriter(path string) *deadLetterWriter {
+	return &deadLetterWriter{path: path}
+}
+
+// write records the skipped lines from one router endpoint. Errors are
+// logged rather than returned so a full disk never stops collection.
+func (d *deadLetterWriter) write(router, endpoint string, lines []string) {
+	if d == nil || len(lines) == 0 {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	file, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		fmt.Printf("Error opening dead-letter file '%s': %v\n", d.path, err)
+		return
+	}
+	defer file.Close()
+
+	timestamp := displayTime(time.Now())
+	encoder := json.NewEncoder(file)
+	for _, line := range lines {
+		if err := encoder.Encode(DeadLetter{Timestamp: timestamp, Router: router, Endpoint: endpoint, Line: line}); err != nil {
+			fmt.Printf("Error writing dead-letter file '%s': %v\n", d.path, err)
+			return
+		}
+	}
+}
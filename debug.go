@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+type CumulativeEntry struct {
+	ID            string `json:"id"`
+	RXBytes       int64  `json:"rx_bytes"`
+	TXBytes       int64  `json:"tx_bytes"`
+	SourceRouter  string `json:"source_router"`
+	ConnectedTime *int64 `json:"connected_time"`
+	LastSeen      string `json:"last_seen"`
+}
+
+// queryCumulativeStats returns the raw counters the next deltas will be
+// computed from. It holds mutex so it never sees a cycle's half-applied
+// batch.
+func queryCumulativeStats(db *sql.DB, mutex *sync.Mutex) ([]CumulativeEntry, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	rows, err := db.Query(`
+		SELECT id, rx_bytes, tx_bytes, COALESCE(source_router, ''), connected_time, COALESCE(last_seen, '')
+		FROM cumulative_stats
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying cumulative stats: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []CumulativeEntry{}
+	for rows.Next() {
+		var entry CumulativeEntry
+		var connected sql.NullInt64
+		if err := rows.Scan(&entry.ID, &entry.RXBytes, &entry.TXBytes, &entry.SourceRouter, &connected, &entry.LastSeen); err != nil {
+			return nil, fmt.Errorf("error scanning cumulative stats: %w", err)
+		}
+		if connected.Valid {
+			entry.ConnectedTime = &connected.Int64
+		}
+		entry.LastSeen = displayStoredTime(entry.LastSeen)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying cumulative stats: %w", err)
+	}
+	return entries, nil
+}
+
+// registerDebugHandlers adds the diagnostic endpoints, only with -debug.
+func registerDebugHandlers(mux *http.ServeMux) {
+	if !*debugEndpoints {
+		return
+	}
+	mux.HandleFunc("/debug/cumulative", handleDebugCumulative)
+	mux.HandleFunc("/debug/ratios", handleDebugRatios)
+	mux.HandleFunc("/config", handleConfig)
+	mux.HandleFunc("/download/stats.db", downloadHandler("stats.db", statsDBPath))
+	mux.HandleFunc("/download/dhcp.db", downloadHandler("dhcp.db", dhcpDBPath))
+}
+
+func handleDebugCumulative(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	entries, err := queryCumulativeStats(db, &dbMutex)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": entries})
+}
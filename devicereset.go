@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -device-change-reset triggers: what, seen on a MAC's DHCP lease, means a
+// different device now uses the MAC.
+const (
+	DEVICE_RESET_VENDOR   = "vendor"
+	DEVICE_RESET_HOSTNAME = "hostname"
+)
+
+// deviceResetTriggers holds the -device-change-reset triggers; it is empty
+// unless the flag is set.
+var deviceResetTriggers = map[string]bool{}
+
+// deviceChange is a MAC whose lease says it now belongs to another device.
+type deviceChange struct {
+	MACAddress string
+	Reason     string
+}
+
+// parseDeviceResetTriggers parses -device-change-reset, a comma-separated
+// list of DEVICE_RESET_VENDOR and DEVICE_RESET_HOSTNAME.
+func parseDeviceResetTriggers(value string) (map[string]bool, error) {
+	triggers := map[string]bool{}
+	for _, trigger := range strings.Split(value, ",") {
+		trigger = strings.ToLower(strings.TrimSpace(trigger))
+		switch trigger {
+		case "":
+		case DEVICE_RESET_VENDOR, DEVICE_RESET_HOSTNAME:
+			triggers[trigger] = true
+		default:
+			return nil, fmt.Errorf("unknown trigger '%s', expected %s or %s", trigger, DEVICE_RESET_VENDOR, DEVICE_RESET_HOSTNAME)
+		}
+	}
+	return triggers, nil
+}
+
+// clientIDVendor returns the vendor a raw DHCP client id names, or "" when
+// it names none. A DUID (RFC 4361 client id) carries either an enterprise
+// number or a hardware address whose OUI is the vendor's; a hardware client
+// id carries the address itself. Locally administered addresses, such as
+// randomized ones, have no vendor.
+func clientIDVendor(raw string) string {
+	octets, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(raw), ":", ""))
+	if err != nil || len(octets) == 0 {
+		return ""
+	}
+
+	var address []byte
+	switch {
+	case octets[0] == 1 && len(octets) == 7:
+		address = octets[1:]
+	case octets[0] == 0xff && len(octets) >= 7:
+		duid := octets[5:]
+		duidType := int(duid[0])<<8 | int(duid[1])
+		switch {
+		case duidType == 1 && len(duid) >= 14:
+			address = duid[8:]
+		case duidType == 2 && len(duid) >= 6:
+			return fmt.Sprintf("enterprise %d", int(duid[2])<<24|int(duid[3])<<16|int(duid[4])<<8|int(duid[5]))
+		case duidType == 3 && len(duid) >= 10:
+			address = duid[4:]
+		}
+	}
+	if len(address) < 3 || address[0]&0x02 != 0 {
+		return ""
+	}
+	return fmt.Sprintf("oui %02x:%02x:%02x", address[0], address[1], address[2])
+}
+
+// leaseDeviceChange compares a lease with the stored lease of its MAC and
+// returns why a different device now holds the MAC, or "" when nothing says
+// so. It only acts on the configured triggers and is conservative: both
+// leases must name a vendor, or both a real hostname, and they must differ.
+// A hostname from the config's hostnames map never counts.
+func leaseDeviceChange(lease DHCPLease, storedClientID, storedHostname string, storedManual bool) string {
+	if deviceResetTriggers[DEVICE_RESET_VENDOR] {
+		old, current := clientIDVendor(storedClientID), clientIDVendor(lease.ClientID)
+		if old != "" && current != "" && old != current {
+			return fmt.Sprintf("vendor changed from %s to %s", old, current)
+		}
+	}
+	if deviceResetTriggers[DEVICE_RESET_HOSTNAME] && !storedManual && !lease.HostnameManual {
+		known := func(hostname string) bool { return hostname != "" && hostname != UNKNOWN_HOSTNAME }
+		if known(storedHostname) && known(lease.Hostname) && !strings.EqualFold(storedHostname, lease.Hostname) {
+			return fmt.Sprintf("hostname changed from %s to %s", storedHostname, lease.Hostname)
+		}
+	}
+	return ""
+}
+
+// resetChangedDevice archives the current month's and all-time totals of
+// the MAC's entities into device_resets and deletes them, along with their
+// cumulative counters, so the next reading starts a fresh baseline. Entities
+// are the MAC itself and, with duplicate_macs separate, its per-interface
+// ids. Past months in monthly_archive stay as they are.
+func resetChangedDevice(db *sql.DB, mutex *sync.Mutex, change deviceChange) (int, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction for resetting %s: %w", change.MACAddress, err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id FROM cumulative_stats WHERE id = ? OR id LIKE ?
+		UNION SELECT id FROM monthly_stats WHERE id = ? OR id LIKE ?
+		UNION SELECT id FROM alltime_stats WHERE id = ? OR id LIKE ?
+	`, change.MACAddress, change.MACAddress+INTERFACE_ID_SEPARATOR+"%",
+		change.MACAddress, change.MACAddress+INTERFACE_ID_SEPARATOR+"%",
+		change.MACAddress, change.MACAddress+INTERFACE_ID_SEPARATOR+"%")
+	if err != nil {
+		return 0, fmt.Errorf("error finding entities of %s: %w", change.MACAddress, err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error finding entities of %s: %w", change.MACAddress, err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error finding entities of %s: %w", change.MACAddress, err)
+	}
+
+	timestamp := storedTime(time.Now())
+	for _, id := range ids {
+		var monthlyRX, monthlyTX, alltimeRX, alltimeTX int64
+		var firstSeen sql.NullString
+		err := tx.QueryRow("SELECT rx_bytes, tx_bytes FROM monthly_stats WHERE id = ?", id).Scan(&monthlyRX, &monthlyTX)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, fmt.Errorf("error reading monthly stats for %s: %w", id, err)
+		}
+		err = tx.QueryRow("SELECT rx_bytes, tx_bytes, first_seen FROM alltime_stats WHERE id = ?", id).Scan(&alltimeRX, &alltimeTX, &firstSeen)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, fmt.Errorf("error reading all-time stats for %s: %w", id, err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO device_resets (id, reset_at, reason, monthly_rx_bytes, monthly_tx_bytes, alltime_rx_bytes, alltime_tx_bytes, first_seen)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, id, timestamp, change.Reason, monthlyRX, monthlyTX, alltimeRX, alltimeTX, firstSeen)
+		if err != nil {
+			return 0, fmt.Errorf("error archiving totals of %s: %w", id, err)
+		}
+		for _, table := range []string{"monthly_stats", "alltime_stats", "cumulative_stats", "router_counters"} {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE id = ?", id); err != nil {
+				return 0, fmt.Errorf("error resetting %s for %s: %w", table, id, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing reset of %s: %w", change.MACAddress, err)
+	}
+	return len(ids), nil
+}
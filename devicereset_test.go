@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestClientIDVendor(t *testing.T) {
+	for raw, want := range map[string]string{
+		"01:00:11:22:33:44:55": "oui 00:11:22",
+		// Locally administered, e.g. a randomized address.
+		"01:02:11:22:33:44:55": "",
+		// RFC 4361: ff, the IAID, then a DUID-LL (type 3, hardware type 1).
+		"ff:00:00:00:01:00:03:00:01:a8:bb:cc:00:00:01": "oui a8:bb:cc",
+		// A DUID-EN (type 2) with enterprise number 311.
+		"ff:00:00:00:01:00:02:00:00:01:37:99": "enterprise 311",
+		"*":                                   "",
+	} {
+		if got := clientIDVendor(raw); got != want {
+			t.Errorf("clientIDVendor(%q) = %q, want %q", raw, got, want)
+		}
+	}
+	if _, err := parseDeviceResetTriggers("vendor, bogus"); err == nil {
+		t.Error("unknown trigger accepted")
+	}
+}
+
+func TestVendorChangeResetsDevice(t *testing.T) {
+	old := deviceResetTriggers
+	defer func() { deviceResetTriggers = old }()
+	deviceResetTriggers = map[string]bool{DEVICE_RESET_VENDOR: true}
+
+	stats := openTestStatsDB(t)
+	dhcp := openTestDHCPDB(t)
+	const mac = "aa:bb:cc:dd:ee:01"
+	storeReadings(t, stats, TrafficUpdate{EntityID: mac, Source: "r1", RXBytes: 100, TXBytes: 100})
+	storeReadings(t, stats, TrafficUpdate{EntityID: mac, Source: "r1", RXBytes: 300, TXBytes: 400})
+
+	lease := DHCPLease{MACAddress: mac, IPAddress: "10.0.0.2", Hostname: "phone", ClientID: "01:00:11:22:33:44:55"}
+	for _, step := range []struct {
+		name     string
+		hostname string
+		clientID string
+		changed  bool
+	}{
+		{"first lease", "phone", "01:00:11:22:33:44:55", false},
+		// Only the vendor trigger is on.
+		{"hostname changed", "tablet", "01:00:11:22:33:44:55", false},
+		// Without a vendor on both leases nothing is said.
+		{"no client id", "tablet", "", false},
+		{"same vendor again", "tablet", "01:00:11:22:33:44:55", false},
+		{"vendor changed", "tablet", "01:f0:99:bf:33:44:55", true},
+	} {
+		lease.Hostname, lease.ClientID = step.hostname, step.clientID
+		changes, err := upsertDHCPLeases(dhcp, &dbMutex, []DHCPLease{lease})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed := len(changes) == 1 && changes[0].MACAddress == mac; changed != step.changed || len(changes) > 1 {
+			t.Fatalf("%s: device changes %+v", step.name, changes)
+		}
+		if !step.changed {
+			continue
+		}
+
+		if n, err := resetChangedDevice(stats, &dbMutex, changes[0]); err != nil || n != 1 {
+			t.Fatalf("resetChangedDevice = %d, %v; want 1 entity reset", n, err)
+		}
+	}
+
+	var monthlyRX, alltimeRX int64
+	if err := stats.QueryRow("SELECT monthly_rx_bytes, alltime_rx_bytes FROM device_resets WHERE id = ?", mac).Scan(&monthlyRX, &alltimeRX); err != nil {
+		t.Fatal(err)
+	}
+	if monthlyRX != 300 || alltimeRX != 300 {
+		t.Errorf("archived %d monthly and %d all-time rx, want 300 and 300", monthlyRX, alltimeRX)
+	}
+
+	// The new device's first reading is its baseline.
+	storeReadings(t, stats, TrafficUpdate{EntityID: mac, Source: "r1", RXBytes: 10, TXBytes: 20})
+	if rx, tx := monthlyTotals(t, stats, mac); rx != 10 || tx != 20 {
+		t.Errorf("monthly totals after the reset = %d/%d, want 10/20", rx, tx)
+	}
+}
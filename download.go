@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// SQLITE_CONTENT_TYPE is the registered media type of a SQLite database.
+const SQLITE_CONTENT_TYPE = "application/vnd.sqlite3"
+
+// isLoopbackRequest reports whether r came from this host. The database
+// downloads hold every client's history, so they are refused to anything
+// else even when -listen opens the API to the network.
+func isLoopbackRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// downloadHandler serves a fresh snapshot of the database at *path as name.
+// The snapshot is written with backupDB to a temporary directory, so the
+// download is consistent while collection keeps running, and removed once
+// it has been sent.
+func downloadHandler(name string, path *string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !isLoopbackRequest(r) {
+			writeError(w, http.StatusForbidden, "database downloads are only served to localhost")
+			return
+		}
+
+		dir, err := ioutil.TempDir("", "netstats-download-")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("error creating snapshot directory: %v", err))
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		db, err := connectDB(*path)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		snapshotPath := filepath.Join(dir, name)
+		err = backupDB(db, &dbMutex, snapshotPath)
+		db.Close()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		file, err := os.Open(snapshotPath)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("error opening snapshot: %v", err))
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("error reading snapshot: %v", err))
+			return
+		}
+
+		// No Content-Length: gzipHandler may compress the body, which
+		// SQLite pages usually allow a lot of.
+		w.Header().Set("Content-Type", SQLITE_CONTENT_TYPE)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, file); err != nil {
+			fmt.Printf("Error sending %s to %s: %v\n", name, r.RemoteAddr, err)
+			return
+		}
+		fmt.Printf("Database snapshot %s (%d bytes) downloaded by %s\n", name, info.Size(), r.RemoteAddr)
+	}
+}
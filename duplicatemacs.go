@@ -0,0 +1,52 @@
+package main
+
+// How a router's WiFi lines that share a MAC address are counted; see
+// RouterConfig.DuplicateMACs.
+const (
+	DUPLICATE_MACS_SUM      = "sum"
+	DUPLICATE_MACS_SEPARATE = "separate"
+
+	// INTERFACE_ID_SEPARATOR joins a MAC address and interface into the
+	// entity id of a client counted per interface.
+	INTERFACE_ID_SEPARATOR = "@"
+)
+
+// clientEntityID is the id a client's traffic is stored under: its MAC or IP
+// address, or with "separate" one id per interface it reports on.
+func (urls RouterConfig) clientEntityID(client ClientStats) string {
+	if urls.DuplicateMACs == DUPLICATE_MACS_SEPARATE && client.Interface != "" {
+		return client.clientKey() + INTERFACE_ID_SEPARATOR + client.Interface
+	}
+	return client.clientKey()
+}
+
+// sumDuplicateUpdates merges the updates of one router's cycle that share
+// an entity id, e.g. a client listed once per VLAN or SSID, into one whose
+// counters are the sum. Stored separately, each line would overwrite the
+// others' cumulative baseline and the deltas would be garbage. The first
+// line's interface and connected time are kept, and the first signal and
+// noise reported. Order is otherwise preserved.
+func sumDuplicateUpdates(routerIP string, updates []TrafficUpdate) []TrafficUpdate {
+	index := map[string]int{}
+	merged := make([]TrafficUpdate, 0, len(updates))
+	for _, u := range updates {
+		i, ok := index[u.EntityID]
+		if !ok {
+			index[u.EntityID] = len(merged)
+			merged = append(merged, u)
+			continue
+		}
+		m := &merged[i]
+		debugf("%s: adding duplicate WiFi line for %s (rx %d, tx %d, interface %s) to its first.\n", routerIP, u.EntityID, u.RXBytes, u.TXBytes, u.Interface)
+		m.RXBytes += u.RXBytes
+		m.TXBytes += u.TXBytes
+		if !m.HasConnectedTime && u.HasConnectedTime {
+			m.ConnectedTime, m.HasConnectedTime = u.ConnectedTime, true
+		}
+		if !m.HasSignal && u.HasSignal {
+			m.Signal, m.HasSignal = u.Signal, true
+			m.Noise, m.HasNoise = u.Noise, u.HasNoise
+		}
+	}
+	return merged
+}
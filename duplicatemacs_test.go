@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDuplicateMACs(t *testing.T) {
+	data := "aa:bb:cc:dd:ee:ff 100 200 wlan0\naa:bb:cc:dd:ee:ff 10 20 wlan1\n11:22:33:44:55:66 1 2 wlan0"
+	clients, _, err := parseWiFiStatsColumns(data, defaultWiFiColumns)
+	if err != nil || len(clients) != 3 {
+		t.Fatalf("parseWiFiStatsColumns = %+v, %v", clients, err)
+	}
+
+	for _, tc := range []struct {
+		mode string
+		want []string
+	}{
+		{"", []string{"aa:bb:cc:dd:ee:ff 110/220 wlan0", "11:22:33:44:55:66 1/2 wlan0"}},
+		{DUPLICATE_MACS_SUM, []string{"aa:bb:cc:dd:ee:ff 110/220 wlan0", "11:22:33:44:55:66 1/2 wlan0"}},
+		{DUPLICATE_MACS_SEPARATE, []string{"aa:bb:cc:dd:ee:ff@wlan0 100/200 wlan0", "aa:bb:cc:dd:ee:ff@wlan1 10/20 wlan1", "11:22:33:44:55:66@wlan0 1/2 wlan0"}},
+	} {
+		urls := RouterConfig{DuplicateMACs: tc.mode}
+		var updates []TrafficUpdate
+		for _, client := range clients {
+			updates = append(updates, TrafficUpdate{EntityID: urls.clientEntityID(client), Source: "r1", Interface: client.Interface, RXBytes: client.RXBytes, TXBytes: client.TXBytes})
+		}
+		var got []string
+		for _, u := range sumDuplicateUpdates("r1", updates) {
+			got = append(got, fmt.Sprintf("%s %d/%d %s", u.EntityID, u.RXBytes, u.TXBytes, u.Interface))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("duplicate_macs %q: %q, want %q", tc.mode, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// setEntityEnabled turns counting of an entity's traffic on or off. Entities
+// without a row in entity_settings are enabled.
+func setEntityEnabled(db *sql.DB, mutex *sync.Mutex, entityID string, enabled bool) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	_, err := db.Exec(`
+		INSERT OR REPLACE INTO entity_settings (id, enabled, updated_at)
+		VALUES (?, ?, ?)
+	`, entityID, enabled, storedTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error updating entity settings for %s: %w", entityID, err)
+	}
+	return nil
+}
+
+// entityEnabled reports whether an entity's traffic is counted.
+func entityEnabled(tx *sql.Tx, entityID string) (bool, error) {
+	var enabled bool
+	err := tx.QueryRow("SELECT enabled FROM entity_settings WHERE id = ?", entityID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading entity settings for %s: %w", entityID, err)
+	}
+	return enabled, nil
+}
+
+// entityEnabledHandler serves /stats/enable/<id> or /stats/disable/<id>.
+func entityEnabledHandler(prefix string, enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		entityID := strings.TrimPrefix(r.URL.Path, prefix)
+		if mac, ok := normalizeMAC(entityID); ok {
+			entityID = mac
+		}
+		if entityID == "" {
+			writeError(w, http.StatusBadRequest, "missing entity id")
+			return
+		}
+
+		db, err := connectDB(*statsDBPath)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer db.Close()
+
+		if err := setEntityEnabled(db, &dbMutex, entityID, enabled); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if enabled {
+			fmt.Printf("Counting enabled for %s via API.\n", entityID)
+		} else {
+			fmt.Printf("Counting disabled for %s via API.\n", entityID)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": entityID, "enabled": enabled})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// TestDisabledEntityKeepsBaseline disables an entity, lets its counters run
+// on, and checks that re-enabling it counts only what came after.
+func TestDisabledEntityKeepsBaseline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "network_stats.db")
+	db, err := connectDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := setupStatsDB(db); err != nil {
+		t.Fatal(err)
+	}
+	old := *statsDBPath
+	*statsDBPath = path
+	defer func() { *statsDBPath = old }()
+
+	const mac = "aa:bb:cc:dd:ee:ff"
+	read := func(bytes int64) {
+		storeReadings(t, db, TrafficUpdate{EntityID: mac, Source: "r1", RXBytes: bytes, TXBytes: bytes})
+	}
+	post := func(prefix, id string, enabled bool) {
+		rec := httptest.NewRecorder()
+		entityEnabledHandler(prefix, enabled)(rec, httptest.NewRequest(http.MethodPost, prefix+id, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST %s%s = %d: %s", prefix, id, rec.Code, rec.Body)
+		}
+	}
+
+	read(100)
+	post("/stats/disable/", "AA-BB-CC-DD-EE-FF", false)
+	read(1000)
+	read(5000)
+	if rx, _ := monthlyTotals(t, db, mac); rx != 100 {
+		t.Errorf("monthly rx while disabled = %d, want 100", rx)
+	}
+
+	post("/stats/enable/", mac, true)
+	read(5100)
+	if rx, _ := monthlyTotals(t, db, mac); rx != 200 {
+		t.Errorf("monthly rx after re-enabling = %d, want 200", rx)
+	}
+}
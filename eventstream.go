@@ -0,0 +1,282 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Events streamed to -event-socket subscribers.
+const (
+	EVENT_NEW_DEVICE    = "new_device"
+	EVENT_QUOTA_CROSSED = "quota_crossed"
+	EVENT_REBOOT        = "reboot"
+
+	// EVENT_SUBSCRIBER_QUEUE is how many events a subscriber may fall
+	// behind by before it is dropped.
+	EVENT_SUBSCRIBER_QUEUE = 64
+	EVENT_WRITE_TIMEOUT    = 5 * time.Second
+)
+
+// quotaEventPercents are the shares of a cap whose crossing is streamed.
+var quotaEventPercents = []float64{80, 100}
+
+// RouterRebootEvent reports the entities of a router whose counters went
+// backwards in a cycle, which usually means the router restarted.
+type RouterRebootEvent struct {
+	Event     string   `json:"event"`
+	Router    string   `json:"router"`
+	Entities  []string `json:"entities"`
+	Timestamp string   `json:"timestamp"`
+}
+
+// QuotaEvent reports that a capped entity has used ThresholdPercent of its
+// cap this month. Each threshold is crossed at most once per month.
+type QuotaEvent struct {
+	Event            string  `json:"event"`
+	ID               string  `json:"id"`
+	ThresholdPercent float64 `json:"threshold_percent"`
+	UsedPercent      float64 `json:"used_percent"`
+	UsedBytes        int64   `json:"used_bytes"`
+	CapBytes         int64   `json:"cap_bytes"`
+	PeriodStart      string  `json:"period_start"`
+	Timestamp        string  `json:"timestamp"`
+}
+
+// eventStream is -event-socket: a Unix socket that streams events as
+// newline-delimited JSON to every connected client. Nothing is read from
+// clients and nothing is kept for those that connect later. Each client
+// has its own queue, and one that falls EVENT_SUBSCRIBER_QUEUE events
+// behind is disconnected rather than holding up collection.
+type eventStream struct {
+	listener    net.Listener
+	mutex       sync.Mutex
+	closed      bool
+	subscribers map[*eventSubscriber]bool
+}
+
+type eventSubscriber struct {
+	conn  net.Conn
+	lines chan []byte
+}
+
+// localEvents is nil unless -event-socket is set; publishing to a nil
+// stream does nothing.
+var localEvents *eventStream
+
+// listenEventSocket starts serving subscribers on the socket at path. A
+// socket left behind by a run that didn't exit cleanly is replaced; any
+// other file there is an error.
+func listenEventSocket(path string) (*eventStream, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("error removing stale event socket '%s': %w", path, err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on event socket '%s': %w", path, err)
+	}
+	s := &eventStream{
+		listener:    listener,
+		subscribers: map[*eventSubscriber]bool{},
+	}
+	go s.accept()
+	return s, nil
+}
+
+func (s *eventStream) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return
+			}
+			fmt.Printf("Error accepting event socket client: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		sub := &eventSubscriber{conn: conn, lines: make(chan []byte, EVENT_SUBSCRIBER_QUEUE)}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.subscribers[sub] = true
+		count := len(s.subscribers)
+		s.mutex.Unlock()
+		debugf("Event socket client connected, %d subscribed.\n", count)
+
+		go s.serve(sub)
+		// A client that hangs up is noticed right away rather than at
+		// the next event.
+		go func() {
+			io.Copy(ioutil.Discard, conn)
+			s.drop(sub, "")
+		}()
+	}
+}
+
+func (s *eventStream) serve(sub *eventSubscriber) {
+	for line := range sub.lines {
+		sub.conn.SetWriteDeadline(time.Now().Add(EVENT_WRITE_TIMEOUT))
+		if _, err := sub.conn.Write(line); err != nil {
+			s.drop(sub, err.Error())
+			return
+		}
+	}
+}
+
+func (s *eventStream) drop(sub *eventSubscriber, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dropLocked(sub, reason)
+}
+
+// dropLocked disconnects sub, logging reason unless it is empty, i.e. the
+// client left on its own. s.mutex must be held.
+func (s *eventStream) dropLocked(sub *eventSubscriber, reason string) {
+	if !s.subscribers[sub] {
+		return
+	}
+	delete(s.subscribers, sub)
+	close(sub.lines)
+	sub.conn.Close()
+	if reason != "" {
+		fmt.Printf("Dropped event socket client: %s.\n", reason)
+	} else {
+		debugf("Event socket client disconnected, %d subscribed.\n", len(s.subscribers))
+	}
+}
+
+// publish sends event to every subscriber.
+func (s *eventStream) publish(event interface{}) {
+	if s == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("Error encoding stream event: %v\n", err)
+		return
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for sub := range s.subscribers {
+		select {
+		case sub.lines <- line:
+		default:
+			s.dropLocked(sub, fmt.Sprintf("%d events behind", EVENT_SUBSCRIBER_QUEUE))
+		}
+	}
+}
+
+// close stops listening, which removes the socket, and disconnects every
+// subscriber.
+func (s *eventStream) close() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	s.listener.Close()
+	for sub := range s.subscribers {
+		s.dropLocked(sub, "")
+	}
+}
+
+// publishLeases streams the new devices among committed lease events.
+func (s *eventStream) publishLeases(events []LeaseEvent) {
+	for _, event := range events {
+		if event.Event == LEASE_EVENT_NEW {
+			event.Event = EVENT_NEW_DEVICE
+			s.publish(event)
+		}
+	}
+}
+
+// publishResets streams one reboot event per router with counter resets
+// among committed increments.
+func (s *eventStream) publishResets(increments []trafficIncrement) {
+	if s == nil {
+		return
+	}
+	reset := map[string][]string{}
+	for _, increment := range increments {
+		if increment.Reset {
+			reset[increment.Source] = append(reset[increment.Source], increment.EntityID)
+		}
+	}
+	routers := make([]string, 0, len(reset))
+	for router := range reset {
+		routers = append(routers, router)
+	}
+	sort.Strings(routers)
+	timestamp := displayTime(time.Now())
+	for _, router := range routers {
+		s.publish(RouterRebootEvent{Event: EVENT_REBOOT, Router: router, Entities: reset[router], Timestamp: timestamp})
+	}
+}
+
+// publishQuotaCrossings streams the thresholds in quotaEventPercents that
+// capped entities have reached this month and haven't been streamed yet.
+// Which were streamed is kept in alert_state, so a restart doesn't repeat
+// them.
+func (s *eventStream) publishQuotaCrossings(db *sql.DB, mutex *sync.Mutex, now time.Time) error {
+	if s == nil {
+		return nil
+	}
+	caps := activeCaps()
+	if len(caps) == 0 {
+		return nil
+	}
+	quotas, err := queryQuotas(db, mutex, caps, now)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	timestamp := displayTime(now)
+	for _, q := range quotas {
+		for _, percent := range quotaEventPercents {
+			if q.UsedBytes*100 < int64(percent)*q.CapBytes {
+				continue
+			}
+			key := alertKey(EVENT_QUOTA_CROSSED, fmt.Sprintf("%s:%g:%s", q.ID, percent, q.PeriodStart))
+			result, err := db.Exec("INSERT OR IGNORE INTO alert_state (alert, fired_at, armed) VALUES (?, ?, 0)", key, storedTime(now))
+			if err != nil {
+				return fmt.Errorf("error recording alert state for %s: %w", key, err)
+			}
+			if n, err := result.RowsAffected(); err != nil || n == 0 {
+				continue
+			}
+			s.publish(QuotaEvent{
+				Event:            EVENT_QUOTA_CROSSED,
+				ID:               q.ID,
+				ThresholdPercent: percent,
+				UsedPercent:      q.UsedPercent,
+				UsedBytes:        q.UsedBytes,
+				CapBytes:         q.CapBytes,
+				PeriodStart:      q.PeriodStart,
+				Timestamp:        timestamp,
+			})
+		}
+	}
+	return nil
+}
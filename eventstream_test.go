@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (s *eventStream) subscriberCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.subscribers)
+}
+
+// subscribe connects n clients to the stream at path and waits until the
+// stream has them all.
+func subscribe(t *testing.T, s *eventStream, path string, n int) []*bufio.Reader {
+	t.Helper()
+	var readers []*bufio.Reader
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		readers = append(readers, bufio.NewReader(conn))
+	}
+	for i := 0; s.subscriberCount() < n; i++ {
+		if i == 100 {
+			t.Fatalf("%d of %d clients subscribed", s.subscriberCount(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return readers
+}
+
+func TestEventStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	s, err := listenEventSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	clients := subscribe(t, s, path, 2)
+
+	s.publishLeases([]LeaseEvent{
+		{Event: LEASE_EVENT_RENEWED, MACAddress: "11:22:33:44:55:66"},
+		{Event: LEASE_EVENT_NEW, MACAddress: "aa:bb:cc:dd:ee:ff"},
+	})
+	s.publishResets([]trafficIncrement{
+		{EntityID: MAIN_WAN_ID, Source: "r1", Reset: true},
+		{EntityID: "aa:bb:cc:dd:ee:ff", Source: "r1"},
+	})
+	for i, client := range clients {
+		var device LeaseEvent
+		if line, err := client.ReadBytes('\n'); err != nil {
+			t.Fatal(err)
+		} else if err := json.Unmarshal(line, &device); err != nil {
+			t.Fatal(err)
+		}
+		if device.Event != EVENT_NEW_DEVICE || device.MACAddress != "aa:bb:cc:dd:ee:ff" {
+			t.Errorf("client %d: first event = %+v, want the new device", i, device)
+		}
+
+		var reboot RouterRebootEvent
+		if line, err := client.ReadBytes('\n'); err != nil {
+			t.Fatal(err)
+		} else if err := json.Unmarshal(line, &reboot); err != nil {
+			t.Fatal(err)
+		}
+		if reboot.Event != EVENT_REBOOT || reboot.Router != "r1" || strings.Join(reboot.Entities, ",") != MAIN_WAN_ID {
+			t.Errorf("client %d: second event = %+v, want r1's reboot", i, reboot)
+		}
+	}
+}
+
+func TestEventStreamDropsSlowSubscriber(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	s, err := listenEventSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	clients := subscribe(t, s, path, 2)
+	reading := clients[0]
+
+	// The second client never reads, so once the socket's buffers fill its
+	// queue does too.
+	event := map[string]string{"event": "filler", "pad": strings.Repeat("x", 512)}
+	for i := 0; i < EVENT_SUBSCRIBER_QUEUE*200 && s.subscriberCount() > 1; i++ {
+		s.publish(event)
+		if i%EVENT_SUBSCRIBER_QUEUE == EVENT_SUBSCRIBER_QUEUE-1 {
+			for j := 0; j < EVENT_SUBSCRIBER_QUEUE; j++ {
+				if _, err := reading.ReadBytes('\n'); err != nil {
+					t.Fatalf("reading client: %v", err)
+				}
+			}
+		}
+	}
+	if n := s.subscriberCount(); n != 1 {
+		t.Fatalf("%d subscribers, want the slow one dropped", n)
+	}
+
+	s.publish(RouterRebootEvent{Event: EVENT_REBOOT, Router: "r1"})
+	for {
+		line, err := reading.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("reading client after the drop: %v", err)
+		}
+		if strings.Contains(string(line), EVENT_REBOOT) {
+			break
+		}
+	}
+}
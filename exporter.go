@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EXPORT_SCHEMA_VERSION is CycleExport's schema_version. It goes up
+	// whenever a field changes meaning or goes away; new fields don't
+	// change it.
+	EXPORT_SCHEMA_VERSION = 1
+
+	EXPORT_TYPE_CYCLE = "cycle"
+)
+
+// Exporter is a destination for each collection cycle's results, such as
+// -push-url or -status-file. Export is called once per cycle after
+// everything is stored and must not hold up the cycle: slow delivery
+// belongs in the background, and an error is only logged.
+type Exporter interface {
+	Name() string
+	Export(doc *CycleExport) error
+}
+
+// CycleExport is the document exporters receive: the cycle summary, what
+// every entity's reading added to its totals, the resulting monthly totals
+// and the lease changes seen during the cycle.
+type CycleExport struct {
+	SchemaVersion int           `json:"schema_version"`
+	Type          string        `json:"type"`
+	GeneratedAt   string        `json:"generated_at"`
+	Summary       *CycleSummary `json:"summary"`
+	Deltas        []ExportDelta `json:"deltas"`
+	Totals        []ExportTotal `json:"totals"`
+	LeaseEvents   []LeaseEvent  `json:"lease_events"`
+}
+
+// ExportDelta is one stored reading. Baseline, Reset and Rejected are as in
+// trafficIncrement.
+type ExportDelta struct {
+	ID       string `json:"id"`
+	Router   string `json:"router"`
+	RXBytes  int64  `json:"rx_bytes"`
+	TXBytes  int64  `json:"tx_bytes"`
+	Baseline bool   `json:"baseline,omitempty"`
+	Reset    bool   `json:"reset,omitempty"`
+	Rejected bool   `json:"rejected,omitempty"`
+}
+
+// ExportTotal is an entity's month-to-date total after the cycle.
+type ExportTotal struct {
+	ID      string `json:"id"`
+	RXBytes int64  `json:"monthly_rx_bytes"`
+	TXBytes int64  `json:"monthly_tx_bytes"`
+}
+
+// exporters are the configured destinations, set up in main.
+var exporters []Exporter
+
+// cycleRecorder gathers what a cycle stored for its CycleExport.
+type cycleRecorder struct {
+	mutex  sync.Mutex
+	deltas []ExportDelta
+	leases []LeaseEvent
+}
+
+// cycleRecords is nil unless an exporter is configured; recording to a nil
+// recorder does nothing.
+var cycleRecords *cycleRecorder
+
+// addIncrements records committed readings.
+func (r *cycleRecorder) addIncrements(increments []trafficIncrement) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, increment := range increments {
+		r.deltas = append(r.deltas, ExportDelta{
+			ID:       increment.EntityID,
+			Router:   increment.Source,
+			RXBytes:  increment.RXBytes,
+			TXBytes:  increment.TXBytes,
+			Baseline: increment.Baseline,
+			Reset:    increment.Reset,
+			Rejected: increment.Rejected != nil,
+		})
+	}
+}
+
+// addLeaseEvents records committed lease changes.
+func (r *cycleRecorder) addLeaseEvents(events []LeaseEvent) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.leases = append(r.leases, events...)
+}
+
+// drain returns everything recorded since the last drain.
+func (r *cycleRecorder) drain() ([]ExportDelta, []LeaseEvent) {
+	if r == nil {
+		return nil, nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	deltas, leases := r.deltas, r.leases
+	r.deltas, r.leases = nil, nil
+	return deltas, leases
+}
+
+// queryExportTotals reads every entity's monthly totals, sorted by id.
+func queryExportTotals(db *sql.DB) ([]ExportTotal, error) {
+	rows, err := db.Query("SELECT id, rx_bytes, tx_bytes FROM monthly_stats ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("error querying monthly totals for export: %w", err)
+	}
+	defer rows.Close()
+
+	totals := []ExportTotal{}
+	for rows.Next() {
+		var total ExportTotal
+		if err := rows.Scan(&total.ID, &total.RXBytes, &total.TXBytes); err != nil {
+			return nil, fmt.Errorf("error scanning monthly totals for export: %w", err)
+		}
+		totals = append(totals, total)
+	}
+	return totals, rows.Err()
+}
+
+// exportCycle hands the finished cycle to every exporter. db is nil when
+// the stats database couldn't be opened, leaving the totals out.
+func exportCycle(db *sql.DB, summary *CycleSummary) {
+	if len(exporters) == 0 {
+		return
+	}
+	deltas, leases := cycleRecords.drain()
+	sort.SliceStable(deltas, func(i, j int) bool { return deltas[i].ID < deltas[j].ID })
+	if deltas == nil {
+		deltas = []ExportDelta{}
+	}
+	if leases == nil {
+		leases = []LeaseEvent{}
+	}
+	doc := &CycleExport{
+		SchemaVersion: EXPORT_SCHEMA_VERSION,
+		Type:          EXPORT_TYPE_CYCLE,
+		GeneratedAt:   displayTime(time.Now()),
+		Summary:       summary,
+		Deltas:        deltas,
+		Totals:        []ExportTotal{},
+		LeaseEvents:   leases,
+	}
+	if db != nil {
+		totals, err := queryExportTotals(db)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			doc.Totals = totals
+		}
+	}
+
+	for _, exporter := range exporters {
+		if err := exporter.Export(doc); err != nil {
+			fmt.Printf("Error exporting cycle to %s: %v\n", exporter.Name(), err)
+		}
+	}
+}
+
+// Name labels the webhook's export errors.
+func (h *webhook) Name() string {
+	return strings.ToLower(h.name) + " webhook"
+}
+
+// Export queues doc for delivery like any other webhook event.
+func (h *webhook) Export(doc *CycleExport) error {
+	h.enqueue(doc, fmt.Sprintf("cycle export (%s)", doc.Summary.StartedAt))
+	return nil
+}
+
+// headerListValue is a repeatable flag of "Name: value" HTTP headers.
+type headerListValue struct {
+	header http.Header
+}
+
+// headerListFlag defines a repeatable header flag and returns the headers
+// it collects.
+func headerListFlag(name, usage string) http.Header {
+	v := &headerListValue{header: http.Header{}}
+	flag.Var(v, name, usage)
+	return v.header
+}
+
+func (v *headerListValue) String() string {
+	if v.header == nil {
+		return ""
+	}
+	var headers []string
+	for name := range v.header {
+		headers = append(headers, name)
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, ", ")
+}
+
+func (v *headerListValue) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return fmt.Errorf("expected 'Name: value', got '%s'", s)
+	}
+	v.header.Add(strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]))
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// urlList is an endpoint URL in the config, written either as a string or
+// as a list of URLs to try in order.
+type urlList []string
+
+func (l *urlList) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*l = nil
+		if url != "" {
+			*l = urlList{url}
+		}
+		return nil
+	}
+	var urls []string
+	if err := json.Unmarshal(data, &urls); err != nil {
+		return fmt.Errorf("expected a URL or a list of URLs, got %s", data)
+	}
+	*l = urls
+	return nil
+}
+
+// UnmarshalJSON reads a router's config, accepting a list of URLs for
+// ap_stats, wan_stats and dhcp_leases: the first becomes the endpoint's URL
+// and the rest go before any fallback_urls of that endpoint.
+func (urls *RouterConfig) UnmarshalJSON(data []byte) error {
+	type plain RouterConfig
+	aux := struct {
+		*plain
+		APStatsURL    *urlList `json:"ap_stats"`
+		WANStatsURL   *urlList `json:"wan_stats"`
+		DHCPLeasesURL *urlList `json:"dhcp_leases"`
+	}{plain: (*plain)(urls)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	for _, field := range []struct {
+		endpoint string
+		list     *urlList
+		url      *string
+	}{
+		{"wifi", aux.APStatsURL, &urls.APStatsURL},
+		{"wan", aux.WANStatsURL, &urls.WANStatsURL},
+		{"dhcp", aux.DHCPLeasesURL, &urls.DHCPLeasesURL},
+	} {
+		// A missing or null key leaves the URL as it was.
+		if field.list == nil {
+			continue
+		}
+		list := *field.list
+		*field.url = ""
+		if len(list) > 0 {
+			*field.url = list[0]
+		}
+		if len(list) > 1 {
+			if urls.FallbackURLs == nil {
+				urls.FallbackURLs = map[string][]string{}
+			}
+			urls.FallbackURLs[field.endpoint] = append(append([]string(nil), list[1:]...), urls.FallbackURLs[field.endpoint]...)
+		}
+	}
+	return nil
+}
+
+// validateFallbackURLs checks a router's fallback_urls: known endpoints
+// that have a URL of their own, text format only, and no empty entries.
+func validateFallbackURLs(routerIP string, urls RouterConfig) error {
+	for endpoint, fallbacks := range urls.FallbackURLs {
+		var url string
+		switch endpoint {
+		case "wifi":
+			url = urls.APStatsURL
+		case "wan":
+			url = urls.WANStatsURL
+		case "dhcp":
+			url = urls.DHCPLeasesURL
+		default:
+			return fmt.Errorf("error: router '%s' has fallback URLs for unknown endpoint '%s', expected wifi, wan or dhcp", routerIP, endpoint)
+		}
+		if len(fallbacks) == 0 {
+			continue
+		}
+		if url == "" {
+			return fmt.Errorf("error: router '%s' has fallback URLs for %s but no URL to fall back from", routerIP, endpoint)
+		}
+		if urls.Format == FORMAT_UBUS {
+			return fmt.Errorf("error: router '%s' can't use fallback URLs with ubus format", routerIP)
+		}
+		for _, fallback := range fallbacks {
+			if fallback == "" {
+				return fmt.Errorf("error: router '%s' has an empty fallback URL for %s", routerIP, endpoint)
+			}
+			if err := validateUnixURL(fallback); err != nil {
+				return fmt.Errorf("error: router '%s': %w", routerIP, err)
+			}
+		}
+	}
+	return nil
+}
+
+// fetchFallbacks fetches endpoint from the first of candidates that answers
+// with data its parser accepts, so a script that is down or prints garbage
+// is skipped. Each attempt gets the full timeout.
+func fetchFallbacks(urls RouterConfig, endpoint string, candidates []string) (string, error) {
+	var failures []string
+	for i, url := range candidates {
+		data, err := fetchData(urls, url)
+		if err == nil {
+			err = checkParseable(urls, endpoint, data)
+		}
+		if err != nil {
+			debugf("%s: %s URL %s failed: %v\n", urls.name, endpoint, redactURL(url), err)
+			failures = append(failures, fmt.Sprintf("%s: %v", redactURL(url), err))
+			continue
+		}
+		if i > 0 {
+			fmt.Printf("%s: fetched %s stats from fallback URL %s (%s).\n", urls.name, endpoint, redactURL(url), strings.Join(failures, "; "))
+		}
+		return data, nil
+	}
+	return "", fmt.Errorf("all %d %s URLs failed: %s", len(candidates), endpoint, strings.Join(failures, "; "))
+}
+
+// checkParseable reports whether endpoint's parser accepts data, without
+// recording anything; the caller parses it again for real.
+func checkParseable(urls RouterConfig, endpoint, data string) error {
+	var err error
+	switch endpoint {
+	case "wifi":
+		columns := urls.wifiColumns
+		if columns.maxFields == 0 {
+			columns = defaultWiFiColumns
+		}
+		_, _, err = parseWiFiStatsColumns(data, columns)
+	case "wan":
+		var wan6 *WANStats
+		if wan6, err = parseWAN6Stats(data); err == nil {
+			if _, err = parseWANStats(data, urls.wanPattern); err != nil && wan6 != nil {
+				err = nil
+			}
+		}
+	case "dhcp":
+		_, _, _, err = parseLeases(urls, data)
+	}
+	if err != nil {
+		return fmt.Errorf("unparseable response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// replyWith starts a server answering every request with status and body.
+func replyWith(t *testing.T, status int, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFallbackURLs(t *testing.T) {
+	failing := replyWith(t, http.StatusInternalServerError, "")
+	garbage := replyWith(t, http.StatusOK, "<html>oops</html>")
+	good := replyWith(t, http.StatusOK, "wan: 5 6\n")
+
+	// A list in the endpoint's own field is the primary URL and then its
+	// fallbacks, ahead of any in fallback_urls.
+	var config Config
+	doc := fmt.Sprintf(`{"r1": {"wan_stats": [%q, %q], "fallback_urls": {"wan": [%q]}, "ap_stats": %q}}`, failing.URL, garbage.URL, good.URL, good.URL)
+	if err := json.Unmarshal([]byte(doc), &config); err != nil {
+		t.Fatal(err)
+	}
+	urls := config["r1"]
+	if urls.WANStatsURL != failing.URL || strings.Join(urls.FallbackURLs["wan"], " ") != garbage.URL+" "+good.URL {
+		t.Fatalf("wan_stats %q with fallbacks %q", urls.WANStatsURL, urls.FallbackURLs["wan"])
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	wan, _, _, err := collectWANStats("r1", urls)
+	if err != nil || wan.RXBytes != 5 || wan.TXBytes != 6 {
+		t.Errorf("collectWANStats = %+v, %v; want the last URL's reading", wan, err)
+	}
+
+	urls.FallbackURLs = map[string][]string{"wan": {garbage.URL}}
+	if _, err := fetchEndpoint(urls, "wan"); err == nil || !strings.Contains(err.Error(), "all 2 wan URLs failed") {
+		t.Errorf("fetchEndpoint with every URL failing = %v", err)
+	}
+}
+
+func TestFallbackURLsValidation(t *testing.T) {
+	for _, config := range []Config{
+		{"r1": {WANStatsURL: "http://192.168.1.1/wan", FallbackURLs: map[string][]string{"bogus": {"http://192.168.1.2/wan"}}}},
+		{"r1": {FallbackURLs: map[string][]string{"wan": {"http://192.168.1.2/wan"}}}},
+		{"r1": {WANStatsURL: "http://192.168.1.1/wan", FallbackURLs: map[string][]string{"wan": {""}}}},
+	} {
+		if err := validateConfig(config); err == nil {
+			t.Errorf("validateConfig accepted %+v", config["r1"].FallbackURLs)
+		}
+	}
+
+	var config Config
+	if err := json.Unmarshal([]byte(`{"r1": {"wan_stats": 5}}`), &config); err == nil {
+		t.Error("a number for wan_stats was accepted")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The handlers below implement the Grafana SimpleJSON datasource protocol on
+// top of the traffic_history table. Point the datasource URL at
+// http://<host>:8080/grafana and Grafana will call:
+//
+//	GET  /grafana/        health check, any 200 response is accepted
+//	POST /grafana/search  {"target": ""}
+//	                      -> ["aa:bb:cc:dd:ee:ff", "main_wan", ...]
+//	POST /grafana/query   {"range": {"from": "2024-01-01T00:00:00.000Z", "to": "2024-01-02T00:00:00.000Z"},
+//	                       "targets": [{"target": "main_wan", "refId": "A"}]}
+//	                      -> [{"target": "main_wan rx", "datapoints": [[1024, 1704067200000], ...]},
+//	                          {"target": "main_wan tx", "datapoints": [[512, 1704067200000], ...]}]
+//
+// Each datapoint is [bytes transferred during the cycle, unix time in ms].
+
+type grafanaSearchRequest struct {
+	Target string `json:"target"`
+}
+
+type grafanaQueryRequest struct {
+	Range struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	} `json:"range"`
+	Targets []struct {
+		Target string `json:"target"`
+		RefID  string `json:"refId"`
+	} `json:"targets"`
+}
+
+type grafanaSeries struct {
+	Target     string     `json:"target"`
+	Datapoints [][2]int64 `json:"datapoints"`
+}
+
+func registerGrafanaHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/grafana/", handleGrafanaHealth)
+	mux.HandleFunc("/grafana/search", handleGrafanaSearch)
+	mux.HandleFunc("/grafana/query", handleGrafanaQuery)
+}
+
+func handleGrafanaHealth(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/grafana/" {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func handleGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req grafanaSearchRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid search body: %v", err))
+			return
+		}
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT DISTINCT id FROM traffic_history ORDER BY id")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("error listing traffic history ids: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("error scanning traffic history id: %v", err))
+			return
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("error listing traffic history ids: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ids)
+}
+
+func handleGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req grafanaQueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid query body: %v", err))
+		return
+	}
+
+	from, err := time.Parse(time.RFC3339, req.Range.From)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid range.from '%s': %v", req.Range.From, err))
+		return
+	}
+	to, err := time.Parse(time.RFC3339, req.Range.To)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid range.to '%s': %v", req.Range.To, err))
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	fromStr := storedTime(from)
+	toStr := storedTime(to)
+
+	series := []grafanaSeries{}
+	for _, target := range req.Targets {
+		if target.Target == "" {
+			continue
+		}
+		rx, tx, err := queryTrafficHistory(db, target.Target, fromStr, toStr)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		series = append(series,
+			grafanaSeries{Target: target.Target + " rx", Datapoints: rx},
+			grafanaSeries{Target: target.Target + " tx", Datapoints: tx},
+		)
+	}
+
+	writeJSON(w, http.StatusOK, series)
+}
+
+func queryTrafficHistory(db *sql.DB, entityID, from, to string) ([][2]int64, [][2]int64, error) {
+	rows, err := db.Query(`
+		SELECT rx_bytes, tx_bytes, timestamp FROM traffic_history
+		WHERE id = ? AND timestamp >= ? AND timestamp <= ?
+		ORDER BY timestamp
+	`, entityID, from, to)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error querying traffic history for %s: %w", entityID, err)
+	}
+	defer rows.Close()
+
+	rx := [][2]int64{}
+	tx := [][2]int64{}
+	for rows.Next() {
+		var rxBytes, txBytes int64
+		var timestampStr string
+		if err := rows.Scan(&rxBytes, &txBytes, &timestampStr); err != nil {
+			return nil, nil, fmt.Errorf("error scanning traffic history for %s: %w", entityID, err)
+		}
+		timestamp, err := parseStoredTime(timestampStr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing traffic history timestamp: %w", err)
+		}
+		ms := timestamp.UnixNano() / int64(time.Millisecond)
+		rx = append(rx, [2]int64{rxBytes, ms})
+		tx = append(tx, [2]int64{txBytes, ms})
+	}
+	return rx, tx, rows.Err()
+}
@@ -0,0 +1,1010 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func registerStatsHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/stats/reset/", handleResetEntity)
+	mux.HandleFunc("/stats/reset-all", handleResetAll)
+	mux.HandleFunc("/stats/disable/", entityEnabledHandler("/stats/disable/", false))
+	mux.HandleFunc("/stats/enable/", entityEnabledHandler("/stats/enable/", true))
+	mux.HandleFunc("/stats/reboots", handleRebootEvents)
+	mux.HandleFunc("/stats/archive", handleMonthlyArchive)
+	mux.HandleFunc("/stats/alltime", handleAllTimeStats)
+	mux.HandleFunc("/stats/bands", handleBandTotals)
+	mux.HandleFunc("/stats/routers", handleRouterLoad)
+	mux.HandleFunc("/stats/top", handleTopTalkers)
+	mux.HandleFunc("/stats/flaps", handleClientFlaps)
+	mux.HandleFunc("/stats/projection", handleProjections)
+	mux.HandleFunc("/stats/tags", handleTagUsage)
+	mux.HandleFunc("/stats/sparkline/", handleSparkline)
+	mux.HandleFunc("/stats/hourly/", handleHourlyUsage)
+	mux.HandleFunc("/stats/range/", handleRangeUsage)
+	mux.HandleFunc("/stats/signal", handleClientSignal)
+	mux.HandleFunc("/quota", handleQuota)
+	mux.HandleFunc("/presence", handlePresence)
+}
+
+const TOP_TALKERS_MAX_LIMIT = 100
+
+const (
+	SPARKLINE_DEFAULT_POINTS = 24
+	// SPARKLINE_MAX_POINTS is a week of cycles.
+	SPARKLINE_MAX_POINTS = 336
+
+	HOURLY_DEFAULT_DAYS = 7
+	HOURLY_MAX_DAYS     = 90
+)
+
+// queryTopTalkers ranks this month's clients by rx, tx or total bytes and
+// labels each with its hostname from dhcpHostnames, loaded from dhcpDB if
+// stale. WAN, tunnel and synthetic ids are left out, since their traffic is
+// the clients' own counted again. Both reads happen under the mutex so they
+// see the same cycle's writes. A non-empty tag limits the ranking to
+// entities with that tag (see tagFilter).
+func queryTopTalkers(statsDB, dhcpDB *sql.DB, mutex *sync.Mutex, by string, limit int, tag string) ([]TopTalker, error) {
+	var orderBy string
+	switch by {
+	case "rx":
+		orderBy = "rx_bytes"
+	case "tx":
+		orderBy = "tx_bytes"
+	case "total":
+		orderBy = "rx_bytes + tx_bytes"
+	default:
+		return nil, fmt.Errorf("unknown metric '%s'", by)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	where := "(rx_bytes > 0 OR tx_bytes > 0) AND substr(id, 1, 2) != ? AND NOT " + wanCondition("id") + " AND NOT " + tunnelCondition("id")
+	args := []interface{}{SYNTHETIC_ID_PREFIX}
+	if tag != "" {
+		condition, tagArgs := tagFilter(tag)
+		where += " AND " + condition
+		args = append(args, tagArgs...)
+	}
+	args = append(args, limit)
+
+	rows, err := statsDB.Query(`
+		SELECT id, rx_bytes, tx_bytes FROM monthly_stats
+		WHERE `+where+`
+		ORDER BY `+orderBy+` DESC, id
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying top talkers: %w", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	start, end := billingPeriod(now)
+
+	talkers := []TopTalker{}
+	for rows.Next() {
+		talker := TopTalker{Rank: len(talkers) + 1}
+		if err := rows.Scan(&talker.ID, &talker.RXBytes, &talker.TXBytes); err != nil {
+			return nil, fmt.Errorf("error scanning top talkers: %w", err)
+		}
+		talker.TotalBytes = talker.RXBytes + talker.TXBytes
+		talker.RXHuman = humanizeBytes(talker.RXBytes)
+		talker.TXHuman = humanizeBytes(talker.TXBytes)
+		talker.TotalHuman = humanizeBytes(talker.TotalBytes)
+		talker.ProjectedBytes = projectUsage(talker.TotalBytes, start, end, now)
+		talker.ProjectedHuman = humanizeBytes(talker.ProjectedBytes)
+		talkers = append(talkers, talker)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying top talkers: %w", err)
+	}
+
+	tags, err := queryEntityTags(statsDB)
+	if err != nil {
+		return nil, err
+	}
+	if err := dhcpHostnames.load(dhcpDB); err != nil {
+		return nil, err
+	}
+	for i := range talkers {
+		talkers[i].Tags = tags[talkers[i].ID]
+		if talkers[i].Tags == nil {
+			talkers[i].Tags = []string{}
+		}
+		talkers[i].Hostname = hostnameFor(talkers[i].ID)
+	}
+	return talkers, nil
+}
+
+// queryProjections projects each entity's monthly total, or only id's when
+// it is set, to the end of the month, largest projection first.
+func queryProjections(db *sql.DB, id string, now time.Time) ([]Projection, error) {
+	query := "SELECT id, rx_bytes + tx_bytes FROM monthly_stats"
+	var args []interface{}
+	if id != "" {
+		query += " WHERE id = ?"
+		args = append(args, id)
+	}
+	query += " ORDER BY rx_bytes + tx_bytes DESC, id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying monthly stats for projection: %w", err)
+	}
+	defer rows.Close()
+
+	start, end := billingPeriod(now)
+	projections := []Projection{}
+	for rows.Next() {
+		p := Projection{
+			PeriodStart: displayTime(start),
+			PeriodEnd:   displayTime(end),
+		}
+		if err := rows.Scan(&p.ID, &p.TotalBytes); err != nil {
+			return nil, fmt.Errorf("error scanning monthly stats for projection: %w", err)
+		}
+		p.ProjectedBytes = projectUsage(p.TotalBytes, start, end, now)
+		p.TotalHuman = humanizeBytes(p.TotalBytes)
+		p.ProjectedHuman = humanizeBytes(p.ProjectedBytes)
+		projections = append(projections, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying monthly stats for projection: %w", err)
+	}
+	return projections, nil
+}
+
+// queryRouterLoad sums the WiFi client traffic each router reported since the
+// given timestamp, along with how many distinct clients it saw.
+func queryRouterLoad(db *sql.DB, since string) ([]RouterLoad, error) {
+	rows, err := db.Query(`
+		SELECT source_router, COUNT(DISTINCT id), SUM(rx_bytes), SUM(tx_bytes) FROM traffic_history
+		WHERE source_router != '' AND NOT `+wanCondition("id")+` AND NOT `+tunnelCondition("id")+` AND timestamp >= ?
+		GROUP BY source_router
+		ORDER BY source_router
+	`, since)
+	if err != nil {
+		return nil, fmt.Errorf("error querying per-router load: %w", err)
+	}
+	defer rows.Close()
+
+	loads := []RouterLoad{}
+	for rows.Next() {
+		var load RouterLoad
+		if err := rows.Scan(&load.SourceRouter, &load.Clients, &load.RXBytes, &load.TXBytes); err != nil {
+			return nil, fmt.Errorf("error scanning per-router load: %w", err)
+		}
+		load.RXHuman = humanizeBytes(load.RXBytes)
+		load.TXHuman = humanizeBytes(load.TXBytes)
+		loads = append(loads, load)
+	}
+	return loads, rows.Err()
+}
+
+// queryBandTotals sums the traffic recorded per WiFi interface since the
+// given timestamp. Entities without an interface (WAN, legacy 3-field
+// lines) are left out.
+func queryBandTotals(db *sql.DB, since string) ([]BandTotal, error) {
+	rows, err := db.Query(`
+		SELECT interface, SUM(rx_bytes), SUM(tx_bytes) FROM traffic_history
+		WHERE interface != '' AND timestamp >= ?
+		GROUP BY interface
+		ORDER BY interface
+	`, since)
+	if err != nil {
+		return nil, fmt.Errorf("error querying per-band totals: %w", err)
+	}
+	defer rows.Close()
+
+	totals := []BandTotal{}
+	for rows.Next() {
+		var total BandTotal
+		if err := rows.Scan(&total.Interface, &total.RXBytes, &total.TXBytes); err != nil {
+			return nil, fmt.Errorf("error scanning per-band totals: %w", err)
+		}
+		total.RXHuman = humanizeBytes(total.RXBytes)
+		total.TXHuman = humanizeBytes(total.TXBytes)
+		totals = append(totals, total)
+	}
+	return totals, rows.Err()
+}
+
+// queryMonthlyArchive returns archived monthly totals, newest month first,
+// optionally limited to one entity.
+func queryMonthlyArchive(db *sql.DB, entityID string) ([]MonthlyArchiveEntry, error) {
+	query := "SELECT id, year_month, rx_bytes, tx_bytes FROM monthly_archive"
+	var args []interface{}
+	if entityID != "" {
+		query += " WHERE id = ?"
+		args = append(args, entityID)
+	}
+	query += " ORDER BY year_month DESC, id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying monthly archive: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []MonthlyArchiveEntry{}
+	for rows.Next() {
+		var entry MonthlyArchiveEntry
+		if err := rows.Scan(&entry.ID, &entry.YearMonth, &entry.RXBytes, &entry.TXBytes); err != nil {
+			return nil, fmt.Errorf("error scanning monthly archive: %w", err)
+		}
+		entry.RXHuman = humanizeBytes(entry.RXBytes)
+		entry.TXHuman = humanizeBytes(entry.TXBytes)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// queryAllTimeStats returns lifetime totals, largest first, optionally
+// limited to one entity.
+func queryAllTimeStats(db *sql.DB, entityID string) ([]AllTimeEntry, error) {
+	query := "SELECT id, rx_bytes, tx_bytes, first_seen, last_seen FROM alltime_stats"
+	var args []interface{}
+	if entityID != "" {
+		query += " WHERE id = ?"
+		args = append(args, entityID)
+	}
+	query += " ORDER BY rx_bytes + tx_bytes DESC, id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying all-time stats: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AllTimeEntry{}
+	for rows.Next() {
+		var entry AllTimeEntry
+		if err := rows.Scan(&entry.ID, &entry.RXBytes, &entry.TXBytes, &entry.FirstSeen, &entry.LastSeen); err != nil {
+			return nil, fmt.Errorf("error scanning all-time stats: %w", err)
+		}
+		entry.FirstSeen = displayStoredTime(entry.FirstSeen)
+		entry.LastSeen = displayStoredTime(entry.LastSeen)
+		entry.RXHuman = humanizeBytes(entry.RXBytes)
+		entry.TXHuman = humanizeBytes(entry.TXBytes)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// queryClientFlaps lists the clients that reconnected at least once this
+// month, most reconnects first.
+func queryClientFlaps(db *sql.DB) ([]ClientFlaps, error) {
+	rows, err := db.Query(`
+		SELECT id, flap_count, source_router FROM monthly_stats
+		WHERE flap_count > 0
+		ORDER BY flap_count DESC, id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying client reconnects: %w", err)
+	}
+	defer rows.Close()
+
+	flaps := []ClientFlaps{}
+	for rows.Next() {
+		var entry ClientFlaps
+		if err := rows.Scan(&entry.ID, &entry.FlapCount, &entry.SourceRouter); err != nil {
+			return nil, fmt.Errorf("error scanning client reconnects: %w", err)
+		}
+		flaps = append(flaps, entry)
+	}
+	return flaps, rows.Err()
+}
+
+// queryRebootEvents lists the most recent recorded reboots, newest first,
+// optionally limited to one entity.
+func queryRebootEvents(db *sql.DB, entityID string, limit int) ([]RebootEvent, error) {
+	query := "SELECT id, detected_at, previous_rx, previous_tx FROM reboot_events"
+	var args []interface{}
+	if entityID != "" {
+		query += " WHERE id = ?"
+		args = append(args, entityID)
+	}
+	query += " ORDER BY detected_at DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying reboot events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []RebootEvent{}
+	for rows.Next() {
+		var event RebootEvent
+		if err := rows.Scan(&event.ID, &event.DetectedAt, &event.PreviousRX, &event.PreviousTX); err != nil {
+			return nil, fmt.Errorf("error scanning reboot event: %w", err)
+		}
+		event.DetectedAt = displayStoredTime(event.DetectedAt)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// resetEntityStats zeroes the monthly totals for entityID. Its cumulative
+// baseline is kept, so the next observation only adds what moved since the
+// last one rather than the router's whole counter. It returns the monthly
+// values that were cleared and whether the entity existed at all.
+func resetEntityStats(db *sql.DB, mutex *sync.Mutex, entityID string) (int64, int64, bool, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to begin transaction for resetting %s: %w", entityID, err)
+	}
+	defer tx.Rollback()
+
+	var rxBytes, txBytes int64
+	monthlyFound := true
+	err = tx.QueryRow("SELECT rx_bytes, tx_bytes FROM monthly_stats WHERE id = ?", entityID).Scan(&rxBytes, &txBytes)
+	if err == sql.ErrNoRows {
+		monthlyFound = false
+	} else if err != nil {
+		return 0, 0, false, fmt.Errorf("error fetching monthly stats for %s: %w", entityID, err)
+	}
+
+	if !monthlyFound {
+		var exists int
+		err = tx.QueryRow("SELECT 1 FROM cumulative_stats WHERE id = ?", entityID).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return 0, 0, false, nil
+		} else if err != nil {
+			return 0, 0, false, fmt.Errorf("error fetching cumulative stats for %s: %w", entityID, err)
+		}
+		return 0, 0, true, nil
+	}
+
+	_, err = tx.Exec("UPDATE monthly_stats SET rx_bytes = 0, tx_bytes = 0, flap_count = 0 WHERE id = ?", entityID)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("error resetting monthly stats for %s: %w", entityID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, false, err
+	}
+	return rxBytes, txBytes, true, nil
+}
+
+// resetAllStats zeroes every monthly total, keeping the cumulative
+// baselines like resetEntityStats. It returns the number of entities whose
+// totals were cleared.
+func resetAllStats(db *sql.DB, mutex *sync.Mutex) (int64, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction for resetting all stats: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE monthly_stats SET rx_bytes = 0, tx_bytes = 0, flap_count = 0")
+	if err != nil {
+		return 0, fmt.Errorf("error resetting monthly stats: %w", err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error resetting monthly stats: %w", err)
+	}
+
+	return count, tx.Commit()
+}
+
+func handleResetEntity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	entityID := strings.TrimPrefix(r.URL.Path, "/stats/reset/")
+	if entityID == "" {
+		writeError(w, http.StatusBadRequest, "missing entity id")
+		return
+	}
+	if mac, ok := normalizeMAC(entityID); ok {
+		entityID = mac
+	}
+
+	db, err := connectDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	rxBytes, txBytes, found, err := resetEntityStats(db, &dbMutex, entityID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("entity '%s' not found", entityID))
+		return
+	}
+
+	fmt.Printf("Stats reset for %s via API (cleared rx=%s tx=%s).\n", entityID, humanizeBytes(rxBytes), humanizeBytes(txBytes))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":               entityID,
+		"cleared_rx_bytes": rxBytes,
+		"cleared_tx_bytes": txBytes,
+		"cleared_rx_human": humanizeBytes(rxBytes),
+		"cleared_tx_human": humanizeBytes(txBytes),
+	})
+}
+
+func handleResetAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if r.URL.Query().Get("confirm") != "yes" {
+		writeError(w, http.StatusBadRequest, "resetting all stats requires ?confirm=yes")
+		return
+	}
+
+	db, err := connectDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	count, err := resetAllStats(db, &dbMutex)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	fmt.Printf("All stats reset via API (%d entities cleared).\n", count)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"entities_reset": count,
+	})
+}
+
+func handleRebootEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	limit := 50
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit '%s'", limitStr))
+			return
+		}
+		limit = n
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	events, err := queryRebootEvents(db, r.URL.Query().Get("id"), limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": events})
+}
+
+func handleMonthlyArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	entries, err := queryMonthlyArchive(db, r.URL.Query().Get("id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": entries})
+}
+
+func handleAllTimeStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	entries, err := queryAllTimeStats(db, r.URL.Query().Get("id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": entries})
+}
+
+func handleProjections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	projections, err := queryProjections(db, r.URL.Query().Get("id"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": projections})
+}
+
+func handleBandTotals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	monthStart, _ := billingPeriod(time.Now())
+	totals, err := queryBandTotals(db, storedTime(monthStart))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": totals})
+}
+
+func handleRouterLoad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	now := time.Now()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	loads, err := queryRouterLoad(db, storedTime(monthStart))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": loads})
+}
+
+func handleTopTalkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = "total"
+	}
+	if by != "rx" && by != "tx" && by != "total" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid by '%s', expected rx, tx or total", by))
+		return
+	}
+
+	limit := 10
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit '%s'", limitStr))
+			return
+		}
+		limit = n
+	}
+	if limit > TOP_TALKERS_MAX_LIMIT {
+		limit = TOP_TALKERS_MAX_LIMIT
+	}
+
+	statsDB, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer statsDB.Close()
+
+	dhcpDB, err := connectReadOnlyDB(*dhcpDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer dhcpDB.Close()
+
+	tag := strings.ToLower(r.URL.Query().Get("tag"))
+	talkers, err := queryTopTalkers(statsDB, dhcpDB, &dbMutex, by, limit, tag)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	total := TopTalker{ID: TOTAL_ID, Hostname: "Whole network"}
+	err = statsDB.QueryRow("SELECT rx_bytes, tx_bytes FROM monthly_stats WHERE id = ?", TOTAL_ID).Scan(&total.RXBytes, &total.TXBytes)
+	if err != nil && err != sql.ErrNoRows {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("error reading %s: %v", TOTAL_ID, err))
+		return
+	}
+	total.TotalBytes = total.RXBytes + total.TXBytes
+	total.RXHuman = humanizeBytes(total.RXBytes)
+	total.TXHuman = humanizeBytes(total.TXBytes)
+	total.TotalHuman = humanizeBytes(total.TotalBytes)
+	now := time.Now()
+	start, end := billingPeriod(now)
+	total.ProjectedBytes = projectUsage(total.TotalBytes, start, end, now)
+	total.ProjectedHuman = humanizeBytes(total.ProjectedBytes)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": talkers, "total": total})
+}
+
+func handleClientFlaps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	flaps, err := queryClientFlaps(db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": flaps})
+}
+
+// querySparkline sums an entity's traffic_history rows into points slots of
+// CYCLE_INTERVAL each, ending at now. Jittered or delayed cycles can put two
+// rows in one slot and none in the next; either way the bytes are counted
+// once. An entity with no history at all gets empty series rather than
+// zeros.
+func querySparkline(db *sql.DB, entityID string, points int, now time.Time) (Sparkline, error) {
+	from := now.Add(-time.Duration(points) * CYCLE_INTERVAL)
+	sparkline := Sparkline{
+		ID:     entityID,
+		From:   displayTime(from),
+		To:     displayTime(now),
+		Points: points,
+		Total:  []int64{},
+		RX:     []int64{},
+		TX:     []int64{},
+	}
+
+	var known int
+	if err := db.QueryRow("SELECT COUNT(*) FROM (SELECT 1 FROM traffic_history WHERE id = ? LIMIT 1)", entityID).Scan(&known); err != nil {
+		return sparkline, fmt.Errorf("error querying traffic history for sparkline: %w", err)
+	}
+	if known == 0 {
+		return sparkline, nil
+	}
+	sparkline.Total = make([]int64, points)
+	sparkline.RX = make([]int64, points)
+	sparkline.TX = make([]int64, points)
+
+	rows, err := db.Query(`
+		SELECT rx_bytes, tx_bytes, timestamp FROM traffic_history
+		WHERE id = ? AND timestamp > ? AND timestamp <= ?
+	`, entityID, storedTime(from), storedTime(now))
+	if err != nil {
+		return sparkline, fmt.Errorf("error querying traffic history for sparkline: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rx, tx int64
+		var timestamp string
+		if err := rows.Scan(&rx, &tx, &timestamp); err != nil {
+			return sparkline, fmt.Errorf("error scanning traffic history for sparkline: %w", err)
+		}
+		t, err := parseStoredTime(timestamp)
+		if err != nil {
+			continue
+		}
+		// A row is stamped at the end of the cycle it covers, so one
+		// exactly on a slot boundary belongs to the slot it closes.
+		slot := int((t.Sub(from) - 1) / CYCLE_INTERVAL)
+		if slot < 0 || slot >= points {
+			continue
+		}
+		sparkline.RX[slot] += rx
+		sparkline.TX[slot] += tx
+		sparkline.Total[slot] += rx + tx
+	}
+	return sparkline, rows.Err()
+}
+
+func handleSparkline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	entityID := strings.TrimPrefix(r.URL.Path, "/stats/sparkline/")
+	if entityID == "" {
+		writeError(w, http.StatusBadRequest, "missing entity id")
+		return
+	}
+	if mac, ok := normalizeMAC(entityID); ok {
+		entityID = mac
+	}
+
+	points := SPARKLINE_DEFAULT_POINTS
+	if pointsStr := r.URL.Query().Get("points"); pointsStr != "" {
+		n, err := strconv.Atoi(pointsStr)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid points '%s'", pointsStr))
+			return
+		}
+		points = n
+	}
+	if points > SPARKLINE_MAX_POINTS {
+		points = SPARKLINE_MAX_POINTS
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	sparkline, err := querySparkline(db, entityID, points, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": sparkline})
+}
+
+// queryHourlyUsage averages an entity's traffic_history over the last days
+// days by local hour of the day. The rows are bucketed here rather than with
+// strftime('%H', timestamp) because timestamps are stored in UTC and SQLite
+// doesn't know the -timezone zone. Days without any row for the entity don't
+// count towards the average, so a device that was away isn't diluted.
+func queryHourlyUsage(db *sql.DB, entityID string, days int, now time.Time) (HourlyUsage, error) {
+	from := now.AddDate(0, 0, -days)
+	usage := HourlyUsage{
+		ID:    entityID,
+		From:  displayTime(from),
+		To:    displayTime(now),
+		Days:  days,
+		Total: make([]int64, 24),
+		RX:    make([]int64, 24),
+		TX:    make([]int64, 24),
+	}
+
+	rows, err := db.Query(`
+		SELECT rx_bytes, tx_bytes, timestamp FROM traffic_history
+		WHERE id = ? AND timestamp > ? AND timestamp <= ?
+	`, entityID, storedTime(from), storedTime(now))
+	if err != nil {
+		return usage, fmt.Errorf("error querying traffic history by hour: %w", err)
+	}
+	defer rows.Close()
+
+	seenDays := map[string]bool{}
+	for rows.Next() {
+		var rx, tx int64
+		var timestamp string
+		if err := rows.Scan(&rx, &tx, &timestamp); err != nil {
+			return usage, fmt.Errorf("error scanning traffic history by hour: %w", err)
+		}
+		t, err := parseStoredTime(timestamp)
+		if err != nil {
+			continue
+		}
+		t = t.In(time.Local)
+		seenDays[t.Format("2006-01-02")] = true
+		usage.RX[t.Hour()] += rx
+		usage.TX[t.Hour()] += tx
+	}
+	if err := rows.Err(); err != nil {
+		return usage, fmt.Errorf("error querying traffic history by hour: %w", err)
+	}
+
+	usage.DaysWithData = len(seenDays)
+	if usage.DaysWithData > 0 {
+		for hour := range usage.Total {
+			usage.RX[hour] /= int64(usage.DaysWithData)
+			usage.TX[hour] /= int64(usage.DaysWithData)
+			usage.Total[hour] = usage.RX[hour] + usage.TX[hour]
+		}
+	}
+	return usage, nil
+}
+
+func handleHourlyUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	entityID := strings.TrimPrefix(r.URL.Path, "/stats/hourly/")
+	if entityID == "" {
+		writeError(w, http.StatusBadRequest, "missing entity id")
+		return
+	}
+	if mac, ok := normalizeMAC(entityID); ok {
+		entityID = mac
+	}
+
+	days := HOURLY_DEFAULT_DAYS
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		n, err := strconv.Atoi(daysStr)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid days '%s'", daysStr))
+			return
+		}
+		days = n
+	}
+	if days > HOURLY_MAX_DAYS {
+		days = HOURLY_MAX_DAYS
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	usage, err := queryHourlyUsage(db, entityID, days, time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": usage})
+}
+
+// RANGE_DATE_LAYOUT is the date-only form /stats/range accepts besides RFC
+// 3339, meaning midnight in the -timezone zone.
+const RANGE_DATE_LAYOUT = "2006-01-02"
+
+// parseRangeTime reads a from or to parameter of /stats/range.
+func parseRangeTime(name, s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, fmt.Errorf("missing %s", name)
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(RANGE_DATE_LAYOUT, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s '%s': expected RFC 3339 or %s", name, s, RANGE_DATE_LAYOUT)
+	}
+	return t, nil
+}
+
+// queryRangeUsage sums an entity's traffic_history rows stamped after from
+// and up to to. A row is stamped at the end of the cycle it covers, so a
+// cycle straddling from counts towards the earlier window. TOTAL_ID has no
+// history of its own and sums the entities it rolls up, per -total-source.
+func queryRangeUsage(db *sql.DB, entityID string, from, to time.Time) (RangeUsage, error) {
+	usage := RangeUsage{ID: entityID, From: displayTime(from), To: displayTime(to)}
+
+	where := "id = ?"
+	args := []interface{}{entityID}
+	if entityID == TOTAL_ID {
+		condition, err := totalCondition(*totalSource)
+		if err != nil {
+			return usage, err
+		}
+		where, args = condition, nil
+	}
+	args = append(args, storedTime(from), storedTime(to))
+
+	err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(rx_bytes), 0), COALESCE(SUM(tx_bytes), 0) FROM traffic_history
+		WHERE `+where+` AND timestamp > ? AND timestamp <= ?
+	`, args...).Scan(&usage.Samples, &usage.RXBytes, &usage.TXBytes)
+	if err != nil {
+		return usage, fmt.Errorf("error summing traffic history for %s: %w", entityID, err)
+	}
+	usage.TotalBytes = usage.RXBytes + usage.TXBytes
+	usage.RXHuman = humanizeBytes(usage.RXBytes)
+	usage.TXHuman = humanizeBytes(usage.TXBytes)
+	usage.TotalHuman = humanizeBytes(usage.TotalBytes)
+	return usage, nil
+}
+
+func handleRangeUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	entityID := strings.TrimPrefix(r.URL.Path, "/stats/range/")
+	if entityID == "" {
+		writeError(w, http.StatusBadRequest, "missing entity id")
+		return
+	}
+	if mac, ok := normalizeMAC(entityID); ok {
+		entityID = mac
+	}
+
+	from, err := parseRangeTime("from", r.URL.Query().Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := parseRangeTime("to", r.URL.Query().Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	usage, err := queryRangeUsage(db, entityID, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": usage})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestResetEntityStatsKeepsBaseline(t *testing.T) {
+	db := openTestStatsDB(t)
+	mac := "aa:bb:cc:dd:ee:ff"
+	storeReadings(t, db, TrafficUpdate{EntityID: mac, Source: "r1", RXBytes: 5000, TXBytes: 1000})
+	storeReadings(t, db, TrafficUpdate{EntityID: mac, Source: "r1", RXBytes: 5600, TXBytes: 1100})
+
+	rx, tx, found, err := resetEntityStats(db, &dbMutex, mac)
+	if err != nil || !found {
+		t.Fatalf("resetEntityStats = %v, %v", found, err)
+	}
+	if rx != 5600 || tx != 1100 {
+		t.Errorf("cleared rx %d tx %d, want 5600 and 1100", rx, tx)
+	}
+	if rx, tx := monthlyTotals(t, db, mac); rx != 0 || tx != 0 {
+		t.Fatalf("monthly after reset = %d/%d, want 0/0", rx, tx)
+	}
+
+	// Only the traffic since the last reading counts, not the whole counter.
+	storeReadings(t, db, TrafficUpdate{EntityID: mac, Source: "r1", RXBytes: 5700, TXBytes: 1150})
+	if rx, tx := monthlyTotals(t, db, mac); rx != 100 || tx != 50 {
+		t.Errorf("monthly after next reading = %d/%d, want 100/50", rx, tx)
+	}
+
+	if _, _, found, err := resetEntityStats(db, &dbMutex, "11:22:33:44:55:66"); err != nil || found {
+		t.Errorf("unknown entity: found %v, err %v", found, err)
+	}
+}
+
+func TestResetAllStatsKeepsBaselines(t *testing.T) {
+	db := openTestStatsDB(t)
+	storeReadings(t, db,
+		TrafficUpdate{EntityID: "aa:bb:cc:dd:ee:01", Source: "r1", RXBytes: 1 << 30, TXBytes: 1 << 20},
+		TrafficUpdate{EntityID: MAIN_WAN_ID, Source: "r1", RXBytes: 1 << 32, TXBytes: 1 << 30},
+	)
+
+	count, err := resetAllStats(db, &dbMutex)
+	if err != nil || count != 2 {
+		t.Fatalf("resetAllStats = %d, %v; want 2 entities", count, err)
+	}
+	storeReadings(t, db,
+		TrafficUpdate{EntityID: "aa:bb:cc:dd:ee:01", Source: "r1", RXBytes: 1<<30 + 10, TXBytes: 1<<20 + 5},
+		TrafficUpdate{EntityID: MAIN_WAN_ID, Source: "r1", RXBytes: 1<<32 + 20, TXBytes: 1<<30 + 8},
+	)
+	if rx, tx := monthlyTotals(t, db, "aa:bb:cc:dd:ee:01"); rx != 10 || tx != 5 {
+		t.Errorf("client monthly = %d/%d, want 10/5", rx, tx)
+	}
+	if rx, tx := monthlyTotals(t, db, MAIN_WAN_ID); rx != 20 || tx != 8 {
+		t.Errorf("WAN monthly = %d/%d, want 20/8", rx, tx)
+	}
+}
+
+func TestHandleResetEntityNormalizesMAC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "network_stats.db")
+	db, err := connectDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := setupStatsDB(db); err != nil {
+		t.Fatal(err)
+	}
+	storeReadings(t, db, TrafficUpdate{EntityID: "aa:bb:cc:dd:ee:ff", Source: "r1", RXBytes: 100, TXBytes: 100})
+
+	old := *statsDBPath
+	*statsDBPath = path
+	defer func() { *statsDBPath = old }()
+
+	for _, tc := range []struct {
+		id   string
+		want int
+	}{
+		{"AA:BB:CC:DD:EE:FF", http.StatusOK},
+		{"aa-bb-cc-dd-ee-ff", http.StatusOK},
+		{"11:22:33:44:55:66", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		handleResetEntity(rec, httptest.NewRequest(http.MethodPost, "/stats/reset/"+tc.id, nil))
+		if rec.Code != tc.want {
+			t.Errorf("POST /stats/reset/%s = %d, want %d: %s", tc.id, rec.Code, tc.want, rec.Body)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleResetEntity(rec, httptest.NewRequest(http.MethodGet, "/stats/reset/"+MAIN_WAN_ID, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestTopTalkersRankOnlyClients(t *testing.T) {
+	stats := openTestStatsDB(t)
+	dhcp := openTestDHCPDB(t)
+	storeReadings(t, stats,
+		TrafficUpdate{EntityID: "aa:bb:cc:dd:ee:01", Source: "r1", RXBytes: 300, TXBytes: 30},
+		TrafficUpdate{EntityID: "aa:bb:cc:dd:ee:02", Source: "r1", RXBytes: 100, TXBytes: 10},
+	)
+	for _, id := range []string{MAIN_WAN_ID, MAIN_WAN6_ID, MAIN_WAN_ID + WAN_ROUTER_SEPARATOR + "r1", TUNNEL_ID_PREFIX + WAN_ROUTER_SEPARATOR + "wg0", TOTAL_ID} {
+		storeReadings(t, stats, TrafficUpdate{EntityID: id, Source: "r1", RXBytes: 1000, TXBytes: 100})
+	}
+
+	talkers, err := queryTopTalkers(stats, dhcp, &dbMutex, "total", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, talker := range talkers {
+		ids = append(ids, talker.ID)
+	}
+	if len(ids) != 2 || ids[0] != "aa:bb:cc:dd:ee:01" || ids[1] != "aa:bb:cc:dd:ee:02" {
+		t.Errorf("ranked %q, want only the two clients", ids)
+	}
+}
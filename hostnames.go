@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// normalizeHostnames validates a router's hostnames map and returns it keyed
+// by normalized MAC address, so "AA-BB-CC-DD-EE-FF" and "aa:bb:cc:dd:ee:ff"
+// name the same device.
+func normalizeHostnames(hostnames map[string]string) (map[string]string, error) {
+	normalized := map[string]string{}
+	for address, name := range hostnames {
+		mac, ok := normalizeMAC(strings.TrimSpace(address))
+		if !ok {
+			return nil, fmt.Errorf("invalid MAC address '%s'", address)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty hostname for %s", address)
+		}
+		if previous, ok := normalized[mac]; ok && previous != name {
+			return nil, fmt.Errorf("%s is named both '%s' and '%s'", mac, previous, name)
+		}
+		normalized[mac] = name
+	}
+	return normalized, nil
+}
+
+// mergeHostnames combines every router's hostnames into one map, since a
+// device may take its lease from a different router than the one whose
+// config names it. Naming a device differently on two routers is an error.
+func mergeHostnames(config Config) (map[string]string, error) {
+	merged := map[string]string{}
+	owners := map[string]string{}
+	for routerIP, urls := range config {
+		for mac, name := range urls.hostnames {
+			if previous, ok := merged[mac]; ok && previous != name {
+				return nil, fmt.Errorf("error: %s is named '%s' by router '%s' and '%s' by router '%s'", mac, previous, owners[mac], name, routerIP)
+			}
+			merged[mac] = name
+			owners[mac] = routerIP
+		}
+	}
+	return merged, nil
+}
+
+// applyHostnames replaces the parsed hostname of every lease the config
+// names, marking it manual so it is stored and shown as such.
+func applyHostnames(urls RouterConfig, leases []DHCPLease) {
+	for i := range leases {
+		if name, ok := urls.hostnames[leases[i].MACAddress]; ok {
+			leases[i].Hostname = name
+			leases[i].HostnameManual = true
+		}
+	}
+}
+
+// hostnameCache holds every leased MAC address's hostname for labelling
+// stats, so read paths don't query dhcp_leases per entity. It is reloaded
+// when older than -hostname-cache-ttl or after leases are upserted.
+type hostnameCache struct {
+	// loadMutex lets one caller reload while the others wait for it
+	// rather than running the same query.
+	loadMutex sync.Mutex
+
+	mutex    sync.RWMutex
+	names    map[string]string
+	loadedAt time.Time
+}
+
+var dhcpHostnames = &hostnameCache{}
+
+// load reloads the cache from db unless it is still fresh.
+func (c *hostnameCache) load(db *sql.DB) error {
+	c.loadMutex.Lock()
+	defer c.loadMutex.Unlock()
+
+	c.mutex.RLock()
+	fresh := !c.loadedAt.IsZero() && time.Since(c.loadedAt) < *hostnameCacheTTL
+	c.mutex.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	names, err := queryHostnames(db)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.names = names
+	c.loadedAt = time.Now()
+	c.mutex.Unlock()
+	return nil
+}
+
+// invalidate makes the next load read dhcp_leases again.
+func (c *hostnameCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.loadedAt = time.Time{}
+}
+
+// lookup returns mac's hostname, with ok false when it has no lease or its
+// lease carries no name.
+func (c *hostnameCache) lookup(mac string) (string, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	name, ok := c.names[mac]
+	if !ok || name == "" || name == UNKNOWN_HOSTNAME {
+		return "", false
+	}
+	return name, true
+}
+
+// hostnameFor returns the cached hostname of mac, or mac itself when it is
+// unknown. Callers load the cache first.
+func hostnameFor(mac string) string {
+	if name, ok := dhcpHostnames.lookup(mac); ok {
+		return name
+	}
+	return mac
+}
+
+// queryHostnames maps every leased MAC address to its hostname. Each leased
+// IP address maps to the hostname too, or to the MAC address when the lease
+// has none, which labels clients tracked by IP with the device currently
+// holding that address.
+func queryHostnames(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query("SELECT mac_address, COALESCE(ip_address, ''), hostname FROM dhcp_leases")
+	if err != nil {
+		return nil, fmt.Errorf("error querying hostnames: %w", err)
+	}
+	defer rows.Close()
+
+	hostnames := map[string]string{}
+	for rows.Next() {
+		var mac, ip, hostname string
+		if err := rows.Scan(&mac, &ip, &hostname); err != nil {
+			return nil, fmt.Errorf("error scanning hostnames: %w", err)
+		}
+		hostnames[mac] = hostname
+		if ip != "" {
+			if hostname == "" || hostname == UNKNOWN_HOSTNAME {
+				hostnames[ip] = mac
+			} else {
+				hostnames[ip] = hostname
+			}
+		}
+	}
+	return hostnames, rows.Err()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHostnameCache(t *testing.T) {
+	db := openTestDHCPDB(t)
+	dhcpHostnames.invalidate()
+	defer dhcpHostnames.invalidate()
+
+	leases := []DHCPLease{
+		{MACAddress: "aa:bb:cc:00:00:01", IPAddress: "10.0.0.1", Hostname: "laptop"},
+		{MACAddress: "aa:bb:cc:00:00:02", IPAddress: "10.0.0.2", Hostname: UNKNOWN_HOSTNAME},
+	}
+	if _, err := upsertDHCPLeases(db, &dbMutex, leases); err != nil {
+		t.Fatal(err)
+	}
+	load := func() {
+		t.Helper()
+		if err := dhcpHostnames.load(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load()
+
+	// Unknown hostnames and misses fall back to the MAC address.
+	for mac, want := range map[string]string{
+		"aa:bb:cc:00:00:01": "laptop",
+		"aa:bb:cc:00:00:02": "aa:bb:cc:00:00:02",
+		"aa:bb:cc:00:00:09": "aa:bb:cc:00:00:09",
+	} {
+		if got := hostnameFor(mac); got != want {
+			t.Errorf("hostnameFor(%s) = %q, want %q", mac, got, want)
+		}
+	}
+
+	// A change behind the cache's back isn't seen until the TTL passes.
+	if _, err := db.Exec("UPDATE dhcp_leases SET hostname = 'renamed' WHERE mac_address = 'aa:bb:cc:00:00:01'"); err != nil {
+		t.Fatal(err)
+	}
+	load()
+	if got := hostnameFor("aa:bb:cc:00:00:01"); got != "laptop" {
+		t.Errorf("fresh cache reloaded: hostname %q", got)
+	}
+	old := *hostnameCacheTTL
+	*hostnameCacheTTL = time.Nanosecond
+	load()
+	*hostnameCacheTTL = old
+	if got := hostnameFor("aa:bb:cc:00:00:01"); got != "renamed" {
+		t.Errorf("stale cache not reloaded: hostname %q", got)
+	}
+
+	// Storing leases invalidates the cache.
+	if _, err := upsertDHCPLeases(db, &dbMutex, []DHCPLease{{MACAddress: "aa:bb:cc:00:00:03", IPAddress: "10.0.0.3", Hostname: "phone"}}); err != nil {
+		t.Fatal(err)
+	}
+	load()
+	if got := hostnameFor("aa:bb:cc:00:00:03"); got != "phone" {
+		t.Errorf("cache not reloaded after storing leases: hostname %q", got)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			dhcpHostnames.invalidate()
+			dhcpHostnames.load(db)
+		}()
+		go func() {
+			defer wg.Done()
+			hostnameFor("aa:bb:cc:00:00:03")
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	BYTE_UNITS_BINARY  = "binary"
+	BYTE_UNITS_DECIMAL = "decimal"
+)
+
+// humanizeBytes formats n in the -byte-units units: binary (1024-based),
+// e.g. "45.0 GiB", or decimal (1000-based), e.g. "48.3 GB".
+func humanizeBytes(n int64) string {
+	if *byteUnits == BYTE_UNITS_DECIMAL {
+		return humanizeBytesSI(n)
+	}
+	return humanizeBytesIEC(n)
+}
+
+// humanizeBytesIEC formats n using binary (1024-based) units, e.g. "45.0
+// GiB".
+func humanizeBytesIEC(n int64) string {
+	return humanize(n, 1024, []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"})
+}
+
+// humanizeBytesSI formats n using decimal (1000-based) units, e.g. "48.3 GB".
+func humanizeBytesSI(n int64) string {
+	return humanize(n, 1000, []string{"B", "kB", "MB", "GB", "TB", "PB", "EB"})
+}
+
+func humanize(n int64, base float64, units []string) string {
+	sign := ""
+	value := float64(n)
+	if n < 0 {
+		sign = "-"
+		value = -value
+	}
+	if value < base {
+		return fmt.Sprintf("%s%d %s", sign, int64(value), units[0])
+	}
+
+	i := 0
+	for value >= base && i < len(units)-1 {
+		value /= base
+		i++
+	}
+	return fmt.Sprintf("%s%.1f %s", sign, value, units[i])
+}
+
+// byteSizeExponents maps a unit's letter to its power of the base.
+var byteSizeExponents = map[byte]int{'k': 1, 'm': 2, 'g': 3, 't': 4, 'p': 5, 'e': 6}
+
+// parseByteSize reads a size such as "4194304", "500GB", "1.5 GiB" or "100M".
+// KiB, MiB, GiB and so on are always binary. KB, MB, GB (or K, M, G) are
+// decimal when decimal is set and binary otherwise, so a threshold means the
+// same thing as the humanized numbers next to it. Case doesn't matter.
+func parseByteSize(s string, decimal bool) (int64, error) {
+	text := strings.ToLower(strings.TrimSpace(s))
+	i := strings.IndexFunc(text, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	number, unit := text, ""
+	if i >= 0 {
+		number, unit = text[:i], strings.TrimSpace(text[i:])
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+
+	base := 1024.0
+	if decimal {
+		base = 1000
+	}
+	exponent := 0
+	switch {
+	case unit == "" || unit == "b":
+	case len(unit) == 3 && strings.HasSuffix(unit, "ib"):
+		base = 1024
+		fallthrough
+	case len(unit) == 1 || (len(unit) == 2 && unit[1] == 'b'):
+		var ok bool
+		if exponent, ok = byteSizeExponents[unit[0]]; !ok {
+			return 0, fmt.Errorf("invalid size '%s': unknown unit '%s'", s, unit)
+		}
+	default:
+		return 0, fmt.Errorf("invalid size '%s': unknown unit '%s'", s, unit)
+	}
+
+	bytes := value * math.Pow(base, float64(exponent))
+	if bytes >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size '%s': too large", s)
+	}
+	return int64(math.Round(bytes)), nil
+}
+
+// byteSizeValue is a flag holding a size in bytes, given as anything
+// parseByteSize accepts. The text is kept so setByteUnits can read it again
+// once -byte-units is known, whatever the order of the flags.
+type byteSizeValue struct {
+	bytes *int64
+	text  string
+}
+
+var byteSizeFlags []*byteSizeValue
+
+// byteSizeFlag defines a flag like flag.Int64 that also takes unit suffixes.
+func byteSizeFlag(name string, value int64, usage string) *int64 {
+	v := &byteSizeValue{bytes: &value}
+	byteSizeFlags = append(byteSizeFlags, v)
+	flag.Var(v, name, usage)
+	return v.bytes
+}
+
+func (v *byteSizeValue) String() string {
+	if v.bytes == nil {
+		return "0"
+	}
+	if v.text != "" {
+		return v.text
+	}
+	return strconv.FormatInt(*v.bytes, 10)
+}
+
+func (v *byteSizeValue) Set(s string) error {
+	n, err := parseByteSize(s, false)
+	if err != nil {
+		return err
+	}
+	*v.bytes, v.text = n, s
+	return nil
+}
+
+// setByteUnits checks -byte-units and reads the byte size flags again in
+// those units.
+func setByteUnits(units string) error {
+	if units != BYTE_UNITS_BINARY && units != BYTE_UNITS_DECIMAL {
+		return fmt.Errorf("error: invalid -byte-units '%s': expected %s or %s", units, BYTE_UNITS_BINARY, BYTE_UNITS_DECIMAL)
+	}
+	for _, v := range byteSizeFlags {
+		if v.text == "" {
+			continue
+		}
+		n, err := parseByteSize(v.text, units == BYTE_UNITS_DECIMAL)
+		if err != nil {
+			return err
+		}
+		*v.bytes = n
+	}
+	return nil
+}
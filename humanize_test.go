@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		decimal bool
+		want    int64
+	}{
+		{"0", false, 0},
+		{"4194304", true, 4194304},
+		{"500GB", false, 500 << 30},
+		{"500GB", true, 500e9},
+		{"500GiB", true, 500 << 30},
+		{"500gib", false, 500 << 30},
+		{"1.5 MB", true, 1500000},
+		{"1.5M", false, 1572864},
+		{"100k", true, 100000},
+		{"4KiB", true, 4096},
+		{"10B", true, 10},
+		{"2TB", true, 2e12},
+		{"1EiB", false, 1 << 60},
+	} {
+		got, err := parseByteSize(tc.value, tc.decimal)
+		if err != nil || got != tc.want {
+			t.Errorf("parseByteSize(%q, %v) = %d, %v; want %d", tc.value, tc.decimal, got, err, tc.want)
+		}
+	}
+	for _, invalid := range []string{"", "GB", "-5MB", "5XB", "5 gibi", "10EB", "5KiBB", "1.2.3"} {
+		if _, err := parseByteSize(invalid, true); err == nil {
+			t.Errorf("parseByteSize(%q) accepted", invalid)
+		}
+	}
+}
+
+func TestByteUnitsFlag(t *testing.T) {
+	var minBytes *byteSizeValue
+	for _, v := range byteSizeFlags {
+		if v.bytes == historyMinBytes {
+			minBytes = v
+		}
+	}
+	oldUnits, oldMin, oldText := *byteUnits, *historyMinBytes, minBytes.text
+	defer func() {
+		*byteUnits, *historyMinBytes, minBytes.text = oldUnits, oldMin, oldText
+	}()
+
+	*byteUnits = BYTE_UNITS_BINARY
+	if err := minBytes.Set("1GB"); err != nil || *historyMinBytes != 1<<30 {
+		t.Errorf("binary -history-min-bytes 1GB = %d, %v", *historyMinBytes, err)
+	}
+	// Switching units parses the flags' text again.
+	if err := setByteUnits(BYTE_UNITS_DECIMAL); err != nil || *historyMinBytes != 1e9 {
+		t.Errorf("decimal -history-min-bytes 1GB = %d, %v", *historyMinBytes, err)
+	}
+	if err := setByteUnits("si"); err == nil {
+		t.Error("-byte-units si accepted")
+	}
+
+	*byteUnits = BYTE_UNITS_DECIMAL
+	if got := humanizeBytes(48300000000); got != "48.3 GB" {
+		t.Errorf("decimal humanizeBytes(48300000000) = %q", got)
+	}
+	*byteUnits = BYTE_UNITS_BINARY
+	if got := humanizeBytes(1 << 30); got != "1.0 GiB" {
+		t.Errorf("binary humanizeBytes(1 GiB) = %q", got)
+	}
+}
+
+func TestHumanizeBytesBoundaries(t *testing.T) {
+	for _, tc := range []struct {
+		n       int64
+		iec, si string
+	}{
+		{0, "0 B", "0 B"},
+		{999, "999 B", "999 B"},
+		{1000, "1000 B", "1.0 kB"},
+		{1023, "1023 B", "1.0 kB"},
+		{1024, "1.0 KiB", "1.0 kB"},
+		{1536, "1.5 KiB", "1.5 kB"},
+		{1 << 20, "1.0 MiB", "1.0 MB"},
+		{-1, "-1 B", "-1 B"},
+		{-1023, "-1023 B", "-1.0 kB"},
+		{-1024, "-1.0 KiB", "-1.0 kB"},
+		{math.MaxInt64, "8.0 EiB", "9.2 EB"},
+		{math.MinInt64, "-8.0 EiB", "-9.2 EB"},
+	} {
+		if got := humanizeBytesIEC(tc.n); got != tc.iec {
+			t.Errorf("humanizeBytesIEC(%d) = %q, want %q", tc.n, got, tc.iec)
+		}
+		if got := humanizeBytesSI(tc.n); got != tc.si {
+			t.Errorf("humanizeBytesSI(%d) = %q, want %q", tc.n, got, tc.si)
+		}
+	}
+}
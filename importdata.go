@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -import-policy values: what happens to a record whose entity (and month,
+// for the archive) already has a row.
+const (
+	IMPORT_POLICY_SKIP  = "skip"
+	IMPORT_POLICY_MERGE = "merge"
+)
+
+// ImportFile is the format read by -import, e.g. from another monitoring
+// tool:
+//
+//	{
+//	  "monthly": [
+//	    {"id": "main_wan", "rx_bytes": 123456, "tx_bytes": 7890}
+//	  ],
+//	  "archive": [
+//	    {"id": "aa:bb:cc:dd:ee:ff", "year_month": "2024-11", "rx_bytes": 1, "tx_bytes": 2}
+//	  ]
+//	}
+//
+// "monthly" holds the current month's totals (monthly_stats) and "archive"
+// past months (monthly_archive); either may be left out. Ids are MAC
+// addresses in any notation or other entity ids such as main_wan, and byte
+// counts can't be negative. Unknown fields are an error, so a typo doesn't
+// import zeros.
+type ImportFile struct {
+	Monthly []ImportRecord `json:"monthly"`
+	Archive []ImportRecord `json:"archive"`
+}
+
+type ImportRecord struct {
+	ID        string `json:"id"`
+	YearMonth string `json:"year_month,omitempty"`
+	RXBytes   int64  `json:"rx_bytes"`
+	TXBytes   int64  `json:"tx_bytes"`
+}
+
+// ImportResult counts what an import did with the records.
+type ImportResult struct {
+	Monthly int
+	Archive int
+	Merged  int
+	Skipped int
+}
+
+// readImportFile decodes and validates an ImportFile, normalizing MAC
+// addresses. Errors name the offending record.
+func readImportFile(path string) (*ImportFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening import file: %w", err)
+	}
+	defer f.Close()
+
+	var data ImportFile
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, fmt.Errorf("error parsing import file '%s': %w", path, err)
+	}
+
+	for _, part := range []struct {
+		section string
+		records []ImportRecord
+	}{
+		{"monthly", data.Monthly},
+		{"archive", data.Archive},
+	} {
+		section, records := part.section, part.records
+		for i := range records {
+			r := &records[i]
+			r.ID = strings.TrimSpace(r.ID)
+			if mac, ok := normalizeMAC(r.ID); ok {
+				r.ID = mac
+			}
+			if r.ID == "" || strings.HasPrefix(r.ID, SYNTHETIC_ID_PREFIX) {
+				return nil, fmt.Errorf("%s record %d: invalid id '%s'", section, i+1, r.ID)
+			}
+			if r.RXBytes < 0 || r.TXBytes < 0 {
+				return nil, fmt.Errorf("%s record %d (%s): negative byte count", section, i+1, r.ID)
+			}
+			switch section {
+			case "monthly":
+				if r.YearMonth != "" {
+					return nil, fmt.Errorf("monthly record %d (%s): year_month belongs in archive records", i+1, r.ID)
+				}
+			case "archive":
+				if _, err := time.Parse("2006-01", r.YearMonth); err != nil {
+					return nil, fmt.Errorf("archive record %d (%s): invalid year_month '%s', expected YYYY-MM", i+1, r.ID, r.YearMonth)
+				}
+			}
+		}
+	}
+	return &data, nil
+}
+
+// importStats writes data in one transaction, so a failed import leaves the
+// database as it was. Every record that is stored or merged also adds to
+// the entity's all-time totals, like collected traffic.
+func importStats(db *sql.DB, mutex *sync.Mutex, data *ImportFile, policy string) (ImportResult, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var result ImportResult
+	tx, err := db.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction for import: %w", err)
+	}
+	defer tx.Rollback()
+
+	timestamp := storedTime(time.Now())
+	for _, r := range data.Monthly {
+		var exists int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM monthly_stats WHERE id = ?", r.ID).Scan(&exists); err != nil {
+			return result, fmt.Errorf("error checking monthly stats for %s: %w", r.ID, err)
+		}
+		switch {
+		case exists == 0:
+			_, err = tx.Exec("INSERT INTO monthly_stats (id, rx_bytes, tx_bytes, timestamp) VALUES (?, ?, ?, ?)", r.ID, r.RXBytes, r.TXBytes, timestamp)
+			result.Monthly++
+		case policy == IMPORT_POLICY_MERGE:
+			_, err = tx.Exec("UPDATE monthly_stats SET rx_bytes = rx_bytes + ?, tx_bytes = tx_bytes + ? WHERE id = ?", r.RXBytes, r.TXBytes, r.ID)
+			result.Merged++
+		default:
+			result.Skipped++
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("error importing monthly stats for %s: %w", r.ID, err)
+		}
+		if err := addImportedAllTime(tx, r, timestamp); err != nil {
+			return result, err
+		}
+	}
+
+	for _, r := range data.Archive {
+		var exists int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM monthly_archive WHERE id = ? AND year_month = ?", r.ID, r.YearMonth).Scan(&exists); err != nil {
+			return result, fmt.Errorf("error checking monthly archive for %s %s: %w", r.ID, r.YearMonth, err)
+		}
+		switch {
+		case exists == 0:
+			_, err = tx.Exec("INSERT INTO monthly_archive (id, year_month, rx_bytes, tx_bytes) VALUES (?, ?, ?, ?)", r.ID, r.YearMonth, r.RXBytes, r.TXBytes)
+			result.Archive++
+		case policy == IMPORT_POLICY_MERGE:
+			_, err = tx.Exec("UPDATE monthly_archive SET rx_bytes = rx_bytes + ?, tx_bytes = tx_bytes + ? WHERE id = ? AND year_month = ?", r.RXBytes, r.TXBytes, r.ID, r.YearMonth)
+			result.Merged++
+		default:
+			result.Skipped++
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("error importing monthly archive for %s %s: %w", r.ID, r.YearMonth, err)
+		}
+		if err := addImportedAllTime(tx, r, timestamp); err != nil {
+			return result, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return ImportResult{}, fmt.Errorf("error committing import: %w", err)
+	}
+	return result, nil
+}
+
+func addImportedAllTime(tx *sql.Tx, r ImportRecord, timestamp string) error {
+	_, err := tx.Exec(`
+		INSERT OR IGNORE INTO alltime_stats (id, rx_bytes, tx_bytes, first_seen, last_seen)
+		VALUES (?, 0, 0, ?, ?)
+	`, r.ID, timestamp, timestamp)
+	if err != nil {
+		return fmt.Errorf("error initializing all-time stats for %s: %w", r.ID, err)
+	}
+	_, err = tx.Exec("UPDATE alltime_stats SET rx_bytes = rx_bytes + ?, tx_bytes = tx_bytes + ? WHERE id = ?", r.RXBytes, r.TXBytes, r.ID)
+	if err != nil {
+		return fmt.Errorf("error updating all-time stats for %s: %w", r.ID, err)
+	}
+	return nil
+}
+
+// runImport is -import: it sets up the stats database, imports path into it
+// and reports the counts. Nothing is collected.
+func runImport(path, policy string) error {
+	if policy != IMPORT_POLICY_SKIP && policy != IMPORT_POLICY_MERGE {
+		return fmt.Errorf("error: invalid -import-policy '%s', expected %s or %s", policy, IMPORT_POLICY_SKIP, IMPORT_POLICY_MERGE)
+	}
+	data, err := readImportFile(path)
+	if err != nil {
+		return err
+	}
+
+	connStats, err := connectDB(*statsDBPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to stats database: %w", err)
+	}
+	defer connStats.Close()
+	if err := setupStatsDB(connStats); err != nil {
+		return fmt.Errorf("failed to set up stats database: %w", err)
+	}
+
+	result, err := importStats(connStats, &dbMutex, data, policy)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d monthly and %d archive rows from %s; %d merged into existing rows, %d duplicates skipped.\n", result.Monthly, result.Archive, path, result.Merged, result.Skipped)
+	return nil
+}
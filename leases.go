@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type leaseResponse struct {
+	MACAddress     string `json:"mac_address"`
+	IPAddress      string `json:"ip_address"`
+	Hostname       string `json:"hostname"`
+	HostnameManual bool   `json:"hostname_manual"`
+	ClientID       string `json:"client_id"`
+	ClientIDKind   string `json:"client_id_kind"`
+	ClientIDValue  string `json:"client_id_value"`
+	LeaseEndTime   int64  `json:"lease_end_time"`
+	LeaseExpires   string `json:"lease_expires"`
+}
+
+// IPConflict is an IP address held by more than one active lease.
+type IPConflict struct {
+	IPAddress    string   `json:"ip_address"`
+	MACAddresses []string `json:"mac_addresses"`
+}
+
+// findIPConflicts returns the IP addresses that more than one unexpired
+// lease claims, sorted by address. A lease end time of 0 means an infinite
+// lease.
+func findIPConflicts(leases []DHCPLease, now time.Time) []IPConflict {
+	macsByIP := map[string][]string{}
+	for _, lease := range leases {
+		if lease.LeaseEndTime != 0 && lease.LeaseEndTime <= now.Unix() {
+			continue
+		}
+		macsByIP[lease.IPAddress] = append(macsByIP[lease.IPAddress], lease.MACAddress)
+	}
+
+	var conflicts []IPConflict
+	for ip, macs := range macsByIP {
+		if len(macs) > 1 {
+			sort.Strings(macs)
+			conflicts = append(conflicts, IPConflict{IPAddress: ip, MACAddresses: macs})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].IPAddress < conflicts[j].IPAddress })
+	return conflicts
+}
+
+// countLeases returns how many leases in the table are unexpired (or
+// infinite) at now, and how many there are in total.
+func countLeases(db *sql.DB, now time.Time) (active, total int, err error) {
+	err = db.QueryRow(
+		"SELECT COALESCE(SUM(lease_end_time = 0 OR lease_end_time > ?), 0), COUNT(*) FROM dhcp_leases",
+		now.Unix(),
+	).Scan(&active, &total)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error counting DHCP leases: %w", err)
+	}
+	return active, total, nil
+}
+
+func registerLeaseHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/leases", handleLeases)
+	mux.HandleFunc("/leases/history/", handleLeaseHistory)
+	mux.HandleFunc("/leases/subnets", handleSubnetOccupancy)
+}
+
+// queryLeases returns the current leases, optionally filtered by one column.
+// An empty column returns every lease.
+func queryLeases(db *sql.DB, column, value string) ([]leaseResponse, error) {
+	query := "SELECT mac_address, ip_address, hostname, hostname_manual, client_id, client_id_kind, client_id_value, lease_end_time FROM dhcp_leases"
+	var args []interface{}
+	switch column {
+	case "":
+	case "hostname":
+		query += " WHERE hostname = ? COLLATE NOCASE"
+		args = append(args, value)
+	default:
+		query += " WHERE " + column + " = ?"
+		args = append(args, value)
+	}
+	query += " ORDER BY ip_address"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying DHCP leases: %w", err)
+	}
+	defer rows.Close()
+
+	leases := []leaseResponse{}
+	for rows.Next() {
+		var lease leaseResponse
+		if err := rows.Scan(&lease.MACAddress, &lease.IPAddress, &lease.Hostname, &lease.HostnameManual, &lease.ClientID, &lease.ClientIDKind, &lease.ClientIDValue, &lease.LeaseEndTime); err != nil {
+			return nil, fmt.Errorf("error scanning DHCP lease: %w", err)
+		}
+		lease.LeaseExpires = formatLeaseExpiry(lease.LeaseEndTime)
+		leases = append(leases, lease)
+	}
+	return leases, rows.Err()
+}
+
+// formatLeaseExpiry renders a dnsmasq lease end time, where 0 means the
+// lease never expires.
+func formatLeaseExpiry(leaseEndTime int64) string {
+	if leaseEndTime == 0 {
+		return "never"
+	}
+	return displayTime(time.Unix(leaseEndTime, 0))
+}
+
+// queryLeaseHistory returns every recorded IP/hostname change for a MAC
+// address, oldest first.
+func queryLeaseHistory(db *sql.DB, macAddress string) ([]LeaseHistoryEntry, error) {
+	rows, err := db.Query(`
+		SELECT mac_address, ip_address, hostname, observed_at FROM lease_history
+		WHERE mac_address = ?
+		ORDER BY observed_at
+	`, strings.ToLower(macAddress))
+	if err != nil {
+		return nil, fmt.Errorf("error querying lease history for %s: %w", macAddress, err)
+	}
+	defer rows.Close()
+
+	history := []LeaseHistoryEntry{}
+	for rows.Next() {
+		var entry LeaseHistoryEntry
+		if err := rows.Scan(&entry.MACAddress, &entry.IPAddress, &entry.Hostname, &entry.ObservedAt); err != nil {
+			return nil, fmt.Errorf("error scanning lease history for %s: %w", macAddress, err)
+		}
+		entry.ObservedAt = displayStoredTime(entry.ObservedAt)
+		history = append(history, entry)
+	}
+	return history, rows.Err()
+}
+
+func handleLeases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var column, value string
+	query := r.URL.Query()
+	switch {
+	case query.Get("mac") != "":
+		column, value = "mac_address", strings.ToLower(query.Get("mac"))
+	case query.Get("ip") != "":
+		ip, ok := canonicalIP(query.Get("ip"))
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid ip '%s'", query.Get("ip")))
+			return
+		}
+		column, value = "ip_address", ip
+	case query.Get("hostname") != "":
+		column, value = "hostname", query.Get("hostname")
+	}
+
+	db, err := connectReadOnlyDB(*dhcpDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	leases, err := queryLeases(db, column, value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": leases})
+}
+
+func handleLeaseHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	macAddress := strings.TrimPrefix(r.URL.Path, "/leases/history/")
+	if macAddress == "" {
+		writeError(w, http.StatusBadRequest, "missing MAC address")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*dhcpDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	history, err := queryLeaseHistory(db, macAddress)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": history})
+}
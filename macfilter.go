@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// normalizeMACPattern turns a track_only/ignore entry into a lowercase,
+// colon-separated prefix. "AA-BB-CC", "aa:bb:cc:*" and "aa:bb:cc" all become
+// "aa:bb:cc"; a full address only matches itself.
+func normalizeMACPattern(pattern string) (string, error) {
+	p := strings.ToLower(strings.TrimSpace(pattern))
+	p = strings.ReplaceAll(p, "-", ":")
+	p = strings.TrimSuffix(p, "*")
+	p = strings.TrimSuffix(p, ":")
+	if p == "" {
+		return "", fmt.Errorf("empty MAC pattern '%s'", pattern)
+	}
+	for _, octet := range strings.Split(p, ":") {
+		if len(octet) == 0 || len(octet) > 2 || strings.Trim(octet, "0123456789abcdef") != "" {
+			return "", fmt.Errorf("invalid MAC pattern '%s'", pattern)
+		}
+	}
+	return p, nil
+}
+
+func matchesMACPatterns(mac string, patterns []string) bool {
+	for _, p := range patterns {
+		if mac == p || strings.HasPrefix(mac, p+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// isRandomizedMAC reports whether mac has the locally administered bit set,
+// which is what phones use for per-network private addresses.
+func isRandomizedMAC(mac string) bool {
+	if len(mac) < 2 {
+		return false
+	}
+	switch mac[1] {
+	case '2', '6', 'a', 'e':
+		return true
+	}
+	return false
+}
+
+// tracksMAC applies the router's ignore_random_macs, ignore and track_only
+// settings to a normalized MAC address.
+func (urls RouterConfig) tracksMAC(mac string) bool {
+	if urls.IgnoreRandomMACs && isRandomizedMAC(mac) {
+		return false
+	}
+	if matchesMACPatterns(mac, urls.ignore) {
+		return false
+	}
+	if len(urls.trackOnly) > 0 {
+		return matchesMACPatterns(mac, urls.trackOnly)
+	}
+	return true
+}
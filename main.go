@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,6 +29,220 @@ type RouterConfig struct {
 	APStatsURL    string `json:"ap_stats"`
 	WANStatsURL   string `json:"wan_stats"`
 	DHCPLeasesURL string `json:"dhcp_leases"`
+
+	// FallbackURLs lists, per endpoint ("wifi", "wan", "dhcp"), URLs tried
+	// in order when the endpoint's URL fails or returns nothing parseable.
+	// ap_stats, wan_stats and dhcp_leases may also be written as a list,
+	// whose first URL is the endpoint's URL and the rest its fallbacks.
+	FallbackURLs map[string][]string `json:"fallback_urls"`
+
+	// The *_command fields run a local command and parse its output instead
+	// of fetching the matching URL; a URL takes precedence when both are
+	// set. CommandShell runs them through /bin/sh -c.
+	APStatsCommand    string `json:"ap_stats_command"`
+	WANStatsCommand   string `json:"wan_stats_command"`
+	DHCPLeasesCommand string `json:"dhcp_leases_command"`
+	CommandShell      bool   `json:"command_shell"`
+
+	// Format selects how AP and WAN stats are fetched: "" or "text" for the
+	// CGI scripts, "ubus" for OpenWRT's HTTP-RPC interface. With
+	// UbusUsername the collector logs in to rpcd for a session instead of
+	// using UbusSession.
+	Format          string   `json:"format"`
+	UbusSession     string   `json:"ubus_session"`
+	UbusUsername    string   `json:"ubus_username"`
+	UbusPassword    string   `json:"ubus_password"`
+	UbusWiFiDevices []string `json:"ubus_wifi_devices"`
+
+	// LeaseFormat is the layout of the dhcp_leases output: "" or "dnsmasq"
+	// for dnsmasq's lease file, "odhcpd" for odhcpd's. LeasePrefixes stores
+	// the IPv6 prefixes odhcpd delegated in dhcp_prefixes instead of
+	// skipping them.
+	LeaseFormat   string `json:"lease_format"`
+	LeasePrefixes bool   `json:"lease_prefixes"`
+
+	// ResetPolicy decides what a counter that went back to near zero adds
+	// for the cycle: "count_new" (the default) adds the new reading, the
+	// traffic since the reset; "ignore" adds nothing and only takes the new
+	// reading as the baseline; "estimate" adds the larger of the new
+	// reading and the entity's last cycle rate times the time since its
+	// previous reading, to make up for the traffic before the reset.
+	ResetPolicy string `json:"reset_policy"`
+
+	// WANPattern overrides the regular expression used to find the WAN
+	// counters in the wan_stats output. It must have exactly two capture
+	// groups: RX bytes, then TX bytes.
+	WANPattern string `json:"wan_pattern"`
+
+	// Tunnels tracks VPN and tunnel interfaces that wan_stats reports next
+	// to the WAN, e.g. {"wg0": "vpn"} stores the "wg0: RX TX" line under
+	// "tunnel:vpn". An empty label uses the interface name.
+	Tunnels map[string]string `json:"tunnels"`
+	// ExcludeTunnelsFromWAN takes each cycle's tunnel traffic off the
+	// router's IPv4 WAN counters, which carry it too.
+	ExcludeTunnelsFromWAN bool `json:"exclude_tunnels_from_wan"`
+
+	// Headers are added to every request sent to this router, e.g.
+	// "Authorization": "Bearer <token>", "X-API-Key" or "User-Agent".
+	Headers map[string]string `json:"headers"`
+
+	// Timeout limits each request to this router, e.g. "30s". Timeouts
+	// sets it per endpoint ("wifi", "wan", "dhcp") instead. Without either
+	// the -wifi-timeout, -wan-timeout and -dhcp-timeout flags apply.
+	Timeout  string            `json:"timeout"`
+	Timeouts map[string]string `json:"timeouts"`
+
+	// TrackOnly limits WiFi clients and leases to these MAC addresses or
+	// prefixes ("aa:bb:cc:*"); Ignore drops them. IgnoreRandomMACs drops
+	// every locally administered (randomized) address.
+	TrackOnly        []string `json:"track_only"`
+	Ignore           []string `json:"ignore"`
+	IgnoreRandomMACs bool     `json:"ignore_random_macs"`
+
+	// Tags assigns categories to MAC addresses or other entity ids, e.g.
+	// {"aa:bb:cc:dd:ee:ff": ["kids", "tablet"]}, for /stats/tags.
+	Tags map[string][]string `json:"tags"`
+
+	// Offsets discounts known non-billable traffic from the readings this
+	// router reports, per entity and cycle, e.g. {"main_wan": {"rx":
+	// 1048576, "tx": 524288}}. See TrafficOffset.
+	Offsets map[string]TrafficOffset `json:"offsets"`
+
+	// Caps sets monthly data caps by entity id, e.g. {"main_wan":
+	// "500GB"}, for /quota. Sizes are parsed like the size flags. Every
+	// router's caps apply to every entity.
+	Caps map[string]string `json:"caps"`
+
+	// Hostnames gives devices a fixed name by MAC address, e.g.
+	// {"aa:bb:cc:dd:ee:ff": "Living room plug"}, in place of whatever
+	// hostname their DHCP lease reports. Every router's map applies to
+	// every lease.
+	Hostnames map[string]string `json:"hostnames"`
+
+	// Subnets lists the DHCP subnets by CIDR with their pool size (0 if
+	// unknown), e.g. {"192.168.1.0/24": 150}, for /leases/subnets. Every
+	// router's entries apply to every lease.
+	Subnets map[string]int `json:"subnets"`
+
+	// WiFiColumns names the ap_stats fields in order for scripts that don't
+	// print "MAC RX TX [interface [connected time]]", e.g. ["rx", "tx",
+	// "mac"]. See newWiFiColumns.
+	WiFiColumns []string `json:"wifi_columns"`
+
+	// DuplicateMACs is how WiFi lines that repeat a MAC address, e.g. one
+	// per VLAN or SSID, are counted: "sum" (the default) adds them up into
+	// one client, "separate" tracks each interface as its own entity.
+	DuplicateMACs string `json:"duplicate_macs"`
+
+	// ClientIdentity is what the ap_stats lines are keyed by: "mac" (the
+	// default) or "ip" for per-IP accounting such as nlbwmon's, whose
+	// clients are then tracked by IP address.
+	ClientIdentity string `json:"client_identity"`
+
+	// WiFiDelimiter is what separates the ap_stats fields: "whitespace"
+	// (the default), "comma" or "tab". See wifiDelimiters.
+	WiFiDelimiter string `json:"wifi_delimiter"`
+
+	// RequestGap spaces out this router's requests, e.g. "500ms", for
+	// routers that struggle with back-to-back CGI calls.
+	RequestGap string `json:"request_gap"`
+
+	// WANGateway marks the router whose WAN interface is the real internet
+	// uplink. Once any router sets it, only gateways count towards main_wan;
+	// the rest (e.g. APs whose "wan" is backhaul) are kept per router only.
+	WANGateway bool `json:"wan_gateway"`
+
+	// Proxy sends this router's HTTP requests through a proxy
+	// ("http://proxy:3128", "socks5://host:1080"), overriding -proxy.
+	// PROXY_DIRECT connects directly even when -proxy is set.
+	Proxy string `json:"proxy"`
+
+	// ClientCert and ClientKey are PEM files presenting a client
+	// certificate to routers that require mutual TLS. CACert is a PEM file
+	// of the CAs trusted for the router's certificate instead of the
+	// system's. See loadRouterTLS.
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+	CACert     string `json:"ca_cert"`
+
+	// SSH fetches this router's URLs through an SSH connection, for
+	// routers only reachable over SSH. See SSHTunnel.
+	SSH *SSHTunnel `json:"ssh"`
+
+	// ParallelFetch fetches the WiFi, WAN and DHCP endpoints at the same
+	// time instead of one after another, for routers that can handle it.
+	ParallelFetch bool `json:"parallel_fetch"`
+
+	// CombinedURL returns the WiFi, WAN and DHCP output in one response,
+	// split into sections by CombinedMarkers (keyed "wifi", "wan", "dhcp";
+	// see defaultCombinedMarkers). When set, the per-endpoint URLs and
+	// commands are ignored.
+	CombinedURL     string            `json:"combined"`
+	CombinedMarkers map[string]string `json:"combined_markers"`
+
+	// Disable lists endpoints ("wifi", "wan", "dhcp") this router doesn't
+	// serve. They are never fetched, even if a URL or command is set.
+	Disable []string `json:"disable"`
+
+	wanPattern *regexp.Regexp
+	// tunnels is Tunnels with every label filled in.
+	tunnels    map[string]string
+	disabled   map[string]bool
+	timeout    time.Duration
+	timeouts   map[string]time.Duration
+	requestGap time.Duration
+	trackOnly  []string
+	ignore     []string
+
+	// wifiColumns is the compiled WiFiColumns; its zero value means the
+	// default layout.
+	wifiColumns wifiColumns
+
+	// combinedMarkers is CombinedMarkers over the defaults; sections holds
+	// the current cycle's split combined response.
+	combinedMarkers map[string]string
+	sections        map[string]string
+
+	// tags is Tags keyed by normalized entity id.
+	tags map[string][]string
+
+	// offsets is Offsets keyed by normalized entity id.
+	offsets map[string]TrafficOffset
+
+	// hostnames is every router's Hostnames merged and keyed by normalized
+	// MAC address.
+	hostnames map[string]string
+
+	// subnets is every router's Subnets merged, most specific first.
+	subnets []subnetPool
+
+	// caps is every router's Caps merged and keyed by normalized entity
+	// id.
+	caps map[string]int64
+
+	// name is the router's key in the config, and endpoint the one being
+	// fetched ("wifi", "wan", "dhcp" or "combined"), for recordResponse.
+	name     string
+	endpoint string
+
+	// tls is the loaded ClientCert, ClientKey and CACert, nil without
+	// any.
+	tls *routerTLS
+
+	// ssh is the loaded SSH, shared with the previous config loads.
+	ssh *sshTunnel
+
+	// perRouterWAN and sharedWAN choose where this router's WAN counters
+	// are stored; see wanIDs.
+	perRouterWAN bool
+	sharedWAN    bool
+
+	// cycleCtx is cancelled when the cycle's -cycle-timeout passes, which
+	// aborts the router's outstanding requests and commands.
+	cycleCtx context.Context
+
+	// writer is the cycle's -single-writer, nil without it.
+	writer *recordWriter
 }
 
 type Config map[string]RouterConfig
@@ -28,12 +251,86 @@ const (
 	STATS_DB_NAME = "/var/www/netstat-data/network_stats.db"
 	DHCP_DB_NAME  = "/var/www/netstat-data/dhcp_leases.db"
 	CONFIG_FILE   = "routers.json"
+	HTTP_ADDR     = "127.0.0.1:8080"
+
+	// CYCLE_INTERVAL is the pause between collection cycles before
+	// -sleep-jitter.
+	CYCLE_INTERVAL = 30 * time.Minute
+
+	// CONFIG_RETRY_MIN_SLEEP is the shortest wait before retrying a
+	// missing, broken or empty configuration.
+	CONFIG_RETRY_MIN_SLEEP = 10 * time.Second
+
+	MAIN_WAN_ID = "main_wan"
+	// MAIN_WAN6_ID tracks the IPv6 WAN counters ("wan6:") separately from
+	// the IPv4 ones in MAIN_WAN_ID.
+	MAIN_WAN6_ID = "main_wan6"
+	// Once a router sets wan_gateway, every router's WAN counters are also
+	// kept under "main_wan:<router>" (and "main_wan6:<router>").
+	WAN_ROUTER_SEPARATOR = ":"
+
+	// Ids starting with SYNTHETIC_ID_PREFIX are rollups computed by the
+	// collector rather than devices; they never collide with a MAC address
+	// and are left out of per-device rankings.
+	SYNTHETIC_ID_PREFIX = "__"
+	TOTAL_ID            = "__total__"
+	// With -unparsed-entity, the byte counters of WiFi lines that were
+	// skipped but still had numeric RX and TX are summed per router under
+	// "__unparsed__:<router>".
+	UNPARSED_ID = "__unparsed__"
+
+	SYSLOG_TAG = "router_stats"
+
+	TOTAL_SOURCE_WAN     = "wan"
+	TOTAL_SOURCE_CLIENTS = "clients"
+
+	COUNTER_32BIT_MAX = 1<<32 - 1
+
+	// COUNTER_RESET_RATIO: a counter that restarted from zero holds at most
+	// the traffic since the reboot, so a drop only counts as a reset when
+	// the new value is below 1/COUNTER_RESET_RATIO of the old one.
+	COUNTER_RESET_RATIO = 4
+
+	FORMAT_TEXT = "text"
+	FORMAT_UBUS = "ubus"
+
+	// How a counter reset is accounted for; see RouterConfig.ResetPolicy.
+	RESET_POLICY_COUNT_NEW = "count_new"
+	RESET_POLICY_IGNORE    = "ignore"
+	RESET_POLICY_ESTIMATE  = "estimate"
+
+	LEASE_FORMAT_DNSMASQ = "dnsmasq"
+	LEASE_FORMAT_ODHCPD  = "odhcpd"
+
+	UNKNOWN_HOSTNAME = "Unknown"
+
+	FETCH_TIMEOUT = 10 * time.Second
+
+	// WIFI_SKIP_THRESHOLD is the fraction of unparseable WiFi stats lines
+	// above which the whole payload is reported as an error.
+	WIFI_SKIP_THRESHOLD = 0.5
 )
 
 type ClientStats struct {
 	MACAddress string
 	RXBytes    int64
 	TXBytes    int64 // Corrected: Changed from 64 to int64
+	Interface  string
+
+	// IPAddress is set instead of MACAddress for a router that keys its
+	// WiFi stats by IP; see RouterConfig.ClientIdentity.
+	IPAddress string
+
+	// ConnectedTime is how long the client has been associated, in seconds,
+	// when the AP reports it.
+	ConnectedTime    int64
+	HasConnectedTime bool
+
+	// Signal and Noise are in dBm, when the AP reports them.
+	Signal    int
+	HasSignal bool
+	Noise     int
+	HasNoise  bool
 }
 
 type WANStats struct {
@@ -47,30 +344,381 @@ type DHCPLease struct {
 	IPAddress    string
 	Hostname     string
 	ClientID     string
+
+	// ClientIDKind and ClientIDValue are ClientID decoded by
+	// normalizeClientID.
+	ClientIDKind  string
+	ClientIDValue string
+
+	// HostnameManual is set when Hostname comes from the config's
+	// hostnames map rather than the lease.
+	HostnameManual bool
+}
+
+type RebootEvent struct {
+	ID         string `json:"id"`
+	DetectedAt string `json:"detected_at"`
+	PreviousRX int64  `json:"previous_rx"`
+	PreviousTX int64  `json:"previous_tx"`
+}
+
+type AllTimeEntry struct {
+	ID        string `json:"id"`
+	RXBytes   int64  `json:"rx_bytes"`
+	TXBytes   int64  `json:"tx_bytes"`
+	RXHuman   string `json:"rx_human"`
+	TXHuman   string `json:"tx_human"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+}
+
+type MonthlyArchiveEntry struct {
+	ID        string `json:"id"`
+	YearMonth string `json:"year_month"`
+	RXBytes   int64  `json:"rx_bytes"`
+	TXBytes   int64  `json:"tx_bytes"`
+	RXHuman   string `json:"rx_human"`
+	TXHuman   string `json:"tx_human"`
+}
+
+type BandTotal struct {
+	Interface string `json:"interface"`
+	RXBytes   int64  `json:"rx_bytes"`
+	TXBytes   int64  `json:"tx_bytes"`
+	RXHuman   string `json:"rx_human"`
+	TXHuman   string `json:"tx_human"`
+}
+
+type TagUsage struct {
+	Tag        string `json:"tag"`
+	Entities   int    `json:"entities"`
+	RXBytes    int64  `json:"rx_bytes"`
+	TXBytes    int64  `json:"tx_bytes"`
+	TotalBytes int64  `json:"total_bytes"`
+	RXHuman    string `json:"rx_human"`
+	TXHuman    string `json:"tx_human"`
+	TotalHuman string `json:"total_human"`
+}
+
+type ClientFlaps struct {
+	ID           string `json:"id"`
+	FlapCount    int    `json:"flap_count"`
+	SourceRouter string `json:"source_router"`
+}
+
+type TopTalker struct {
+	Rank       int    `json:"rank"`
+	ID         string `json:"id"`
+	Hostname   string `json:"hostname"`
+	RXBytes    int64  `json:"rx_bytes"`
+	TXBytes    int64  `json:"tx_bytes"`
+	TotalBytes int64  `json:"total_bytes"`
+	RXHuman    string `json:"rx_human"`
+	TXHuman    string `json:"tx_human"`
+	TotalHuman string `json:"total_human"`
+
+	// Linear projection of TotalBytes to the end of the month.
+	ProjectedBytes int64  `json:"projected_total_bytes"`
+	ProjectedHuman string `json:"projected_total_human"`
+
+	Tags []string `json:"tags"`
+}
+
+// Sparkline is an entity's traffic over its last Points cycle intervals,
+// oldest first, one slot per CYCLE_INTERVAL ending at To. Intervals with no
+// traffic_history row are 0.
+type Sparkline struct {
+	ID     string  `json:"id"`
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Points int     `json:"points"`
+	Total  []int64 `json:"total"`
+	RX     []int64 `json:"rx"`
+	TX     []int64 `json:"tx"`
+}
+
+// RangeUsage is what an entity moved between From and To, summed from its
+// traffic_history rows.
+type RangeUsage struct {
+	ID         string `json:"id"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Samples    int    `json:"samples"`
+	RXBytes    int64  `json:"rx_bytes"`
+	TXBytes    int64  `json:"tx_bytes"`
+	TotalBytes int64  `json:"total_bytes"`
+	RXHuman    string `json:"rx_human"`
+	TXHuman    string `json:"tx_human"`
+	TotalHuman string `json:"total_human"`
+}
+
+// HourlyUsage is an entity's average traffic per hour of the day in the
+// -timezone zone, index 0 being midnight to 1am. Each value is the bytes
+// moved in that hour summed over the window and divided by DaysWithData.
+type HourlyUsage struct {
+	ID           string  `json:"id"`
+	From         string  `json:"from"`
+	To           string  `json:"to"`
+	Days         int     `json:"days"`
+	DaysWithData int     `json:"days_with_data"`
+	Total        []int64 `json:"total"`
+	RX           []int64 `json:"rx"`
+	TX           []int64 `json:"tx"`
+}
+
+type Projection struct {
+	ID             string `json:"id"`
+	TotalBytes     int64  `json:"total_bytes"`
+	ProjectedBytes int64  `json:"projected_total_bytes"`
+	TotalHuman     string `json:"total_human"`
+	ProjectedHuman string `json:"projected_total_human"`
+	PeriodStart    string `json:"period_start"`
+	PeriodEnd      string `json:"period_end"`
+}
+
+type RouterLoad struct {
+	SourceRouter string `json:"source_router"`
+	Clients      int    `json:"clients"`
+	RXBytes      int64  `json:"rx_bytes"`
+	TXBytes      int64  `json:"tx_bytes"`
+	RXHuman      string `json:"rx_human"`
+	TXHuman      string `json:"tx_human"`
+}
+
+type LeaseHistoryEntry struct {
+	MACAddress string `json:"mac_address"`
+	IPAddress  string `json:"ip_address"`
+	Hostname   string `json:"hostname"`
+	ObservedAt string `json:"observed_at"`
 }
 
 var ErrURLEmpty = fmt.Errorf("URL is empty")
+var ErrNoRouters = fmt.Errorf("no routers configured")
+var ErrNoDatabases = fmt.Errorf("no database could be opened")
+var ErrConfigLoad = fmt.Errorf("failed to load configuration")
+
+var defaultWANPattern = regexp.MustCompile(`wan:\s+(\d+)\s+(\d+)`)
+var defaultWAN6Pattern = regexp.MustCompile(`wan6:\s+(\d+)\s+(\d+)`)
+
+var (
+	statsDBPath        = flag.String("stats-db", STATS_DB_NAME, "path of the traffic stats database, or :memory: for a throwaway in-memory database")
+	dhcpDBPath         = flag.String("dhcp-db", DHCP_DB_NAME, "path of the DHCP leases database, or :memory: for a throwaway in-memory database")
+	dataDir            = flag.String("data-dir", "", "directory for network_stats.db and dhcp_leases.db, created if missing; relative -stats-db and -dhcp-db paths are taken from here")
+	singleDB           = flag.Bool("single-db", false, "keep the DHCP tables in the stats database instead of a separate file")
+	walMode            = flag.Bool("wal", false, "switch both databases to write-ahead logging so readers don't block writes")
+	proxyURL           = flag.String("proxy", "", "HTTP proxy for router requests, e.g. http://proxy:3128; routers can override it with \"proxy\" (default: the HTTP_PROXY environment settings)")
+	listenAddr         = flag.String("listen", HTTP_ADDR, "address the HTTP API listens on; use :8080 to listen on every interface")
+	tlsCert            = flag.String("tls-cert", "", "serve the HTTP API over HTTPS with this certificate file (requires -tls-key)")
+	tlsKey             = flag.String("tls-key", "", "private key file for -tls-cert")
+	leaseWebhookURL    = flag.String("lease-webhook", "", "POST a JSON event to this URL when a DHCP lease is new, renewed or expires (empty disables)")
+	eventSocket        = flag.String("event-socket", "", "stream new device, quota and reboot events as JSON lines to clients of this Unix socket (empty disables)")
+	anomalyFactor      = flag.Float64("anomaly-factor", 0, "warn when an entity's TX/RX ratio for a cycle exceeds this multiple of its recent average, e.g. 5 (0 disables)")
+	anomalyMinBytes    = byteSizeFlag("anomaly-min-bytes", 100<<20, "only flag an upload anomaly when the entity sent at least this many bytes in the cycle (e.g. 100MiB)")
+	anomalyWindow      = flag.Int("anomaly-window", 24, "number of recent cycles averaged into each entity's TX/RX baseline")
+	alertCooldown      = flag.Duration("alert-cooldown", 0, "once an upload anomaly alert fires for an entity, don't repeat it while the anomaly persists and at most once per this long, e.g. 24h (0 alerts every anomalous cycle)")
+	anomalyWebhookURL  = flag.String("anomaly-webhook", "", "POST a JSON event to this URL for each upload anomaly (empty disables)")
+	singleWriter       = flag.Bool("single-writer", false, "send each cycle's readings and leases to one writer goroutine that commits them together, instead of each router writing its own under a shared lock")
+	writerQueue        = flag.Int("writer-queue", 64, "with -single-writer, how many writes routers can queue before they wait for the writer")
+	presence           = flag.Bool("presence", false, "keep the presence table and /presence of which clients are active, for home automation")
+	presenceMinBytes   = byteSizeFlag("presence-min-bytes", 10<<10, "with -presence, a client is active in a cycle where it moves more than this many bytes (e.g. 10KiB)")
+	presenceIdleCycles = flag.Int("presence-idle-cycles", 2, "with -presence, cycles without traffic above -presence-min-bytes before a client is inactive")
+	recordCycles       = flag.Bool("record-cycles", false, "store each collection cycle's duration and router counts in the cycle_stats table")
+	cycleTimeout       = flag.Duration("cycle-timeout", 10*time.Minute, "abandon routers that haven't finished this long after a collection cycle starts (0 disables)")
+	totalSource        = flag.String("total-source", TOTAL_SOURCE_WAN, "what the __total__ rollup sums: wan or clients")
+	totalWAN6          = flag.Bool("total-wan6", false, "with -total-source wan, add the IPv6 WAN counters (main_wan6) to the __total__ rollup")
+	dbMaxOpenConns     = flag.Int("db-max-open-conns", 1, "maximum open connections per database handle (0 is unlimited)")
+	dbBusyRetries      = flag.Int("db-busy-retries", 3, "times to retry a write that fails because the database is locked")
+	dbBusyBackoff      = flag.Duration("db-busy-backoff", 100*time.Millisecond, "wait before the first retry of a locked write; doubles on each retry")
+	dbSetupRetries     = flag.Int("db-setup-retries", 3, "times to retry opening and setting up a database at the start of a cycle before skipping it")
+	dbSetupBackoff     = flag.Duration("db-setup-backoff", 2*time.Second, "wait before the first retry of a database that couldn't be opened; doubles on each retry")
+	configRetrySleep   = flag.Duration("config-retry-sleep", time.Minute, "wait this long instead of the full interval before the next cycle when the configuration failed to load or has no routers (at least 10s)")
+	setupRetrySleep    = flag.Duration("setup-retry-sleep", 5*time.Minute, "wait this long instead of the full interval before the next cycle when no database could be opened")
+	dbConnMaxLifetime  = flag.Duration("db-conn-max-lifetime", 0, "close database connections after this long, e.g. 1h (0 keeps them)")
+	configPath         = flag.String("config", CONFIG_FILE, "router configuration file, or a directory of *.json files merged together")
+	configDB           = flag.String("config-db", "", "read the router list from this database (a DSN for -config-db-driver) instead of -config; re-read every cycle")
+	configDBDriver     = flag.String("config-db-driver", "sqlite3", "database/sql driver for -config-db; only sqlite3 is built in")
+	configQuery        = flag.String("config-query", DEFAULT_CONFIG_QUERY, "query returning one row per router for -config-db; columns are named like the routers.json keys")
+	pruneNow           = flag.Bool("prune", false, "apply -prune-stale-days and -archive-months once, report the rows removed and exit")
+	importFile         = flag.String("import", "", "import monthly and archive totals from this JSON file into the stats database and exit (see ImportFile for the format)")
+	importPolicy       = flag.String("import-policy", IMPORT_POLICY_SKIP, "what -import does with records that already have a row: skip, or merge to add their bytes")
+	initDB             = flag.Bool("init-db", false, "create or upgrade both databases, print their schema versions and exit")
+	dryRun             = flag.Bool("dry-run", false, "fetch and parse every router once, log the results and exit without writing to the databases")
+	repair             = flag.Bool("repair", false, "print how monthly_stats and monthly_archive differ from the sums of traffic_history and exit; add -apply to replace them")
+	repairApply        = flag.Bool("apply", false, "with -repair, write the rebuilt totals instead of only printing them")
+	verifyOnly         = flag.Bool("verify", false, "fetch and parse every configured URL once, print a PASS/FAIL table and exit non-zero on any failure")
+	selfTest           = flag.Bool("selftest", false, "parse embedded sample data, store it in an in-memory database, read it back and exit non-zero on any failure")
+	deadLetterFile     = flag.String("dead-letter-file", "", "append every input line a parser skipped to this JSON Lines file (empty disables)")
+	showVersion        = flag.Bool("version", false, "print the version and build information and exit")
+	syslogAddr         = flag.String("syslog", "", "also send log output to syslog: \"local\" or a remote host:port over UDP (empty disables)")
+	syslogFacility     = flag.String("syslog-facility", "daemon", "syslog facility, e.g. daemon, user or local0-local7")
+	debugEndpoints     = flag.Bool("debug", false, "serve diagnostic endpoints such as /debug/cumulative")
+	verbose            = flag.Bool("verbose", false, "log every parsed record")
+	shutdownTimeout    = flag.Duration("shutdown-timeout", 30*time.Second, "on SIGINT or SIGTERM, wait this long for a running collection cycle to finish")
+	pidFile            = flag.String("pidfile", "", "write the process ID to this file while running")
+	backupDir          = flag.String("backup-dir", "/var/www/netstat-data/backups", "directory for database backups")
+	backupInterval     = flag.Duration("backup-interval", 0, "back up both databases this often, e.g. 24h (0 disables scheduled backups)")
+	backupKeep         = flag.Int("backup-keep", 7, "number of backups of each database to keep (0 keeps everything)")
+	qualityInterval    = flag.Duration("quality-report-interval", 24*time.Hour, "log a data-quality report of how each router endpoint parsed this often (0 disables; /quality is always served)")
+	qualitySkipJump    = flag.Float64("quality-skip-jump", 0.25, "flag an endpoint's format as changed when the share of lines skipped rises this much above its usual share, e.g. 0.25 for 25 points")
+	vacuumInterval     = flag.Duration("vacuum-interval", 0, "VACUUM both databases this often, e.g. 168h, to give the space freed by pruning back to the file system (0 disables)")
+	vacuumNow          = flag.Bool("vacuum", false, "VACUUM both databases once, report the space reclaimed and exit; runs after -prune when both are given")
+	pauseFile          = flag.String("pause-file", "", "skip collection cycles while this file exists, e.g. during router maintenance")
+	collectMinInterval = flag.Duration("collect-min-interval", time.Minute, "minimum time between manually triggered collections")
+	routerJitter       = flag.Duration("router-jitter", 0, "delay each router's fetches by a random amount up to this duration")
+	sleepJitter        = flag.Duration("sleep-jitter", 0, "vary the sleep between cycles by up to plus or minus this duration")
+	delayFirst         = flag.Bool("delay-first", false, "wait one interval (with -sleep-jitter) before the first collection cycle instead of starting immediately")
+	timezone           = flag.String("timezone", "", "IANA time zone for month boundaries and displayed timestamps, e.g. Europe/Berlin (default: system local time)")
+	timeLayout         = flag.String("time-layout", LEGACY_TIME_LAYOUT, "Go time layout for timestamps in API responses, events and logs, e.g. 2006-01-02T15:04:05Z07:00 for RFC 3339; the databases always store RFC 3339 UTC")
+	pushURL            = flag.String("push-url", "", "POST a JSON document of each cycle's deltas, monthly totals and lease events to this URL (empty disables)")
+	pushHeaders        = headerListFlag("push-header", "add an HTTP header to -push-url requests, as 'Name: value' (repeatable), e.g. 'Authorization: Bearer TOKEN'")
+	deviceChangeReset  = flag.String("device-change-reset", "", "archive a MAC's totals and start it afresh when its DHCP lease shows a different device: comma-separated vendor and/or hostname (empty disables)")
+	once               = flag.Bool("once", false, "run one collection cycle, print how each router's endpoints did and exit: 0 if everything succeeded, 1 if some of it failed, 2 if nothing did, 3 if -deadline passed")
+	deadline           = flag.Duration("deadline", 0, "with -once, abandon routers still running this long after the start, write what finished and exit with 3 (0 disables)")
+	flushEvery         = flag.Int("flush-every", 1, "write collected readings and leases to the databases only every N cycles, holding them in memory in between to save flash writes (1 writes every cycle)")
+	statusFile         = flag.String("status-file", "", "replace this file with a JSON summary of each collection cycle, e.g. /run/netstats/status.json (empty disables)")
+	snapshotFile       = flag.String("snapshot-file", "", "append each cycle's parsed clients, WAN readings and leases to this JSON Lines file (empty disables)")
+	snapshotDaily      = flag.Bool("snapshot-rotate-daily", false, "start a new snapshot file each day")
+	snapshotMaxSize    = byteSizeFlag("snapshot-max-size", 0, "start a new snapshot file once it reaches this many bytes, e.g. 50MB (0 disables)")
+	maxRedirects       = flag.Int("max-redirects", 3, "number of HTTP redirects to follow when fetching from a router (0 disables following)")
+	maxResponseSize    = byteSizeFlag("max-response-size", 4<<20, "largest response body in bytes accepted from a router, e.g. 4MiB (0 disables the limit)")
+	wifiTimeout        = flag.Duration("wifi-timeout", FETCH_TIMEOUT, "default timeout for WiFi stats requests")
+	wanTimeout         = flag.Duration("wan-timeout", FETCH_TIMEOUT, "default timeout for WAN stats requests")
+	dhcpTimeout        = flag.Duration("dhcp-timeout", FETCH_TIMEOUT, "default timeout for DHCP lease requests")
+	httpKeepAlive      = flag.Bool("http-keepalive", false, "reuse connections to routers between requests")
+	archiveMonths      = flag.Int("archive-months", 0, "number of months of monthly_archive to keep (0 keeps everything)")
+	pruneStaleDays     = flag.Int("prune-stale-days", 0, "delete cumulative_stats rows for entities not seen for this many days (0 disables)")
+	pruneStaleMonthly  = flag.Bool("prune-stale-monthly", false, "with -prune-stale-days, also delete the pruned entities' monthly_stats rows")
+	hostnameCacheTTL   = flag.Duration("hostname-cache-ttl", 5*time.Minute, "how long the API reuses DHCP hostnames before reading them again (new leases always refresh them)")
+	byteUnits          = flag.String("byte-units", BYTE_UNITS_BINARY, "units for human-readable sizes and KB/MB/GB in size flags: binary (1024, GiB) or decimal (1000, GB)")
+	historyRetention   = flag.Int("history-retention-days", 90, "delete traffic_history rows older than this many days (0 or less keeps everything)")
+	unparsedEntity     = flag.Bool("unparsed-entity", false, "add the counters of WiFi lines skipped for a bad MAC address or connected time to __unparsed__:<router>, so client totals still reconcile")
+	dataCap            = byteSizeFlag("data-cap", 0, "monthly data cap of the __total__ rollup for /quota, e.g. 500GB (0 for none; router configs can cap entities with \"caps\")")
+	historyMinBytes    = byteSizeFlag("history-min-bytes", 0, "don't add a traffic_history row for cycles where an entity moved fewer bytes than this, e.g. 4KiB (totals still count them)")
+	recordReboots      = flag.Bool("record-reboots", false, "store detected router reboots in the reboot_events table")
+	maxCycleIncrement  = byteSizeFlag("max-cycle-increment", 0, "reject a cycle in which one entity's counters grew by more than this, e.g. 50GB, as garbage data (0 disables)")
+	spikeFactor        = flag.Float64("spike-factor", 0, "reject a cycle in which an entity moved more than this multiple of its recent average, e.g. 100 (0 disables)")
+	spikeMinBytes      = byteSizeFlag("spike-min-bytes", 1<<30, "only let -spike-factor reject a cycle of at least this many bytes, e.g. 1GiB")
+	warmupCycles       = flag.Int("warmup-cycles", 0, "keep each entity's first N readings after a restart, counter reset or new baseline out of the totals, only taking them as the baseline (0 counts every reading)")
+)
+
+// dbMutex serializes writes to both databases across the collection cycle
+// and the HTTP handlers.
+var dbMutex sync.Mutex
+
+func debugf(format string, args ...interface{}) {
+	if *verbose {
+		fmt.Printf(format, args...)
+	}
+}
 
-func loadConfig(filename string) (Config, error) {
-	file, err := os.Open(filename)
+// setTimezone makes name the process's local time zone, so every
+// time.Now() and stored timestamp, and with them the monthly reset, follow
+// it. An empty name keeps the system zone.
+func setTimezone(name string) error {
+	if name == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("error: Configuration file '%s' not found", filename)
-		}
-		return nil, fmt.Errorf("error opening config file '%s': %w", filename, err)
+		return fmt.Errorf("error loading time zone '%s': %w", name, err)
+	}
+	time.Local = loc
+	return nil
+}
+
+// jitter returns a random duration in [0, max). It returns 0 when max is not
+// positive, so unset jitter options leave the schedule untouched.
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// configRetryInterval bounds -config-retry-sleep: at least
+// CONFIG_RETRY_MIN_SLEEP, so a config that stays broken is not reloaded in a
+// tight loop, and at most CYCLE_INTERVAL, since retrying sooner is its point.
+func configRetryInterval(sleep time.Duration) time.Duration {
+	if sleep < CONFIG_RETRY_MIN_SLEEP {
+		return CONFIG_RETRY_MIN_SLEEP
 	}
-	defer file.Close()
+	if sleep > CYCLE_INTERVAL {
+		return CYCLE_INTERVAL
+	}
+	return sleep
+}
 
-	byteValue, err := ioutil.ReadAll(file)
+// cycleSleep returns the pause between cycles: 30 minutes, moved by up to
+// -sleep-jitter either way.
+func cycleSleep() time.Duration {
+	return CYCLE_INTERVAL + jitter(2**sleepJitter) - *sleepJitter
+}
+
+// enableWAL switches the database at path to write-ahead logging. The mode
+// is stored in the file, so this only needs to happen once; readers such as
+// api.php then no longer block the collector's commits.
+func enableWAL(path string) error {
+	db, err := connectDB(path)
 	if err != nil {
-		return nil, fmt.Errorf("error reading config file '%s': %w", filename, err)
+		return err
+	}
+	defer db.Close()
+
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode=WAL").Scan(&mode); err != nil {
+		return fmt.Errorf("error enabling WAL for %s: %w", path, err)
 	}
+	if mode != "wal" {
+		fmt.Printf("Warning: %s stayed in %s journal mode.\n", path, mode)
+	}
+	return nil
+}
+
+// applyDataDir moves the databases under dir: the default file names go
+// there, as do relative -stats-db and -dhcp-db paths. Absolute paths and
+// ":memory:" are left alone. The directory is created if needed.
+func applyDataDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating data directory '%s': %w", dir, err)
+	}
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
 
-	var config Config
-	if err := json.Unmarshal(byteValue, &config); err != nil {
-		return nil, fmt.Errorf("error: Invalid JSON format in '%s': %w", filename, err)
+	place := func(path, flagName, defaultName string) string {
+		switch {
+		case !set[flagName]:
+			return filepath.Join(dir, defaultName)
+		case path == ":memory:" || filepath.IsAbs(path):
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	*statsDBPath = place(*statsDBPath, "stats-db", filepath.Base(STATS_DB_NAME))
+	*dhcpDBPath = place(*dhcpDBPath, "dhcp-db", filepath.Base(DHCP_DB_NAME))
+	return nil
+}
+
+// resolveDBPath turns ":memory:" into a named, shared-cache in-memory
+// database so every connection in the process sees the same data. A plain
+// ":memory:" DSN would give each pooled connection its own empty database.
+// The first connection is kept open for the life of the process, since
+// SQLite drops a shared in-memory database when its last connection closes.
+func resolveDBPath(path, name string) string {
+	if path != ":memory:" {
+		return path
+	}
+
+	dsn := "file:" + name + "?mode=memory&cache=shared"
+	if _, err := connectDB(dsn); err != nil {
+		fmt.Printf("Failed to open in-memory database %s: %v\n", name, err)
+		os.Exit(1)
 	}
-	return config, nil
+	fmt.Printf("Using in-memory %s database; its data is lost when the process exits.\n", name)
+	return dsn
 }
 
 func connectDB(dbName string) (*sql.DB, error) {
@@ -78,6 +726,11 @@ func connectDB(dbName string) (*sql.DB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("database connection error for %s: %w", dbName, err)
 	}
+	// SQLite allows one writer at a time per file, and every write here is
+	// already serialized by dbMutex, so extra connections only add lock
+	// contention and file handles. One connection per *sql.DB is the default.
+	db.SetMaxOpenConns(*dbMaxOpenConns)
+	db.SetConnMaxLifetime(*dbConnMaxLifetime)
 	if err = db.Ping(); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("database ping error for %s: %w", dbName, err)
@@ -85,61 +738,55 @@ func connectDB(dbName string) (*sql.DB, error) {
 	return db, nil
 }
 
-func setupStatsDB(db *sql.DB) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction for stats DB setup: %w", err)
+// connectReadOnlyDB opens dbName with SQLite's query_only pragma set, so any
+// write through the handle fails. The HTTP query handlers use it; only the
+// collection cycle and the explicit reset and backup endpoints write, through
+// connectDB.
+func connectReadOnlyDB(dbName string) (*sql.DB, error) {
+	separator := "?"
+	if strings.Contains(dbName, "?") {
+		separator = "&"
 	}
-	defer tx.Rollback()
+	return connectDB(dbName + separator + "_query_only=1")
+}
 
-	_, err = tx.Exec(`
-		CREATE TABLE IF NOT EXISTS cumulative_stats (
-			id TEXT PRIMARY KEY,
-			rx_bytes INTEGER,
-			tx_bytes INTEGER
-		)
-	`)
+// addColumnIfMissing adds a column to a table created by an older version,
+// since CREATE TABLE IF NOT EXISTS leaves existing tables untouched.
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
 	if err != nil {
-		return fmt.Errorf("error creating cumulative_stats table: %w", err)
+		return fmt.Errorf("error inspecting %s table: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("error inspecting %s table: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error inspecting %s table: %w", table, err)
 	}
+	rows.Close()
 
-	_, err = tx.Exec(`
-		CREATE TABLE IF NOT EXISTS monthly_stats (
-			id TEXT PRIMARY KEY,
-			rx_bytes INTEGER,
-			tx_bytes INTEGER,
-			timestamp TEXT
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("error creating monthly_stats table: %w", err)
+	if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+		return fmt.Errorf("error adding %s.%s column: %w", table, column, err)
 	}
+	return nil
+}
 
-	return tx.Commit()
+func setupStatsDB(db *sql.DB) error {
+	return migrate(db, "stats", statsMigrations)
 }
 
 func setupDHCPDB(db *sql.DB) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction for DHCP DB setup: %w", err)
-	}
-	defer tx.Rollback()
-
-	_, err = tx.Exec(`
-		CREATE TABLE IF NOT EXISTS dhcp_leases (
-			mac_address TEXT PRIMARY KEY,
-			lease_end_time INTEGER,
-			ip_address TEXT,
-			hostname TEXT,
-			client_id TEXT,
-			timestamp TEXT
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("error creating dhcp_leases table: %w", err)
-	}
-
-	return tx.Commit()
+	return migrate(db, "dhcp", dhcpMigrations)
 }
 
 func resetMonthlyStats(db *sql.DB, mutex *sync.Mutex) error {
@@ -161,396 +808,1930 @@ func resetMonthlyStats(db *sql.DB, mutex *sync.Mutex) error {
 		if err == sql.ErrNoRows {
 			return nil
 		}
-		return fmt.Errorf("error fetching last update timestamp from monthly_stats: %w", lastUpdateStr, err)
+		return fmt.Errorf("error fetching last update timestamp from monthly_stats: %w", err)
 	}
 
-	lastUpdateDate, err := time.Parse("2006-01-02 15:04:05", lastUpdateStr)
+	lastUpdateDate, err := parseStoredTime(lastUpdateStr)
 	if err != nil {
-		return fmt.Errorf("error parsing last update timestamp '%s': %w", lastUpdateStr, err)
+		return fmt.Errorf("error parsing last update timestamp: %w", err)
 	}
+	lastUpdateDate = lastUpdateDate.In(time.Local)
 
 	currentDate := time.Now()
 
 	if lastUpdateDate.Month() != currentDate.Month() || lastUpdateDate.Year() != currentDate.Year() {
-		_, err := db.Exec(`
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction for monthly reset: %w", err)
+		}
+		defer tx.Rollback()
+
+		if err := archiveMonthlyStats(tx); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
 			UPDATE monthly_stats
 			SET rx_bytes = 0,
 				tx_bytes = 0,
+				flap_count = 0,
 				timestamp = ?
-		`, currentDate.Format("2006-01-02 15:04:05"))
+		`, storedTime(currentDate))
 		if err != nil {
 			return fmt.Errorf("error resetting monthly stats: %w", err)
 		}
-		fmt.Println("Monthly statistics reset due to new month/year.")
+
+		if *archiveMonths > 0 {
+			if _, err := pruneMonthlyArchive(tx, *archiveMonths, currentDate); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing monthly reset: %w", err)
+		}
+		fmt.Println("Monthly statistics archived and reset due to new month/year.")
 	}
 	return nil
 }
 
-func fetchData(url string) (string, error) {
-	if url == "" {
-		return "", ErrURLEmpty
+// archiveMonthlyStats copies every non-zero monthly_stats row to
+// monthly_archive. Each row's timestamp is its last update, so its month in
+// -timezone is the month the totals belong to.
+func archiveMonthlyStats(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, timestamp, rx_bytes, tx_bytes FROM monthly_stats WHERE rx_bytes > 0 OR tx_bytes > 0")
+	if err != nil {
+		return fmt.Errorf("error archiving monthly stats: %w", err)
 	}
-
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
-			DisableKeepAlives: true,
-		},
+	type archiveRow struct {
+		id, yearMonth string
+		rx, tx        int64
 	}
-
-	resp, err := client.Get(url)
-	if err != nil {
-		return "", fmt.Errorf("error fetching data from %s: %w", url, err)
+	var archive []archiveRow
+	for rows.Next() {
+		var row archiveRow
+		var timestamp string
+		if err := rows.Scan(&row.id, &timestamp, &row.rx, &row.tx); err != nil {
+			rows.Close()
+			return fmt.Errorf("error archiving monthly stats: %w", err)
+		}
+		updated, err := parseStoredTime(timestamp)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("error archiving monthly stats for %s: %w", row.id, err)
+		}
+		row.yearMonth = updated.In(time.Local).Format("2006-01")
+		archive = append(archive, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error archiving monthly stats: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("HTTP error fetching data from %s: %d - %s", url, resp.StatusCode, resp.Status)
+	for _, row := range archive {
+		_, err := tx.Exec(`
+			INSERT OR REPLACE INTO monthly_archive (id, year_month, rx_bytes, tx_bytes)
+			VALUES (?, ?, ?, ?)
+		`, row.id, row.yearMonth, row.rx, row.tx)
+		if err != nil {
+			return fmt.Errorf("error archiving monthly stats for %s: %w", row.id, err)
+		}
 	}
+	return nil
+}
 
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+// pruneMonthlyArchive deletes monthly_archive rows more than months before
+// now's month and returns how many it removed.
+func pruneMonthlyArchive(tx *sql.Tx, months int, now time.Time) (int64, error) {
+	cutoff := time.Date(now.Year(), now.Month()-time.Month(months), 1, 0, 0, 0, 0, now.Location())
+	res, err := tx.Exec("DELETE FROM monthly_archive WHERE year_month < ?", cutoff.Format("2006-01"))
+	if err != nil {
+		return 0, fmt.Errorf("error pruning monthly archive: %w", err)
+	}
+	pruned, err := res.RowsAffected()
 	if err != nil {
-		return "", fmt.Errorf("error reading response body from %s: %w", url, err)
+		return 0, fmt.Errorf("error pruning monthly archive: %w", err)
+	}
+	if pruned > 0 {
+		fmt.Printf("Pruned %d monthly archive rows older than %s.\n", pruned, cutoff.Format("2006-01"))
 	}
+	return pruned, nil
+}
+
+var (
+	httpClientOnce sync.Once
+	httpClient     *http.Client
+)
 
-	return string(bodyBytes), nil
+// sharedHTTPClient returns the client used for every router request that
+// has no proxy configured. It has no timeout of its own; each request
+// carries a context deadline instead so routers can use different timeouts.
+func sharedHTTPClient() *http.Client {
+	httpClientOnce.Do(func() {
+		httpClient = newHTTPClient(http.ProxyFromEnvironment, nil)
+	})
+	return httpClient
 }
 
-func parseWiFiStats(data string) ([]ClientStats, error) {
-	if data == "" {
-		return nil, nil
+// newHTTPClient builds a router client. A nil tlsConfig uses the default
+// TLS settings.
+func newHTTPClient(proxy func(*http.Request) (*url.URL, error), tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		CheckRedirect: checkRedirect,
+		Transport: &http.Transport{
+			Proxy:               proxy,
+			TLSClientConfig:     tlsConfig,
+			DisableKeepAlives:   !*httpKeepAlive,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     90 * time.Second,
+		},
 	}
+}
 
-	var clients []ClientStats
-	lines := strings.Split(strings.TrimSpace(data), "\n")
-	for _, line := range lines {
-		parts := strings.Fields(line)
-		if len(parts) == 3 {
-			macAddress := strings.ToLower(parts[0])
-			rxBytes, err := strconv.ParseInt(parts[1], 10, 64)
-			if err != nil {
-				fmt.Printf("Error parsing RX bytes for line '%s': %v\n", line, err)
-				continue
-			}
-			txBytes, err := strconv.ParseInt(parts[2], 10, 64)
-			if err != nil {
-				fmt.Printf("Error parsing TX bytes for line '%s': %v\n", line, err)
-				continue
-			}
-			clients = append(clients, ClientStats{
-				MACAddress: macAddress,
-				RXBytes:    rxBytes,
-				TXBytes:    txBytes,
-			})
-		} else {
-			fmt.Printf("Warning: Skipping malformed WiFi stats line: '%s'\n", line)
-		}
+// PROXY_DIRECT as a router's proxy bypasses both -proxy and the
+// environment's proxy settings.
+const PROXY_DIRECT = "direct"
+
+// routerClients holds the clients of routers with their own proxy, TLS or
+// SSH settings, keyed by what sets them apart.
+var (
+	routerClientsMutex sync.Mutex
+	routerClients      = map[string]*http.Client{}
+)
+
+// parseProxyURL checks a proxy setting: PROXY_DIRECT, or an http, https or
+// socks5 URL with a host.
+func parseProxyURL(s string) (*url.URL, error) {
+	if s == PROXY_DIRECT {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL '%s': %w", s, err)
 	}
-	return clients, nil
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL '%s': scheme must be http, https or socks5", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL '%s': missing host", s)
+	}
+	return u, nil
 }
 
-func parseWANStats(data string) (*WANStats, error) {
-	if data == "" {
-		return nil, nil
+// routerHTTPClient returns the client for fetching url from the router: the
+// socket's client for unix:// URLs, the tunnel's for routers behind SSH,
+// otherwise one per distinct proxy and TLS setting, or sharedHTTPClient when
+// the router sets neither and -proxy is unset.
+func routerHTTPClient(urls RouterConfig, url string) *http.Client {
+	if socketPath, _, ok := splitUnixURL(url); ok {
+		return unixHTTPClient(socketPath)
+	}
+	if urls.ssh != nil {
+		return urls.ssh.httpClient(urls.tls)
 	}
 
-	re := regexp.MustCompile(`wan:\s+(\d+)\s+(\d+)`)
-	match := re.FindStringSubmatch(data)
+	setting := urls.Proxy
+	if setting == "" {
+		setting = *proxyURL
+	}
+	if setting == "" && urls.tls == nil {
+		return sharedHTTPClient()
+	}
+	key := setting
+	var tlsConfig *tls.Config
+	if urls.tls != nil {
+		key += " " + urls.tls.digest
+		tlsConfig = urls.tls.config
+	}
 
-	if len(match) == 3 {
-		rxBytes, err := strconv.ParseInt(match[1], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing WAN RX bytes from data '%s': %w", data, err)
-		}
-		txBytes, err := strconv.ParseInt(match[2], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing WAN TX bytes from data '%s': %w", data, err)
+	routerClientsMutex.Lock()
+	defer routerClientsMutex.Unlock()
+
+	if client, ok := routerClients[key]; ok {
+		return client
+	}
+	proxy := http.ProxyFromEnvironment
+	if setting != "" {
+		// Settings are validated at startup and config load.
+		parsed, err := parseProxyURL(setting)
+		switch {
+		case err != nil:
+			fmt.Printf("Ignoring proxy: %v\n", err)
+		case parsed == nil:
+			proxy = nil
+		default:
+			proxy = http.ProxyURL(parsed)
 		}
-		return &WANStats{
-			RXBytes: rxBytes,
-			TXBytes: txBytes,
-		}, nil
 	}
-
-	return nil, fmt.Errorf("WAN stats pattern not found in data: '%s'", data)
+	client := newHTTPClient(proxy, tlsConfig)
+	routerClients[key] = client
+	return client
 }
 
-func parseDHCPLeases(data string) ([]DHCPLease, error) {
-	if data == "" {
-		return nil, nil
+// checkRedirect follows up to -max-redirects redirects. With -max-redirects
+// 0 the redirect response itself is returned, so fetchData reports it as an
+// HTTP error instead of silently reading e.g. a login page.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if *maxRedirects <= 0 {
+		return http.ErrUseLastResponse
+	}
+	if len(via) > *maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", *maxRedirects)
 	}
+	return nil
+}
 
-	var leases []DHCPLease
-	lines := strings.Split(strings.TrimSpace(data), "\n")
-	ipv4LeasePattern := regexp.MustCompile(
-		`^(\d+)\s+([0-9a-fA-F:]{17})\s+([\d\.]+)\s+(.*?)\s+([\d0-9a-fA-F:]+)$`,
-	)
+// readLimited reads body up to -max-response-size bytes and fails instead
+// of buffering anything larger, so a misconfigured URL can't exhaust memory.
+func readLimited(body io.Reader) ([]byte, error) {
+	limit := *maxResponseSize
+	if limit <= 0 {
+		return ioutil.ReadAll(body)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("response exceeds %s limit", humanizeBytes(limit))
+	}
+	return data, nil
+}
 
-	for _, line := range lines {
-		match := ipv4LeasePattern.FindStringSubmatch(line)
-		if len(match) == 6 {
-			leaseEndTime, err := strconv.ParseInt(match[1], 10, 64)
-			if err != nil {
-				fmt.Printf("Error parsing lease end time for line '%s': %v\n", line, err)
-				continue
-			}
-			macAddress := strings.ToLower(match[2])
-			ipAddress := match[3]
-			hostname := strings.TrimSpace(match[4])
-			if hostname == "*" {
-				hostname = "Unknown"
-			} else {
-				hostnameParts := strings.Fields(hostname)
-				if len(hostnameParts) > 0 {
-					hostname = hostnameParts[0]
-				}
-			}
-			clientID := match[5]
-
-			leases = append(leases, DHCPLease{
-				MACAddress:   macAddress,
-				LeaseEndTime: leaseEndTime,
-				IPAddress:    ipAddress,
-				Hostname:     hostname,
-				ClientID:     clientID,
-			})
-		} else {
-			fmt.Printf("Warning: Skipping malformed DHCP lease line: '%s'\n", line)
-		}
+// logRedirect notes when a request ended up somewhere other than the
+// configured URL, which usually means the config should be updated.
+func logRedirect(url string, resp *http.Response) {
+	if finalURL := resp.Request.URL.String(); finalURL != requestURL(url) {
+		fmt.Printf("Note: %s redirected to %s; consider updating the config.\n", url, finalURL)
 	}
-	return leases, nil
 }
 
-func updateTrafficStats(db *sql.DB, mutex *sync.Mutex, entityID string, newRX, newTX int64) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+// newRouterRequest builds a request carrying the router's headers and a
+// deadline of its configured timeout. The caller must call the returned
+// cancel function once the response body has been read.
+func newRouterRequest(urls RouterConfig, method, url string, body io.Reader) (*http.Request, context.CancelFunc, error) {
+	timeout := urls.timeout
+	if timeout <= 0 {
+		timeout = FETCH_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(urls.context(), timeout)
 
-	tx, err := db.Begin()
+	req, err := http.NewRequestWithContext(ctx, method, requestURL(url), body)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction for traffic stats: %w", err)
+		cancel()
+		return nil, nil, fmt.Errorf("error creating request for %s: %w", url, err)
 	}
-	defer tx.Rollback()
-
-	var lastRX, lastTX int64
-	err = tx.QueryRow("SELECT rx_bytes, tx_bytes FROM cumulative_stats WHERE id = ?", entityID).Scan(&lastRX, &lastTX)
+	for name, value := range urls.Headers {
+		req.Header.Set(name, value)
+	}
+	return req, cancel, nil
+}
 
-	var monthlyCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM monthly_stats WHERE id = ?", entityID).Scan(&monthlyCount)
-	if err != nil {
-		return fmt.Errorf("error checking monthly stats existence for %s: %w", entityID, err)
+// context returns the context the router's fetches run under.
+func (urls RouterConfig) context() context.Context {
+	if urls.cycleCtx == nil {
+		return context.Background()
 	}
-	if monthlyCount == 0 {
-		_, err = tx.Exec(`
-			INSERT INTO monthly_stats (id, rx_bytes, tx_bytes, timestamp)
-			VALUES (?, ?, ?, ?)
-		`, entityID, 0, 0, time.Now().Format("2006-01-02 15:04:05"))
-		if err != nil {
-			return fmt.Errorf("error initializing monthly stats for %s: %w", entityID, err)
-		}
+	return urls.cycleCtx
+}
+
+// pause waits out the router's request_gap between two of its requests
+// that run one after another, which adds breathing room for routers that
+// need it. With parallel_fetch the endpoints aren't spaced out.
+func (urls RouterConfig) pause() {
+	if urls.requestGap > 0 {
+		time.Sleep(urls.requestGap)
 	}
+}
 
-	var incrementalRX, incrementalTX int64
+// FetchResult is a router response: its body and, for /status, its HTTP
+// status and body size.
+type FetchResult struct {
+	Body       string
+	StatusCode int
+	Size       int64
+}
 
-	if err == sql.ErrNoRows {
-		incrementalRX = newRX
-		incrementalTX = newTX
-	} else if err != nil {
-		return fmt.Errorf("error fetching cumulative stats for %s: %w", entityID, err)
-	} else {
-		if newRX >= lastRX {
-			incrementalRX = newRX - lastRX
-		} else {
-			incrementalRX = newRX
-		}
+// fetchData returns the body of url, recording the response's status and
+// size against the router's endpoint.
+func fetchData(urls RouterConfig, url string) (string, error) {
+	result, err := fetchDataResult(urls, url)
+	recordResponse(urls.name, urls.endpoint, result)
+	return result.Body, err
+}
 
-		if newTX >= lastTX {
-			incrementalTX = newTX - lastTX
-		} else {
-			incrementalTX = newTX
-		}
+// fetchDataResult fetches url. StatusCode is set whenever the router
+// answered, including with an error status; Body and Size only for 200 OK.
+func fetchDataResult(urls RouterConfig, url string) (FetchResult, error) {
+	if url == "" {
+		return FetchResult{}, ErrURLEmpty
 	}
 
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	_, err = tx.Exec(`
-		UPDATE monthly_stats
-		SET rx_bytes = rx_bytes + ?,
-			tx_bytes = tx_bytes + ?,
-			timestamp = ?
-		WHERE id = ?
-	`, incrementalRX, incrementalTX, timestamp, entityID)
+	req, cancel, err := newRouterRequest(urls, http.MethodGet, url, nil)
 	if err != nil {
-		return fmt.Errorf("error updating monthly stats for %s: %w", entityID, err)
+		return FetchResult{}, err
 	}
+	defer cancel()
 
-	_, err = tx.Exec(`
-		INSERT OR REPLACE INTO cumulative_stats (id, rx_bytes, tx_bytes)
-		VALUES (?, ?, ?)
-	`, entityID, newRX, newTX)
+	resp, err := routerHTTPClient(urls, url).Do(req)
 	if err != nil {
-		return fmt.Errorf("error upserting cumulative stats for %s: %w", entityID, err)
+		return FetchResult{}, fmt.Errorf("error fetching data from %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	logRedirect(url, resp)
+
+	result := FetchResult{StatusCode: resp.StatusCode}
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("HTTP error fetching data from %s: %d - %s", url, resp.StatusCode, resp.Status)
+	}
+
+	bodyBytes, err := readLimited(resp.Body)
+	if err != nil {
+		return result, fmt.Errorf("error reading response body from %s: %w", url, err)
+	}
+
+	result.Body = string(bodyBytes)
+	result.Size = int64(len(bodyBytes))
+	return result, nil
+}
+
+func collectWiFiStats(routerIP string, urls RouterConfig) ([]ClientStats, WiFiParseSummary, error) {
+	if urls.Format == FORMAT_UBUS {
+		clients, err := fetchUbusWiFiStats(urls.forEndpoint("wifi"))
+		return clients, WiFiParseSummary{Parsed: len(clients)}, err
+	}
+
+	data, err := fetchEndpoint(urls, "wifi")
+	if err != nil {
+		return nil, WiFiParseSummary{}, err
+	}
+	columns := urls.wifiColumns
+	if columns.maxFields == 0 {
+		columns = defaultWiFiColumns
+	}
+	clients, summary, err := parseWiFiStatsColumns(data, columns)
+	deadLetters.write(routerIP, "wifi", summary.SkippedLines)
+	parseErrors := summary.Skipped
+	if err != nil && parseErrors == 0 {
+		parseErrors = 1
+	}
+	recordParseErrors(routerIP, "wifi", parseErrors)
+	if err != nil {
+		return clients, summary, parseError{fmt.Errorf("error parsing WiFi stats: %w", err)}
+	}
+	if summary.Skipped > 0 {
+		fmt.Printf("Warning: Skipped %d of %d WiFi stats lines from %s.\n", summary.Skipped, summary.Lines(), routerIP)
+	}
+	return clients, summary, nil
+}
+
+// collectWANStats returns the IPv4 and IPv6 WAN counters and those of the
+// router's tracked tunnels, by interface. Either WAN may be nil when the
+// router only reports one family; it is an error only when the response
+// holds neither.
+func collectWANStats(routerIP string, urls RouterConfig) (*WANStats, *WANStats, map[string]WANStats, error) {
+	if urls.Format == FORMAT_UBUS {
+		wan, err := fetchUbusWANStats(urls.forEndpoint("wan"))
+		return wan, nil, nil, err
+	}
+
+	data, err := fetchEndpoint(urls, "wan")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	wan6, err := parseWAN6Stats(data)
+	if err == nil {
+		var tunnels map[string]WANStats
+		if tunnels, err = parseTunnelStats(data, urls.tunnels); err == nil {
+			var wan *WANStats
+			if wan, err = parseWANStats(data, urls.wanPattern); err == nil || wan6 != nil {
+				return wan, wan6, tunnels, nil
+			}
+		}
+	}
+	deadLetters.write(routerIP, "wan", []string{data})
+	recordParseErrors(routerIP, "wan", 1)
+	return nil, nil, nil, parseError{fmt.Errorf("error parsing WAN stats: %w", err)}
+}
+
+// isValidMAC reports whether s is a 6-byte hardware address in any of the
+// notations net.ParseMAC accepts.
+func isValidMAC(s string) bool {
+	_, ok := normalizeMAC(s)
+	return ok
+}
+
+// normalizeMAC returns the canonical lowercase, colon-separated form of a
+// 6-byte MAC address.
+func normalizeMAC(s string) (string, bool) {
+	hw, err := net.ParseMAC(s)
+	if err != nil || len(hw) != 6 {
+		return "", false
+	}
+	return hw.String(), true
+}
+
+// canonicalIP returns the standard form of an IPv4 or IPv6 address:
+// dotted decimal without leading zeros for IPv4 (including IPv4-mapped IPv6
+// such as ::ffff:192.168.1.5), and the compressed lowercase form for IPv6.
+// Zero-padded IPv4 octets ("192.168.001.005") are read as decimal.
+func canonicalIP(s string) (string, bool) {
+	if octets := strings.Split(s, "."); len(octets) == 4 {
+		for i, octet := range octets {
+			if trimmed := strings.TrimLeft(octet, "0"); trimmed != "" {
+				octets[i] = trimmed
+			} else if octet != "" {
+				octets[i] = "0"
+			}
+		}
+		s = strings.Join(octets, ".")
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String(), true
+	}
+	return ip.String(), true
+}
+
+// canonicalIPv4 is canonicalIP limited to IPv4 addresses.
+func canonicalIPv4(s string) (string, bool) {
+	canonical, ok := canonicalIP(s)
+	if !ok || strings.Contains(canonical, ":") {
+		return "", false
+	}
+	return canonical, true
+}
+
+// WiFiParseSummary counts the lines parseWiFiStats accepted and skipped.
+type WiFiParseSummary struct {
+	Parsed       int
+	Skipped      int
+	SkippedLines []string
+
+	// UnparsedLines counts the skipped lines whose RX and TX columns were
+	// still numbers, such as lines with an invalid MAC address, and
+	// UnparsedRX and UnparsedTX sum their counters.
+	UnparsedLines int
+	UnparsedRX    int64
+	UnparsedTX    int64
+}
+
+func (s WiFiParseSummary) Lines() int {
+	return s.Parsed + s.Skipped
+}
+
+func (s *WiFiParseSummary) skip(line string) {
+	s.Skipped++
+	s.SkippedLines = append(s.SkippedLines, line)
+}
+
+// skipUnparsed skips a line that has the layout's number of fields, adding
+// its counters to the unparsed totals when both are numbers.
+func (s *WiFiParseSummary) skipUnparsed(line string, parts []string, columns wifiColumns) {
+	s.skip(line)
+	rx, rxErr := strconv.ParseInt(parts[columns.rx], 10, 64)
+	tx, txErr := strconv.ParseInt(parts[columns.tx], 10, 64)
+	if rxErr == nil && txErr == nil {
+		s.UnparsedLines++
+		s.UnparsedRX += rx
+		s.UnparsedTX += tx
+	}
+}
+
+// parseWiFiStats returns every client it could parse along with a count of
+// skipped lines. When more than WIFI_SKIP_THRESHOLD of the lines are skipped
+// it also returns an error, since that usually means the CGI output format
+// changed rather than a few odd lines.
+func parseWiFiStats(data string) ([]ClientStats, WiFiParseSummary, error) {
+	return parseWiFiStatsColumns(data, defaultWiFiColumns)
+}
+
+// wifiColumns gives the field index of each WiFi stats column, or -1 for an
+// optional column the layout doesn't have. Lines need at least minFields
+// fields and at most maxFields.
+type wifiColumns struct {
+	mac, rx, tx, iface, connectedTime, signal, noise int
+	minFields, maxFields                             int
+
+	// separator splits the fields; empty means any run of whitespace.
+	separator string
+
+	// ipKey reads the mac column as an IP address.
+	ipKey bool
+}
+
+// wifiDelimiters maps the wifi_delimiter names to the separator they split
+// on.
+var wifiDelimiters = map[string]string{
+	"whitespace": "",
+	"comma":      ",",
+	"tab":        "\t",
+}
+
+// split breaks a WiFi stats line into fields. With a separator each field
+// is trimmed of surrounding spaces, so "aa:bb, 10, 20" works, and empty
+// fields at the end of the line, left by a trailing separator, are dropped.
+func (c wifiColumns) split(line string) []string {
+	if c.separator == "" {
+		return strings.Fields(line)
+	}
+	parts := strings.Split(strings.TrimSpace(line), c.separator)
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	for len(parts) > 0 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	return parts
+}
+
+// defaultWiFiColumns is "MAC RX TX [interface [connected time [signal
+// [noise]]]]".
+var defaultWiFiColumns = wifiColumns{mac: 0, rx: 1, tx: 2, iface: 3, connectedTime: 4, signal: 5, noise: 6, minFields: 3, maxFields: 7}
+
+// newWiFiColumns builds a layout from column names in field order: "mac",
+// "rx" and "tx" are required, "interface", "connected_time", "signal" and
+// "noise" optional, and "-" marks a field to ignore. Optional columns must
+// come after the required ones and may be missing from a line.
+func newWiFiColumns(names []string) (wifiColumns, error) {
+	c := wifiColumns{mac: -1, rx: -1, tx: -1, iface: -1, connectedTime: -1, signal: -1, noise: -1, maxFields: len(names)}
+	for i, name := range names {
+		var index *int
+		switch name {
+		case "mac":
+			index = &c.mac
+		case "rx":
+			index = &c.rx
+		case "tx":
+			index = &c.tx
+		case "interface":
+			index = &c.iface
+		case "connected_time":
+			index = &c.connectedTime
+		case "signal":
+			index = &c.signal
+		case "noise":
+			index = &c.noise
+		case "-":
+			continue
+		default:
+			return c, fmt.Errorf("unknown column '%s', expected mac, rx, tx, interface, connected_time, signal, noise or -", name)
+		}
+		if *index != -1 {
+			return c, fmt.Errorf("column '%s' is listed twice", name)
+		}
+		*index = i
+	}
+	if c.mac == -1 || c.rx == -1 || c.tx == -1 {
+		return c, fmt.Errorf("columns must include mac, rx and tx")
+	}
+
+	for _, index := range []int{c.mac, c.rx, c.tx} {
+		if index+1 > c.minFields {
+			c.minFields = index + 1
+		}
+	}
+	for _, index := range []int{c.iface, c.connectedTime, c.signal, c.noise} {
+		if index != -1 && index < c.minFields {
+			return c, fmt.Errorf("optional columns must come after mac, rx and tx")
+		}
+	}
+	return c, nil
+}
+
+// parseWiFiStatsColumns is parseWiFiStats for a router-specific column
+// layout.
+func parseWiFiStatsColumns(data string, columns wifiColumns) ([]ClientStats, WiFiParseSummary, error) {
+	var summary WiFiParseSummary
+	if data == "" {
+		return nil, summary, nil
+	}
+
+	var clients []ClientStats
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	for _, line := range lines {
+		parts := columns.split(line)
+		if len(parts) >= columns.minFields && len(parts) <= columns.maxFields {
+			macAddress, ipAddress, ok := columns.clientKey(parts[columns.mac])
+			if !ok {
+				debugf("Warning: Skipping WiFi stats line with invalid %s: '%s'\n", columns.keyName(), line)
+				summary.skipUnparsed(line, parts, columns)
+				continue
+			}
+			rxBytes, err := strconv.ParseInt(parts[columns.rx], 10, 64)
+			if err != nil {
+				debugf("Error parsing RX bytes for line '%s': %v\n", line, err)
+				summary.skip(line)
+				continue
+			}
+			txBytes, err := strconv.ParseInt(parts[columns.tx], 10, 64)
+			if err != nil {
+				debugf("Error parsing TX bytes for line '%s': %v\n", line, err)
+				summary.skip(line)
+				continue
+			}
+			client := ClientStats{
+				MACAddress: macAddress,
+				IPAddress:  ipAddress,
+				RXBytes:    rxBytes,
+				TXBytes:    txBytes,
+			}
+			if columns.iface != -1 && columns.iface < len(parts) {
+				client.Interface = parts[columns.iface]
+			}
+			if columns.connectedTime != -1 && columns.connectedTime < len(parts) {
+				connectedTime, err := strconv.ParseInt(parts[columns.connectedTime], 10, 64)
+				if err != nil {
+					debugf("Error parsing connected time for line '%s': %v\n", line, err)
+					summary.skipUnparsed(line, parts, columns)
+					continue
+				}
+				client.ConnectedTime = connectedTime
+				client.HasConnectedTime = true
+			}
+			// RF figures are extras: one that doesn't parse is dropped
+			// but the line's traffic still counts.
+			if columns.signal != -1 && columns.signal < len(parts) {
+				if signal, err := strconv.Atoi(parts[columns.signal]); err == nil {
+					client.Signal, client.HasSignal = signal, true
+				} else {
+					debugf("Ignoring signal for line '%s': %v\n", line, err)
+				}
+			}
+			if columns.noise != -1 && columns.noise < len(parts) {
+				if noise, err := strconv.Atoi(parts[columns.noise]); err == nil {
+					client.Noise, client.HasNoise = noise, true
+				} else {
+					debugf("Ignoring noise for line '%s': %v\n", line, err)
+				}
+			}
+			clients = append(clients, client)
+			summary.Parsed++
+		} else {
+			debugf("Warning: Skipping malformed WiFi stats line: '%s'\n", line)
+			summary.skip(line)
+		}
+	}
+
+	if float64(summary.Skipped) > WIFI_SKIP_THRESHOLD*float64(summary.Lines()) {
+		return clients, summary, fmt.Errorf("%d/%d WiFi lines failed to parse, the stats format may have changed", summary.Skipped, summary.Lines())
+	}
+	return clients, summary, nil
+}
+
+// parseWANStats extracts the WAN RX/TX counters from data using re, which
+// must have two capture groups (RX, then TX). A nil re uses the default
+// "wan: RX TX" pattern.
+func parseWANStats(data string, re *regexp.Regexp) (*WANStats, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	if re == nil {
+		re = defaultWANPattern
+	}
+	match := re.FindStringSubmatch(data)
+
+	if len(match) == 3 {
+		rxBytes, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing WAN RX bytes from data '%s': %w", data, err)
+		}
+		txBytes, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing WAN TX bytes from data '%s': %w", data, err)
+		}
+		return &WANStats{
+			RXBytes: rxBytes,
+			TXBytes: txBytes,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("WAN stats pattern not found in data: '%s'", data)
+}
+
+// parseWAN6Stats extracts the "wan6: RX TX" counters from data. Unlike
+// parseWANStats it returns nil without an error when they are missing, since
+// most routers don't report IPv6 separately.
+func parseWAN6Stats(data string) (*WANStats, error) {
+	if !defaultWAN6Pattern.MatchString(data) {
+		return nil, nil
+	}
+	return parseWANStats(data, defaultWAN6Pattern)
+}
+
+// Kinds of DHCP client identifier reported by normalizeClientID.
+const (
+	CLIENT_ID_NONE     = "none"
+	CLIENT_ID_SAME_MAC = "same_mac"
+	CLIENT_ID_MAC      = "mac"
+	CLIENT_ID_RFC4361  = "rfc4361"
+	CLIENT_ID_TEXT     = "text"
+	CLIENT_ID_HEX      = "hex"
+)
+
+// normalizeClientID classifies a dnsmasq client id (colon-separated hex, or
+// "*" when the client sent none) and returns a readable value for it:
+//
+//	01:aa:bb:cc:dd:ee:ff          -> mac, "aa:bb:cc:dd:ee:ff" (type 1 = Ethernet)
+//	ff:<4-byte IAID>:<DUID>       -> rfc4361, "iaid=<hex> duid=<hex>"
+//	printable ASCII bytes         -> text, the decoded string
+//	anything else                 -> hex, the id lowercased
+func normalizeClientID(raw string) (kind, value string) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if raw == "" || raw == "*" {
+		return CLIENT_ID_NONE, ""
+	}
+
+	var octets []byte
+	for _, part := range strings.Split(raw, ":") {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return CLIENT_ID_HEX, raw
+		}
+		octets = append(octets, byte(b))
+	}
+
+	switch {
+	case len(octets) == 7 && octets[0] == 1:
+		return CLIENT_ID_MAC, net.HardwareAddr(octets[1:]).String()
+	case len(octets) > 5 && octets[0] == 0xff:
+		parts := strings.Split(raw, ":")
+		return CLIENT_ID_RFC4361, fmt.Sprintf("iaid=%s duid=%s", strings.Join(parts[1:5], ""), strings.Join(parts[5:], ""))
+	}
+
+	for _, b := range octets {
+		if b < 0x20 || b > 0x7e {
+			return CLIENT_ID_HEX, raw
+		}
+	}
+	return CLIENT_ID_TEXT, string(octets)
+}
+
+// ipv4LeasePattern matches the usual dnsmasq lease line: expiry, MAC, IP,
+// hostname and a hex client id.
+var ipv4LeasePattern = regexp.MustCompile(
+	`^(\d+)\s+([0-9a-fA-F:]{17})\s+([\d\.]+)\s+(.*?)\s+([\d0-9a-fA-F:]+)$`,
+)
+
+// parseDHCPLeases returns the leases it could parse and the raw lines it
+// skipped. Lines the strict pattern rejects, such as a `*` client id or a
+// missing trailing field, are retried with parseLeaseFields.
+func parseDHCPLeases(data string) ([]DHCPLease, []string, error) {
+	if data == "" {
+		return nil, nil, nil
+	}
+
+	var leases []DHCPLease
+	var skipped []string
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+
+	for _, line := range lines {
+		match := ipv4LeasePattern.FindStringSubmatch(line)
+		if len(match) == 6 {
+			leaseEndTime, err := strconv.ParseInt(match[1], 10, 64)
+			if err != nil {
+				debugf("Error parsing lease end time for line '%s': %v\n", line, err)
+				skipped = append(skipped, line)
+				continue
+			}
+			if ip, ok := canonicalIPv4(match[3]); ok {
+				leases = append(leases, newDHCPLease(leaseEndTime, strings.ToLower(match[2]), ip, match[4], match[5]))
+				continue
+			}
+		}
+		if lease, ok := parseLeaseFields(line); ok {
+			leases = append(leases, lease)
+		} else {
+			debugf("Warning: Skipping malformed DHCP lease line: '%s'\n", line)
+			skipped = append(skipped, line)
+		}
+	}
+	return leases, skipped, nil
+}
+
+// parseLeaseFields splits a lease line on whitespace. The first three fields
+// must be the expiry, a MAC and an IPv4 address; after those, the first token
+// is the hostname and the last, if there are two or more, the client id.
+// Either may be `*` or `-`.
+func parseLeaseFields(line string) (DHCPLease, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return DHCPLease{}, false
+	}
+	leaseEndTime, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return DHCPLease{}, false
+	}
+	macAddress, ok := normalizeMAC(fields[1])
+	if !ok {
+		return DHCPLease{}, false
+	}
+	ip, ok := canonicalIPv4(fields[2])
+	if !ok {
+		return DHCPLease{}, false
+	}
+
+	var hostname, clientID string
+	rest := fields[3:]
+	if len(rest) > 0 {
+		hostname = rest[0]
+	}
+	if len(rest) > 1 {
+		clientID = rest[len(rest)-1]
+	}
+	return newDHCPLease(leaseEndTime, macAddress, ip, hostname, clientID), true
+}
+
+// newDHCPLease builds a lease from its raw fields, turning placeholder
+// hostnames into UNKNOWN_HOSTNAME and classifying the client id.
+func newDHCPLease(leaseEndTime int64, macAddress, ipAddress, hostname, clientID string) DHCPLease {
+	hostname = leaseHostname(hostname)
+	if clientID == "" || clientID == "-" {
+		clientID = "*"
+	}
+
+	clientIDKind, clientIDValue := normalizeClientID(clientID)
+	if clientIDKind == CLIENT_ID_MAC && clientIDValue == macAddress {
+		clientIDKind, clientIDValue = CLIENT_ID_SAME_MAC, ""
+	}
+
+	return DHCPLease{
+		MACAddress:    macAddress,
+		LeaseEndTime:  leaseEndTime,
+		IPAddress:     ipAddress,
+		Hostname:      hostname,
+		ClientID:      clientID,
+		ClientIDKind:  clientIDKind,
+		ClientIDValue: clientIDValue,
+	}
+}
+
+// leaseHostname keeps the first word of a lease's hostname and turns the
+// placeholders into UNKNOWN_HOSTNAME.
+func leaseHostname(hostname string) string {
+	if hostnameParts := strings.Fields(hostname); len(hostnameParts) > 0 {
+		hostname = hostnameParts[0]
+	}
+	if hostname == "" || hostname == "*" || hostname == "-" {
+		return UNKNOWN_HOSTNAME
+	}
+	return hostname
+}
+
+// isCounterWrap reports whether a drop from last to current looks like a
+// 32-bit counter rolling over rather than the router restarting: the old
+// value fits in 32 bits and was already close to the top of the range, and
+// the new one is below where it was, less three quarters of the range, so
+// the wrap moved less than a quarter of the range.
+func isCounterWrap(last, current int64) bool {
+	return current < last && last <= COUNTER_32BIT_MAX && last >= COUNTER_32BIT_MAX/4*3 && current < last-COUNTER_32BIT_MAX/4*3
+}
+
+// isCounterReset reports whether a drop from last to current looks like the
+// counter restarted from zero, i.e. the router rebooted: the new value is
+// near zero next to the old one (see COUNTER_RESET_RATIO).
+func isCounterReset(last, current int64) bool {
+	return current < last && !isCounterWrap(last, current) && current < last/COUNTER_RESET_RATIO
+}
+
+// counterIncrement is what a counter moved from last to current. A drop
+// that is neither a wrap nor a reset, such as a glitch in the router's
+// accounting, moved nothing.
+func counterIncrement(last, current int64) int64 {
+	switch {
+	case current >= last:
+		return current - last
+	case isCounterWrap(last, current):
+		return COUNTER_32BIT_MAX - last + 1 + current
+	case isCounterReset(last, current):
+		return current
+	}
+	return 0
+}
+
+// estimateResetTraffic guesses what an entity moved between its previous
+// reading, stamped lastSeen, and now, when a counter reset lost the bytes
+// before the reset. Its most recent traffic_history row is taken as one
+// CYCLE_INTERVAL's worth and scaled to the elapsed time. ok is false when
+// there is no history or no usable lastSeen to go on.
+func estimateResetTraffic(tx *sql.Tx, entityID, lastSeen string, now time.Time) (estimatedRX, estimatedTX int64, ok bool, err error) {
+	seen, parseErr := parseStoredTime(lastSeen)
+	if parseErr != nil || !now.After(seen) {
+		return 0, 0, false, nil
+	}
+	var lastRX, lastTX int64
+	err = tx.QueryRow("SELECT rx_bytes, tx_bytes FROM traffic_history WHERE id = ? ORDER BY timestamp DESC LIMIT 1", entityID).Scan(&lastRX, &lastTX)
+	if err == sql.ErrNoRows {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("error reading traffic history to estimate reset for %s: %w", entityID, err)
+	}
+	scale := float64(now.Sub(seen)) / float64(CYCLE_INTERVAL)
+	return int64(float64(lastRX) * scale), int64(float64(lastTX) * scale), true, nil
+}
+
+// TrafficUpdate is one cumulative counter reading to fold into the monthly
+// totals. Source is the router that reported the reading and Interface the
+// radio a WiFi client was seen on (empty for WAN entities).
+//
+// Per-client counters are kept by each access point, so a reading is diffed
+// against the last one from the same router. Only a router reporting the
+// client for the first time has its counter counted in full.
+type TrafficUpdate struct {
+	EntityID  string
+	Source    string
+	Interface string
+	RXBytes   int64
+	TXBytes   int64
+
+	ConnectedTime    int64
+	HasConnectedTime bool
+
+	Signal    int
+	HasSignal bool
+	Noise     int
+	HasNoise  bool
+
+	// ResetPolicy is the reporting router's reset_policy; empty means
+	// RESET_POLICY_COUNT_NEW.
+	ResetPolicy string
+
+	// Offset is subtracted from the cycle's increment; see TrafficOffset.
+	Offset TrafficOffset
+	// OffsetBy lists entities written earlier in the same batch whose
+	// increments are subtracted too, like Offset, e.g. tunnels that the WAN
+	// counters also carry. Written on its own, the reading isn't offset.
+	OffsetBy []string
+
+	// ReadAt is when the reading was taken, for one held by -flush-every;
+	// zero means now.
+	ReadAt time.Time
+}
+
+// updateTrafficStatsBatch applies several readings in a single transaction,
+// so a router's clients cost one lock acquisition and one commit instead of
+// one each. If any reading fails nothing is written.
+func updateTrafficStatsBatch(db *sql.DB, mutex *sync.Mutex, updates []TrafficUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	return retryBusy("traffic stats", func() error {
+		return writeTrafficStatsBatch(db, mutex, updates)
+	})
+}
+
+func writeTrafficStatsBatch(db *sql.DB, mutex *sync.Mutex, updates []TrafficUpdate) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for traffic stats: %w", err)
+	}
+	defer tx.Rollback()
+
+	increments := make([]trafficIncrement, 0, len(updates))
+	for _, u := range updates {
+		for _, id := range u.OffsetBy {
+			for _, earlier := range increments {
+				if earlier.EntityID == id && !earlier.Baseline {
+					u.Offset.RX += earlier.RXBytes
+					u.Offset.TX += earlier.TXBytes
+				}
+			}
+		}
+		increment, err := applyTrafficUpdate(tx, u)
+		if err != nil {
+			return err
+		}
+		increments = append(increments, increment)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// Only committed increments feed the baselines, since a failed batch
+	// is retried.
+	uploadAnomalies.observe(db, increments)
+	entityWarmup.observe(increments)
+	counterSpikes.observe(increments)
+	cycleRecords.addIncrements(increments)
+	clientPresence.observe(increments)
+	localEvents.publishResets(increments)
+	return nil
+}
+
+// trafficIncrement is what one reading added to an entity's totals. Baseline
+// is set for an entity's first reading and its first from each further
+// router, when the increment is its whole counter rather than one cycle's
+// traffic. Reset is set when the reading found a counter reset. Rejected
+// holds the counters of a reading the spike guard refused, which then added
+// nothing. Source is the router the reading came from.
+type trafficIncrement struct {
+	EntityID string
+	Source   string
+	RXBytes  int64
+	TXBytes  int64
+	Baseline bool
+	Reset    bool
+	Rejected *counterReading
+}
+
+// belowHistoryThreshold reports whether a cycle's increment is too small to
+// be worth a traffic_history row, e.g. an idle device's keepalives. Such
+// increments still count towards the monthly and all-time totals.
+func belowHistoryThreshold(incrementalRX, incrementalTX, minBytes int64) bool {
+	return minBytes > 0 && incrementalRX+incrementalTX < minBytes
+}
+
+func applyTrafficUpdate(tx *sql.Tx, u TrafficUpdate) (trafficIncrement, error) {
+	entityID, source, iface, newRX, newTX := u.EntityID, u.Source, u.Interface, u.RXBytes, u.TXBytes
+	now := u.ReadAt
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var lastRX, lastTX int64
+	var lastSource string
+	var lastConnected sql.NullInt64
+	var lastSeen sql.NullString
+	cumulativeErr := tx.QueryRow("SELECT rx_bytes, tx_bytes, source_router, connected_time, last_seen FROM cumulative_stats WHERE id = ?", entityID).Scan(&lastRX, &lastTX, &lastSource, &lastConnected, &lastSeen)
+	// Each access point keeps its own counter for a client, so a reading
+	// from another router than last time is diffed against that router's
+	// last reading. Only a router reporting the client for the first time
+	// starts a new baseline.
+	if cumulativeErr == nil && entityID != MAIN_WAN_ID && entityID != MAIN_WAN6_ID && lastSource != "" && lastSource != source {
+		debugf("%s reported by %s, last by %s.\n", entityID, source, lastSource)
+		cumulativeErr = tx.QueryRow("SELECT rx_bytes, tx_bytes FROM router_counters WHERE id = ? AND source_router = ?", entityID, source).Scan(&lastRX, &lastTX)
+	}
+
+	var monthlyRX, monthlyTX int64
+	err := tx.QueryRow("SELECT rx_bytes, tx_bytes FROM monthly_stats WHERE id = ?", entityID).Scan(&monthlyRX, &monthlyTX)
+	if err != nil && err != sql.ErrNoRows {
+		return trafficIncrement{}, fmt.Errorf("error reading monthly stats for %s: %w", entityID, err)
+	}
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec(`
+			INSERT INTO monthly_stats (id, rx_bytes, tx_bytes, timestamp)
+			VALUES (?, ?, ?, ?)
+		`, entityID, 0, 0, storedTime(now))
+		if err != nil {
+			return trafficIncrement{}, fmt.Errorf("error initializing monthly stats for %s: %w", entityID, err)
+		}
+	}
+
+	var incrementalRX, incrementalTX int64
+	baseline, reset := false, false
+
+	if cumulativeErr == sql.ErrNoRows {
+		incrementalRX = newRX
+		incrementalTX = newTX
+		baseline = true
+	} else if cumulativeErr != nil {
+		return trafficIncrement{}, fmt.Errorf("error fetching cumulative stats for %s: %w", entityID, cumulativeErr)
+	} else {
+		incrementalRX = counterIncrement(lastRX, newRX)
+		incrementalTX = counterIncrement(lastTX, newTX)
+
+		rxReset, txReset := isCounterReset(lastRX, newRX), isCounterReset(lastTX, newTX)
+		if !rxReset && !txReset && ((newRX < lastRX && !isCounterWrap(lastRX, newRX)) || (newTX < lastTX && !isCounterWrap(lastTX, newTX))) {
+			fmt.Printf("Warning: Counters of %s went down (rx %d -> %d, tx %d -> %d) too little for a reboot; counting nothing for the drop.\n", entityID, lastRX, newRX, lastTX, newTX)
+		}
+		if rxReset || txReset {
+			reset = true
+			fmt.Printf("Counter reset detected for %s (rx %d -> %d, tx %d -> %d), router likely rebooted.\n", entityID, lastRX, newRX, lastTX, newTX)
+			if *recordReboots {
+				_, err = tx.Exec(`
+					INSERT INTO reboot_events (id, detected_at, previous_rx, previous_tx)
+					VALUES (?, ?, ?, ?)
+				`, entityID, storedTime(now), lastRX, lastTX)
+				if err != nil {
+					return trafficIncrement{}, fmt.Errorf("error recording reboot event for %s: %w", entityID, err)
+				}
+			}
+
+			switch u.ResetPolicy {
+			case RESET_POLICY_IGNORE:
+				if rxReset {
+					incrementalRX = 0
+				}
+				if txReset {
+					incrementalTX = 0
+				}
+			case RESET_POLICY_ESTIMATE:
+				estimatedRX, estimatedTX, ok, err := estimateResetTraffic(tx, entityID, lastSeen.String, now)
+				if err != nil {
+					return trafficIncrement{}, err
+				}
+				if ok {
+					debugf("%s: estimated rx %d, tx %d across the reset.\n", entityID, estimatedRX, estimatedTX)
+					if rxReset && estimatedRX > incrementalRX {
+						incrementalRX = estimatedRX
+					}
+					if txReset && estimatedTX > incrementalTX {
+						incrementalTX = estimatedTX
+					}
+				}
+			}
+		}
+	}
+
+	// A rejected reading keeps the previous counters as the baseline, so a
+	// one-off garbage value doesn't make the next reading look like a reset.
+	var rejected *counterReading
+	if !baseline {
+		if reason := counterSpikes.implausible(entityID, incrementalRX, incrementalTX); reason != "" {
+			reading := counterReading{RX: newRX, TX: newTX}
+			if pending, ok := counterSpikes.resumeFrom(entityID, reading); ok {
+				fmt.Printf("Counters of %s carried on from last cycle's rejected reading, counting from it.\n", entityID)
+				incrementalRX, incrementalTX = newRX-pending.RX, newTX-pending.TX
+			} else {
+				fmt.Printf("Warning: Rejected reading for %s (rx %d -> %d, tx %d -> %d): %s.\n", entityID, lastRX, newRX, lastTX, newTX, reason)
+				rejected = &reading
+				incrementalRX, incrementalTX = 0, 0
+				newRX, newTX = lastRX, lastTX
+			}
+		}
+	}
+
+	// A baseline is the whole counter, not one cycle, so there is no
+	// cycle's worth of excluded traffic to take off it.
+	if !baseline && (u.Offset.RX > 0 || u.Offset.TX > 0) {
+		offsetRX, offsetTX := subtractOffset(incrementalRX, u.Offset.RX), subtractOffset(incrementalTX, u.Offset.TX)
+		debugf("%s: offset rx %d -> %d, tx %d -> %d.\n", entityID, incrementalRX, offsetRX, incrementalTX, offsetTX)
+		incrementalRX, incrementalTX = offsetRX, offsetTX
+	}
+
+	// A disabled entity's readings still move its baseline below, so
+	// enabling it again only counts traffic from then on.
+	enabled, err := entityEnabled(tx, entityID)
+	if err != nil {
+		return trafficIncrement{}, err
+	}
+	if !enabled {
+		debugf("%s: disabled, not counting rx %d, tx %d.\n", entityID, incrementalRX, incrementalTX)
+		incrementalRX, incrementalTX = 0, 0
+	}
+
+	if entityWarmup.warmingUp(entityID, baseline || reset, *warmupCycles) {
+		debugf("%s: warming up, not counting rx %d, tx %d.\n", entityID, incrementalRX, incrementalTX)
+		incrementalRX, incrementalTX = 0, 0
+	}
+
+	timestamp := storedTime(now)
+	monthlyRX, monthlyTX = accumulateTotals("monthly_stats", entityID, monthlyRX, monthlyTX, incrementalRX, incrementalTX)
+	_, err = tx.Exec(`
+		UPDATE monthly_stats
+		SET rx_bytes = ?,
+			tx_bytes = ?,
+			timestamp = ?,
+			interface = ?,
+			source_router = ?
+		WHERE id = ?
+	`, monthlyRX, monthlyTX, timestamp, iface, source, entityID)
+	if err != nil {
+		return trafficIncrement{}, fmt.Errorf("error updating monthly stats for %s: %w", entityID, err)
+	}
+
+	if !belowHistoryThreshold(incrementalRX, incrementalTX, *historyMinBytes) {
+		_, err = tx.Exec(`
+			INSERT INTO traffic_history (id, rx_bytes, tx_bytes, timestamp, interface, source_router)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, entityID, incrementalRX, incrementalTX, timestamp, iface, source)
+		if err != nil {
+			return trafficIncrement{}, fmt.Errorf("error recording traffic history for %s: %w", entityID, err)
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR IGNORE INTO alltime_stats (id, rx_bytes, tx_bytes, first_seen, last_seen)
+		VALUES (?, 0, 0, ?, ?)
+	`, entityID, timestamp, timestamp)
+	if err != nil {
+		return trafficIncrement{}, fmt.Errorf("error initializing all-time stats for %s: %w", entityID, err)
+	}
+	var alltimeRX, alltimeTX int64
+	err = tx.QueryRow("SELECT rx_bytes, tx_bytes FROM alltime_stats WHERE id = ?", entityID).Scan(&alltimeRX, &alltimeTX)
+	if err != nil {
+		return trafficIncrement{}, fmt.Errorf("error reading all-time stats for %s: %w", entityID, err)
+	}
+	alltimeRX, alltimeTX = accumulateTotals("alltime_stats", entityID, alltimeRX, alltimeTX, incrementalRX, incrementalTX)
+	_, err = tx.Exec(`
+		UPDATE alltime_stats
+		SET rx_bytes = ?,
+			tx_bytes = ?,
+			last_seen = ?
+		WHERE id = ?
+	`, alltimeRX, alltimeTX, timestamp, entityID)
+	if err != nil {
+		return trafficIncrement{}, fmt.Errorf("error updating all-time stats for %s: %w", entityID, err)
 	}
 
-	return tx.Commit()
+	// A connected time lower than last cycle's on the same AP means the
+	// client dropped off and reassociated in between.
+	var connected interface{}
+	if u.HasConnectedTime {
+		connected = u.ConnectedTime
+		if cumulativeErr == nil && lastConnected.Valid && lastSource == source && u.ConnectedTime < lastConnected.Int64 {
+			debugf("%s reconnected to %s (connected for %ds, was %ds).\n", entityID, source, u.ConnectedTime, lastConnected.Int64)
+			_, err = tx.Exec("UPDATE monthly_stats SET flap_count = flap_count + 1 WHERE id = ?", entityID)
+			if err != nil {
+				return trafficIncrement{}, fmt.Errorf("error counting reconnect for %s: %w", entityID, err)
+			}
+		}
+	}
+
+	// SNR needs both figures; a signal alone is still kept.
+	var signal, noise, snr interface{}
+	if u.HasSignal {
+		signal = u.Signal
+		if u.HasNoise {
+			noise = u.Noise
+			snr = computeSNR(u.Signal, u.Noise)
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO cumulative_stats (id, rx_bytes, tx_bytes, source_router, connected_time, last_seen, signal, noise, snr)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, entityID, newRX, newTX, source, connected, storedTime(now), signal, noise, snr)
+	if err != nil {
+		return trafficIncrement{}, fmt.Errorf("error upserting cumulative stats for %s: %w", entityID, err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO router_counters (id, source_router, rx_bytes, tx_bytes)
+		VALUES (?, ?, ?, ?)
+	`, entityID, source, newRX, newTX)
+	if err != nil {
+		return trafficIncrement{}, fmt.Errorf("error upserting %s's counters for %s: %w", entityID, source, err)
+	}
+	return trafficIncrement{EntityID: entityID, Source: source, RXBytes: incrementalRX, TXBytes: incrementalTX, Baseline: baseline, Reset: reset, Rejected: rejected}, nil
 }
 
-func upsertDHCPLeases(db *sql.DB, mutex *sync.Mutex, leases []DHCPLease) error {
+// upsertDHCPLeases stores leases and returns the MACs whose lease shows a
+// different device, per -device-change-reset.
+func upsertDHCPLeases(db *sql.DB, mutex *sync.Mutex, leases []DHCPLease) ([]deviceChange, error) {
 	if len(leases) == 0 {
-		return nil
+		return nil, nil
+	}
+	var changes []deviceChange
+	err := retryBusy("DHCP leases", func() error {
+		var err error
+		changes, err = writeDHCPLeases(db, mutex, leases)
+		return err
+	})
+	if err == nil {
+		dhcpHostnames.invalidate()
 	}
+	return changes, err
+}
 
+func writeDHCPLeases(db *sql.DB, mutex *sync.Mutex, leases []DHCPLease) ([]deviceChange, error) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
 	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction for DHCP leases: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction for DHCP leases: %w", err)
 	}
 	defer tx.Rollback()
 
 	stmt, err := tx.Prepare(`
-		INSERT OR REPLACE INTO dhcp_leases (mac_address, lease_end_time, ip_address, hostname, client_id, timestamp)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT OR REPLACE INTO dhcp_leases (mac_address, lease_end_time, ip_address, hostname, client_id, client_id_kind, client_id_value, timestamp, expired_notified, hostname_manual)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
-		return fmt.Errorf("failed to prepare statement for DHCP leases: %w", err)
+		return nil, fmt.Errorf("failed to prepare statement for DHCP leases: %w", err)
 	}
 	defer stmt.Close()
 
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	now := time.Now()
+	timestamp := storedTime(now)
+	var events []LeaseEvent
+	var changes []deviceChange
 	for _, lease := range leases {
-		_, err := stmt.Exec(
+		var currentIP, currentHostname, currentClientID string
+		var currentEnd, expiredNotified int64
+		var currentManual bool
+		err := tx.QueryRow("SELECT ip_address, hostname, client_id, lease_end_time, expired_notified, hostname_manual FROM dhcp_leases WHERE mac_address = ?", lease.MACAddress).Scan(&currentIP, &currentHostname, &currentClientID, &currentEnd, &expiredNotified, &currentManual)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("error fetching current DHCP lease for %s: %w", lease.MACAddress, err)
+		}
+		if err == nil {
+			if reason := leaseDeviceChange(lease, currentClientID, currentHostname, currentManual); reason != "" {
+				changes = append(changes, deviceChange{MACAddress: lease.MACAddress, Reason: reason})
+			}
+		}
+		if event, ok := leaseChangeEvent(lease, err == nil, currentEnd, displayTime(now)); ok {
+			events = append(events, event)
+		}
+		// The expired event is only sent again once the lease changes.
+		if err == sql.ErrNoRows || currentEnd != lease.LeaseEndTime {
+			expiredNotified = 0
+		}
+		// Devices often send their name only on some requests; don't let a
+		// nameless renewal overwrite a hostname we already know. A manual
+		// name removed from the config is not kept.
+		if lease.Hostname == UNKNOWN_HOSTNAME && err == nil && !currentManual && currentHostname != "" && currentHostname != UNKNOWN_HOSTNAME {
+			lease.Hostname = currentHostname
+		}
+		if err == sql.ErrNoRows || currentIP != lease.IPAddress || currentHostname != lease.Hostname {
+			_, err = tx.Exec(`
+				INSERT INTO lease_history (mac_address, ip_address, hostname, observed_at)
+				VALUES (?, ?, ?, ?)
+			`, lease.MACAddress, lease.IPAddress, lease.Hostname, timestamp)
+			if err != nil {
+				return nil, fmt.Errorf("error recording lease history for %s: %w", lease.MACAddress, err)
+			}
+		}
+
+		_, err = stmt.Exec(
 			lease.MACAddress,
 			lease.LeaseEndTime,
 			lease.IPAddress,
 			lease.Hostname,
 			lease.ClientID,
+			lease.ClientIDKind,
+			lease.ClientIDValue,
 			timestamp,
+			expiredNotified,
+			lease.HostnameManual,
 		)
 		if err != nil {
-			return fmt.Errorf("error upserting DHCP lease for %s: %w", lease.MACAddress, err)
+			return nil, fmt.Errorf("error upserting DHCP lease for %s: %w", lease.MACAddress, err)
 		}
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	leaseEvents.send(events)
+	cycleRecords.addLeaseEvents(events)
+	localEvents.publishLeases(events)
+	return changes, nil
 }
 
-func main() {
-	for {
-		fmt.Println("Starting data collection cycle...")
-		routers, err := loadConfig(CONFIG_FILE)
+// pruneStaleEntities deletes the cumulative_stats and router_counters rows,
+// and with monthly also the monthly_stats rows, of entities last seen more
+// than days ago. An entity that comes back later starts again from a fresh
+// baseline.
+func pruneStaleEntities(db *sql.DB, mutex *sync.Mutex, days int, monthly bool) (map[string]int64, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	cutoff := storedTime(time.Now().AddDate(0, 0, -days))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction for pruning stale entities: %w", err)
+	}
+	defer tx.Rollback()
+
+	pruned := map[string]int64{}
+	if monthly {
+		res, err := tx.Exec("DELETE FROM monthly_stats WHERE id IN (SELECT id FROM cumulative_stats WHERE last_seen < ?)", cutoff)
 		if err != nil {
-			fmt.Printf("Failed to load configuration: %v\n", err)
-			time.Sleep(30 * time.Minute)
-			continue
+			return nil, fmt.Errorf("error pruning stale monthly stats: %w", err)
 		}
-		if len(routers) == 0 {
-			fmt.Println("No routers configured. Exiting this cycle, will retry in 30 minutes.")
-			time.Sleep(30 * time.Minute)
-			continue
+		if pruned["monthly_stats"], err = res.RowsAffected(); err != nil {
+			return nil, fmt.Errorf("error pruning stale monthly stats: %w", err)
 		}
+	}
+	res, err := tx.Exec("DELETE FROM cumulative_stats WHERE last_seen < ?", cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("error pruning stale cumulative stats: %w", err)
+	}
+	if pruned["cumulative_stats"], err = res.RowsAffected(); err != nil {
+		return nil, fmt.Errorf("error pruning stale cumulative stats: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM router_counters WHERE id NOT IN (SELECT id FROM cumulative_stats)")
+	if err != nil {
+		return nil, fmt.Errorf("error pruning stale router counters: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing stale entity pruning: %w", err)
+	}
+	if pruned["cumulative_stats"] > 0 {
+		fmt.Printf("Pruned %d entities not seen since %s.\n", pruned["cumulative_stats"], cutoff)
+	}
+	return pruned, nil
+}
+
+// HISTORY_PRUNE_BATCH is how many traffic_history rows pruneTrafficHistory
+// deletes per transaction.
+const HISTORY_PRUNE_BATCH = 5000
 
-		connStats, err := connectDB(STATS_DB_NAME)
+// pruneTrafficHistory deletes the traffic_history rows older than days. The
+// rows go in batches of HISTORY_PRUNE_BATCH, each in its own transaction, so
+// a large backlog (say, the first run after an upgrade) never holds the
+// write lock for long.
+func pruneTrafficHistory(db *sql.DB, mutex *sync.Mutex, days int) (int64, error) {
+	cutoff := storedTime(time.Now().AddDate(0, 0, -days))
+
+	var pruned int64
+	for {
+		n, err := pruneTrafficHistoryBatch(db, mutex, cutoff)
 		if err != nil {
-			fmt.Printf("Failed to connect to stats database: %v\n", err)
-			time.Sleep(30 * time.Minute)
-			continue
+			return pruned, err
+		}
+		pruned += n
+		if n < HISTORY_PRUNE_BATCH {
+			break
+		}
+	}
+	if pruned > 0 {
+		fmt.Printf("Pruned %d traffic history rows from before %s.\n", pruned, cutoff)
+	}
+	return pruned, nil
+}
+
+func pruneTrafficHistoryBatch(db *sql.DB, mutex *sync.Mutex, cutoff string) (int64, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction for pruning traffic history: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM traffic_history WHERE rowid IN (SELECT rowid FROM traffic_history WHERE timestamp < ? LIMIT ?)", cutoff, HISTORY_PRUNE_BATCH)
+	if err != nil {
+		return 0, fmt.Errorf("error pruning traffic history: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error pruning traffic history: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing traffic history pruning: %w", err)
+	}
+	return n, nil
+}
+
+// updateTotalStats recomputes the TOTAL_ID row in monthly_stats from this
+// month's WAN totals (IPv4 only unless -total-wan6 is set), or from every
+// WiFi client's, including any UNPARSED_ID entities, when source is
+// TOTAL_SOURCE_CLIENTS. The row is replaced rather than incremented, so it
+// always equals the sum of the real entities.
+func updateTotalStats(db *sql.DB, mutex *sync.Mutex, source string) error {
+	where, err := totalCondition(source)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for total stats: %w", err)
+	}
+	defer tx.Rollback()
+
+	var rxBytes, txBytes int64
+	err = tx.QueryRow("SELECT COALESCE(SUM(rx_bytes), 0), COALESCE(SUM(tx_bytes), 0) FROM monthly_stats WHERE "+where).Scan(&rxBytes, &txBytes)
+	if err != nil {
+		return fmt.Errorf("error summing monthly stats for %s: %w", TOTAL_ID, err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO monthly_stats (id, rx_bytes, tx_bytes, timestamp, interface, source_router, flap_count)
+		VALUES (?, ?, ?, ?, '', '', 0)
+	`, TOTAL_ID, rxBytes, txBytes, storedTime(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error storing %s: %w", TOTAL_ID, err)
+	}
+
+	return tx.Commit()
+}
+
+// totalCondition is the SQL condition on an id column selecting the
+// entities TOTAL_ID sums for source.
+func totalCondition(source string) (string, error) {
+	switch source {
+	case TOTAL_SOURCE_WAN:
+		if *totalWAN6 {
+			return "id IN ('" + MAIN_WAN_ID + "', '" + MAIN_WAN6_ID + "')", nil
 		}
-		defer connStats.Close()
+		return "id = '" + MAIN_WAN_ID + "'", nil
+	case TOTAL_SOURCE_CLIENTS:
+		return "NOT " + wanCondition("id") + " AND NOT " + tunnelCondition("id") + " AND (substr(id, 1, 2) != '" + SYNTHETIC_ID_PREFIX + "' OR substr(id, 1, " + strconv.Itoa(len(UNPARSED_ID)) + ") = '" + UNPARSED_ID + "')", nil
+	}
+	return "", fmt.Errorf("unknown total source '%s'", source)
+}
+
+// runInitDB creates or upgrades the tables in both databases. It is safe to
+// run repeatedly.
+func runInitDB() error {
+	connStats, err := connectDB(*statsDBPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to stats database: %w", err)
+	}
+	defer connStats.Close()
+	if err := setupStatsDB(connStats); err != nil {
+		return fmt.Errorf("failed to set up stats database: %w", err)
+	}
 
-		connDHCP, err := connectDB(DHCP_DB_NAME)
+	connDHCP := connStats
+	if *dhcpDBPath != *statsDBPath {
+		connDHCP, err = connectDB(*dhcpDBPath)
 		if err != nil {
-			fmt.Printf("Failed to connect to DHCP database: %v\n", err)
-			time.Sleep(30 * time.Minute)
-			continue
+			return fmt.Errorf("failed to connect to DHCP database: %w", err)
 		}
 		defer connDHCP.Close()
+	}
+	if err := setupDHCPDB(connDHCP); err != nil {
+		return fmt.Errorf("failed to set up DHCP database: %w", err)
+	}
+
+	for _, db := range []struct {
+		conn      *sql.DB
+		path      string
+		component string
+	}{
+		{connStats, *statsDBPath, "stats"},
+		{connDHCP, *dhcpDBPath, "dhcp"},
+	} {
+		version, err := schemaVersion(db.conn, db.component)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s schema at version %d.\n", db.path, db.component, version)
+	}
+	return nil
+}
 
-		var dbMutex sync.Mutex
+// pruneArchiveNow runs pruneMonthlyArchive in a transaction of its own,
+// outside the monthly reset.
+func pruneArchiveNow(db *sql.DB, mutex *sync.Mutex, months int) (int64, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
 
-		if err := setupStatsDB(connStats); err != nil {
-			fmt.Printf("Failed to set up stats database: %v\n", err)
-			time.Sleep(30 * time.Minute)
-			continue
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction for archive pruning: %w", err)
+	}
+	defer tx.Rollback()
+
+	pruned, err := pruneMonthlyArchive(tx, months, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing archive pruning: %w", err)
+	}
+	return pruned, nil
+}
+
+// runPrune applies the configured retention settings (-prune-stale-days,
+// -archive-months and -history-retention-days) once and reports the rows
+// removed from each table. It takes dbMutex like the daemon's own pruning,
+// and SQLite's locking keeps it safe to run while the daemon is collecting.
+func runPrune() error {
+	if *pruneStaleDays <= 0 && *archiveMonths <= 0 && *historyRetention <= 0 {
+		fmt.Println("Nothing to prune: set -prune-stale-days, -archive-months and/or -history-retention-days to choose what to remove.")
+		return nil
+	}
+
+	connStats, err := connectDB(*statsDBPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to stats database: %w", err)
+	}
+	defer connStats.Close()
+	if err := setupStatsDB(connStats); err != nil {
+		return fmt.Errorf("failed to set up stats database: %w", err)
+	}
+
+	pruned := map[string]int64{}
+	if *pruneStaleDays > 0 {
+		stale, err := pruneStaleEntities(connStats, &dbMutex, *pruneStaleDays, *pruneStaleMonthly)
+		if err != nil {
+			return err
 		}
-		if err := setupDHCPDB(connDHCP); err != nil {
-			fmt.Printf("Failed to set up DHCP database: %v\n", err)
-			time.Sleep(30 * time.Minute)
-			continue
+		for table, n := range stale {
+			pruned[table] += n
 		}
+	}
+	if *archiveMonths > 0 {
+		n, err := pruneArchiveNow(connStats, &dbMutex, *archiveMonths)
+		if err != nil {
+			return err
+		}
+		pruned["monthly_archive"] = n
+	}
+	if *historyRetention > 0 {
+		n, err := pruneTrafficHistory(connStats, &dbMutex, *historyRetention)
+		if err != nil {
+			return err
+		}
+		pruned["traffic_history"] = n
+	}
+
+	tables := make([]string, 0, len(pruned))
+	for table := range pruned {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		fmt.Printf("%s: %d rows removed.\n", table, pruned[table])
+	}
+	return nil
+}
+
+// runDryRun fetches and parses every configured router once, logging what
+// would have been stored. It never opens the databases.
+func runDryRun() {
+	fmt.Println("Dry run: fetching and parsing only, nothing will be written.")
+	routers, err := loadRouters()
+	if err != nil {
+		fmt.Printf("Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if len(routers) == 0 {
+		fmt.Println("No routers configured.")
+		return
+	}
 
-		if err := resetMonthlyStats(connStats, &dbMutex); err != nil {
-			fmt.Printf("Failed to reset monthly stats: %v\n", err)
+	for routerIP, urls := range routers {
+		processRouter(routerIP, urls, nil, nil)
+	}
+	fmt.Println("Dry run complete.")
+}
+
+func main() {
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if err := setTimezone(*timezone); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := setByteUnits(*byteUnits); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := startSyslog(*syslogAddr, *syslogFacility); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *verifyOnly {
+		os.Exit(runVerify())
+	}
+	if *selfTest {
+		if !runSelfTest() {
+			os.Exit(1)
 		}
+		return
+	}
+	if *dryRun {
+		*verbose = true
+		runDryRun()
+		return
+	}
 
-		var wg sync.WaitGroup
+	if err := applyDataDir(*dataDir); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	*statsDBPath = resolveDBPath(*statsDBPath, "network_stats")
+	if *singleDB {
+		// Both sets of tables live in the stats database and share its
+		// connection.
+		*dhcpDBPath = *statsDBPath
+	} else {
+		*dhcpDBPath = resolveDBPath(*dhcpDBPath, "dhcp_leases")
+	}
 
-		for routerIP, urls := range routers {
-			wg.Add(1)
-			go func(routerIP string, urls RouterConfig) {
-				defer wg.Done()
+	fmt.Printf("Starting %s.\n", versionString())
 
-				fmt.Printf("Processing router: %s\n", routerIP)
+	if *totalSource != TOTAL_SOURCE_WAN && *totalSource != TOTAL_SOURCE_CLIENTS {
+		fmt.Printf("Invalid -total-source '%s': expected %s or %s.\n", *totalSource, TOTAL_SOURCE_WAN, TOTAL_SOURCE_CLIENTS)
+		os.Exit(1)
+	}
 
-				apData, err := fetchData(urls.APStatsURL)
-				if err != nil {
-					if err != ErrURLEmpty {
-						fmt.Printf("Error fetching AP stats for %s: %v\n", routerIP, err)
-					}
-				} else {
-					clients, err := parseWiFiStats(apData)
-					if err != nil {
-						fmt.Printf("Error parsing WiFi stats for %s: %v\n", routerIP, err)
-					} else if len(clients) > 0 {
-						for _, client := range clients {
-							if err := updateTrafficStats(connStats, &dbMutex, client.MACAddress, client.RXBytes, client.TXBytes); err != nil {
-								fmt.Printf("Error updating traffic stats for client %s (%s): %v\n", client.MACAddress, routerIP, err)
-							}
-						}
-					} else {
-						fmt.Printf("No WiFi client data found for %s.\n", routerIP)
-					}
-				}
+	if *anomalyFactor < 0 || (*anomalyFactor > 0 && *anomalyFactor <= 1) {
+		fmt.Printf("Invalid -anomaly-factor %g: expected 0 to disable or a value above 1.\n", *anomalyFactor)
+		os.Exit(1)
+	}
+	if *anomalyWindow < ANOMALY_MIN_SAMPLES {
+		fmt.Printf("Invalid -anomaly-window %d: expected at least %d cycles.\n", *anomalyWindow, ANOMALY_MIN_SAMPLES)
+		os.Exit(1)
+	}
 
-				wanData, err := fetchData(urls.WANStatsURL)
-				if err != nil {
-					if err != ErrURLEmpty {
-						fmt.Printf("Error fetching WAN stats for %s: %v\n", routerIP, err)
-					}
-				} else {
-					wan, err := parseWANStats(wanData)
-					if err != nil {
-						fmt.Printf("Error parsing WAN stats for %s: %v\n", routerIP, err)
-					} else if wan != nil {
-						if err := updateTrafficStats(connStats, &dbMutex, "main_wan", wan.RXBytes, wan.TXBytes); err != nil {
-							fmt.Printf("Error updating traffic stats for main_wan (%s): %v\n", routerIP, err)
-						}
-					} else {
-						fmt.Printf("No WAN data found for %s.\n", routerIP)
-					}
-				}
+	if *spikeFactor < 0 || (*spikeFactor > 0 && *spikeFactor <= 1) {
+		fmt.Printf("Invalid -spike-factor %g: expected 0 to disable or a value above 1.\n", *spikeFactor)
+		os.Exit(1)
+	}
 
-				dhcpData, err := fetchData(urls.DHCPLeasesURL)
-				if err != nil {
-					if err != ErrURLEmpty {
-						fmt.Printf("Error fetching DHCP leases for %s: %v\n", routerIP, err)
-					}
-				} else {
-					leases, err := parseDHCPLeases(dhcpData)
-					if err != nil {
-						fmt.Printf("Error parsing DHCP leases for %s: %v\n", routerIP, err)
-					} else if len(leases) > 0 {
-						if err := upsertDHCPLeases(connDHCP, &dbMutex, leases); err != nil {
-							fmt.Printf("Error upserting DHCP leases for %s: %v\n", routerIP, err)
-						}
-					} else {
-						fmt.Printf("No DHCP lease data found for %s.\n", routerIP)
-					}
-				}
-			}(routerIP, urls)
+	if *flushEvery < 1 {
+		fmt.Printf("Invalid -flush-every %d: expected 1 or more.\n", *flushEvery)
+		os.Exit(1)
+	}
+	if *deadline < 0 || (*deadline > 0 && !*once) {
+		fmt.Printf("Invalid -deadline %s: expected a positive duration, with -once.\n", *deadline)
+		os.Exit(1)
+	}
+	if *writerQueue < 1 {
+		fmt.Printf("Invalid -writer-queue %d: expected 1 or more.\n", *writerQueue)
+		os.Exit(1)
+	}
+	if *presenceIdleCycles < 1 {
+		fmt.Printf("Invalid -presence-idle-cycles %d: expected 1 or more.\n", *presenceIdleCycles)
+		os.Exit(1)
+	}
+	if *qualitySkipJump <= 0 || *qualitySkipJump > 1 {
+		fmt.Printf("Invalid -quality-skip-jump %g: expected more than 0 and at most 1.\n", *qualitySkipJump)
+		os.Exit(1)
+	}
+
+	if triggers, err := parseDeviceResetTriggers(*deviceChangeReset); err != nil {
+		fmt.Printf("Invalid -device-change-reset: %v\n", err)
+		os.Exit(1)
+	} else {
+		deviceResetTriggers = triggers
+	}
+
+	if *proxyURL != "" {
+		if _, err := parseProxyURL(*proxyURL); err != nil {
+			fmt.Printf("Invalid -proxy: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *walMode {
+		for _, path := range []string{*statsDBPath, *dhcpDBPath} {
+			if err := enableWAL(path); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if *initDB {
+		if err := runInitDB(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *importFile != "" {
+		if err := runImport(*importFile, *importPolicy); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *repair {
+		if err := runRepair(*repairApply); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *pruneNow || *vacuumNow {
+		if *pruneNow {
+			if err := runPrune(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		if *vacuumNow {
+			if err := vacuumDatabases(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	if err := writePIDFile(*pidFile); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	handleShutdownSignals(*pidFile, *shutdownTimeout)
+
+	if *deadLetterFile != "" {
+		deadLetters = newDeadLetterWriter(*deadLetterFile)
+	}
+	if *snapshotFile != "" {
+		snapshots = newSnapshotWriter(*snapshotFile, *snapshotDaily, *snapshotMaxSize)
+	}
+	if *leaseWebhookURL != "" {
+		leaseEvents = newWebhook("Lease", *leaseWebhookURL)
+	}
+	if *eventSocket != "" {
+		stream, err := listenEventSocket(*eventSocket)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		localEvents = stream
+	}
+	if *anomalyFactor > 0 {
+		var notify *webhook
+		if *anomalyWebhookURL != "" {
+			notify = newWebhook("Anomaly", *anomalyWebhookURL)
+		}
+		uploadAnomalies = newUploadDetector(*anomalyFactor, *anomalyMinBytes, *anomalyWindow, notify)
+	}
+	if *maxCycleIncrement > 0 || *spikeFactor > 0 {
+		counterSpikes = newSpikeGuard(*maxCycleIncrement, *spikeFactor, *spikeMinBytes)
+	}
+	if *presence {
+		clientPresence = newPresenceTracker(*presenceMinBytes, *presenceIdleCycles)
+	}
+	if *flushEvery > 1 {
+		pendingWrites = newWriteBuffer(*flushEvery)
+	}
+	if *pushURL != "" {
+		push := newWebhook("Push", *pushURL)
+		push.headers = pushHeaders
+		exporters = append(exporters, push)
+	}
+	if *statusFile != "" {
+		exporters = append(exporters, statusFileExporter{path: *statusFile})
+	}
+	if len(exporters) > 0 {
+		cycleRecords = &cycleRecorder{}
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	if *once {
+		code := runOnce()
+		removePIDFile(*pidFile)
+		os.Exit(code)
+	}
+	if err := startHTTPServer(*listenAddr, *tlsCert, *tlsKey); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	startBackupSchedule(*backupDir, *backupInterval, *backupKeep)
+	startVacuumSchedule(*vacuumInterval)
+	startQualityReports(*qualityInterval)
+
+	ready := false
+	if *delayFirst {
+		// systemd would give up waiting for a readiness notification
+		// that only comes after a full interval.
+		sdNotify("READY=1")
+		ready = true
+		sleep := cycleSleep()
+		fmt.Printf("Waiting %s before the first data collection cycle...\n", sleep.Round(time.Second))
+		watchdogSleep(sleep)
+	}
+	for {
+		fmt.Println("Starting data collection cycle...")
+		summary, err := runCycle(*routerJitter)
+		if errors.Is(err, ErrCollectionPaused) {
+			// Paused is a deliberate state, not a failure, so the
+			// service still counts as started.
+			if !ready {
+				sdNotify("READY=1")
+				ready = true
+			}
+			sleep := cycleSleep()
+			fmt.Printf("Skipping data collection cycle: %v. Checking again in %s.\n", err, sleep.Round(time.Second))
+			watchdogSleep(sleep)
+			continue
+		}
+		if err != nil {
+			sleep := CYCLE_INTERVAL
+			if errors.Is(err, ErrNoDatabases) {
+				sleep = *setupRetrySleep
+			}
+			if errors.Is(err, ErrConfigLoad) || err == ErrNoRouters {
+				sleep = configRetryInterval(*configRetrySleep)
+			}
+			if err == ErrNoRouters {
+				fmt.Printf("No routers configured. Exiting this cycle, will retry in %s.\n", sleep)
+			} else {
+				fmt.Printf("Data collection cycle failed: %v. Retrying in %s.\n", err, sleep)
+			}
+			watchdogSleep(sleep)
+			continue
 		}
 
-		wg.Wait()
-		fmt.Println("Data collection cycle complete. Sleeping for 30 minutes...")
-		time.Sleep(30 * time.Minute)
+		if !ready {
+			sdNotify("READY=1")
+			ready = true
+		}
+		sleep := cycleSleep()
+		fmt.Printf("Data collection cycle complete in %s. Sleeping for %s...\n", summary.Duration, sleep.Round(time.Second))
+		watchdogSleep(sleep)
 	}
 }
@@ -0,0 +1,755 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestStatsDB returns a migrated stats database in a temporary
+// directory, closed when the test ends.
+func openTestStatsDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := connectDB(filepath.Join(t.TempDir(), "network_stats.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := setupStatsDB(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// openTestDHCPDB is openTestStatsDB for the DHCP database.
+func openTestDHCPDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := connectDB(filepath.Join(t.TempDir(), "dhcp_leases.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := setupDHCPDB(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// monthlyTotals returns id's monthly_stats row, or zeros when it has none.
+func monthlyTotals(t testing.TB, db *sql.DB, id string) (int64, int64) {
+	t.Helper()
+	var rx, tx int64
+	err := db.QueryRow("SELECT rx_bytes, tx_bytes FROM monthly_stats WHERE id = ?", id).Scan(&rx, &tx)
+	if err != nil && err != sql.ErrNoRows {
+		t.Fatal(err)
+	}
+	return rx, tx
+}
+
+// storeReadings writes one batch of readings from router, failing the test
+// on error.
+func storeReadings(t testing.TB, db *sql.DB, updates ...TrafficUpdate) {
+	t.Helper()
+	if err := updateTrafficStatsBatch(db, &dbMutex, updates); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCounterIncrement(t *testing.T) {
+	const gb = 1000 * 1000 * 1000
+	for _, tc := range []struct {
+		name          string
+		last, current int64
+		want          int64
+		wrap, reset   bool
+	}{
+		{"growth", 1000, 1500, 500, false, false},
+		{"unchanged", 1000, 1000, 0, false, false},
+		{"32-bit wrap", COUNTER_32BIT_MAX - 99, 50, 150, true, false},
+		{"reboot", 5 * gb, 10 << 20, 10 << 20, false, true},
+		{"32-bit reboot from high up", 3500 * 1000 * 1000, 500 * 1000 * 1000, 500 * 1000 * 1000, false, true},
+		{"small drop", 5 * gb, 4900 * 1000 * 1000, 0, false, false},
+		{"64-bit drop", 1 << 40, 1 << 39, 0, false, false},
+	} {
+		if got := isCounterWrap(tc.last, tc.current); got != tc.wrap {
+			t.Errorf("%s: isCounterWrap = %v, want %v", tc.name, got, tc.wrap)
+		}
+		if got := isCounterReset(tc.last, tc.current); got != tc.reset {
+			t.Errorf("%s: isCounterReset = %v, want %v", tc.name, got, tc.reset)
+		}
+		if got := counterIncrement(tc.last, tc.current); got != tc.want {
+			t.Errorf("%s: counterIncrement = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestOnlyGenuineResetsRecorded(t *testing.T) {
+	old := *recordReboots
+	*recordReboots = true
+	defer func() { *recordReboots = old }()
+
+	db := openTestStatsDB(t)
+	const gb = 1000 * 1000 * 1000
+	for _, rx := range []int64{5 * gb, 4900 * 1000 * 1000, 4950 * 1000 * 1000, 1000} {
+		storeReadings(t, db, TrafficUpdate{EntityID: MAIN_WAN_ID, Source: "r1", RXBytes: rx})
+	}
+
+	// 5 GB baseline, nothing for the small drop, 50 MB, then 1000 after
+	// the reboot.
+	if rx, _ := monthlyTotals(t, db, MAIN_WAN_ID); rx != 5*gb+50*1000*1000+1000 {
+		t.Errorf("monthly rx = %d", rx)
+	}
+	var reboots int
+	if err := db.QueryRow("SELECT COUNT(*) FROM reboot_events").Scan(&reboots); err != nil {
+		t.Fatal(err)
+	}
+	if reboots != 1 {
+		t.Errorf("%d reboot events recorded, want 1", reboots)
+	}
+}
+
+func TestPerRouterBaselines(t *testing.T) {
+	const mac = "aa:bb:cc:dd:ee:01"
+	reading := func(router string, rx int64) TrafficUpdate {
+		return TrafficUpdate{EntityID: mac, Source: router, RXBytes: rx, TXBytes: rx / 2}
+	}
+
+	// A stale entry on r2 lists the client next to its live one on r1
+	// every cycle: each AP's counter is diffed against its own.
+	db := openTestStatsDB(t)
+	for _, rx := range []int64{1000, 1100, 1200} {
+		storeReadings(t, db, reading("r1", rx))
+		storeReadings(t, db, reading("r2", 500))
+	}
+	if rx, tx := monthlyTotals(t, db, mac); rx != 1700 || tx != 850 {
+		t.Errorf("monthly totals listed by two routers = %d/%d, want 1700/850", rx, tx)
+	}
+
+	// Roaming r1 -> r2 -> r1: the return reassociates, so r1's counter
+	// starts again from zero.
+	db = openTestStatsDB(t)
+	for _, u := range []TrafficUpdate{reading("r1", 100), reading("r1", 300), reading("r2", 50), reading("r2", 80), reading("r1", 40), reading("r1", 60)} {
+		storeReadings(t, db, u)
+	}
+	if rx, tx := monthlyTotals(t, db, mac); rx != 440 || tx != 220 {
+		t.Errorf("monthly totals after roaming back = %d/%d, want 440/220", rx, tx)
+	}
+	var routers int
+	if err := db.QueryRow("SELECT COUNT(*) FROM router_counters WHERE id = ?", mac).Scan(&routers); err != nil {
+		t.Fatal(err)
+	}
+	if routers != 2 {
+		t.Errorf("%d routers' counters kept, want 2", routers)
+	}
+}
+
+func TestCustomWANPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		data    string
+		rx, tx  int64
+	}{
+		{"", "lan: 1 2\nwan: 5 6\n", 5, 6},
+		{`eth1:\s+(\d+)\s+(\d+)`, "wan: 1 2\neth1: 7 8\n", 7, 8},
+		{`pppoe-wan\s+rx=(\d+)\s+tx=(\d+)`, "pppoe-wan rx=9 tx=10\n", 9, 10},
+	} {
+		config := Config{"r1": {WANStatsURL: "http://192.168.1.1/wan", WANPattern: tc.pattern}}
+		if err := validateConfig(config); err != nil {
+			t.Errorf("validateConfig(%q): %v", tc.pattern, err)
+			continue
+		}
+		wan, err := parseWANStats(tc.data, config["r1"].wanPattern)
+		if err != nil || wan.RXBytes != tc.rx || wan.TXBytes != tc.tx {
+			t.Errorf("parseWANStats with %q = %+v, %v; want %d/%d", tc.pattern, wan, err, tc.rx, tc.tx)
+		}
+	}
+
+	config := Config{"r1": {WANStatsURL: "http://192.168.1.1/wan", WANPattern: `eth1:\s+(\d+)\s+(\d+)`}}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseWANStats("wan: 5 6\n", config["r1"].wanPattern); err == nil {
+		t.Error("a custom pattern fell back to the default")
+	}
+
+	for _, invalid := range []string{`eth1:\s+(\d+`, `eth1:\s+(\d+)`, `(eth1):\s+(\d+)\s+(\d+)`} {
+		err := validateConfig(Config{"r1": {WANStatsURL: "http://192.168.1.1/wan", WANPattern: invalid}})
+		if err == nil || !strings.Contains(err.Error(), "wan_pattern") {
+			t.Errorf("validateConfig(%q) = %v, want a wan_pattern error", invalid, err)
+		}
+	}
+}
+
+// TestConcurrentNewEntity stores a new id's first readings from many
+// goroutines at once, which must leave exactly one monthly row for it.
+func TestConcurrentNewEntity(t *testing.T) {
+	db := openTestStatsDB(t)
+	const id = "11:22:33:44:55:66"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := TrafficUpdate{EntityID: id, Source: "r1", Interface: "wlan0", RXBytes: int64(100 + i), TXBytes: int64(100 + i)}
+			if err := updateTrafficStatsBatch(db, &dbMutex, []TrafficUpdate{u}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM monthly_stats WHERE id = ?", id).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("%d monthly rows for %s, want 1", rows, id)
+	}
+}
+
+func TestRouterHeaders(t *testing.T) {
+	headers := map[string]string{
+		"Authorization": "Bearer token",
+		"X-API-Key":     "key",
+		"User-Agent":    "netstats-test",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, want := range headers {
+			if got := r.Header.Get(name); got != want {
+				http.Error(w, name+" is "+got, http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Write([]byte("wan: 5 6\n"))
+	}))
+	defer server.Close()
+
+	if data, err := fetchData(RouterConfig{Headers: headers}, server.URL); err != nil || data != "wan: 5 6\n" {
+		t.Errorf("fetch with headers = %q, %v", data, err)
+	}
+	if _, err := fetchData(RouterConfig{}, server.URL); err == nil {
+		t.Error("fetch without the headers was accepted")
+	}
+}
+
+func TestHostnameFlap(t *testing.T) {
+	db := openTestDHCPDB(t)
+	for i, step := range []struct {
+		hostname string
+		want     string
+	}{
+		{"*", UNKNOWN_HOSTNAME},
+		{"phone", "phone"},
+		{"*", "phone"},
+		{"*", "phone"},
+		{"tablet", "tablet"},
+		{"*", "tablet"},
+	} {
+		leases, _, err := parseDHCPLeases("1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 " + step.hostname + " 01:aa:bb:cc:dd:ee:01")
+		if err != nil || len(leases) != 1 {
+			t.Fatalf("step %d: parsed %+v, %v", i, leases, err)
+		}
+		if _, err := upsertDHCPLeases(db, &dbMutex, leases); err != nil {
+			t.Fatal(err)
+		}
+		var hostname string
+		if err := db.QueryRow("SELECT hostname FROM dhcp_leases WHERE mac_address = 'aa:bb:cc:dd:ee:01'").Scan(&hostname); err != nil {
+			t.Fatal(err)
+		}
+		if hostname != step.want {
+			t.Errorf("step %d: hostname %q after a lease naming %q, want %q", i, hostname, step.hostname, step.want)
+		}
+	}
+}
+
+func TestNormalizeClientID(t *testing.T) {
+	for _, tc := range []struct {
+		raw         string
+		kind, value string
+	}{
+		{"01:AA:BB:CC:DD:EE:FF", CLIENT_ID_MAC, "aa:bb:cc:dd:ee:ff"},
+		{"ff:00:00:00:01:00:03:00:01:a8:bb:cc:00:00:01", CLIENT_ID_RFC4361, "iaid=00000001 duid=00030001a8bbcc000001"},
+		{"70:68:6f:6e:65", CLIENT_ID_TEXT, "phone"},
+		{"00:01:02:7f", CLIENT_ID_HEX, "00:01:02:7f"},
+		// Type 1 with the wrong length isn't a MAC.
+		{"01:aa:bb:cc", CLIENT_ID_HEX, "01:aa:bb:cc"},
+		{"*", CLIENT_ID_NONE, ""},
+		{"", CLIENT_ID_NONE, ""},
+		{" * ", CLIENT_ID_NONE, ""},
+		{"01:zz:bb:cc:dd:ee:ff", CLIENT_ID_HEX, "01:zz:bb:cc:dd:ee:ff"},
+		{"01::bb", CLIENT_ID_HEX, "01::bb"},
+		{"100:01", CLIENT_ID_HEX, "100:01"},
+	} {
+		kind, value := normalizeClientID(tc.raw)
+		if kind != tc.kind || value != tc.value {
+			t.Errorf("normalizeClientID(%q) = %s %q, want %s %q", tc.raw, kind, value, tc.kind, tc.value)
+		}
+	}
+}
+
+func TestFetchRedirects(t *testing.T) {
+	old := *maxRedirects
+	defer func() { *maxRedirects = old }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/moved", http.StatusMovedPermanently) })
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/stats", http.StatusFound) })
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("wan: 5 6\n")) })
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, tc := range []struct {
+		maxRedirects int
+		ok           bool
+	}{
+		{0, false},
+		{1, false},
+		{2, true},
+		{3, true},
+	} {
+		*maxRedirects = tc.maxRedirects
+		data, err := fetchData(RouterConfig{}, server.URL+"/old")
+		if tc.ok && (err != nil || data != "wan: 5 6\n") {
+			t.Errorf("-max-redirects %d: fetch = %q, %v; want the final page", tc.maxRedirects, data, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("-max-redirects %d: fetch through 2 redirects = %q, want an error", tc.maxRedirects, data)
+		}
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	old := *maxResponseSize
+	defer func() { *maxResponseSize = old }()
+	*maxResponseSize = 1024
+
+	atLimit := replyWith(t, http.StatusOK, strings.Repeat("x", 1024))
+	oversized := replyWith(t, http.StatusOK, strings.Repeat("x", 1025))
+	if data, err := fetchData(RouterConfig{}, atLimit.URL); err != nil || len(data) != 1024 {
+		t.Errorf("fetch at the limit = %d bytes, %v", len(data), err)
+	}
+	if data, err := fetchData(RouterConfig{}, oversized.URL); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("fetch over the limit = %d bytes, %v; want an error", len(data), err)
+	}
+
+	*maxResponseSize = 0
+	if data, err := fetchData(RouterConfig{}, oversized.URL); err != nil || len(data) != 1025 {
+		t.Errorf("fetch without a limit = %d bytes, %v", len(data), err)
+	}
+}
+
+func TestResetPolicies(t *testing.T) {
+	const mac = "aa:bb:cc:00:00:01"
+	for _, tc := range []struct {
+		policy string
+		want   int64
+	}{
+		{"", 1000 + 50},
+		{RESET_POLICY_COUNT_NEW, 1000 + 50},
+		{RESET_POLICY_IGNORE, 1000},
+		// The last cycle's 1000 scaled to the hour since the last reading.
+		{RESET_POLICY_ESTIMATE, 1000 + 2000},
+	} {
+		db := openTestStatsDB(t)
+		read := func(bytes int64) {
+			storeReadings(t, db, TrafficUpdate{EntityID: mac, Source: "r1", RXBytes: bytes, TXBytes: bytes, ResetPolicy: tc.policy})
+		}
+		read(1000000)
+		read(1001000)
+		if _, err := db.Exec("UPDATE cumulative_stats SET last_seen = ?", storedTime(time.Now().Add(-time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+		read(50)
+
+		if rx, _ := monthlyTotals(t, db, mac); rx-1000000 != tc.want {
+			t.Errorf("reset_policy %q: counted %d after the baseline, want %d", tc.policy, rx-1000000, tc.want)
+		}
+	}
+
+	if err := validateConfig(Config{"r1": {ResetPolicy: "bogus"}}); err == nil {
+		t.Error("unknown reset_policy accepted")
+	}
+}
+
+// benchmarkClientWrites stores a router's 30 client readings per cycle,
+// either in one batch or in a transaction each as before batching.
+func benchmarkClientWrites(b *testing.B, batched bool) {
+	db := openTestStatsDB(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		updates := routerWrites("10.0.0.1", 0, 30, int64(100*(i+1)), int64(10*(i+1)))
+		if batched {
+			storeReadings(b, db, updates...)
+			continue
+		}
+		for _, u := range updates {
+			storeReadings(b, db, u)
+		}
+	}
+}
+
+func BenchmarkClientWritesBatched(b *testing.B) { benchmarkClientWrites(b, true) }
+func BenchmarkClientWritesPerRow(b *testing.B)  { benchmarkClientWrites(b, false) }
+
+func TestConnectedTimeFlaps(t *testing.T) {
+	clients, _, err := parseWiFiStats("aa:bb:cc:dd:ee:01 10 20 wlan0 100\naa:bb:cc:dd:ee:02 10 20 wlan1\naa:bb:cc:dd:ee:03 10 20\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 3 {
+		t.Fatalf("parsed clients %+v, want 3", clients)
+	}
+	if c := clients[0]; !c.HasConnectedTime || c.ConnectedTime != 100 || c.Interface != "wlan0" {
+		t.Errorf("extended line = %+v, want connected for 100s on wlan0", c)
+	}
+	for _, c := range clients[1:] {
+		if c.HasConnectedTime || c.RXBytes != 10 || c.TXBytes != 20 {
+			t.Errorf("legacy line = %+v, want its traffic and no connected time", c)
+		}
+	}
+
+	db := openTestStatsDB(t)
+	const mac = "aa:bb:cc:dd:ee:01"
+	// Three drops in connected time. Roaming to r2 with a higher one and a
+	// reading without it are not reconnects.
+	for _, step := range []struct {
+		source    string
+		connected int64
+	}{{"r1", 100}, {"r1", 200}, {"r1", 5}, {"r1", 50}, {"r1", 1}, {"r2", 900}, {"r2", 10}} {
+		storeReadings(t, db, TrafficUpdate{EntityID: mac, Source: step.source, RXBytes: 10, TXBytes: 20, ConnectedTime: step.connected, HasConnectedTime: true})
+	}
+	storeReadings(t, db, TrafficUpdate{EntityID: mac, Source: "r2", RXBytes: 10, TXBytes: 20})
+
+	flaps, err := queryClientFlaps(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flaps) != 1 || flaps[0].ID != mac || flaps[0].FlapCount != 3 {
+		t.Errorf("flaps = %+v, want 3 for %s", flaps, mac)
+	}
+}
+
+func TestParseDHCPLeaseVariants(t *testing.T) {
+	data := `1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 phone 01:aa:bb:cc:dd:ee:01
+1700000000 aa:bb:cc:dd:ee:02 192.168.1.11 laptop *
+1700000000 AA:BB:CC:DD:EE:03 192.168.1.12 * *
+1700000000 aa:bb:cc:dd:ee:04 192.168.1.13 tv
+1700000000 aa:bb:cc:dd:ee:05 192.168.1.14
+1700000000 aa:bb:cc:dd:ee:06 192.168.1.15 - -
+1700000000 aa:bb:cc:dd:ee:07 192.168.1.16 my host 01:aa:bb:cc:dd:ee:07
+duid 00:01:00:01:2a:2b:2c:2d:aa:bb:cc:dd:ee:ff
+not a lease line`
+
+	leases, skipped, err := parseDHCPLeases(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 2 {
+		t.Errorf("skipped %q, want the duid and the malformed line", skipped)
+	}
+	want := []struct {
+		mac      string
+		hostname string
+		kind     string
+	}{
+		{"aa:bb:cc:dd:ee:01", "phone", CLIENT_ID_SAME_MAC},
+		{"aa:bb:cc:dd:ee:02", "laptop", CLIENT_ID_NONE},
+		{"aa:bb:cc:dd:ee:03", UNKNOWN_HOSTNAME, CLIENT_ID_NONE},
+		{"aa:bb:cc:dd:ee:04", "tv", CLIENT_ID_NONE},
+		{"aa:bb:cc:dd:ee:05", UNKNOWN_HOSTNAME, CLIENT_ID_NONE},
+		{"aa:bb:cc:dd:ee:06", UNKNOWN_HOSTNAME, CLIENT_ID_NONE},
+		// Extra tokens between the hostname and the client id are dropped.
+		{"aa:bb:cc:dd:ee:07", "my", CLIENT_ID_SAME_MAC},
+	}
+	if len(leases) != len(want) {
+		t.Fatalf("parsed leases %+v, want %d", leases, len(want))
+	}
+	for i, w := range want {
+		if lease := leases[i]; lease.MACAddress != w.mac || lease.Hostname != w.hostname || lease.ClientIDKind != w.kind {
+			t.Errorf("lease %d = %+v, want %s named %q with client id kind %q", i, lease, w.mac, w.hostname, w.kind)
+		}
+	}
+}
+
+func TestReadOnlyHandleRefusesWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "network_stats.db")
+	db, err := connectDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setupStatsDB(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	ro, err := connectReadOnlyDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	var rows int
+	if err := ro.QueryRow("SELECT COUNT(*) FROM monthly_stats").Scan(&rows); err != nil {
+		t.Errorf("read through the read-only handle: %v", err)
+	}
+	if _, err := ro.Exec("INSERT INTO monthly_stats (id, rx_bytes, tx_bytes, timestamp) VALUES ('x', 1, 1, '')"); err == nil {
+		t.Error("insert through the read-only handle succeeded")
+	}
+
+	// An in-memory database's name already has parameters.
+	memory, err := connectReadOnlyDB(resolveDBPath(":memory:", "read_only_test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memory.Close()
+	if _, err := memory.Exec("CREATE TABLE scratch (x)"); err == nil {
+		t.Error("write through the in-memory read-only handle succeeded")
+	}
+}
+
+func TestHistoryMinBytes(t *testing.T) {
+	for _, tc := range []struct {
+		rx, tx, minBytes int64
+		want             bool
+	}{
+		{0, 0, 0, false},
+		{4095, 0, 4096, true},
+		{2048, 2047, 4096, true},
+		{2048, 2048, 4096, false},
+		{4097, 0, 4096, false},
+	} {
+		if got := belowHistoryThreshold(tc.rx, tc.tx, tc.minBytes); got != tc.want {
+			t.Errorf("belowHistoryThreshold(%d, %d, %d) = %v, want %v", tc.rx, tc.tx, tc.minBytes, got, tc.want)
+		}
+	}
+
+	old := *historyMinBytes
+	*historyMinBytes = 4096
+	defer func() { *historyMinBytes = old }()
+	db := openTestStatsDB(t)
+	// The baseline, then cycles of 4095 and 4096 bytes.
+	for _, rx := range []int64{10000, 14095, 18191} {
+		storeReadings(t, db, TrafficUpdate{EntityID: MAIN_WAN_ID, Source: "r1", RXBytes: rx})
+	}
+
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM traffic_history WHERE id = ? AND rx_bytes < 10000", MAIN_WAN_ID).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("%d history rows after the baseline, want only the 4096-byte cycle's", rows)
+	}
+	if rx, _ := monthlyTotals(t, db, MAIN_WAN_ID); rx != 18191 {
+		t.Errorf("monthly rx = %d, want every cycle counted", rx)
+	}
+}
+
+func TestWiFiColumnLayouts(t *testing.T) {
+	for _, tc := range []struct {
+		columns []string
+		data    string
+		want    []ClientStats
+	}{
+		{
+			[]string{"rx", "tx", "mac"},
+			"10 20 AA:BB:CC:DD:EE:01\n30 40 aa:bb:cc:dd:ee:02\n",
+			[]ClientStats{{MACAddress: "aa:bb:cc:dd:ee:01", RXBytes: 10, TXBytes: 20}, {MACAddress: "aa:bb:cc:dd:ee:02", RXBytes: 30, TXBytes: 40}},
+		},
+		{
+			// Optional columns may be missing from a line.
+			[]string{"-", "mac", "tx", "rx", "interface"},
+			"x aa:bb:cc:dd:ee:01 5 7 wlan1\nx aa:bb:cc:dd:ee:02 5 7\n",
+			[]ClientStats{{MACAddress: "aa:bb:cc:dd:ee:01", RXBytes: 7, TXBytes: 5, Interface: "wlan1"}, {MACAddress: "aa:bb:cc:dd:ee:02", RXBytes: 7, TXBytes: 5}},
+		},
+	} {
+		columns, err := newWiFiColumns(tc.columns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients, summary, err := parseWiFiStatsColumns(tc.data, columns)
+		if err != nil || summary.Skipped != 0 || len(clients) != len(tc.want) {
+			t.Errorf("%q: parsed %+v, %+v, %v", tc.columns, clients, summary, err)
+			continue
+		}
+		for i, want := range tc.want {
+			got := clients[i]
+			if got.MACAddress != want.MACAddress || got.RXBytes != want.RXBytes || got.TXBytes != want.TXBytes || got.Interface != want.Interface {
+				t.Errorf("%q: client %d = %+v, want %+v", tc.columns, i, got, want)
+			}
+		}
+	}
+
+	for _, invalid := range [][]string{
+		{"mac", "rx"},
+		{"mac", "rx", "tx", "mac"},
+		{"interface", "mac", "rx", "tx"},
+		{"mac", "rx", "bogus"},
+	} {
+		if _, err := newWiFiColumns(invalid); err == nil {
+			t.Errorf("newWiFiColumns(%q) accepted", invalid)
+		}
+	}
+	if err := validateConfig(Config{"r1": {WiFiColumns: []string{"rx"}}}); err == nil {
+		t.Error("wifi_columns without mac and tx accepted")
+	}
+}
+
+func TestWANAddressFamilies(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     string
+		wan      *WANStats
+		wan6     *WANStats
+		wantFail bool
+	}{
+		{"IPv4 only", "wan: 10 20\n", &WANStats{RXBytes: 10, TXBytes: 20}, nil, false},
+		{"IPv6 only", "wan6: 30 40\n", nil, &WANStats{RXBytes: 30, TXBytes: 40}, false},
+		{"dual-stack", "wan: 10 20\nwan6: 30 40\n", &WANStats{RXBytes: 10, TXBytes: 20}, &WANStats{RXBytes: 30, TXBytes: 40}, false},
+		{"neither", "lan: 1 2\n", nil, nil, true},
+	} {
+		server := replyWith(t, http.StatusOK, tc.data)
+		wan, wan6, _, err := collectWANStats("r1", RouterConfig{WANStatsURL: server.URL})
+		if (err != nil) != tc.wantFail {
+			t.Errorf("%s: error %v", tc.name, err)
+			continue
+		}
+		for _, family := range []struct {
+			name      string
+			got, want *WANStats
+		}{{"wan", wan, tc.wan}, {"wan6", wan6, tc.wan6}} {
+			if (family.got == nil) != (family.want == nil) ||
+				family.got != nil && (family.got.RXBytes != family.want.RXBytes || family.got.TXBytes != family.want.TXBytes) {
+				t.Errorf("%s: %s = %+v, want %+v", tc.name, family.name, family.got, family.want)
+			}
+		}
+	}
+}
+
+func TestWiFiDelimiters(t *testing.T) {
+	for _, tc := range []struct {
+		delimiter string
+		data      string
+	}{
+		{"", "aa:bb:cc:00:00:01 100 200 wlan0\n"},
+		{"whitespace", "aa:bb:cc:00:00:01\t 100  200 wlan0\n"},
+		{"comma", "aa:bb:cc:00:00:01,100,200,wlan0\n"},
+		{"tab", "aa:bb:cc:00:00:01\t100\t200\twlan0\n"},
+	} {
+		config := Config{"r1": {APStatsURL: "http://192.168.1.1/wifi", WiFiDelimiter: tc.delimiter}}
+		if err := validateConfig(config); err != nil {
+			t.Fatal(err)
+		}
+		columns := config["r1"].wifiColumns
+		if columns.maxFields == 0 {
+			columns = defaultWiFiColumns
+		}
+		clients, _, err := parseWiFiStatsColumns(tc.data, columns)
+		if err != nil || len(clients) != 1 || clients[0].RXBytes != 100 || clients[0].TXBytes != 200 || clients[0].Interface != "wlan0" {
+			t.Errorf("wifi_delimiter %q: parsed %+v, %v", tc.delimiter, clients, err)
+		}
+	}
+
+	// A comma-separated line with a space in a field keeps the space.
+	config := Config{"r1": {WiFiDelimiter: "comma", WiFiColumns: []string{"rx", "tx", "mac", "interface"}}}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	clients, _, err := parseWiFiStatsColumns("1,2,aa:bb:cc:00:00:01,guest wifi\n", config["r1"].wifiColumns)
+	if err != nil || len(clients) != 1 || clients[0].TXBytes != 2 || clients[0].Interface != "guest wifi" {
+		t.Errorf("comma with wifi_columns: parsed %+v, %v", clients, err)
+	}
+
+	if err := validateConfig(Config{"r1": {WiFiDelimiter: ";"}}); err == nil {
+		t.Error("unknown wifi_delimiter accepted")
+	}
+}
+
+func TestRouterProxy(t *testing.T) {
+	// The proxy answers for the router and sees the absolute request URL.
+	var requested string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		w.Write([]byte("wan: 1 2"))
+	}))
+	defer proxy.Close()
+	data, err := fetchData(RouterConfig{Proxy: proxy.URL}, "http://router.invalid/cgi-bin/wan.cgi")
+	if err != nil || data != "wan: 1 2" || requested != "http://router.invalid/cgi-bin/wan.cgi" {
+		t.Errorf("fetch through the proxy = %q, %v; proxy saw %q", data, err, requested)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://192.168.1.1/cgi-bin/wan.cgi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyFor := func(urls RouterConfig) string {
+		t.Helper()
+		transport := routerHTTPClient(urls, "http://192.168.1.1/").Transport.(*http.Transport)
+		if transport.Proxy == nil {
+			return ""
+		}
+		u, err := transport.Proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u == nil {
+			return ""
+		}
+		return u.String()
+	}
+
+	old := *proxyURL
+	defer func() { *proxyURL = old }()
+	*proxyURL = "http://global.example:3128"
+	for _, tc := range []struct {
+		proxy string
+		want  string
+	}{
+		{"http://proxy.example:3128", "http://proxy.example:3128"},
+		{"", "http://global.example:3128"},
+		{PROXY_DIRECT, ""},
+	} {
+		if got := proxyFor(RouterConfig{Proxy: tc.proxy}); got != tc.want {
+			t.Errorf("proxy %q: requests go through %q, want %q", tc.proxy, got, tc.want)
+		}
+	}
+
+	for _, invalid := range []string{"ftp://proxy.example", "http://"} {
+		if err := validateConfig(Config{"r1": {Proxy: invalid}}); err == nil {
+			t.Errorf("proxy %q accepted", invalid)
+		}
+	}
+}
+
+func TestCanonicalIP(t *testing.T) {
+	for value, want := range map[string]string{
+		"192.168.1.5":          "192.168.1.5",
+		"192.168.001.005":      "192.168.1.5",
+		"010.000.000.001":      "10.0.0.1",
+		"::ffff:192.168.1.5":   "192.168.1.5",
+		"FE80:0000::0001":      "fe80::1",
+		"2001:db8:0:0:0:0:2:1": "2001:db8::2:1",
+	} {
+		if got, ok := canonicalIP(value); !ok || got != want {
+			t.Errorf("canonicalIP(%q) = %q, %v; want %q", value, got, ok, want)
+		}
+	}
+	for _, invalid := range []string{"256.1.1.1", "1.2.3", "1.2.3.4.5", "abc", "", "1..2.3", "1.2.3.-4"} {
+		if got, ok := canonicalIP(invalid); ok {
+			t.Errorf("canonicalIP(%q) accepted as %q", invalid, got)
+		}
+	}
+	if _, ok := canonicalIPv4("fe80::1"); ok {
+		t.Error("canonicalIPv4 accepted an IPv6 address")
+	}
+
+	leases, skipped, _ := parseDHCPLeases("1700000000 aa:bb:cc:dd:ee:01 192.168.001.005 host 01:aa:bb:cc:dd:ee:01\n1700000000 aa:bb:cc:dd:ee:02 300.1.1.1 host *\n1700000000 aa:bb:cc:dd:ee:03 10.0.0.09 - *\n")
+	if len(leases) != 2 || leases[0].IPAddress != "192.168.1.5" || leases[1].IPAddress != "10.0.0.9" || len(skipped) != 1 {
+		t.Errorf("parseDHCPLeases = %+v, skipped %q", leases, skipped)
+	}
+}
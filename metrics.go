@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metricLabels renders Prometheus labels in the given order, escaping the
+// values as the text exposition format requires.
+func metricLabels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], value)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+type monthlyMetric struct {
+	id      string
+	rxBytes int64
+	txBytes int64
+}
+
+// writeTrafficMetrics writes this month's RX/TX per entity. WiFi clients are
+// labelled with their MAC and DHCP hostname ("unknown" without a lease);
+// main_wan and rollups only carry the id.
+func writeTrafficMetrics(w io.Writer, statsDB, dhcpDB *sql.DB) error {
+	rows, err := statsDB.Query("SELECT id, rx_bytes, tx_bytes FROM monthly_stats ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("error querying monthly stats for metrics: %w", err)
+	}
+	var entries []monthlyMetric
+	for rows.Next() {
+		var m monthlyMetric
+		if err := rows.Scan(&m.id, &m.rxBytes, &m.txBytes); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning monthly stats for metrics: %w", err)
+		}
+		entries = append(entries, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error querying monthly stats for metrics: %w", err)
+	}
+
+	if err := dhcpHostnames.load(dhcpDB); err != nil {
+		return err
+	}
+
+	labels := func(id string) string {
+		if !isValidMAC(id) {
+			return metricLabels("id", id)
+		}
+		hostname := hostnameFor(id)
+		if hostname == id {
+			hostname = "unknown"
+		}
+		return metricLabels("id", id, "mac", id, "hostname", hostname)
+	}
+
+	writeMetricHeader(w, "netstats_monthly_rx_bytes", "gauge", "Bytes received this month.")
+	for _, m := range entries {
+		fmt.Fprintf(w, "netstats_monthly_rx_bytes%s %d\n", labels(m.id), m.rxBytes)
+	}
+	writeMetricHeader(w, "netstats_monthly_tx_bytes", "gauge", "Bytes sent this month.")
+	for _, m := range entries {
+		fmt.Fprintf(w, "netstats_monthly_tx_bytes%s %d\n", labels(m.id), m.txBytes)
+	}
+	return nil
+}
+
+func writeLeaseMetrics(w io.Writer, dhcpDB *sql.DB) error {
+	active, total, err := countLeases(dhcpDB, time.Now())
+	if err != nil {
+		return err
+	}
+	writeMetricHeader(w, "netstats_dhcp_leases_active", "gauge", "Unexpired DHCP leases.")
+	fmt.Fprintf(w, "netstats_dhcp_leases_active %d\n", active)
+	writeMetricHeader(w, "netstats_dhcp_leases", "gauge", "DHCP leases in the table, expired or not.")
+	fmt.Fprintf(w, "netstats_dhcp_leases %d\n", total)
+	return nil
+}
+
+// writeFetchMetrics writes the per-router fetch counters from /status.
+func writeFetchMetrics(w io.Writer) {
+	statuses := routerStatusSnapshot()
+
+	writeMetricHeader(w, "netstats_fetches_total", "counter", "Router fetches since the collector started.")
+	for _, status := range statuses {
+		endpoints := make([]string, 0, len(status.Fetches))
+		for endpoint := range status.Fetches {
+			endpoints = append(endpoints, endpoint)
+		}
+		sort.Strings(endpoints)
+		for _, endpoint := range endpoints {
+			m := status.Fetches[endpoint]
+			fmt.Fprintf(w, "netstats_fetches_total%s %d\n", metricLabels("router", status.Router, "endpoint", endpoint, "result", "success"), m.Successes)
+			fmt.Fprintf(w, "netstats_fetches_total%s %d\n", metricLabels("router", status.Router, "endpoint", endpoint, "result", "failure"), m.Failures)
+		}
+	}
+}
+
+// writeParseErrorMetrics writes the per-router parse error counters from
+// /status.
+func writeParseErrorMetrics(w io.Writer) {
+	writeMetricHeader(w, "netstats_parse_errors_total", "counter", "Input lines skipped or responses rejected by the parsers since the collector started.")
+	for _, status := range routerStatusSnapshot() {
+		endpoints := make([]string, 0, len(status.ParseErrors))
+		for endpoint := range status.ParseErrors {
+			endpoints = append(endpoints, endpoint)
+		}
+		sort.Strings(endpoints)
+		for _, endpoint := range endpoints {
+			fmt.Fprintf(w, "netstats_parse_errors_total%s %d\n", metricLabels("router", status.Router, "endpoint", endpoint), status.ParseErrors[endpoint])
+		}
+	}
+}
+
+// writeCycleMetrics describes the most recent collection cycle. Nothing is
+// written until the first cycle has finished.
+func writeCycleMetrics(w io.Writer) {
+	summary := lastCycleSummary()
+	if summary == nil {
+		return
+	}
+	writeMetricHeader(w, "netstats_cycle_duration_seconds", "gauge", "Wall-clock duration of the last collection cycle.")
+	fmt.Fprintf(w, "netstats_cycle_duration_seconds %g\n", summary.DurationSeconds)
+	writeMetricHeader(w, "netstats_cycle_routers", "gauge", "Routers processed by the last collection cycle.")
+	fmt.Fprintf(w, "netstats_cycle_routers%s %d\n", metricLabels("result", "success"), len(summary.Routers)-summary.RoutersFailed)
+	fmt.Fprintf(w, "netstats_cycle_routers%s %d\n", metricLabels("result", "failure"), summary.RoutersFailed)
+}
+
+func registerMetricsHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/metrics", handleMetrics)
+}
+
+// handleMetrics serves the Prometheus text exposition format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	statsDB, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer statsDB.Close()
+
+	dhcpDB, err := connectReadOnlyDB(*dhcpDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer dhcpDB.Close()
+
+	var b strings.Builder
+	if err := writeTrafficMetrics(&b, statsDB, dhcpDB); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := writeLeaseMetrics(&b, dhcpDB); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeFetchMetrics(&b)
+	writeParseErrorMetrics(&b)
+	writeCycleMetrics(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// A migration moves one set of tables ("stats" or "dhcp") from version-1 to
+// version. Steps must be idempotent: databases created before schema_version
+// existed start at version 0 and replay every step over tables that may
+// already be partly up to date.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var statsMigrations = []migration{
+	{1, "create cumulative_stats and monthly_stats", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS cumulative_stats (
+				id TEXT PRIMARY KEY,
+				rx_bytes INTEGER,
+				tx_bytes INTEGER
+			)
+		`, `
+			CREATE TABLE IF NOT EXISTS monthly_stats (
+				id TEXT PRIMARY KEY,
+				rx_bytes INTEGER,
+				tx_bytes INTEGER,
+				timestamp TEXT
+			)
+		`)
+	}},
+	{2, "index monthly_stats by timestamp", func(tx *sql.Tx) error {
+		return execAll(tx, "CREATE INDEX IF NOT EXISTS idx_monthly_stats_timestamp ON monthly_stats (timestamp)")
+	}},
+	{3, "create traffic_history", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS traffic_history (
+				id TEXT,
+				rx_bytes INTEGER,
+				tx_bytes INTEGER,
+				timestamp TEXT
+			)
+		`, "CREATE INDEX IF NOT EXISTS idx_traffic_history_id_timestamp ON traffic_history (id, timestamp)")
+	}},
+	{4, "create monthly_archive", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS monthly_archive (
+				id TEXT,
+				year_month TEXT,
+				rx_bytes INTEGER,
+				tx_bytes INTEGER,
+				PRIMARY KEY (id, year_month)
+			)
+		`)
+	}},
+	{5, "create reboot_events", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS reboot_events (
+				id TEXT,
+				detected_at TEXT,
+				previous_rx INTEGER,
+				previous_tx INTEGER
+			)
+		`)
+	}},
+	{6, "record the WiFi interface", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "monthly_stats", "interface", "TEXT DEFAULT ''"); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "traffic_history", "interface", "TEXT DEFAULT ''")
+	}},
+	{7, "record the source router", func(tx *sql.Tx) error {
+		for _, table := range []string{"cumulative_stats", "monthly_stats", "traffic_history"} {
+			if err := addColumnIfMissing(tx, table, "source_router", "TEXT DEFAULT ''"); err != nil {
+				return err
+			}
+		}
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS router_counters (
+				id TEXT,
+				source_router TEXT,
+				rx_bytes INTEGER,
+				tx_bytes INTEGER,
+				PRIMARY KEY (id, source_router)
+			)
+		`)
+	}},
+	// alltime_stats accumulates the same increments as monthly_stats but is
+	// never reset, so it survives month rollovers and API resets.
+	{8, "create alltime_stats", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS alltime_stats (
+				id TEXT PRIMARY KEY,
+				rx_bytes INTEGER,
+				tx_bytes INTEGER,
+				first_seen TEXT,
+				last_seen TEXT
+			)
+		`)
+	}},
+	{9, "count client reconnects", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "cumulative_stats", "connected_time", "INTEGER"); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "monthly_stats", "flap_count", "INTEGER DEFAULT 0")
+	}},
+	{10, "track when entities were last seen", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "cumulative_stats", "last_seen", "TEXT"); err != nil {
+			return err
+		}
+		// Existing rows start their retention window now rather than
+		// being pruned on the first cycle after the upgrade.
+		_, err := tx.Exec("UPDATE cumulative_stats SET last_seen = ? WHERE last_seen IS NULL", storedTime(time.Now()))
+		return err
+	}},
+	{11, "create cycle_stats", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS cycle_stats (
+				started_at TEXT,
+				duration_ms INTEGER,
+				routers INTEGER,
+				routers_failed INTEGER,
+				records INTEGER
+			)
+		`, "CREATE INDEX IF NOT EXISTS idx_cycle_stats_started_at ON cycle_stats (started_at)")
+	}},
+	{12, "create entity_tags", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS entity_tags (
+				id TEXT,
+				tag TEXT,
+				PRIMARY KEY (id, tag)
+			)
+		`, "CREATE INDEX IF NOT EXISTS idx_entity_tags_tag ON entity_tags (tag)")
+	}},
+	{13, "store timestamps in UTC", func(tx *sql.Tx) error {
+		for _, column := range [][2]string{
+			{"monthly_stats", "timestamp"},
+			{"traffic_history", "timestamp"},
+			{"reboot_events", "detected_at"},
+			{"alltime_stats", "first_seen"},
+			{"alltime_stats", "last_seen"},
+			{"cumulative_stats", "last_seen"},
+			{"cycle_stats", "started_at"},
+			{"schema_version", "updated_at"},
+		} {
+			if err := convertLegacyTimes(tx, column[0], column[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{14, "index traffic_history by timestamp", func(tx *sql.Tx) error {
+		return execAll(tx, "CREATE INDEX IF NOT EXISTS idx_traffic_history_timestamp ON traffic_history (timestamp)")
+	}},
+	{15, "record client signal and noise", func(tx *sql.Tx) error {
+		for _, column := range []string{"signal", "noise", "snr"} {
+			if err := addColumnIfMissing(tx, "cumulative_stats", column, "INTEGER"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{16, "create entity_settings", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS entity_settings (
+				id TEXT PRIMARY KEY,
+				enabled INTEGER NOT NULL DEFAULT 1,
+				updated_at TEXT
+			)
+		`)
+	}},
+	{17, "create alert_state", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS alert_state (
+				alert TEXT PRIMARY KEY,
+				fired_at TEXT NOT NULL,
+				armed INTEGER NOT NULL DEFAULT 0
+			)
+		`)
+	}},
+	{18, "create device_resets", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS device_resets (
+				id TEXT NOT NULL,
+				reset_at TEXT NOT NULL,
+				reason TEXT NOT NULL,
+				monthly_rx_bytes INTEGER NOT NULL DEFAULT 0,
+				monthly_tx_bytes INTEGER NOT NULL DEFAULT 0,
+				alltime_rx_bytes INTEGER NOT NULL DEFAULT 0,
+				alltime_tx_bytes INTEGER NOT NULL DEFAULT 0,
+				first_seen TEXT
+			)
+		`, "CREATE INDEX IF NOT EXISTS idx_device_resets_id ON device_resets (id)")
+	}},
+	{19, "create presence", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS presence (
+				id TEXT PRIMARY KEY,
+				active INTEGER NOT NULL DEFAULT 0,
+				idle_cycles INTEGER NOT NULL DEFAULT 0,
+				last_active TEXT,
+				router TEXT,
+				updated_at TEXT
+			)
+		`)
+	}},
+}
+
+var dhcpMigrations = []migration{
+	{1, "create dhcp_leases", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS dhcp_leases (
+				mac_address TEXT PRIMARY KEY,
+				lease_end_time INTEGER,
+				ip_address TEXT,
+				hostname TEXT,
+				client_id TEXT,
+				timestamp TEXT
+			)
+		`)
+	}},
+	{2, "index dhcp_leases by ip_address", func(tx *sql.Tx) error {
+		return execAll(tx, "CREATE INDEX IF NOT EXISTS idx_dhcp_leases_ip_address ON dhcp_leases (ip_address)")
+	}},
+	{3, "create lease_history", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS lease_history (
+				mac_address TEXT,
+				ip_address TEXT,
+				hostname TEXT,
+				observed_at TEXT
+			)
+		`, "CREATE INDEX IF NOT EXISTS idx_lease_history_mac_observed ON lease_history (mac_address, observed_at)")
+	}},
+	{4, "index dhcp_leases by hostname", func(tx *sql.Tx) error {
+		return execAll(tx, "CREATE INDEX IF NOT EXISTS idx_dhcp_leases_hostname ON dhcp_leases (hostname COLLATE NOCASE)")
+	}},
+	{5, "decode client ids", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "dhcp_leases", "client_id_kind", "TEXT DEFAULT ''"); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "dhcp_leases", "client_id_value", "TEXT DEFAULT ''")
+	}},
+	{6, "track lease expiry notifications", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "dhcp_leases", "expired_notified", "INTEGER DEFAULT 0"); err != nil {
+			return err
+		}
+		// Leases that ran out before the upgrade are not news.
+		_, err := tx.Exec("UPDATE dhcp_leases SET expired_notified = 1 WHERE lease_end_time != 0 AND lease_end_time <= ?", time.Now().Unix())
+		return err
+	}},
+	{7, "mark manual hostnames", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "dhcp_leases", "hostname_manual", "INTEGER DEFAULT 0")
+	}},
+	{8, "store timestamps in UTC", func(tx *sql.Tx) error {
+		for _, column := range [][2]string{
+			{"dhcp_leases", "timestamp"},
+			{"lease_history", "observed_at"},
+			{"schema_version", "updated_at"},
+		} {
+			if err := convertLegacyTimes(tx, column[0], column[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{9, "create dhcp_prefixes", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS dhcp_prefixes (
+				prefix TEXT PRIMARY KEY,
+				mac_address TEXT,
+				lease_end_time INTEGER,
+				hostname TEXT,
+				client_id TEXT,
+				timestamp TEXT
+			)
+		`, "CREATE INDEX IF NOT EXISTS idx_dhcp_prefixes_mac_address ON dhcp_prefixes (mac_address)")
+	}},
+}
+
+// migrate brings the component's tables up to the last migration in one
+// transaction, recording progress in schema_version. Both components can
+// share a database in -single-db mode, so each has its own row.
+func migrate(db *sql.DB, component string, migrations []migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for %s schema migration: %w", component, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			component TEXT PRIMARY KEY,
+			version INTEGER,
+			updated_at TEXT
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_version table: %w", err)
+	}
+
+	var current int
+	err = tx.QueryRow("SELECT version FROM schema_version WHERE component = ?", component).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error reading %s schema version: %w", component, err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := m.apply(tx); err != nil {
+			return fmt.Errorf("error applying %s schema migration %d (%s): %w", component, m.version, m.description, err)
+		}
+		_, err = tx.Exec(`
+			INSERT OR REPLACE INTO schema_version (component, version, updated_at)
+			VALUES (?, ?, ?)
+		`, component, m.version, storedTime(time.Now()))
+		if err != nil {
+			return fmt.Errorf("error recording %s schema version %d: %w", component, m.version, err)
+		}
+		fmt.Printf("Applied %s schema migration %d: %s.\n", component, m.version, m.description)
+	}
+
+	return tx.Commit()
+}
+
+// schemaVersion returns the last migration applied to component, or 0.
+func schemaVersion(db *sql.DB, component string) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT version FROM schema_version WHERE component = ?", component).Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("error reading %s schema version: %w", component, err)
+	}
+	return version, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMigrateFromVersion0 upgrades tables made before schema_version
+// existed, then checks that setup is a no-op the second time and that the
+// upgraded tables take writes.
+func TestMigrateFromVersion0(t *testing.T) {
+	db, err := connectDB(filepath.Join(t.TempDir(), "network_stats.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, statement := range []string{
+		"CREATE TABLE cumulative_stats (id TEXT PRIMARY KEY, rx_bytes INTEGER, tx_bytes INTEGER)",
+		"CREATE TABLE monthly_stats (id TEXT PRIMARY KEY, rx_bytes INTEGER, tx_bytes INTEGER, timestamp TEXT)",
+		"INSERT INTO cumulative_stats VALUES ('main_wan', 5, 5)",
+		"CREATE TABLE dhcp_leases (mac_address TEXT PRIMARY KEY, lease_end_time INTEGER, ip_address TEXT, hostname TEXT, client_id TEXT, timestamp TEXT)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := setupStatsDB(db); err != nil {
+			t.Fatal(err)
+		}
+		if err := setupDHCPDB(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for component, migrations := range map[string][]migration{"stats": statsMigrations, "dhcp": dhcpMigrations} {
+		version, err := schemaVersion(db, component)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := migrations[len(migrations)-1].version; version != want {
+			t.Errorf("%s schema version = %d, want %d", component, version, want)
+		}
+	}
+
+	var rx int64
+	if err := db.QueryRow("SELECT rx_bytes FROM cumulative_stats WHERE id = ?", MAIN_WAN_ID).Scan(&rx); err != nil || rx != 5 {
+		t.Errorf("cumulative rx after upgrade = %d, %v; want 5", rx, err)
+	}
+	storeReadings(t, db, TrafficUpdate{EntityID: "11:22:33:44:55:66", Source: "r1", RXBytes: 10, TXBytes: 20})
+	if rx, tx := monthlyTotals(t, db, "11:22:33:44:55:66"); rx != 10 || tx != 20 {
+		t.Errorf("monthly totals after upgrade = %d/%d, want 10/20", rx, tx)
+	}
+	if _, err := upsertDHCPLeases(db, &dbMutex, []DHCPLease{{MACAddress: "aa:bb:cc:dd:ee:ff", IPAddress: "192.168.1.10"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexesAfterSetup(t *testing.T) {
+	for _, tc := range []struct {
+		db      *sql.DB
+		indexes []string
+	}{
+		{openTestStatsDB(t), []string{"idx_monthly_stats_timestamp"}},
+		{openTestDHCPDB(t), []string{"idx_dhcp_leases_ip_address", "idx_dhcp_leases_hostname"}},
+	} {
+		for _, index := range tc.indexes {
+			var n int
+			if err := tc.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?", index).Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("index %s missing after setup", index)
+			}
+		}
+	}
+
+	// resetMonthlyStats' lookup of the latest update uses the index.
+	db := openTestStatsDB(t)
+	rows, err := db.Query("EXPLAIN QUERY PLAN SELECT timestamp FROM monthly_stats ORDER BY timestamp DESC LIMIT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, detail)
+	}
+	if !strings.Contains(strings.Join(plan, "\n"), "idx_monthly_stats_timestamp") {
+		t.Errorf("query plan %q doesn't use idx_monthly_stats_timestamp", plan)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DelegatedPrefix is an IPv6 prefix odhcpd delegated to a client (IA_PD),
+// stored in dhcp_prefixes when the router sets lease_prefixes.
+type DelegatedPrefix struct {
+	Prefix       string
+	MACAddress   string
+	LeaseEndTime int64
+	Hostname     string
+	ClientID     string
+}
+
+// parseLeases parses the DHCP endpoint's output in the router's
+// lease_format. Only odhcpd output can contain delegated prefixes.
+func parseLeases(urls RouterConfig, data string) ([]DHCPLease, []DelegatedPrefix, []string, error) {
+	if urls.LeaseFormat == LEASE_FORMAT_ODHCPD {
+		return parseODHCPDLeases(data)
+	}
+	leases, skipped, err := parseDHCPLeases(data)
+	return leases, nil, skipped, err
+}
+
+// parseODHCPDLeases reads odhcpd's lease file. Every record is one line:
+//
+//	# <interface> <DUID or MAC> <IAID or "ipv4"> <hostname> <valid until> <assigned> <prefix length> <address/length>...
+//
+// IPv4 records become leases as usual. IPv6 address records (IA_NA, prefix
+// length 128) become leases for their first address, unless the same client
+// also has an IPv4 lease, which takes precedence since leases are kept per
+// MAC address. Prefix records (IA_PD) are returned separately. IPv6 records
+// are only usable when the DUID contains the client's MAC address
+// (DUID-LLT or DUID-LL); others are skipped.
+func parseODHCPDLeases(data string) ([]DHCPLease, []DelegatedPrefix, []string, error) {
+	if data == "" {
+		return nil, nil, nil, nil
+	}
+
+	var leases []DHCPLease
+	var prefixes []DelegatedPrefix
+	var skipped []string
+	// ipv6Lease marks which leases came from an IA_NA record, so an IPv4
+	// record for the same MAC address can replace them.
+	index := map[string]int{}
+	ipv6Lease := map[string]bool{}
+
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 9 || fields[0] != "#" {
+			debugf("Warning: Skipping malformed odhcpd lease line: '%s'\n", line)
+			skipped = append(skipped, line)
+			continue
+		}
+		identifier, iaid, hostname := fields[2], fields[3], fields[4]
+		validUntil, err := strconv.ParseInt(fields[5], 10, 64)
+		if err != nil {
+			debugf("Error parsing lease end time for line '%s': %v\n", line, err)
+			skipped = append(skipped, line)
+			continue
+		}
+		switch {
+		case validUntil == 0:
+			// odhcpd keeps expired records until it next cleans up.
+			debugf("Ignoring expired odhcpd lease: '%s'\n", line)
+			continue
+		case validUntil < 0:
+			// Infinite, which dnsmasq writes as 0.
+			validUntil = 0
+		}
+		addresses := fields[8:]
+
+		if iaid == "ipv4" {
+			macAddress, ok := hexMAC(identifier)
+			ip, ipOK := canonicalIPv4(strings.TrimSuffix(addresses[0], "/32"))
+			if !ok || !ipOK {
+				debugf("Warning: Skipping malformed odhcpd lease line: '%s'\n", line)
+				skipped = append(skipped, line)
+				continue
+			}
+			lease := newDHCPLease(validUntil, macAddress, ip, hostname, "*")
+			if i, ok := index[macAddress]; ok {
+				if ipv6Lease[macAddress] {
+					leases[i] = lease
+					ipv6Lease[macAddress] = false
+				}
+				continue
+			}
+			index[macAddress] = len(leases)
+			leases = append(leases, lease)
+			continue
+		}
+
+		macAddress, ok := duidMAC(identifier)
+		if !ok {
+			debugf("Warning: Skipping odhcpd lease without a MAC address in its DUID: '%s'\n", line)
+			skipped = append(skipped, line)
+			continue
+		}
+		clientID, ok := odhcpdClientID(iaid, identifier)
+		if !ok {
+			debugf("Warning: Skipping malformed odhcpd lease line: '%s'\n", line)
+			skipped = append(skipped, line)
+			continue
+		}
+
+		if fields[7] == "128" {
+			ip := net.ParseIP(strings.TrimSuffix(addresses[0], "/128"))
+			if ip == nil || ip.To4() != nil {
+				debugf("Warning: Skipping malformed odhcpd lease line: '%s'\n", line)
+				skipped = append(skipped, line)
+				continue
+			}
+			if _, ok := index[macAddress]; ok {
+				continue
+			}
+			index[macAddress] = len(leases)
+			ipv6Lease[macAddress] = true
+			leases = append(leases, newDHCPLease(validUntil, macAddress, ip.String(), hostname, clientID))
+			continue
+		}
+
+		valid := true
+		var recordPrefixes []DelegatedPrefix
+		for _, address := range addresses {
+			_, prefix, err := net.ParseCIDR(address)
+			if err != nil || prefix.IP.To4() != nil {
+				valid = false
+				break
+			}
+			recordPrefixes = append(recordPrefixes, DelegatedPrefix{
+				Prefix:       prefix.String(),
+				MACAddress:   macAddress,
+				LeaseEndTime: validUntil,
+				Hostname:     leaseHostname(hostname),
+				ClientID:     clientID,
+			})
+		}
+		if !valid {
+			debugf("Warning: Skipping malformed odhcpd lease line: '%s'\n", line)
+			skipped = append(skipped, line)
+			continue
+		}
+		prefixes = append(prefixes, recordPrefixes...)
+	}
+	return leases, prefixes, skipped, nil
+}
+
+// hexMAC reads the bare hex hardware address odhcpd writes for IPv4 leases.
+func hexMAC(s string) (string, bool) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 6 {
+		return "", false
+	}
+	return net.HardwareAddr(b).String(), true
+}
+
+// duidMAC extracts the Ethernet address from a hex DUID-LLT (type 1) or
+// DUID-LL (type 3). Other DUID types don't contain one.
+func duidMAC(duid string) (string, bool) {
+	b, err := hex.DecodeString(duid)
+	if err != nil || len(b) < 4 || binary.BigEndian.Uint16(b[2:4]) != 1 {
+		return "", false
+	}
+	var mac []byte
+	switch binary.BigEndian.Uint16(b[0:2]) {
+	case 1:
+		if len(b) > 8 {
+			mac = b[8:]
+		}
+	case 3:
+		mac = b[4:]
+	}
+	if len(mac) != 6 {
+		return "", false
+	}
+	return net.HardwareAddr(mac).String(), true
+}
+
+// odhcpdClientID writes an IPv6 record's IAID and DUID as an RFC 4361
+// client id, the form normalizeClientID already decodes. odhcpd prints the
+// IAID in hex without leading zeros.
+func odhcpdClientID(iaid, duid string) (string, bool) {
+	n, err := strconv.ParseUint(iaid, 16, 32)
+	if err != nil {
+		return "", false
+	}
+	b, err := hex.DecodeString(duid)
+	if err != nil {
+		return "", false
+	}
+	octets := []string{"ff"}
+	for _, c := range append([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, b...) {
+		octets = append(octets, fmt.Sprintf("%02x", c))
+	}
+	return strings.Join(octets, ":"), true
+}
+
+// upsertDelegatedPrefixes stores the delegated prefixes, keyed by prefix.
+func upsertDelegatedPrefixes(db *sql.DB, mutex *sync.Mutex, prefixes []DelegatedPrefix) error {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	return retryBusy("delegated prefixes", func() error {
+		return writeDelegatedPrefixes(db, mutex, prefixes)
+	})
+}
+
+func writeDelegatedPrefixes(db *sql.DB, mutex *sync.Mutex, prefixes []DelegatedPrefix) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for delegated prefixes: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT OR REPLACE INTO dhcp_prefixes (prefix, mac_address, lease_end_time, hostname, client_id, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("error preparing delegated prefix statement: %w", err)
+	}
+	defer stmt.Close()
+
+	timestamp := storedTime(time.Now())
+	for _, prefix := range prefixes {
+		if _, err := stmt.Exec(prefix.Prefix, prefix.MACAddress, prefix.LeaseEndTime, prefix.Hostname, prefix.ClientID, timestamp); err != nil {
+			return fmt.Errorf("error storing delegated prefix %s: %w", prefix.Prefix, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing delegated prefixes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestParseODHCPDLeases(t *testing.T) {
+	data := `# br-lan 00030001aabbcc000011 1a2b3c4d router2 1760000000 100 128 fd00::11/128
+# br-lan 00030001aabbcc000011 1a2b3c4e router2 1760000000 100 56 fd00:0:0:100::/56 fd00:0:0:200::/56
+# br-lan 00030001aabbcc000022 1a2b3c4f laptop 1760000000 200 128 fd00::22/128
+# br-lan aabbcc000022 ipv4 laptop 1760000000 200 32 192.168.1.22/32
+# br-lan 0002000001379900 1a2b3c50 printer 1760000000 300 128 fd00::33/128
+# br-lan aabbcc000044 ipv4 phone 0 400 32 192.168.1.44/32
+not an odhcpd line`
+
+	leases, prefixes, skipped, err := parseODHCPDLeases(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The IA_NA lease, and the IPv4 lease in place of laptop's IA_NA one.
+	// The enterprise DUID has no MAC address and the expired lease is left
+	// out.
+	if len(leases) != 2 {
+		t.Fatalf("parsed leases %+v, want 2", leases)
+	}
+	if lease := leases[0]; lease.MACAddress != "aa:bb:cc:00:00:11" || lease.IPAddress != "fd00::11" || lease.Hostname != "router2" ||
+		lease.ClientIDKind != CLIENT_ID_RFC4361 || lease.ClientIDValue != "iaid=1a2b3c4d duid=00030001aabbcc000011" {
+		t.Errorf("IA_NA lease = %+v", lease)
+	}
+	if lease := leases[1]; lease.MACAddress != "aa:bb:cc:00:00:22" || lease.IPAddress != "192.168.1.22" {
+		t.Errorf("dual-stack lease = %+v, want the IPv4 one", lease)
+	}
+
+	if len(prefixes) != 2 {
+		t.Fatalf("parsed prefixes %+v, want 2", prefixes)
+	}
+	for i, want := range []string{"fd00:0:0:100::/56", "fd00:0:0:200::/56"} {
+		if prefix := prefixes[i]; prefix.Prefix != want || prefix.MACAddress != "aa:bb:cc:00:00:11" || prefix.Hostname != "router2" || prefix.LeaseEndTime != 1760000000 {
+			t.Errorf("prefix %d = %+v, want %s", i, prefix, want)
+		}
+	}
+	if len(skipped) != 2 {
+		t.Errorf("skipped %q, want the enterprise DUID and the malformed line", skipped)
+	}
+}
+
+func TestStoreDelegatedPrefixes(t *testing.T) {
+	db := openTestDHCPDB(t)
+	_, prefixes, _, err := parseODHCPDLeases("# br-lan 00030001aabbcc000011 1a2b3c4e router2 1760000000 100 56 fd00:0:0:100::/56")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storePrefixes(&RouterResult{Router: "r1"}, RouterConfig{LeasePrefixes: true}, db, prefixes)
+	var stored int
+	if err := db.QueryRow("SELECT COUNT(*) FROM dhcp_prefixes WHERE mac_address = 'aa:bb:cc:00:00:11' AND hostname = 'router2'").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Errorf("%d prefixes stored, want 1", stored)
+	}
+
+	if err := validateConfig(Config{"r1": {LeasePrefixes: true}}); err == nil {
+		t.Error("lease_prefixes accepted without lease_format odhcpd")
+	}
+}
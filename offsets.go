@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TrafficOffset is traffic a router config discounts from an entity's
+// increment every cycle, in bytes: a known baseline of management or VPN
+// traffic that shouldn't count against a cap.
+type TrafficOffset struct {
+	RX int64 `json:"rx"`
+	TX int64 `json:"tx"`
+}
+
+// normalizeOffsets validates a router's offsets map and returns it keyed by
+// canonical entity id, like normalizeTags.
+func normalizeOffsets(offsets map[string]TrafficOffset) (map[string]TrafficOffset, error) {
+	normalized := map[string]TrafficOffset{}
+	for entity, offset := range offsets {
+		id := strings.TrimSpace(entity)
+		if mac, ok := normalizeMAC(id); ok {
+			id = mac
+		}
+		if id == "" || strings.HasPrefix(id, SYNTHETIC_ID_PREFIX) {
+			return nil, fmt.Errorf("can't offset entity '%s'", entity)
+		}
+		if offset.RX < 0 || offset.TX < 0 {
+			return nil, fmt.Errorf("negative offset for %s", entity)
+		}
+		normalized[id] = offset
+	}
+	return normalized, nil
+}
+
+// offsetFor returns the offset for a reading this router stores under id.
+// A per-router WAN id takes the offset of its base, so "main_wan" applies
+// wherever the router's WAN counters are stored.
+func (urls RouterConfig) offsetFor(id string) TrafficOffset {
+	if offset, ok := urls.offsets[id]; ok {
+		return offset
+	}
+	for _, base := range []string{MAIN_WAN_ID, MAIN_WAN6_ID} {
+		if strings.HasPrefix(id, base+WAN_ROUTER_SEPARATOR) {
+			return urls.offsets[base]
+		}
+	}
+	return TrafficOffset{}
+}
+
+// subtractOffset takes offset off a cycle's increment, never going below
+// zero: a cycle with less traffic than the baseline adds nothing.
+func subtractOffset(increment, offset int64) int64 {
+	if increment < offset {
+		return 0
+	}
+	return increment - offset
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestNormalizeOffsets(t *testing.T) {
+	offsets, err := normalizeOffsets(map[string]TrafficOffset{"AA-BB-CC-DD-EE-FF": {RX: 1}, MAIN_WAN_ID: {TX: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offsets["aa:bb:cc:dd:ee:ff"].RX != 1 {
+		t.Errorf("offsets = %+v, want the MAC normalized", offsets)
+	}
+	if _, err := normalizeOffsets(map[string]TrafficOffset{MAIN_WAN_ID: {RX: -1}}); err == nil {
+		t.Error("negative offset accepted")
+	}
+
+	urls := RouterConfig{offsets: offsets}
+	if urls.offsetFor(MAIN_WAN_ID+":10.0.0.1").TX != 5 || urls.offsetFor(MAIN_WAN6_ID).TX != 0 {
+		t.Error("offsetFor doesn't match the router's own WAN id only")
+	}
+}
+
+func TestOffsetsNeverNegative(t *testing.T) {
+	if subtractOffset(100, 30) != 70 || subtractOffset(10, 30) != 0 {
+		t.Error("subtractOffset doesn't clamp at zero")
+	}
+
+	db := openTestStatsDB(t)
+	offset := TrafficOffset{RX: 100, TX: 100}
+	for _, bytes := range []int64{1000, 1500, 1550, 2550} {
+		storeReadings(t, db, TrafficUpdate{EntityID: MAIN_WAN_ID, Source: "r1", RXBytes: bytes, TXBytes: bytes, Offset: offset})
+	}
+
+	// The 1000 baseline, then 400, 0 rather than -50, and 900.
+	var rx, tx int64
+	if err := db.QueryRow("SELECT rx_bytes, tx_bytes FROM alltime_stats WHERE id = ?", MAIN_WAN_ID).Scan(&rx, &tx); err != nil {
+		t.Fatal(err)
+	}
+	if rx != 2300 || tx != 2300 {
+		t.Errorf("counted %d/%d, want 2300/2300", rx, tx)
+	}
+	var negative int
+	if err := db.QueryRow("SELECT COUNT(*) FROM traffic_history WHERE rx_bytes < 0 OR tx_bytes < 0").Scan(&negative); err != nil {
+		t.Fatal(err)
+	}
+	if negative != 0 {
+		t.Errorf("%d negative history rows", negative)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// addSaturating adds increment to total, stopping at math.MaxInt64 instead
+// of overflowing. SQLite would turn an overflowing sum into a float, which
+// then no longer scans into an int64, so totals are added up here. ok is
+// false when the sum had to stop at the limit.
+func addSaturating(total, increment int64) (sum int64, ok bool) {
+	if increment > 0 && total > math.MaxInt64-increment {
+		return math.MaxInt64, false
+	}
+	return total + increment, true
+}
+
+// accumulateTotals adds a cycle's increments to an entity's totals in
+// table. A total that reaches the limit stays there, with a warning when it
+// first gets there; at 9.2 EB that takes decades even at 10 Gbit/s, so it
+// points to garbage data rather than real traffic.
+func accumulateTotals(table, id string, rx, tx, incrementalRX, incrementalTX int64) (int64, int64) {
+	newRX, rxOK := addSaturating(rx, incrementalRX)
+	newTX, txOK := addSaturating(tx, incrementalTX)
+	if (!rxOK && rx < math.MaxInt64) || (!txOK && tx < math.MaxInt64) {
+		fmt.Printf("Warning: %s total of %s reached the int64 limit (rx %d + %d, tx %d + %d) and stays at it.\n", table, id, rx, incrementalRX, tx, incrementalTX)
+	}
+	return newRX, newTX
+}
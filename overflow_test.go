@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAddSaturating(t *testing.T) {
+	if sum, ok := addSaturating(math.MaxInt64-5, 5); !ok || sum != math.MaxInt64 {
+		t.Errorf("addSaturating to exactly MaxInt64 = %d, %v", sum, ok)
+	}
+	if sum, ok := addSaturating(math.MaxInt64-5, 6); ok || sum != math.MaxInt64 {
+		t.Errorf("addSaturating past MaxInt64 = %d, %v; want it capped", sum, ok)
+	}
+}
+
+func TestTotalsSaturateNearMaxInt64(t *testing.T) {
+	db := openTestStatsDB(t)
+	storeReadings(t, db, TrafficUpdate{EntityID: MAIN_WAN_ID, Source: "r1", RXBytes: 100, TXBytes: 100})
+	if _, err := db.Exec("UPDATE alltime_stats SET rx_bytes = ?", int64(math.MaxInt64-10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE monthly_stats SET tx_bytes = ?", int64(math.MaxInt64-10)); err != nil {
+		t.Fatal(err)
+	}
+	for _, bytes := range []int64{150, 200} {
+		storeReadings(t, db, TrafficUpdate{EntityID: MAIN_WAN_ID, Source: "r1", RXBytes: bytes, TXBytes: bytes})
+	}
+
+	var alltimeRX, alltimeTX int64
+	if err := db.QueryRow("SELECT rx_bytes, tx_bytes FROM alltime_stats WHERE id = ?", MAIN_WAN_ID).Scan(&alltimeRX, &alltimeTX); err != nil {
+		t.Fatal(err)
+	}
+	monthlyRX, monthlyTX := monthlyTotals(t, db, MAIN_WAN_ID)
+	if alltimeRX != math.MaxInt64 || alltimeTX != 200 {
+		t.Errorf("all-time totals = %d/%d, want %d/200", alltimeRX, alltimeTX, int64(math.MaxInt64))
+	}
+	if monthlyRX != 200 || monthlyTX != math.MaxInt64 {
+		t.Errorf("monthly totals = %d/%d, want 200/%d", monthlyRX, monthlyTX, int64(math.MaxInt64))
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PresenceEntry is one client in /presence.
+type PresenceEntry struct {
+	ID         string `json:"id"`
+	Hostname   string `json:"hostname"`
+	Active     bool   `json:"active"`
+	LastActive string `json:"last_active,omitempty"`
+	IdleCycles int    `json:"idle_cycles"`
+	Router     string `json:"router,omitempty"`
+}
+
+// presenceTracker sums each client's traffic over a cycle, so the presence
+// table can be updated once the cycle is over. A client counts as one
+// device across its interfaces, keyed by MAC address (or IP address).
+type presenceTracker struct {
+	mutex      sync.Mutex
+	minBytes   int64
+	idleCycles int
+	bytes      map[string]int64
+	sources    map[string]string
+}
+
+// clientPresence is nil unless -presence is set; observing with a nil
+// tracker does nothing.
+var clientPresence *presenceTracker
+
+func newPresenceTracker(minBytes int64, idleCycles int) *presenceTracker {
+	return &presenceTracker{
+		minBytes:   minBytes,
+		idleCycles: idleCycles,
+		bytes:      map[string]int64{},
+		sources:    map[string]string{},
+	}
+}
+
+// presenceID is the client an entity belongs to, or "" for WAN and tunnel
+// counters and rollups.
+func presenceID(entityID string) string {
+	if strings.HasPrefix(entityID, SYNTHETIC_ID_PREFIX) || strings.HasPrefix(entityID, MAIN_WAN_ID) || isTunnelID(entityID) {
+		return ""
+	}
+	if i := strings.Index(entityID, INTERFACE_ID_SEPARATOR); i > 0 {
+		return entityID[:i]
+	}
+	return entityID
+}
+
+// observe adds committed increments to the cycle's sums. A baseline or
+// rejected reading says the client is there but not how much it moved, so
+// it counts as no traffic.
+func (p *presenceTracker) observe(increments []trafficIncrement) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, increment := range increments {
+		id := presenceID(increment.EntityID)
+		if id == "" {
+			continue
+		}
+		var moved int64
+		if !increment.Baseline && increment.Rejected == nil {
+			moved = increment.RXBytes + increment.TXBytes
+		}
+		p.bytes[id] += moved
+		p.sources[id] = increment.Source
+	}
+}
+
+// update applies the cycle's sums to the presence table and starts the next
+// cycle. A client that moved more than minBytes is active; any other client
+// counts an idle cycle and becomes inactive after idleCycles of them. Clients
+// of a router whose fetches failed this cycle are left as they are, since
+// their traffic is unknown rather than zero.
+func (p *presenceTracker) update(db *sql.DB, mutex *sync.Mutex, summary *CycleSummary, now time.Time) error {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	bytes, sources := p.bytes, p.sources
+	p.bytes, p.sources = map[string]int64{}, map[string]string{}
+	p.mutex.Unlock()
+
+	failed := map[string]bool{}
+	for _, result := range summary.Routers {
+		if len(result.FailedFetches) > 0 {
+			failed[result.Router] = true
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for presence: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, active, idle_cycles, COALESCE(router, '') FROM presence")
+	if err != nil {
+		return fmt.Errorf("error querying presence: %w", err)
+	}
+	entries := map[string]*PresenceEntry{}
+	for rows.Next() {
+		entry := &PresenceEntry{}
+		if err := rows.Scan(&entry.ID, &entry.Active, &entry.IdleCycles, &entry.Router); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning presence: %w", err)
+		}
+		entries[entry.ID] = entry
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error querying presence: %w", err)
+	}
+
+	timestamp := storedTime(now)
+	for id := range bytes {
+		if _, ok := entries[id]; !ok {
+			entries[id] = &PresenceEntry{ID: id}
+		}
+	}
+	for id, entry := range entries {
+		moved, seen := bytes[id]
+		if seen {
+			entry.Router = sources[id]
+		} else if failed[entry.Router] {
+			continue
+		}
+
+		wasActive := entry.Active
+		if seen && moved > p.minBytes {
+			entry.Active = true
+			entry.IdleCycles = 0
+			entry.LastActive = timestamp
+		} else {
+			entry.IdleCycles++
+			if entry.IdleCycles >= p.idleCycles {
+				entry.Active = false
+			}
+		}
+		if entry.Active && !wasActive {
+			debugf("%s is now active.\n", id)
+		} else if !entry.Active && wasActive {
+			debugf("%s is now inactive after %d idle cycles.\n", id, entry.IdleCycles)
+		}
+
+		_, err := tx.Exec(`
+			INSERT INTO presence (id, active, idle_cycles, last_active, router, updated_at)
+			VALUES (?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?)
+			ON CONFLICT(id) DO UPDATE SET
+				active = excluded.active,
+				idle_cycles = excluded.idle_cycles,
+				last_active = COALESCE(excluded.last_active, presence.last_active),
+				router = excluded.router,
+				updated_at = excluded.updated_at
+		`, id, entry.Active, entry.IdleCycles, entry.LastActive, entry.Router, timestamp)
+		if err != nil {
+			return fmt.Errorf("error updating presence for %s: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing presence: %w", err)
+	}
+	return nil
+}
+
+// queryPresence reads the presence table, labelled with hostnames from
+// dhcpDB, keyed by hostname for home automation. A client whose hostname is
+// unknown or shared with another client is keyed by its id instead.
+func queryPresence(statsDB, dhcpDB *sql.DB) (map[string]PresenceEntry, error) {
+	rows, err := statsDB.Query("SELECT id, active, idle_cycles, COALESCE(last_active, ''), COALESCE(router, '') FROM presence ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("error querying presence: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []PresenceEntry
+	for rows.Next() {
+		var entry PresenceEntry
+		if err := rows.Scan(&entry.ID, &entry.Active, &entry.IdleCycles, &entry.LastActive, &entry.Router); err != nil {
+			return nil, fmt.Errorf("error scanning presence: %w", err)
+		}
+		entry.LastActive = displayStoredTime(entry.LastActive)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying presence: %w", err)
+	}
+
+	if err := dhcpHostnames.load(dhcpDB); err != nil {
+		return nil, err
+	}
+	named := map[string]int{}
+	for i := range entries {
+		entries[i].Hostname = hostnameFor(entries[i].ID)
+		named[strings.ToLower(entries[i].Hostname)]++
+	}
+
+	presence := map[string]PresenceEntry{}
+	for _, entry := range entries {
+		key := entry.Hostname
+		if named[strings.ToLower(key)] > 1 {
+			key = entry.ID
+		}
+		presence[key] = entry
+	}
+	return presence, nil
+}
+
+func handlePresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	statsDB, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer statsDB.Close()
+
+	dhcpDB, err := connectReadOnlyDB(*dhcpDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer dhcpDB.Close()
+
+	presence, err := queryPresence(statsDB, dhcpDB)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": presence})
+}
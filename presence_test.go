@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceTransitions(t *testing.T) {
+	db := openTestStatsDB(t)
+	dhcp := openTestDHCPDB(t)
+	const mac = "aa:bb:cc:dd:ee:01"
+
+	// Active from 1000 bytes a cycle, idle after two quiet cycles.
+	p := newPresenceTracker(1000, 2)
+	now := time.Now()
+	collected := &CycleSummary{Routers: []RouterResult{{Router: "r1"}}}
+	failed := &CycleSummary{Routers: []RouterResult{{Router: "r1", FailedFetches: []string{"wifi"}}}}
+
+	for _, step := range []struct {
+		name       string
+		summary    *CycleSummary
+		increments []trafficIncrement
+		wantActive bool
+		wantIdle   int
+	}{
+		{"baseline", collected, []trafficIncrement{
+			{EntityID: mac, Source: "r1", RXBytes: 5000, Baseline: true},
+			{EntityID: MAIN_WAN_ID, RXBytes: 1e9},
+		}, false, 1},
+		{"busy on two radios", collected, []trafficIncrement{
+			{EntityID: mac + "@wlan0", Source: "r1", RXBytes: 600},
+			{EntityID: mac + "@wlan1", Source: "r1", TXBytes: 600},
+		}, true, 0},
+		{"quiet", collected, []trafficIncrement{{EntityID: mac, Source: "r1", RXBytes: 10}}, true, 1},
+		{"router failed", failed, nil, true, 1},
+		{"absent", collected, nil, false, 2},
+		{"busy again", collected, []trafficIncrement{{EntityID: mac, Source: "r1", TXBytes: 2000}}, true, 0},
+	} {
+		p.observe(step.increments)
+		now = now.Add(30 * time.Minute)
+		if err := p.update(db, &dbMutex, step.summary, now); err != nil {
+			t.Fatal(err)
+		}
+
+		var active bool
+		var idle int
+		err := db.QueryRow("SELECT active, idle_cycles FROM presence WHERE id = ?", mac).Scan(&active, &idle)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if active != step.wantActive || idle != step.wantIdle {
+			t.Errorf("%s: active %v after %d idle cycles, want %v after %d", step.name, active, idle, step.wantActive, step.wantIdle)
+		}
+	}
+
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM presence").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("%d presence rows, want only %s's", rows, mac)
+	}
+	presence, err := queryPresence(db, dhcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := presence[mac]; !ok || !entry.Active || entry.LastActive == "" || entry.Router != "r1" {
+		t.Errorf("queryPresence = %+v", presence)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+// billingPeriod returns the start of the month containing now and the start
+// of the next one, which is when monthly_stats is reset.
+func billingPeriod(now time.Time) (start, end time.Time) {
+	start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+// projectUsage extrapolates used, counted from start until now, linearly to
+// end. Before any time has passed, or once the period is over, it returns
+// used unchanged.
+func projectUsage(used int64, start, end, now time.Time) int64 {
+	elapsed := now.Sub(start)
+	if elapsed <= 0 || !now.Before(end) {
+		return used
+	}
+	return int64(float64(used) * float64(end.Sub(start)) / float64(elapsed))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBillingPeriod(t *testing.T) {
+	for _, tc := range []struct {
+		now        time.Time
+		start, end time.Time
+	}{
+		{time.Date(2026, 4, 16, 12, 0, 0, 0, time.UTC), time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 12, 31, 23, 59, 0, 0, time.UTC), time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 2, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		start, end := billingPeriod(tc.now)
+		if !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("billingPeriod(%s) = %s - %s, want %s - %s", tc.now, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+func TestProjectUsage(t *testing.T) {
+	// April has 30 days.
+	start, end := billingPeriod(time.Date(2026, 4, 10, 0, 0, 0, 0, time.UTC))
+	december, january := billingPeriod(time.Date(2026, 12, 5, 0, 0, 0, 0, time.UTC))
+	for _, tc := range []struct {
+		name       string
+		start, end time.Time
+		now        time.Time
+		want       int64
+	}{
+		{"mid-month", start, end, start.AddDate(0, 0, 15), 2000},
+		{"a third in", start, end, start.AddDate(0, 0, 10), 3000},
+		{"at the start", start, end, start, 1000},
+		{"before the start", start, end, start.Add(-time.Hour), 1000},
+		{"at the end", start, end, end, 1000},
+		{"after the end", start, end, end.AddDate(0, 0, 3), 1000},
+		// A quarter of December's 31 days, with the period ending in the
+		// next year.
+		{"december", december, january, december.Add(31 * 24 * time.Hour / 4), 4000},
+	} {
+		if got := projectUsage(1000, tc.start, tc.end, tc.now); got != tc.want {
+			t.Errorf("%s: projectUsage(1000) = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+	if !january.Equal(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("December's period ends %s, want 2027-01-01", january)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// QUALITY_MIN_CYCLES is how many parsed responses an endpoint needs
+	// before a jump in its skip ratio counts as a format change.
+	QUALITY_MIN_CYCLES = 3
+
+	// QUALITY_BASELINE_WEIGHT is how far each parsed response moves an
+	// endpoint's baseline skip ratio towards its own.
+	QUALITY_BASELINE_WEIGHT = 0.1
+)
+
+// EndpointQuality is how well one router endpoint has been parsing. The
+// counts and ParseSuccessRate cover the report window, which starts again
+// after each logged report; the rest carries over.
+type EndpointQuality struct {
+	Router        string `json:"router"`
+	Endpoint      string `json:"endpoint"`
+	Fetches       int    `json:"fetches"`
+	FailedFetches int    `json:"failed_fetches"`
+	FailedParses  int    `json:"failed_parses"`
+	LinesParsed   int    `json:"lines_parsed"`
+	LinesSkipped  int    `json:"lines_skipped"`
+
+	// ParseSuccessRate is the percentage of the window's lines that
+	// parsed, a response that failed to parse as a whole counting as one
+	// skipped line. It is null until a response has arrived.
+	ParseSuccessRate *float64 `json:"parse_success_rate"`
+
+	LastSuccess         string `json:"last_success,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+
+	// SkipRatio is the share of the latest response's lines that were
+	// skipped, and BaselineSkipRatio the usual share in earlier ones.
+	// FormatChanged is set while SkipRatio is -quality-skip-jump or more
+	// above the baseline, which suggests the router's output changed.
+	SkipRatio          float64 `json:"skip_ratio"`
+	BaselineSkipRatio  float64 `json:"baseline_skip_ratio"`
+	FormatChanged      bool    `json:"format_changed"`
+	FormatChangedSince string  `json:"format_changed_since,omitempty"`
+
+	// NeedsAttention is set when the endpoint is failing or its format
+	// appears to have changed.
+	NeedsAttention bool `json:"needs_attention"`
+
+	parsedResponses int
+}
+
+var (
+	qualityMutex sync.Mutex
+	// qualities is keyed by router and then endpoint.
+	qualities    = map[string]map[string]*EndpointQuality{}
+	qualitySince = time.Now()
+)
+
+// recordQuality adds one response from router's endpoint: the lines parsed
+// and skipped, and err from fetching or parsing it. Skipped fetches
+// (ErrURLEmpty) are not counted.
+func recordQuality(router, endpoint string, parsed, skipped int, err error) {
+	if err == ErrURLEmpty {
+		return
+	}
+
+	qualityMutex.Lock()
+	defer qualityMutex.Unlock()
+
+	q := qualityLocked(router, endpoint)
+	q.Fetches++
+	if err != nil && !isParseError(err) {
+		q.FailedFetches++
+		q.ConsecutiveFailures++
+		return
+	}
+
+	now := time.Now()
+	if err != nil {
+		q.FailedParses++
+		q.ConsecutiveFailures++
+		if skipped == 0 {
+			skipped = 1
+		}
+	} else {
+		q.ConsecutiveFailures = 0
+		q.LastSuccess = displayTime(now)
+	}
+	q.LinesParsed += parsed
+	q.LinesSkipped += skipped
+
+	q.SkipRatio = 0
+	if parsed+skipped > 0 {
+		q.SkipRatio = float64(skipped) / float64(parsed+skipped)
+	}
+	// A response that jumped isn't folded into the baseline, so a format
+	// that really changed stays flagged until it is fixed.
+	if q.parsedResponses >= QUALITY_MIN_CYCLES && q.SkipRatio-q.BaselineSkipRatio >= *qualitySkipJump {
+		if !q.FormatChanged {
+			fmt.Printf("Warning: %s of the %s lines from %s were skipped, up from %s; its format may have changed.\n", formatRatio(q.SkipRatio), endpoint, router, formatRatio(q.BaselineSkipRatio))
+			q.FormatChanged = true
+			q.FormatChangedSince = displayTime(now)
+		}
+		return
+	}
+	q.FormatChanged = false
+	q.FormatChangedSince = ""
+	if q.parsedResponses == 0 {
+		q.BaselineSkipRatio = q.SkipRatio
+	} else {
+		q.BaselineSkipRatio += QUALITY_BASELINE_WEIGHT * (q.SkipRatio - q.BaselineSkipRatio)
+	}
+	q.parsedResponses++
+}
+
+// qualityLocked returns router's quality entry for endpoint, creating it if
+// needed. qualityMutex must be held.
+func qualityLocked(router, endpoint string) *EndpointQuality {
+	endpoints, ok := qualities[router]
+	if !ok {
+		endpoints = map[string]*EndpointQuality{}
+		qualities[router] = endpoints
+	}
+	q, ok := endpoints[endpoint]
+	if !ok {
+		q = &EndpointQuality{Router: router, Endpoint: endpoint}
+		endpoints[endpoint] = q
+	}
+	return q
+}
+
+// qualitySnapshot returns a copy of every endpoint's quality, by router and
+// endpoint, and when the window started. With reset, a new window starts.
+func qualitySnapshot(reset bool) ([]EndpointQuality, time.Time) {
+	qualityMutex.Lock()
+	defer qualityMutex.Unlock()
+
+	entries := []EndpointQuality{}
+	for _, endpoints := range qualities {
+		for _, q := range endpoints {
+			entry := *q
+			if lines := entry.LinesParsed + entry.LinesSkipped; lines > 0 {
+				rate := math.Round(float64(entry.LinesParsed)*1000/float64(lines)) / 10
+				entry.ParseSuccessRate = &rate
+			}
+			entry.NeedsAttention = entry.ConsecutiveFailures > 0 || entry.FormatChanged
+			entries = append(entries, entry)
+
+			if reset {
+				q.Fetches, q.FailedFetches, q.FailedParses = 0, 0, 0
+				q.LinesParsed, q.LinesSkipped = 0, 0
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Router != entries[j].Router {
+			return entries[i].Router < entries[j].Router
+		}
+		return entries[i].Endpoint < entries[j].Endpoint
+	})
+	since := qualitySince
+	if reset {
+		qualitySince = time.Now()
+	}
+	return entries, since
+}
+
+func formatRatio(ratio float64) string {
+	return fmt.Sprintf("%.1f%%", ratio*100)
+}
+
+// qualitySummary describes an endpoint's window for the log, e.g. "wifi:
+// 99.5% of 2000 lines parsed, last success 2026-10-15 14:30:00".
+func (q EndpointQuality) qualitySummary() string {
+	var parts []string
+	if q.ParseSuccessRate != nil {
+		parts = append(parts, fmt.Sprintf("%.1f%% of %d lines parsed", *q.ParseSuccessRate, q.LinesParsed+q.LinesSkipped))
+	} else {
+		parts = append(parts, "nothing parsed")
+	}
+	if q.LastSuccess != "" {
+		parts = append(parts, "last success "+q.LastSuccess)
+	} else {
+		parts = append(parts, "never succeeded")
+	}
+	if q.ConsecutiveFailures > 0 {
+		parts = append(parts, fmt.Sprintf("%d consecutive failures", q.ConsecutiveFailures))
+	}
+	if q.FormatChanged {
+		parts = append(parts, fmt.Sprintf("format may have changed (%s skipped, usually %s)", formatRatio(q.SkipRatio), formatRatio(q.BaselineSkipRatio)))
+	}
+	summary := q.Endpoint + ": " + strings.Join(parts, ", ")
+	if q.NeedsAttention {
+		summary += " [needs attention]"
+	}
+	return summary
+}
+
+// logQualityReport prints a line per router summarizing how its endpoints
+// parsed since the previous report, and starts a new window.
+func logQualityReport() {
+	entries, since := qualitySnapshot(true)
+	if len(entries) == 0 {
+		return
+	}
+	byRouter := map[string][]string{}
+	var routers []string
+	for _, q := range entries {
+		if _, ok := byRouter[q.Router]; !ok {
+			routers = append(routers, q.Router)
+		}
+		byRouter[q.Router] = append(byRouter[q.Router], q.qualitySummary())
+	}
+	for _, router := range routers {
+		fmt.Printf("Data quality for %s since %s: %s.\n", router, displayTime(since), strings.Join(byRouter[router], "; "))
+	}
+}
+
+func startQualityReports(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			logQualityReport()
+		}
+	}()
+}
+
+func handleQuality(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	entries, since := qualitySnapshot(false)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": entries, "since": displayTime(since)})
+}
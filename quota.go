@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quota is how an entity with a data cap is doing this billing period.
+// Remaining and overage never go below zero.
+type Quota struct {
+	ID             string  `json:"id"`
+	CapBytes       int64   `json:"cap_bytes"`
+	UsedBytes      int64   `json:"used_bytes"`
+	RemainingBytes int64   `json:"remaining_bytes"`
+	ProjectedBytes int64   `json:"projected_total_bytes"`
+	OverageBytes   int64   `json:"projected_overage_bytes"`
+	UsedPercent    float64 `json:"used_percent"`
+	CapHuman       string  `json:"cap_human"`
+	UsedHuman      string  `json:"used_human"`
+	RemainingHuman string  `json:"remaining_human"`
+	ProjectedHuman string  `json:"projected_total_human"`
+	OverageHuman   string  `json:"projected_overage_human"`
+	DaysLeft       int     `json:"days_left"`
+	PeriodStart    string  `json:"period_start"`
+	PeriodEnd      string  `json:"period_end"`
+}
+
+// normalizeCaps validates a router's caps map, parsing each size with
+// parseByteSize, and returns it keyed by canonical entity id like
+// normalizeTags. TOTAL_ID is the one rollup that can be capped.
+func normalizeCaps(caps map[string]string) (map[string]int64, error) {
+	normalized := map[string]int64{}
+	for entity, size := range caps {
+		id := strings.TrimSpace(entity)
+		if mac, ok := normalizeMAC(id); ok {
+			id = mac
+		}
+		if id == "" || (strings.HasPrefix(id, SYNTHETIC_ID_PREFIX) && id != TOTAL_ID) {
+			return nil, fmt.Errorf("can't cap entity '%s'", entity)
+		}
+		bytes, err := parseByteSize(size, *byteUnits == BYTE_UNITS_DECIMAL)
+		if err != nil || bytes <= 0 {
+			return nil, fmt.Errorf("invalid cap '%s' for %s", size, entity)
+		}
+		normalized[id] = bytes
+	}
+	return normalized, nil
+}
+
+// mergeCaps combines every router's caps into one map. Capping an entity
+// differently on two routers is an error.
+func mergeCaps(config Config) (map[string]int64, error) {
+	merged := map[string]int64{}
+	owners := map[string]string{}
+	for routerIP, urls := range config {
+		for id, bytes := range urls.caps {
+			if previous, ok := merged[id]; ok && previous != bytes {
+				return nil, fmt.Errorf("error: %s is capped at %d bytes by router '%s' and %d by router '%s'", id, previous, owners[id], bytes, routerIP)
+			}
+			merged[id] = bytes
+			owners[id] = routerIP
+		}
+	}
+	return merged, nil
+}
+
+// activeCaps returns the caps in force: the merged caps of the recorded
+// configuration, which every router carries, with -data-cap for TOTAL_ID
+// unless the configuration caps it too.
+func activeCaps() map[string]int64 {
+	caps := map[string]int64{}
+	if *dataCap > 0 {
+		caps[TOTAL_ID] = *dataCap
+	}
+
+	activeConfigMutex.Lock()
+	defer activeConfigMutex.Unlock()
+
+	for _, urls := range activeConfig {
+		for id, bytes := range urls.caps {
+			caps[id] = bytes
+		}
+		break
+	}
+	return caps
+}
+
+// daysLeft counts the days until end, the current one included.
+func daysLeft(now, end time.Time) int {
+	if !now.Before(end) {
+		return 0
+	}
+	return int(math.Ceil(end.Sub(now).Hours() / 24))
+}
+
+// queryQuotas reports each capped entity's month so far, TOTAL_ID first and
+// then by id. It holds mutex so the totals are never read halfway through a
+// cycle's batch. An entity with no traffic yet has used nothing.
+func queryQuotas(db *sql.DB, mutex *sync.Mutex, caps map[string]int64, now time.Time) ([]Quota, error) {
+	ids := make([]string, 0, len(caps))
+	for id := range caps {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if (ids[i] == TOTAL_ID) != (ids[j] == TOTAL_ID) {
+			return ids[i] == TOTAL_ID
+		}
+		return ids[i] < ids[j]
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	start, end := billingPeriod(now)
+	quotas := []Quota{}
+	for _, id := range ids {
+		q := Quota{ID: id, CapBytes: caps[id], DaysLeft: daysLeft(now, end), PeriodStart: displayTime(start), PeriodEnd: displayTime(end)}
+		err := db.QueryRow("SELECT rx_bytes + tx_bytes FROM monthly_stats WHERE id = ?", id).Scan(&q.UsedBytes)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("error querying monthly stats for quota of %s: %w", id, err)
+		}
+		q.ProjectedBytes = projectUsage(q.UsedBytes, start, end, now)
+		if q.UsedBytes < q.CapBytes {
+			q.RemainingBytes = q.CapBytes - q.UsedBytes
+		}
+		if q.ProjectedBytes > q.CapBytes {
+			q.OverageBytes = q.ProjectedBytes - q.CapBytes
+		}
+		q.UsedPercent = math.Round(float64(q.UsedBytes)*1000/float64(q.CapBytes)) / 10
+		q.CapHuman = humanizeBytes(q.CapBytes)
+		q.UsedHuman = humanizeBytes(q.UsedBytes)
+		q.RemainingHuman = humanizeBytes(q.RemainingBytes)
+		q.ProjectedHuman = humanizeBytes(q.ProjectedBytes)
+		q.OverageHuman = humanizeBytes(q.OverageBytes)
+		quotas = append(quotas, q)
+	}
+	return quotas, nil
+}
+
+func handleQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	quotas, err := queryQuotas(db, &dbMutex, activeCaps(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": quotas})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// repairRow is one entity's stored and rebuilt totals for a month. Current
+// marks the month in monthly_stats; the others are monthly_archive rows.
+type repairRow struct {
+	YearMonth  string
+	Current    bool
+	ID         string
+	StoredRX   int64
+	StoredTX   int64
+	RepairedRX int64
+	RepairedTX int64
+}
+
+// repairPlan is what -repair found: the rows whose totals differ from their
+// traffic_history, and the months history doesn't fully cover.
+type repairPlan struct {
+	Rows    []repairRow
+	Skipped []string
+}
+
+// historyCoverage returns the time from which traffic_history is complete:
+// its oldest row, or the start of that row's month when the row is as old
+// as the first collection in alltime_stats, meaning nothing was ever pruned.
+// ok is false when there is no history at all.
+func historyCoverage(db *sql.DB) (from time.Time, ok bool, err error) {
+	var earliest, firstSeen sql.NullString
+	if err := db.QueryRow("SELECT MIN(timestamp) FROM traffic_history").Scan(&earliest); err != nil {
+		return time.Time{}, false, fmt.Errorf("error reading oldest traffic history: %w", err)
+	}
+	if !earliest.Valid {
+		return time.Time{}, false, nil
+	}
+	from, err = parseStoredTime(earliest.String)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error parsing oldest traffic history timestamp: %w", err)
+	}
+	from = from.In(time.Local)
+
+	if err := db.QueryRow("SELECT MIN(first_seen) FROM alltime_stats").Scan(&firstSeen); err != nil {
+		return time.Time{}, false, fmt.Errorf("error reading first collection time: %w", err)
+	}
+	if firstSeen.Valid {
+		started, err := parseStoredTime(firstSeen.String)
+		if err == nil && !from.After(started.Add(CYCLE_INTERVAL)) {
+			from, _ = billingPeriod(from)
+		}
+	}
+	return from, true, nil
+}
+
+// planRepair compares the totals of every month up to now with the sum of
+// its traffic_history rows. Months that start before history is complete
+// are skipped, since part of their traffic is gone. A row is stamped at the
+// end of the cycle it covers, as queryRangeUsage assumes. TOTAL_ID is
+// rebuilt from the entities it rolls up per -total-source.
+func planRepair(db *sql.DB, mutex *sync.Mutex, now time.Time) (repairPlan, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var plan repairPlan
+	from, ok, err := historyCoverage(db)
+	if err != nil {
+		return plan, err
+	}
+	if !ok {
+		return plan, fmt.Errorf("traffic_history is empty, so there is nothing to rebuild the totals from")
+	}
+
+	// The oldest month worth reporting is the oldest with anything stored.
+	first, _ := billingPeriod(from)
+	var oldestArchive sql.NullString
+	if err := db.QueryRow("SELECT MIN(year_month) FROM monthly_archive").Scan(&oldestArchive); err != nil {
+		return plan, fmt.Errorf("error reading oldest archived month: %w", err)
+	}
+	if oldestArchive.Valid {
+		if archived, err := time.ParseInLocation("2006-01", oldestArchive.String, time.Local); err == nil && archived.Before(first) {
+			first = archived
+		}
+	}
+
+	current, _ := billingPeriod(now)
+	for start := first; !start.After(current); start = start.AddDate(0, 1, 0) {
+		yearMonth := start.Format("2006-01")
+		if from.After(start) {
+			plan.Skipped = append(plan.Skipped, yearMonth)
+			continue
+		}
+		rows, err := repairMonth(db, yearMonth, start, start.AddDate(0, 1, 0), start.Equal(current))
+		if err != nil {
+			return plan, err
+		}
+		plan.Rows = append(plan.Rows, rows...)
+	}
+	return plan, nil
+}
+
+// repairMonth returns the rows of one month whose stored totals differ from
+// the history between start and end.
+func repairMonth(db *sql.DB, yearMonth string, start, end time.Time, current bool) ([]repairRow, error) {
+	rows := map[string]*repairRow{}
+	row := func(id string) *repairRow {
+		r, ok := rows[id]
+		if !ok {
+			r = &repairRow{YearMonth: yearMonth, Current: current, ID: id}
+			rows[id] = r
+		}
+		return r
+	}
+
+	query, args := "SELECT id, rx_bytes, tx_bytes FROM monthly_archive WHERE year_month = ?", []interface{}{yearMonth}
+	if current {
+		query, args = "SELECT id, rx_bytes, tx_bytes FROM monthly_stats", nil
+	}
+	stored, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading stored totals for %s: %w", yearMonth, err)
+	}
+	defer stored.Close()
+	for stored.Next() {
+		var id string
+		var rx, tx int64
+		if err := stored.Scan(&id, &rx, &tx); err != nil {
+			return nil, fmt.Errorf("error reading stored totals for %s: %w", yearMonth, err)
+		}
+		r := row(id)
+		r.StoredRX, r.StoredTX = rx, tx
+	}
+	if err := stored.Err(); err != nil {
+		return nil, fmt.Errorf("error reading stored totals for %s: %w", yearMonth, err)
+	}
+
+	history, err := db.Query(`
+		SELECT id, SUM(rx_bytes), SUM(tx_bytes) FROM traffic_history
+		WHERE timestamp > ? AND timestamp <= ? AND id != ?
+		GROUP BY id
+	`, storedTime(start), storedTime(end), TOTAL_ID)
+	if err != nil {
+		return nil, fmt.Errorf("error summing traffic history for %s: %w", yearMonth, err)
+	}
+	defer history.Close()
+	for history.Next() {
+		var id string
+		var rx, tx int64
+		if err := history.Scan(&id, &rx, &tx); err != nil {
+			return nil, fmt.Errorf("error summing traffic history for %s: %w", yearMonth, err)
+		}
+		r := row(id)
+		r.RepairedRX, r.RepairedTX = rx, tx
+	}
+	if err := history.Err(); err != nil {
+		return nil, fmt.Errorf("error summing traffic history for %s: %w", yearMonth, err)
+	}
+
+	where, err := totalCondition(*totalSource)
+	if err != nil {
+		return nil, err
+	}
+	var totalRX, totalTX int64
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(rx_bytes), 0), COALESCE(SUM(tx_bytes), 0) FROM traffic_history
+		WHERE `+where+` AND timestamp > ? AND timestamp <= ?
+	`, storedTime(start), storedTime(end)).Scan(&totalRX, &totalTX)
+	if err != nil {
+		return nil, fmt.Errorf("error summing %s for %s: %w", TOTAL_ID, yearMonth, err)
+	}
+	if _, ok := rows[TOTAL_ID]; ok || totalRX+totalTX > 0 {
+		r := row(TOTAL_ID)
+		r.RepairedRX, r.RepairedTX = totalRX, totalTX
+	}
+
+	var changed []repairRow
+	for _, r := range rows {
+		if r.StoredRX != r.RepairedRX || r.StoredTX != r.RepairedTX {
+			changed = append(changed, *r)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].ID < changed[j].ID })
+	return changed, nil
+}
+
+// applyRepair writes a plan's rebuilt totals in one transaction. An archived
+// month whose entity turns out to have moved nothing loses its row, as
+// archiveMonthlyStats never stores one; this month's rows stay, at zero.
+func applyRepair(db *sql.DB, mutex *sync.Mutex, rows []repairRow) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for repair: %w", err)
+	}
+	defer tx.Rollback()
+
+	timestamp := storedTime(time.Now())
+	for _, r := range rows {
+		switch {
+		case r.Current:
+			_, err = tx.Exec("UPDATE monthly_stats SET rx_bytes = ?, tx_bytes = ? WHERE id = ?", r.RepairedRX, r.RepairedTX, r.ID)
+			if err == nil {
+				_, err = tx.Exec(`
+					INSERT OR IGNORE INTO monthly_stats (id, rx_bytes, tx_bytes, timestamp)
+					VALUES (?, ?, ?, ?)
+				`, r.ID, r.RepairedRX, r.RepairedTX, timestamp)
+			}
+		case r.RepairedRX == 0 && r.RepairedTX == 0:
+			_, err = tx.Exec("DELETE FROM monthly_archive WHERE id = ? AND year_month = ?", r.ID, r.YearMonth)
+		default:
+			_, err = tx.Exec(`
+				INSERT OR REPLACE INTO monthly_archive (id, year_month, rx_bytes, tx_bytes)
+				VALUES (?, ?, ?, ?)
+			`, r.ID, r.YearMonth, r.RepairedRX, r.RepairedTX)
+		}
+		if err != nil {
+			return fmt.Errorf("error repairing %s for %s: %w", r.ID, r.YearMonth, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing repair: %w", err)
+	}
+	return nil
+}
+
+// runRepair is -repair: it prints how each month's totals differ from their
+// traffic_history and, with apply, replaces them. Nothing is collected.
+func runRepair(apply bool) error {
+	connStats, err := connectDB(*statsDBPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to stats database: %w", err)
+	}
+	defer connStats.Close()
+	if err := setupStatsDB(connStats); err != nil {
+		return fmt.Errorf("failed to set up stats database: %w", err)
+	}
+
+	plan, err := planRepair(connStats, &dbMutex, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(plan.Skipped) > 0 {
+		fmt.Printf("Skipping %d month(s) that traffic_history doesn't fully cover: %v\n", len(plan.Skipped), plan.Skipped)
+	}
+	if *historyMinBytes > 0 {
+		fmt.Printf("Warning: -history-min-bytes %d leaves small cycles out of traffic_history, so rebuilt totals can be lower than the real ones.\n", *historyMinBytes)
+	}
+	if len(plan.Rows) == 0 {
+		fmt.Println("Every covered month's totals match traffic_history.")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MONTH\tID\tSTORED RX\tSTORED TX\tREPAIRED RX\tREPAIRED TX")
+	for _, r := range plan.Rows {
+		month := r.YearMonth
+		if r.Current {
+			month += " (current)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\n", month, r.ID, r.StoredRX, r.StoredTX, r.RepairedRX, r.RepairedTX)
+	}
+	tw.Flush()
+
+	if !apply {
+		fmt.Printf("%d row(s) differ. Run again with -apply to replace them.\n", len(plan.Rows))
+		return nil
+	}
+	if err := applyRepair(connStats, &dbMutex, plan.Rows); err != nil {
+		return err
+	}
+	fmt.Printf("Repaired %d row(s).\n", len(plan.Rows))
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+)
+
+// routerTLS is a router's client certificate and trusted CAs, loaded when
+// the configuration is validated.
+type routerTLS struct {
+	config *tls.Config
+
+	// digest identifies the files' contents, so renewed certificates get
+	// a new client at the next config load instead of the cached one.
+	digest string
+}
+
+// loadRouterTLS reads a router's client_cert, client_key and ca_cert files.
+// The certificate and key must be set together and match; either may be
+// left out with only ca_cert set. Errors name the file at fault, since they
+// are shown at config load.
+func loadRouterTLS(certFile, keyFile, caFile string) (*routerTLS, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("client_cert and client_key must be set together")
+	}
+
+	hash := sha256.New()
+	config := &tls.Config{}
+	if certFile != "" {
+		certPEM, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client certificate: %w", err)
+		}
+		keyPEM, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client key: %w", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate '%s' or key '%s': %w", certFile, keyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+		hash.Write(certPEM)
+		hash.Write(keyPEM)
+	}
+	if caFile != "" {
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("invalid CA certificate '%s': no PEM certificates found", caFile)
+		}
+		config.RootCAs = pool
+		hash.Write(caPEM)
+	}
+	return &routerTLS{config: config, digest: hex.EncodeToString(hash.Sum(nil))}, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"sync"
+)
+
+// The samples mix valid lines with malformed ones, so the self-test covers
+// both what the parsers accept and what they skip.
+//
+//go:embed selftest/*.txt
+var selfTestFS embed.FS
+
+// SELFTEST_DB is a private in-memory database, so -selftest never touches
+// the configured databases.
+const SELFTEST_DB = "file:selftest?mode=memory&cache=shared"
+
+type selfTestCheck struct {
+	name string
+	run  func() error
+}
+
+// runSelfTest parses the embedded samples, stores the results in an
+// in-memory database and reads them back, printing PASS or FAIL for each
+// step. It returns false if any step failed.
+func runSelfTest() bool {
+	var clients []ClientStats
+	var wan, wan6 *WANStats
+	var leases []DHCPLease
+	var db *sql.DB
+	var mutex sync.Mutex
+
+	checks := []selfTestCheck{
+		{"parse WiFi stats", func() error {
+			var summary WiFiParseSummary
+			var err error
+			clients, summary, err = parseWiFiStats(selfTestSample("wifi.txt"))
+			if err != nil {
+				return err
+			}
+			if len(clients) != 3 || summary.Skipped != 2 {
+				return fmt.Errorf("got %d clients and %d skipped lines, expected 3 and 2", len(clients), summary.Skipped)
+			}
+			if summary.UnparsedLines != 1 || summary.UnparsedRX != 100 || summary.UnparsedTX != 200 {
+				return fmt.Errorf("got %d unparsed lines with %d/%d bytes, expected 1 with 100/200", summary.UnparsedLines, summary.UnparsedRX, summary.UnparsedTX)
+			}
+			if clients[1].MACAddress != "aa:bb:cc:00:00:02" {
+				return fmt.Errorf("got MAC %s, expected aa:bb:cc:00:00:02", clients[1].MACAddress)
+			}
+			return nil
+		}},
+		{"parse delimited WiFi stats", func() error {
+			for _, sample := range []struct {
+				delimiter string
+				file      string
+				iface     string
+			}{
+				{"comma", "wifi-comma.txt", "wlan0"},
+				{"tab", "wifi-tab.txt", "wlan0 5g"},
+			} {
+				columns := defaultWiFiColumns
+				columns.separator = wifiDelimiters[sample.delimiter]
+				delimited, summary, err := parseWiFiStatsColumns(selfTestSample(sample.file), columns)
+				if err != nil {
+					return fmt.Errorf("%s: %w", sample.delimiter, err)
+				}
+				if len(delimited) != 2 || summary.Skipped != 1 {
+					return fmt.Errorf("%s: got %d clients and %d skipped lines, expected 2 and 1", sample.delimiter, len(delimited), summary.Skipped)
+				}
+				if delimited[0].RXBytes != 1048576 || delimited[0].Interface != sample.iface || delimited[1].TXBytes != 1024 {
+					return fmt.Errorf("%s: got %+v, expected 1048576 bytes received on '%s'", sample.delimiter, delimited[0], sample.iface)
+				}
+			}
+			return nil
+		}},
+		{"parse WAN stats", func() error {
+			data := selfTestSample("wan.txt")
+			var err error
+			if wan, err = parseWANStats(data, nil); err != nil {
+				return err
+			}
+			if wan6, err = parseWAN6Stats(data); err != nil {
+				return err
+			}
+			if wan.RXBytes != 987654321 || wan.TXBytes != 123456789 {
+				return fmt.Errorf("got wan %d/%d, expected 987654321/123456789", wan.RXBytes, wan.TXBytes)
+			}
+			if wan6 == nil || wan6.RXBytes != 5000 || wan6.TXBytes != 6000 {
+				return fmt.Errorf("wan6 counters missing or wrong")
+			}
+			return nil
+		}},
+		{"parse DHCP leases", func() error {
+			var skipped []string
+			var err error
+			leases, skipped, err = parseDHCPLeases(selfTestSample("dhcp.txt"))
+			if err != nil {
+				return err
+			}
+			if len(leases) != 3 || len(skipped) != 2 {
+				return fmt.Errorf("got %d leases and %d skipped lines, expected 3 and 2", len(leases), len(skipped))
+			}
+			if leases[1].IPAddress != "192.168.1.11" || leases[1].Hostname != UNKNOWN_HOSTNAME {
+				return fmt.Errorf("got %s (%s), expected 192.168.1.11 (%s)", leases[1].IPAddress, leases[1].Hostname, UNKNOWN_HOSTNAME)
+			}
+			return nil
+		}},
+		{"parse odhcpd leases", func() error {
+			odhcpdLeases, prefixes, skipped, err := parseODHCPDLeases(selfTestSample("odhcpd.txt"))
+			if err != nil {
+				return err
+			}
+			if len(odhcpdLeases) != 2 || len(prefixes) != 1 || len(skipped) != 2 {
+				return fmt.Errorf("got %d leases, %d prefixes and %d skipped lines, expected 2, 1 and 2", len(odhcpdLeases), len(prefixes), len(skipped))
+			}
+			if odhcpdLeases[0].MACAddress != "aa:bb:cc:00:00:10" || odhcpdLeases[0].IPAddress != "fd12:3456:789a::2f4" {
+				return fmt.Errorf("got %s at %s, expected aa:bb:cc:00:00:10 at fd12:3456:789a::2f4", odhcpdLeases[0].MACAddress, odhcpdLeases[0].IPAddress)
+			}
+			if odhcpdLeases[1].IPAddress != "192.168.1.160" {
+				return fmt.Errorf("got %s for the dual-stack client, expected its IPv4 lease 192.168.1.160", odhcpdLeases[1].IPAddress)
+			}
+			if prefixes[0].Prefix != "2001:db8:1:100::/56" || prefixes[0].MACAddress != "aa:bb:cc:00:00:11" {
+				return fmt.Errorf("got prefix %s for %s, expected 2001:db8:1:100::/56 for aa:bb:cc:00:00:11", prefixes[0].Prefix, prefixes[0].MACAddress)
+			}
+			return nil
+		}},
+		{"open database", func() error {
+			var err error
+			if db, err = connectDB(SELFTEST_DB); err != nil {
+				return err
+			}
+			if err := setupStatsDB(db); err != nil {
+				return err
+			}
+			return setupDHCPDB(db)
+		}},
+		{"store stats", func() error {
+			var updates []TrafficUpdate
+			for _, client := range clients {
+				updates = append(updates, TrafficUpdate{EntityID: client.MACAddress, Source: "selftest", Interface: client.Interface, RXBytes: client.RXBytes, TXBytes: client.TXBytes})
+			}
+			updates = append(updates,
+				TrafficUpdate{EntityID: MAIN_WAN_ID, Source: "selftest", RXBytes: wan.RXBytes, TXBytes: wan.TXBytes},
+				TrafficUpdate{EntityID: MAIN_WAN6_ID, Source: "selftest", RXBytes: wan6.RXBytes, TXBytes: wan6.TXBytes})
+			if err := updateTrafficStatsBatch(db, &mutex, updates); err != nil {
+				return err
+			}
+			_, err := upsertDHCPLeases(db, &mutex, leases)
+			return err
+		}},
+		{"read back stats", func() error {
+			expected := map[string][2]int64{
+				"aa:bb:cc:00:00:01": {1048576, 524288},
+				"aa:bb:cc:00:00:02": {2048, 1024},
+				"aa:bb:cc:00:00:03": {4096, 8192},
+				MAIN_WAN_ID:         {wan.RXBytes, wan.TXBytes},
+				MAIN_WAN6_ID:        {wan6.RXBytes, wan6.TXBytes},
+			}
+			for id, want := range expected {
+				var rx, tx int64
+				if err := db.QueryRow("SELECT rx_bytes, tx_bytes FROM monthly_stats WHERE id = ?", id).Scan(&rx, &tx); err != nil {
+					return fmt.Errorf("error reading monthly stats for %s: %w", id, err)
+				}
+				if rx != want[0] || tx != want[1] {
+					return fmt.Errorf("%s has %d/%d, expected %d/%d", id, rx, tx, want[0], want[1])
+				}
+			}
+			return nil
+		}},
+		{"read back leases", func() error {
+			var count int
+			if err := db.QueryRow("SELECT COUNT(*) FROM dhcp_leases").Scan(&count); err != nil {
+				return fmt.Errorf("error counting DHCP leases: %w", err)
+			}
+			if count != 3 {
+				return fmt.Errorf("got %d leases, expected 3", count)
+			}
+			var ip string
+			if err := db.QueryRow("SELECT ip_address FROM dhcp_leases WHERE mac_address = ?", "aa:bb:cc:00:00:03").Scan(&ip); err != nil {
+				return fmt.Errorf("error reading DHCP lease: %w", err)
+			}
+			if ip != "192.168.1.12" {
+				return fmt.Errorf("got IP %s, expected 192.168.1.12", ip)
+			}
+			return nil
+		}},
+	}
+
+	passed := true
+	for _, check := range checks {
+		// Later steps use what earlier ones produced, so stop at the first
+		// failure.
+		if !passed {
+			fmt.Printf("SKIP %s\n", check.name)
+			continue
+		}
+		if err := check.run(); err != nil {
+			fmt.Printf("FAIL %s: %v\n", check.name, err)
+			passed = false
+			continue
+		}
+		fmt.Printf("PASS %s\n", check.name)
+	}
+	if db != nil {
+		db.Close()
+	}
+	return passed
+}
+
+func selfTestSample(name string) string {
+	data, err := selfTestFS.ReadFile("selftest/" + name)
+	if err != nil {
+		// The samples are compiled in, so this only happens if the embed
+		// pattern and the names above disagree.
+		panic(err)
+	}
+	return string(data)
+}
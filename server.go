@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// REQUEST_ID_HEADER carries the id requestIDHandler gives each request, so
+// writeError can log and return it without access to the request.
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// startHTTPServer binds addr before returning, so a port that is taken or
+// an address that doesn't exist fails startup instead of a background log
+// line. With certFile and keyFile set it serves HTTPS.
+func startHTTPServer(addr, certFile, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("error: -tls-cert and -tls-key must be set together")
+	}
+	if certFile != "" {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return fmt.Errorf("error loading TLS certificate: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error: HTTP server can't listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	registerGrafanaHandlers(mux)
+	registerStatsHandlers(mux)
+	registerLeaseHandlers(mux)
+	registerBackupHandlers(mux)
+	registerCollectHandlers(mux)
+	registerMaintenanceHandlers(mux)
+	registerStatusHandlers(mux)
+	registerMetricsHandlers(mux)
+	registerDebugHandlers(mux)
+	registerDashboardHandlers(mux)
+
+	server := &http.Server{Handler: requestIDHandler(gzipHandler(mux))}
+	go func() {
+		var err error
+		if certFile != "" {
+			fmt.Printf("HTTPS server listening on %s\n", listener.Addr())
+			err = server.ServeTLS(listener, certFile, keyFile)
+		} else {
+			fmt.Printf("HTTP server listening on %s\n", listener.Addr())
+			err = server.Serve(listener)
+		}
+		fmt.Printf("HTTP server error: %v\n", err)
+	}()
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Error encoding JSON response: %v\n", err)
+	}
+}
+
+// requestIDHandler sets a random request id on every response.
+func requestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(REQUEST_ID_HEADER, newRequestID())
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// writeError sends {"error": message, "code": status, "request_id": ...} and
+// logs the error with the same request id.
+func writeError(w http.ResponseWriter, status int, message string) {
+	requestID := w.Header().Get(REQUEST_ID_HEADER)
+	fmt.Printf("HTTP %d [%s]: %s\n", status, requestID, message)
+	writeJSON(w, status, map[string]interface{}{
+		"error":      message,
+		"code":       status,
+		"request_id": requestID,
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// ClientSignal is the RF reading of a client's last cycle, in dBm (SNR in
+// dB). Noise and SNR are nil when the AP only reports signal.
+type ClientSignal struct {
+	ID           string `json:"id"`
+	SourceRouter string `json:"source_router"`
+	Signal       int    `json:"signal"`
+	Noise        *int   `json:"noise"`
+	SNR          *int   `json:"snr"`
+	LastSeen     string `json:"last_seen"`
+}
+
+// computeSNR is the margin of signal over noise, both in dBm, in dB.
+func computeSNR(signal, noise int) int {
+	return signal - noise
+}
+
+// queryClientSignal lists the clients whose last reading had a signal,
+// weakest link first: those with an SNR by SNR, then signal-only ones by
+// signal.
+func queryClientSignal(db *sql.DB) ([]ClientSignal, error) {
+	rows, err := db.Query(`
+		SELECT id, COALESCE(source_router, ''), signal, noise, snr, COALESCE(last_seen, '')
+		FROM cumulative_stats
+		WHERE signal IS NOT NULL
+		ORDER BY snr IS NULL, snr, signal, id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying client signal: %w", err)
+	}
+	defer rows.Close()
+
+	clients := []ClientSignal{}
+	for rows.Next() {
+		var client ClientSignal
+		var noise, snr sql.NullInt64
+		if err := rows.Scan(&client.ID, &client.SourceRouter, &client.Signal, &noise, &snr, &client.LastSeen); err != nil {
+			return nil, fmt.Errorf("error scanning client signal: %w", err)
+		}
+		if noise.Valid && snr.Valid {
+			n, s := int(noise.Int64), int(snr.Int64)
+			client.Noise, client.SNR = &n, &s
+		}
+		client.LastSeen = displayStoredTime(client.LastSeen)
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+func handleClientSignal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	clients, err := queryClientSignal(db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": clients})
+}
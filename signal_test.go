@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestComputeSNR(t *testing.T) {
+	for _, tc := range []struct{ signal, noise, want int }{
+		{-67, -95, 28},
+		{-90, -92, 2},
+		{-40, -40, 0},
+		{-95, -90, -5},
+	} {
+		if got := computeSNR(tc.signal, tc.noise); got != tc.want {
+			t.Errorf("computeSNR(%d, %d) = %d, want %d", tc.signal, tc.noise, got, tc.want)
+		}
+	}
+}
+
+func TestClientSignal(t *testing.T) {
+	clients, summary, err := parseWiFiStats("aa:bb:cc:00:00:01 1 2 wlan0 10 -67 -95\naa:bb:cc:00:00:02 1 2 wlan0 10 -80\naa:bb:cc:00:00:03 1 2 wlan0 10 bad -90\naa:bb:cc:00:00:04 1 2\n")
+	if err != nil || len(clients) != 4 || summary.Skipped != 0 {
+		t.Fatalf("parseWiFiStats = %+v, %+v, %v", clients, summary, err)
+	}
+	for i, want := range []struct{ signal, noise bool }{{true, true}, {true, false}, {false, true}, {false, false}} {
+		if clients[i].HasSignal != want.signal || clients[i].HasNoise != want.noise {
+			t.Errorf("client %d = %+v, want signal %v and noise %v", i, clients[i], want.signal, want.noise)
+		}
+	}
+
+	db := openTestStatsDB(t)
+	var updates []TrafficUpdate
+	for _, c := range clients {
+		updates = append(updates, TrafficUpdate{EntityID: c.MACAddress, Source: "r1", RXBytes: c.RXBytes, TXBytes: c.TXBytes, Signal: c.Signal, HasSignal: c.HasSignal, Noise: c.Noise, HasNoise: c.HasNoise})
+	}
+	updates = append(updates, TrafficUpdate{EntityID: "aa:bb:cc:00:00:06", Source: "r1", Signal: -85, HasSignal: true, Noise: -90, HasNoise: true})
+	storeReadings(t, db, updates...)
+
+	// Weakest SNR first, then the clients with only a signal.
+	list, err := queryClientSignal(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].ID != "aa:bb:cc:00:00:06" || *list[0].SNR != 5 ||
+		list[1].ID != "aa:bb:cc:00:00:01" || *list[1].SNR != 28 || list[2].SNR != nil || list[2].Signal != -80 {
+		t.Errorf("queryClientSignal = %+v", list)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SnapshotRecord is one line of the raw snapshot file: a single client, WAN
+// reading or lease as parsed during a cycle, before any aggregation.
+type SnapshotRecord struct {
+	Timestamp string `json:"timestamp"`
+	Router    string `json:"router"`
+	Type      string `json:"type"`
+
+	ID        string `json:"id,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	RXBytes   *int64 `json:"rx_bytes,omitempty"`
+	TXBytes   *int64 `json:"tx_bytes,omitempty"`
+
+	IPAddress    string `json:"ip_address,omitempty"`
+	Hostname     string `json:"hostname,omitempty"`
+	ClientID     string `json:"client_id,omitempty"`
+	LeaseEndTime *int64 `json:"lease_end_time,omitempty"`
+}
+
+// snapshotWriter appends SnapshotRecords as JSON Lines to path. Records are
+// buffered and written out by flush, which the cycle calls once at its end.
+// Before each flush the file is rotated to path.<timestamp> when it was
+// started on an earlier day (rotateDaily) or has reached maxSize bytes.
+type snapshotWriter struct {
+	mutex       sync.Mutex
+	path        string
+	rotateDaily bool
+	maxSize     int64
+	pending     []SnapshotRecord
+}
+
+// snapshots is nil unless -snapshot-file is set; its methods do nothing on
+// a nil writer.
+var snapshots *snapshotWriter
+
+func newSnapshotWriter(path string, rotateDaily bool, maxSize int64) *snapshotWriter {
+	return &snapshotWriter{path: path, rotateDaily: rotateDaily, maxSize: maxSize}
+}
+
+func (s *snapshotWriter) addClient(router string, client ClientStats) {
+	rx, tx := client.RXBytes, client.TXBytes
+	s.add(SnapshotRecord{Router: router, Type: "client", ID: client.clientKey(), Interface: client.Interface, RXBytes: &rx, TXBytes: &tx})
+}
+
+func (s *snapshotWriter) addWAN(router, id string, wan WANStats) {
+	rx, tx := wan.RXBytes, wan.TXBytes
+	s.add(SnapshotRecord{Router: router, Type: "wan", ID: id, RXBytes: &rx, TXBytes: &tx})
+}
+
+func (s *snapshotWriter) addLease(router string, lease DHCPLease) {
+	end := lease.LeaseEndTime
+	s.add(SnapshotRecord{Router: router, Type: "lease", ID: lease.MACAddress, IPAddress: lease.IPAddress, Hostname: lease.Hostname, ClientID: lease.ClientID, LeaseEndTime: &end})
+}
+
+func (s *snapshotWriter) add(record SnapshotRecord) {
+	if s == nil {
+		return
+	}
+	record.Timestamp = displayTime(time.Now())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending = append(s.pending, record)
+}
+
+// flush writes every pending record and syncs the file, so a cycle's
+// snapshot is on disk before the collector sleeps.
+func (s *snapshotWriter) flush() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	if err := s.rotate(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return fmt.Errorf("error opening snapshot file '%s': %w", s.path, err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, record := range s.pending {
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("error encoding snapshot record: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing snapshot file '%s': %w", s.path, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error syncing snapshot file '%s': %w", s.path, err)
+	}
+
+	s.pending = nil
+	return nil
+}
+
+func (s *snapshotWriter) rotate() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking snapshot file '%s': %w", s.path, err)
+	}
+
+	now := time.Now()
+	modified := info.ModTime()
+	newDay := s.rotateDaily && (modified.YearDay() != now.YearDay() || modified.Year() != now.Year())
+	tooBig := s.maxSize > 0 && info.Size() >= s.maxSize
+	if !newDay && !tooBig {
+		return nil
+	}
+
+	rotatedPath := s.path + "." + now.Format("20060102-150405")
+	if err := os.Rename(s.path, rotatedPath); err != nil {
+		return fmt.Errorf("error rotating snapshot file '%s': %w", s.path, err)
+	}
+	fmt.Printf("Rotated snapshot file to %s.\n", rotatedPath)
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// SPIKE_MIN_SAMPLES is how many accepted cycles an entity needs before
+	// -spike-factor can reject its increments.
+	SPIKE_MIN_SAMPLES = 5
+
+	// SPIKE_WINDOW is the number of recent cycles averaged into each
+	// entity's rate for -spike-factor.
+	SPIKE_WINDOW = 24
+)
+
+// counterReading is a pair of raw cumulative counters as read from a router.
+type counterReading struct {
+	RX int64
+	TX int64
+}
+
+// spikeGuard rejects cycle increments too large to be real, e.g. a counter
+// a CGI bug returned as garbage, so they never reach the totals. A rejected
+// reading doesn't become the baseline; it is kept as pending instead, and
+// if the next reading carries on plausibly from it the jump was real and
+// counting resumes from there. Like uploadDetector it lives in memory.
+type spikeGuard struct {
+	mutex    sync.Mutex
+	maxBytes int64
+	factor   float64
+	minBytes int64
+	recent   map[string][]int64
+	pending  map[string]counterReading
+}
+
+// counterSpikes is nil unless -max-cycle-increment or -spike-factor is set;
+// a nil guard accepts everything.
+var counterSpikes *spikeGuard
+
+func newSpikeGuard(maxBytes int64, factor float64, minBytes int64) *spikeGuard {
+	return &spikeGuard{
+		maxBytes: maxBytes,
+		factor:   factor,
+		minBytes: minBytes,
+		recent:   map[string][]int64{},
+		pending:  map[string]counterReading{},
+	}
+}
+
+// implausible returns why a cycle's increment for id is too large to count,
+// or "" when it isn't.
+func (g *spikeGuard) implausible(id string, rx, tx int64) string {
+	if g == nil {
+		return ""
+	}
+	total := rx + tx
+	if g.maxBytes > 0 && total > g.maxBytes {
+		return fmt.Sprintf("%s in one cycle is above -max-cycle-increment %s", humanizeBytes(total), humanizeBytes(g.maxBytes))
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	recent := g.recent[id]
+	if g.factor <= 0 || len(recent) < SPIKE_MIN_SAMPLES || total < g.minBytes {
+		return ""
+	}
+	var sum int64
+	for _, bytes := range recent {
+		sum += bytes
+	}
+	average := float64(sum) / float64(len(recent))
+	if float64(total) > g.factor*average {
+		return fmt.Sprintf("%s in one cycle is more than %g times the recent average of %s", humanizeBytes(total), g.factor, humanizeBytes(int64(average)))
+	}
+	return ""
+}
+
+// resumeFrom returns the reading rejected for id last cycle when reading
+// carries on plausibly from it, meaning the counters really jumped.
+func (g *spikeGuard) resumeFrom(id string, reading counterReading) (counterReading, bool) {
+	if g == nil {
+		return counterReading{}, false
+	}
+	g.mutex.Lock()
+	pending, ok := g.pending[id]
+	g.mutex.Unlock()
+
+	if !ok || reading.RX < pending.RX || reading.TX < pending.TX {
+		return counterReading{}, false
+	}
+	return pending, g.implausible(id, reading.RX-pending.RX, reading.TX-pending.TX) == ""
+}
+
+// observe records committed readings: a rejected one becomes the entity's
+// pending reading, and an accepted cycle joins its average. It runs after
+// the commit, like uploadDetector.observe.
+func (g *spikeGuard) observe(increments []trafficIncrement) {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, increment := range increments {
+		if increment.Rejected != nil {
+			g.pending[increment.EntityID] = *increment.Rejected
+			continue
+		}
+		delete(g.pending, increment.EntityID)
+		// A baseline or reset increment is a whole counter, not a cycle.
+		if increment.Baseline || increment.Reset {
+			continue
+		}
+		recent := append(g.recent[increment.EntityID], increment.RXBytes+increment.TXBytes)
+		if len(recent) > SPIKE_WINDOW {
+			recent = recent[len(recent)-SPIKE_WINDOW:]
+		}
+		g.recent[increment.EntityID] = recent
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestSpikeGuard(t *testing.T) {
+	defer func() { counterSpikes = nil }()
+	recent := []int64{0, 100, 200, 300, 400, 500, 600}
+	for _, tc := range []struct {
+		name     string
+		guard    *spikeGuard
+		readings []int64
+		wantRX   int64
+		wantLast int64
+	}{
+		// A one-off garbage reading is skipped and the next one counts
+		// from the old baseline.
+		{"one-off spike", newSpikeGuard(1000, 0, 0), []int64{100, 200, 1 << 40, 300, 400}, 400, 400},
+		// A real jump is rejected once, then counting resumes from it.
+		{"real jump", newSpikeGuard(1000, 0, 0), []int64{100, 200, 5000, 5100, 5200}, 400, 5200},
+		{"factor of recent average", newSpikeGuard(0, 10, 1000), append(recent, 600+100000, 800), 800, 800},
+		{"disabled", nil, []int64{100, 200, 1 << 40}, 1 << 40, 1 << 40},
+	} {
+		counterSpikes = tc.guard
+		db := openTestStatsDB(t)
+		for _, rx := range tc.readings {
+			storeReadings(t, db, TrafficUpdate{EntityID: MAIN_WAN_ID, Source: "r1", RXBytes: rx})
+		}
+
+		var rx, last int64
+		if err := db.QueryRow("SELECT rx_bytes FROM alltime_stats WHERE id = ?", MAIN_WAN_ID).Scan(&rx); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.QueryRow("SELECT rx_bytes FROM cumulative_stats WHERE id = ?", MAIN_WAN_ID).Scan(&last); err != nil {
+			t.Fatal(err)
+		}
+		if rx != tc.wantRX || last != tc.wantLast {
+			t.Errorf("%s: counted %d up to reading %d, want %d up to %d", tc.name, rx, last, tc.wantRX, tc.wantLast)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSH_DEFAULT_PORT is used when an ssh host doesn't name a port.
+const SSH_DEFAULT_PORT = "22"
+
+// SSHTunnel is a router's "ssh" setting: its requests are forwarded through
+// an SSH connection to Host, so the URLs are as seen from that host (e.g.
+// http://127.0.0.1/cgi-bin/totalwifi.cgi on the router itself). Key is a
+// private key file without a passphrase, and KnownHosts a known_hosts file
+// that must list Host's key.
+type SSHTunnel struct {
+	Host       string `json:"host"`
+	User       string `json:"user"`
+	Key        string `json:"key"`
+	KnownHosts string `json:"known_hosts"`
+}
+
+// sshTunnel is one router's SSH connection. It is dialed on the first
+// request and kept across cycles; a connection that drops is dialed again
+// by the next request.
+type sshTunnel struct {
+	router string
+	addr   string
+	config *ssh.ClientConfig
+
+	// digest identifies the settings and files, so an edited key or
+	// known_hosts replaces the tunnel at the next config load.
+	digest string
+
+	mutex  sync.Mutex
+	client *ssh.Client
+}
+
+var (
+	sshTunnelsMutex sync.Mutex
+	sshTunnels      = map[string]*sshTunnel{}
+)
+
+// loadSSHTunnel reads a router's ssh setting and returns its tunnel: the
+// existing one while nothing changed, so the connection outlives the config
+// reloads of each cycle. Nothing is dialed here.
+func loadSSHTunnel(router string, settings SSHTunnel) (*sshTunnel, error) {
+	if settings.Host == "" || settings.User == "" || settings.Key == "" || settings.KnownHosts == "" {
+		return nil, fmt.Errorf("ssh needs host, user, key and known_hosts")
+	}
+	addr := settings.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, SSH_DEFAULT_PORT)
+	}
+
+	keyPEM, err := ioutil.ReadFile(settings.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SSH key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH key '%s': %w", settings.Key, err)
+	}
+	knownHosts, err := ioutil.ReadFile(settings.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SSH known_hosts: %w", err)
+	}
+	hostKeyCallback, err := knownhosts.New(settings.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH known_hosts '%s': %w", settings.KnownHosts, err)
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s@%s\n", settings.User, addr)
+	hash.Write(keyPEM)
+	hash.Write(knownHosts)
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	sshTunnelsMutex.Lock()
+	defer sshTunnelsMutex.Unlock()
+
+	previous := sshTunnels[router]
+	if previous != nil && previous.digest == digest {
+		return previous, nil
+	}
+	if previous != nil {
+		previous.close()
+	}
+	tunnel := &sshTunnel{
+		router: router,
+		addr:   addr,
+		config: &ssh.ClientConfig{
+			User:            settings.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+		},
+		digest: digest,
+	}
+	sshTunnels[router] = tunnel
+	return tunnel, nil
+}
+
+// connect returns the tunnel's SSH connection, dialing it if there is none.
+// The handshake is bounded by ctx, the request's timeout.
+func (t *sshTunnel) connect(ctx context.Context) (*ssh.Client, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.client != nil {
+		return t.client, nil
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SSH server %s: %w", t.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, t.addr, t.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error opening SSH session to %s: %w", t.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(sshConn, chans, reqs)
+	t.client = client
+	fmt.Printf("%s: SSH tunnel to %s established.\n", t.router, t.addr)
+	go func() {
+		err := client.Wait()
+		if t.drop(client) {
+			fmt.Printf("%s: SSH tunnel to %s closed: %v\n", t.router, t.addr, err)
+		}
+	}()
+	return client, nil
+}
+
+// drop forgets client if it is still the tunnel's connection, so the next
+// request dials a new one. It reports whether it was.
+func (t *sshTunnel) drop(client *ssh.Client) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.client != client {
+		return false
+	}
+	t.client = nil
+	return true
+}
+
+func (t *sshTunnel) close() {
+	t.mutex.Lock()
+	client := t.client
+	t.client = nil
+	t.mutex.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+}
+
+// dial opens a connection to addr from the SSH server. A connection that
+// died since the last request is dialed again once; a refusal from the far
+// side, which the SSH server reports as an OpenChannelError, is not the
+// tunnel's fault and is returned as is.
+func (t *sshTunnel) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := t.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		var refused *ssh.OpenChannelError
+		if errors.As(err, &refused) || ctx.Err() != nil || attempt > 0 {
+			return nil, fmt.Errorf("error connecting to %s through SSH server %s: %w", addr, t.addr, err)
+		}
+		debugf("%s: SSH tunnel to %s failed (%v), reconnecting.\n", t.router, t.addr, err)
+		if t.drop(client) {
+			client.Close()
+		}
+	}
+}
+
+// httpClient returns the client whose connections go through the tunnel,
+// one per TLS setting. Proxies don't apply.
+func (t *sshTunnel) httpClient(routerTLS *routerTLS) *http.Client {
+	key := "ssh " + t.router + " " + t.digest
+	var tlsConfig *tls.Config
+	if routerTLS != nil {
+		key += " " + routerTLS.digest
+		tlsConfig = routerTLS.config
+	}
+
+	routerClientsMutex.Lock()
+	defer routerClientsMutex.Unlock()
+
+	if client, ok := routerClients[key]; ok {
+		return client
+	}
+	client := newHTTPClient(nil, tlsConfig)
+	client.Transport.(*http.Transport).DialContext = t.dial
+	routerClients[key] = client
+	return client
+}
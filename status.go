@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RouterStatus is the outcome of the most recent cycle for one router.
+type RouterStatus struct {
+	Router              string   `json:"router"`
+	LastCycle           string   `json:"last_cycle"`
+	Success             bool     `json:"success"`
+	FailedFetches       []string `json:"failed_fetches,omitempty"`
+	LastError           string   `json:"last_error,omitempty"`
+	LastSuccess         string   `json:"last_success,omitempty"`
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+
+	// IPConflicts is the router's current list of IP addresses claimed
+	// by more than one active lease.
+	IPConflicts []IPConflict `json:"ip_conflicts,omitempty"`
+
+	// Fetches holds cumulative request timings keyed by endpoint ("wifi",
+	// "wan", "dhcp").
+	Fetches map[string]*FetchMetrics `json:"fetches,omitempty"`
+
+	// ParseErrors counts, per endpoint, the input lines the parsers skipped
+	// plus any response that failed to parse at all.
+	ParseErrors map[string]int `json:"parse_errors,omitempty"`
+}
+
+// FetchMetrics accumulates the latency and outcome of one router endpoint's
+// fetches since the collector started.
+type FetchMetrics struct {
+	Successes int     `json:"successes"`
+	Failures  int     `json:"failures"`
+	MinMS     float64 `json:"min_ms"`
+	AvgMS     float64 `json:"avg_ms"`
+	MaxMS     float64 `json:"max_ms"`
+
+	// LastStatus and LastSize are the HTTP status and body size of the
+	// endpoint's latest response, and LastStatusSince when the status last
+	// changed. They are unset until the router first answers, and aren't
+	// kept for commands.
+	LastStatus      int    `json:"last_status,omitempty"`
+	LastSize        int64  `json:"last_size"`
+	LastStatusSince string `json:"last_status_since,omitempty"`
+
+	total time.Duration
+}
+
+func (m *FetchMetrics) observe(d time.Duration, failed bool) {
+	if failed {
+		m.Failures++
+	} else {
+		m.Successes++
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	if m.Successes+m.Failures == 1 || ms < m.MinMS {
+		m.MinMS = ms
+	}
+	if ms > m.MaxMS {
+		m.MaxMS = ms
+	}
+	m.total += d
+	m.AvgMS = float64(m.total) / float64(time.Millisecond) / float64(m.Successes+m.Failures)
+}
+
+// DatabaseStatus is whether a database could be opened by the most recent
+// cycle. Since is when it last changed between available and unavailable.
+type DatabaseStatus struct {
+	Available bool   `json:"available"`
+	LastError string `json:"last_error,omitempty"`
+	Since     string `json:"since"`
+}
+
+var (
+	routerStatusMutex sync.Mutex
+	routerStatuses    = map[string]*RouterStatus{}
+
+	// databaseStatuses is keyed "stats" and "dhcp"; both are guarded by
+	// routerStatusMutex.
+	databaseStatuses = map[string]*DatabaseStatus{}
+)
+
+// recordDatabaseStatus stores whether the cycle could open the named
+// database, err being why not.
+func recordDatabaseStatus(name string, err error) {
+	routerStatusMutex.Lock()
+	defer routerStatusMutex.Unlock()
+
+	status, ok := databaseStatuses[name]
+	if !ok || status.Available != (err == nil) {
+		status = &DatabaseStatus{Available: err == nil, Since: displayTime(time.Now())}
+		databaseStatuses[name] = status
+	}
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+	}
+}
+
+// databaseStatusSnapshot returns a copy of the database states and whether
+// any database is unavailable.
+func databaseStatusSnapshot() (map[string]DatabaseStatus, bool) {
+	routerStatusMutex.Lock()
+	defer routerStatusMutex.Unlock()
+
+	statuses := map[string]DatabaseStatus{}
+	degraded := false
+	for name, status := range databaseStatuses {
+		statuses[name] = *status
+		degraded = degraded || !status.Available
+	}
+	return statuses, degraded
+}
+
+// routerStatusLocked returns the status entry for router, creating it if
+// needed. routerStatusMutex must be held.
+func routerStatusLocked(router string) *RouterStatus {
+	status, ok := routerStatuses[router]
+	if !ok {
+		status = &RouterStatus{Router: router}
+		routerStatuses[router] = status
+	}
+	return status
+}
+
+// recordFetch adds one fetch of endpoint from router to its metrics. Skipped
+// fetches (ErrURLEmpty) are not counted.
+func recordFetch(router, endpoint string, d time.Duration, err error) {
+	if err == ErrURLEmpty {
+		return
+	}
+
+	routerStatusMutex.Lock()
+	defer routerStatusMutex.Unlock()
+
+	fetchMetricsLocked(router, endpoint).observe(d, err != nil)
+}
+
+// recordResponse keeps the status and size of a response from router's
+// endpoint. Requests that got no response, or weren't made for a known
+// router and endpoint, leave the last ones in place.
+func recordResponse(router, endpoint string, result FetchResult) {
+	if router == "" || endpoint == "" || result.StatusCode == 0 {
+		return
+	}
+
+	routerStatusMutex.Lock()
+	defer routerStatusMutex.Unlock()
+
+	metrics := fetchMetricsLocked(router, endpoint)
+	if metrics.LastStatus != result.StatusCode {
+		metrics.LastStatusSince = displayTime(time.Now())
+	}
+	metrics.LastStatus = result.StatusCode
+	metrics.LastSize = result.Size
+}
+
+// fetchMetricsLocked returns router's metrics for endpoint, creating them if
+// needed. routerStatusMutex must be held.
+func fetchMetricsLocked(router, endpoint string) *FetchMetrics {
+	status := routerStatusLocked(router)
+	if status.Fetches == nil {
+		status.Fetches = map[string]*FetchMetrics{}
+	}
+	metrics, ok := status.Fetches[endpoint]
+	if !ok {
+		metrics = &FetchMetrics{}
+		status.Fetches[endpoint] = metrics
+	}
+	return metrics
+}
+
+// recordParseErrors adds n parse errors for router's endpoint.
+func recordParseErrors(router, endpoint string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	routerStatusMutex.Lock()
+	defer routerStatusMutex.Unlock()
+
+	status := routerStatusLocked(router)
+	if status.ParseErrors == nil {
+		status.ParseErrors = map[string]int{}
+	}
+	status.ParseErrors[endpoint] += n
+}
+
+// recordRouterStatus stores the outcome of processRouter. A router counts as
+// failed when any of its fetches failed; the failure count is cleared by the
+// next fully successful cycle.
+func recordRouterStatus(result RouterResult) {
+	routerStatusMutex.Lock()
+	defer routerStatusMutex.Unlock()
+
+	status := routerStatusLocked(result.Router)
+
+	now := displayTime(time.Now())
+	status.LastCycle = now
+	status.FailedFetches = result.FailedFetches
+	status.IPConflicts = result.IPConflicts
+	status.Success = len(result.FailedFetches) == 0
+	if status.Success {
+		status.ConsecutiveFailures = 0
+		status.LastError = ""
+		status.LastSuccess = now
+	} else {
+		status.ConsecutiveFailures++
+		if len(result.Errors) > 0 {
+			status.LastError = result.Errors[len(result.Errors)-1]
+		}
+	}
+}
+
+func routerStatusSnapshot() []RouterStatus {
+	routerStatusMutex.Lock()
+	defer routerStatusMutex.Unlock()
+
+	statuses := make([]RouterStatus, 0, len(routerStatuses))
+	for _, status := range routerStatuses {
+		entry := *status
+		entry.FailedFetches = append([]string(nil), status.FailedFetches...)
+		entry.IPConflicts = append([]IPConflict(nil), status.IPConflicts...)
+		if status.Fetches != nil {
+			entry.Fetches = map[string]*FetchMetrics{}
+			for endpoint, metrics := range status.Fetches {
+				copied := *metrics
+				entry.Fetches[endpoint] = &copied
+			}
+		}
+		if status.ParseErrors != nil {
+			entry.ParseErrors = map[string]int{}
+			for endpoint, n := range status.ParseErrors {
+				entry.ParseErrors[endpoint] = n
+			}
+		}
+		statuses = append(statuses, entry)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Router < statuses[j].Router })
+	return statuses
+}
+
+func registerStatusHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/quality", handleQuality)
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	databases, degraded := databaseStatusSnapshot()
+	response := map[string]interface{}{
+		"data": routerStatusSnapshot(),
+		"database": map[string]interface{}{
+			"max_open_conns":    *dbMaxOpenConns,
+			"conn_max_lifetime": dbConnMaxLifetime.String(),
+		},
+		"databases": databases,
+		"degraded":  degraded,
+		"paused":    collectionPauseStatus(),
+	}
+
+	// Router status doesn't depend on the DHCP database, so it is still
+	// reported when the lease counts can't be read.
+	active, total, err := readLeaseCounts()
+	if err != nil {
+		fmt.Printf("Error reading lease counts for /status: %v\n", err)
+		response["leases_error"] = err.Error()
+	} else {
+		response["leases"] = map[string]int{
+			"active": active,
+			"total":  total,
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func readLeaseCounts() (active, total int, err error) {
+	dhcpDB, err := connectReadOnlyDB(*dhcpDBPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer dhcpDB.Close()
+	return countLeases(dhcpDB, time.Now())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeStatusFile replaces path with the cycle summary as JSON, for
+// -status-file. The summary is written to a temporary file in the same
+// directory and renamed over path, so a reader sees the previous cycle's
+// file or this one's, never part of one.
+func writeStatusFile(path string, summary *CycleSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding status file: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("error creating status file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing status file: %w", err)
+	}
+	// TempFile creates the file readable by its owner only; the status is
+	// meant for other programs.
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("error writing status file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error replacing status file: %w", err)
+	}
+	return nil
+}
+
+// statusFileExporter is -status-file as an Exporter. The file keeps holding
+// only the summary.
+type statusFileExporter struct {
+	path string
+}
+
+func (e statusFileExporter) Name() string {
+	return "status file"
+}
+
+func (e statusFileExporter) Export(doc *CycleExport) error {
+	return writeStatusFile(e.path, doc.Summary)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// OTHER_SUBNET groups the leases that fall in none of the configured
+// subnets.
+const OTHER_SUBNET = "other"
+
+// SubnetOccupancy is how many leases one subnet holds. PoolSize and
+// Utilization are only set for configured subnets with a pool size.
+type SubnetOccupancy struct {
+	Subnet      string   `json:"subnet"`
+	Active      int      `json:"active"`
+	Total       int      `json:"total"`
+	PoolSize    int      `json:"pool_size,omitempty"`
+	Utilization *float64 `json:"utilization_percent,omitempty"`
+}
+
+// subnetPool is one entry of the merged subnets config.
+type subnetPool struct {
+	network  *net.IPNet
+	poolSize int
+}
+
+// normalizeSubnets validates a router's subnets map, keyed by CIDR with the
+// DHCP pool size (0 if unknown), and returns it keyed by network address so
+// "192.168.1.1/24" and "192.168.1.0/24" are the same subnet.
+func normalizeSubnets(subnets map[string]int) (map[string]int, error) {
+	normalized := map[string]int{}
+	for cidr, poolSize := range subnets {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet '%s'", cidr)
+		}
+		if poolSize < 0 {
+			return nil, fmt.Errorf("negative pool size for %s", cidr)
+		}
+		normalized[network.String()] = poolSize
+	}
+	return normalized, nil
+}
+
+// mergeSubnets combines every router's subnets, since the lease table holds
+// all routers' leases. Giving one subnet two pool sizes is an error. The
+// result is ordered most specific first, so an address in nested subnets
+// counts towards the smallest.
+func mergeSubnets(config Config) ([]subnetPool, error) {
+	sizes := map[string]int{}
+	owners := map[string]string{}
+	for routerIP, urls := range config {
+		for _, pool := range urls.subnets {
+			subnet := pool.network.String()
+			if previous, ok := sizes[subnet]; ok && previous != pool.poolSize {
+				return nil, fmt.Errorf("error: subnet %s has pool size %d on router '%s' and %d on router '%s'", subnet, previous, owners[subnet], pool.poolSize, routerIP)
+			}
+			sizes[subnet] = pool.poolSize
+			owners[subnet] = routerIP
+		}
+	}
+	return subnetPools(sizes), nil
+}
+
+// subnetPools turns a normalized subnets map into pools, most specific
+// first and then by address.
+func subnetPools(subnets map[string]int) []subnetPool {
+	var pools []subnetPool
+	for subnet, poolSize := range subnets {
+		_, network, _ := net.ParseCIDR(subnet)
+		pools = append(pools, subnetPool{network: network, poolSize: poolSize})
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		oi, _ := pools[i].network.Mask.Size()
+		oj, _ := pools[j].network.Mask.Size()
+		if oi != oj {
+			return oi > oj
+		}
+		return pools[i].network.String() < pools[j].network.String()
+	})
+	return pools
+}
+
+// leaseSubnet names the subnet ip is counted under: the first configured
+// pool that contains it, OTHER_SUBNET if pools are configured but none
+// does, and otherwise its /24 (IPv4) or /64 (IPv6).
+func leaseSubnet(ip net.IP, pools []subnetPool) string {
+	if len(pools) > 0 {
+		for _, pool := range pools {
+			if pool.network.Contains(ip) {
+				return pool.network.String()
+			}
+		}
+		return OTHER_SUBNET
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// querySubnetOccupancy counts the leases in each subnet, active meaning
+// unexpired or infinite at now. Every configured subnet is listed even when
+// empty; OTHER_SUBNET comes last and only when it has leases.
+func querySubnetOccupancy(db *sql.DB, pools []subnetPool, now time.Time) ([]SubnetOccupancy, error) {
+	rows, err := db.Query("SELECT ip_address, lease_end_time FROM dhcp_leases")
+	if err != nil {
+		return nil, fmt.Errorf("error querying DHCP leases by subnet: %w", err)
+	}
+	defer rows.Close()
+
+	bySubnet := map[string]*SubnetOccupancy{}
+	for _, pool := range pools {
+		subnet := pool.network.String()
+		bySubnet[subnet] = &SubnetOccupancy{Subnet: subnet, PoolSize: pool.poolSize}
+	}
+	for rows.Next() {
+		var ipAddress string
+		var leaseEndTime int64
+		if err := rows.Scan(&ipAddress, &leaseEndTime); err != nil {
+			return nil, fmt.Errorf("error scanning DHCP leases by subnet: %w", err)
+		}
+		ip := net.ParseIP(ipAddress)
+		if ip == nil {
+			continue
+		}
+		subnet := leaseSubnet(ip, pools)
+		occupancy, ok := bySubnet[subnet]
+		if !ok {
+			occupancy = &SubnetOccupancy{Subnet: subnet}
+			bySubnet[subnet] = occupancy
+		}
+		occupancy.Total++
+		if leaseEndTime == 0 || leaseEndTime > now.Unix() {
+			occupancy.Active++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying DHCP leases by subnet: %w", err)
+	}
+
+	occupancies := []SubnetOccupancy{}
+	for _, occupancy := range bySubnet {
+		if occupancy.PoolSize > 0 {
+			utilization := float64(occupancy.Active) / float64(occupancy.PoolSize) * 100
+			occupancy.Utilization = &utilization
+		}
+		occupancies = append(occupancies, *occupancy)
+	}
+	sort.Slice(occupancies, func(i, j int) bool {
+		if (occupancies[i].Subnet == OTHER_SUBNET) != (occupancies[j].Subnet == OTHER_SUBNET) {
+			return occupancies[j].Subnet == OTHER_SUBNET
+		}
+		return compareSubnets(occupancies[i].Subnet, occupancies[j].Subnet)
+	})
+	return occupancies, nil
+}
+
+// compareSubnets orders CIDRs IPv4 first, then by network address and
+// prefix length.
+func compareSubnets(a, b string) bool {
+	_, netA, errA := net.ParseCIDR(a)
+	_, netB, errB := net.ParseCIDR(b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	if v4A, v4B := netA.IP.To4() != nil, netB.IP.To4() != nil; v4A != v4B {
+		return v4A
+	}
+	if ipA, ipB := string(netA.IP.To16()), string(netB.IP.To16()); ipA != ipB {
+		return ipA < ipB
+	}
+	onesA, _ := netA.Mask.Size()
+	onesB, _ := netB.Mask.Size()
+	return onesA < onesB
+}
+
+func handleSubnetOccupancy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*dhcpDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	occupancies, err := querySubnetOccupancy(db, activeSubnetPools(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": occupancies})
+}
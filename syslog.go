@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// teeStdout replaces os.Stdout with a pipe so every line the program prints
+// is still written to the original stdout and also handed to send. All
+// logging goes through fmt.Print*, so this is what routes it to syslog.
+func teeStdout(send func(line string)) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("error creating stdout pipe: %w", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Text()
+			io.WriteString(stdout, line+"\n")
+			if strings.TrimSpace(line) != "" {
+				send(line)
+			}
+		}
+	}()
+	return nil
+}
+
+// isErrorLine reports whether a log line reports a failure, so it can be
+// sent to syslog at error rather than info priority.
+func isErrorLine(line string) bool {
+	for _, prefix := range []string{"Error", "Failed", "Warning", "HTTP 5"} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return strings.Contains(line, " failed")
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "fmt"
+
+// startSyslog is a no-op where log/syslog isn't available.
+func startSyslog(addr, facility string) error {
+	if addr != "" {
+		fmt.Println("Warning: syslog is not supported on this platform, -syslog ignored.")
+	}
+	return nil
+}
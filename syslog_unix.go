@@ -0,0 +1,54 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"syslog": syslog.LOG_SYSLOG,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// startSyslog copies everything the program logs to syslog: the local
+// daemon when addr is "local", otherwise a remote host:port over UDP.
+// An empty addr leaves logging on stdout only.
+func startSyslog(addr, facility string) error {
+	if addr == "" {
+		return nil
+	}
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return fmt.Errorf("unknown syslog facility '%s'", facility)
+	}
+
+	network, raddr := "udp", addr
+	if addr == "local" {
+		network, raddr = "", ""
+	}
+	writer, err := syslog.Dial(network, raddr, priority|syslog.LOG_INFO, SYSLOG_TAG)
+	if err != nil {
+		return fmt.Errorf("error connecting to syslog at %s: %w", addr, err)
+	}
+
+	return teeStdout(func(line string) {
+		if isErrorLine(line) {
+			writer.Err(line)
+		} else {
+			writer.Info(line)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// UNTAGGED_TAG groups the entities no router config tags, in /stats/tags and
+// as a ?tag= filter.
+const UNTAGGED_TAG = "untagged"
+
+// normalizeTags validates a router's tags map and returns it keyed by
+// canonical entity id: MAC addresses are normalized, anything else (such as
+// main_wan) is kept as written. Tags are trimmed and lowercased.
+func normalizeTags(tags map[string][]string) (map[string][]string, error) {
+	normalized := map[string][]string{}
+	for entity, entityTags := range tags {
+		id := strings.TrimSpace(entity)
+		if mac, ok := normalizeMAC(id); ok {
+			id = mac
+		}
+		if id == "" || strings.HasPrefix(id, SYNTHETIC_ID_PREFIX) {
+			return nil, fmt.Errorf("can't tag entity '%s'", entity)
+		}
+		for _, tag := range entityTags {
+			tag = strings.ToLower(strings.TrimSpace(tag))
+			if tag == "" || tag == UNTAGGED_TAG {
+				return nil, fmt.Errorf("invalid tag '%s' for %s", tag, entity)
+			}
+			normalized[id] = append(normalized[id], tag)
+		}
+	}
+	return normalized, nil
+}
+
+// collectTags merges every router's tags into one sorted, de-duplicated set
+// per entity; a device that roams between routers can be tagged on any of
+// them.
+func collectTags(routers Config) map[string][]string {
+	seen := map[string]map[string]bool{}
+	for _, urls := range routers {
+		for id, tags := range urls.tags {
+			if seen[id] == nil {
+				seen[id] = map[string]bool{}
+			}
+			for _, tag := range tags {
+				seen[id][tag] = true
+			}
+		}
+	}
+
+	merged := map[string][]string{}
+	for id, tags := range seen {
+		for tag := range tags {
+			merged[id] = append(merged[id], tag)
+		}
+		sort.Strings(merged[id])
+	}
+	return merged
+}
+
+// syncEntityTags replaces the entity_tags table with tags, so it always
+// mirrors the current configuration.
+func syncEntityTags(db *sql.DB, mutex *sync.Mutex, tags map[string][]string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for entity tags: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM entity_tags"); err != nil {
+		return fmt.Errorf("error clearing entity tags: %w", err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO entity_tags (id, tag) VALUES (?, ?)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement for entity tags: %w", err)
+	}
+	defer stmt.Close()
+
+	for id, entityTags := range tags {
+		for _, tag := range entityTags {
+			if _, err := stmt.Exec(id, tag); err != nil {
+				return fmt.Errorf("error storing tag '%s' for %s: %w", tag, id, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// tagFilter returns an SQL condition limiting monthly_stats ids to those
+// carrying tag, or to untagged ones for UNTAGGED_TAG, with its argument.
+func tagFilter(tag string) (string, []interface{}) {
+	if tag == UNTAGGED_TAG {
+		return "id NOT IN (SELECT id FROM entity_tags)", nil
+	}
+	return "id IN (SELECT id FROM entity_tags WHERE tag = ?)", []interface{}{tag}
+}
+
+// queryEntityTags returns each tagged entity's tags.
+func queryEntityTags(db *sql.DB) (map[string][]string, error) {
+	rows, err := db.Query("SELECT id, tag FROM entity_tags ORDER BY id, tag")
+	if err != nil {
+		return nil, fmt.Errorf("error querying entity tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := map[string][]string{}
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, fmt.Errorf("error scanning entity tags: %w", err)
+		}
+		tags[id] = append(tags[id], tag)
+	}
+	return tags, rows.Err()
+}
+
+// queryTagUsage sums this month's usage per tag, largest first. An entity
+// with several tags counts towards each of them. Untagged devices form the
+// UNTAGGED_TAG group; the WAN and tunnel entities and rollups only appear
+// when tagged.
+func queryTagUsage(db *sql.DB) ([]TagUsage, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(t.tag, ?), COUNT(DISTINCT m.id), SUM(m.rx_bytes), SUM(m.tx_bytes)
+		FROM monthly_stats m LEFT JOIN entity_tags t ON t.id = m.id
+		WHERE t.tag IS NOT NULL OR (NOT `+wanCondition("m.id")+` AND NOT `+tunnelCondition("m.id")+` AND substr(m.id, 1, 2) != ?)
+		GROUP BY 1
+		ORDER BY SUM(m.rx_bytes) + SUM(m.tx_bytes) DESC, 1
+	`, UNTAGGED_TAG, SYNTHETIC_ID_PREFIX)
+	if err != nil {
+		return nil, fmt.Errorf("error querying per-tag usage: %w", err)
+	}
+	defer rows.Close()
+
+	usage := []TagUsage{}
+	for rows.Next() {
+		var entry TagUsage
+		if err := rows.Scan(&entry.Tag, &entry.Entities, &entry.RXBytes, &entry.TXBytes); err != nil {
+			return nil, fmt.Errorf("error scanning per-tag usage: %w", err)
+		}
+		entry.TotalBytes = entry.RXBytes + entry.TXBytes
+		entry.RXHuman = humanizeBytes(entry.RXBytes)
+		entry.TXHuman = humanizeBytes(entry.TXBytes)
+		entry.TotalHuman = humanizeBytes(entry.TotalBytes)
+		usage = append(usage, entry)
+	}
+	return usage, rows.Err()
+}
+
+func handleTagUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	db, err := connectReadOnlyDB(*statsDBPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer db.Close()
+
+	usage, err := queryTagUsage(db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": usage})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	// STORED_TIME_LAYOUT is how timestamps are written to the databases:
+	// RFC 3339 in UTC, e.g. "2026-10-15T05:12:58Z". They sort correctly as
+	// text and mean the same thing on any machine that reads the file.
+	STORED_TIME_LAYOUT = "2006-01-02T15:04:05Z"
+
+	// LEGACY_TIME_LAYOUT is the local time older versions stored, and the
+	// default -time-layout.
+	LEGACY_TIME_LAYOUT = "2006-01-02 15:04:05"
+)
+
+// storedTime formats t for a database column.
+func storedTime(t time.Time) string {
+	return t.UTC().Format(STORED_TIME_LAYOUT)
+}
+
+// parseStoredTime reads a timestamp from a database column. Besides RFC 3339
+// it accepts the legacy layout, taken as local time, for rows written before
+// the migration that converts them.
+func parseStoredTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(LEGACY_TIME_LAYOUT, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unrecognized timestamp '%s'", s)
+	}
+	return t, nil
+}
+
+// displayTime formats t for API responses, events and logs, using
+// -time-layout in the -timezone zone.
+func displayTime(t time.Time) string {
+	return t.In(time.Local).Format(*timeLayout)
+}
+
+// displayStoredTime converts a stored timestamp for display. Values that
+// don't parse, such as an empty column, are returned as they are.
+func displayStoredTime(s string) string {
+	t, err := parseStoredTime(s)
+	if err != nil {
+		return s
+	}
+	return displayTime(t)
+}
+
+// convertLegacyTimes rewrites the values of table.column still in the legacy
+// local-time layout as stored timestamps. Values already converted are left
+// alone, so it is safe to run twice on a shared database.
+func convertLegacyTimes(tx *sql.Tx, table, column string) error {
+	rows, err := tx.Query("SELECT rowid, " + column + " FROM " + table + " WHERE " + column + " LIKE '____-__-__ __:__:__'")
+	if err != nil {
+		return fmt.Errorf("error reading %s.%s timestamps: %w", table, column, err)
+	}
+	converted := map[int64]string{}
+	for rows.Next() {
+		var rowid int64
+		var value string
+		if err := rows.Scan(&rowid, &value); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading %s.%s timestamps: %w", table, column, err)
+		}
+		t, err := time.ParseInLocation(LEGACY_TIME_LAYOUT, value, time.Local)
+		if err != nil {
+			continue
+		}
+		converted[rowid] = storedTime(t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading %s.%s timestamps: %w", table, column, err)
+	}
+
+	for rowid, value := range converted {
+		if _, err := tx.Exec("UPDATE "+table+" SET "+column+" = ? WHERE rowid = ?", value, rowid); err != nil {
+			return fmt.Errorf("error converting %s.%s timestamps: %w", table, column, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withTimezone runs the test with time.Local set to name.
+func withTimezone(t *testing.T, name string) {
+	t.Helper()
+	old := time.Local
+	t.Cleanup(func() { time.Local = old })
+	if err := setTimezone(name); err != nil {
+		t.Skip(err)
+	}
+}
+
+func TestParseStoredTime(t *testing.T) {
+	withTimezone(t, "America/New_York")
+	want := time.Date(2026, 2, 1, 3, 0, 0, 0, time.UTC)
+
+	for _, s := range []string{
+		"2026-01-31 22:00:00",       // legacy, local time
+		"2026-02-01T03:00:00Z",      // stored
+		"2026-01-31T22:00:00-05:00", // RFC 3339 with an offset
+	} {
+		got, err := parseStoredTime(s)
+		if err != nil {
+			t.Errorf("parseStoredTime(%q): %v", s, err)
+		} else if !got.Equal(want) {
+			t.Errorf("parseStoredTime(%q) = %v, want %v", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "yesterday", "2026-02-31 10:00:00"} {
+		if _, err := parseStoredTime(s); err == nil {
+			t.Errorf("parseStoredTime(%q) succeeded, want an error", s)
+		}
+	}
+
+	if got := storedTime(want.In(time.Local)); got != "2026-02-01T03:00:00Z" {
+		t.Errorf("storedTime = %q, want 2026-02-01T03:00:00Z", got)
+	}
+	if got := displayStoredTime("2026-02-01T03:00:00Z"); got != "2026-01-31 22:00:00" {
+		t.Errorf("displayStoredTime = %q, want the local 2026-01-31 22:00:00", got)
+	}
+	if got := displayStoredTime(""); got != "" {
+		t.Errorf("displayStoredTime(\"\") = %q, want it unchanged", got)
+	}
+}
+
+func TestLegacyTimesMigrated(t *testing.T) {
+	withTimezone(t, "America/New_York")
+	db, err := connectDB(filepath.Join(t.TempDir(), "network_stats.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A database from before timestamps were stored in UTC.
+	if err := migrate(db, "stats", statsMigrations[:12]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO monthly_stats (id, rx_bytes, tx_bytes, timestamp) VALUES ('a', 5, 6, '2026-01-31 22:00:00')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupStatsDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored string
+	if err := db.QueryRow("SELECT timestamp FROM monthly_stats WHERE id = 'a'").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != "2026-02-01T03:00:00Z" {
+		t.Errorf("migrated timestamp = %q, want 2026-02-01T03:00:00Z", stored)
+	}
+}
+
+func TestMonthlyResetAcrossTimezones(t *testing.T) {
+	kualaLumpur, err := time.LoadLocation("Asia/Kuala_Lumpur")
+	if err != nil {
+		t.Skip(err)
+	}
+	now := time.Now().In(kualaLumpur)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, kualaLumpur)
+	if now.Sub(monthStart) < 24*time.Hour {
+		t.Skip("the month has only just started in some of the zones")
+	}
+	// Half an hour into this month in Kuala Lumpur (UTC+8) is still last
+	// month in UTC and New York.
+	updated := monthStart.Add(30 * time.Minute)
+
+	for _, tc := range []struct {
+		zone  string
+		reset bool
+	}{
+		{"Asia/Kuala_Lumpur", false},
+		{"UTC", true},
+		{"America/New_York", true},
+	} {
+		withTimezone(t, tc.zone)
+		db := openTestStatsDB(t)
+		if _, err := db.Exec("INSERT INTO monthly_stats (id, rx_bytes, tx_bytes, timestamp) VALUES ('a', 5, 6, ?)", storedTime(updated)); err != nil {
+			t.Fatal(err)
+		}
+		if err := resetMonthlyStats(db, &dbMutex); err != nil {
+			t.Fatal(err)
+		}
+
+		if rx, _ := monthlyTotals(t, db, "a"); (rx == 0) != tc.reset {
+			t.Errorf("%s: monthly rx %d after the reset check, want reset %v", tc.zone, rx, tc.reset)
+		}
+		var archived int
+		lastMonth := updated.In(time.Local).Format("2006-01")
+		if err := db.QueryRow("SELECT COUNT(*) FROM monthly_archive WHERE id = 'a' AND year_month = ?", lastMonth).Scan(&archived); err != nil {
+			t.Fatal(err)
+		}
+		if (archived == 1) != tc.reset {
+			t.Errorf("%s: %d archive rows for %s, want reset %v", tc.zone, archived, lastMonth, tc.reset)
+		}
+	}
+}
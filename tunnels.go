@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TUNNEL_ID_PREFIX starts the entity id of a tracked tunnel interface:
+// "tunnel:<label>", e.g. "tunnel:vpn".
+const TUNNEL_ID_PREFIX = "tunnel"
+
+// tunnelLinePattern matches the "<interface>: RX TX" lines of wan_stats.
+var tunnelLinePattern = regexp.MustCompile(`(?m)^\s*([A-Za-z0-9_.@-]+):\s+(\d+)\s+(\d+)`)
+
+var tunnelLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func tunnelID(label string) string {
+	return TUNNEL_ID_PREFIX + WAN_ROUTER_SEPARATOR + label
+}
+
+func isTunnelID(id string) bool {
+	return strings.HasPrefix(id, TUNNEL_ID_PREFIX+WAN_ROUTER_SEPARATOR)
+}
+
+// tunnelCondition is an SQL condition matching column against every tunnel
+// entity. Tunnel traffic also crosses the WAN, so like wanCondition it keeps
+// tunnels out of anything that sums client traffic.
+func tunnelCondition(column string) string {
+	prefix := TUNNEL_ID_PREFIX + WAN_ROUTER_SEPARATOR
+	return "substr(" + column + ", 1, " + strconv.Itoa(len(prefix)) + ") = '" + prefix + "'"
+}
+
+// normalizeTunnels validates a router's tunnels map, interface to label,
+// and returns it with every label filled in; an empty label is the
+// interface's name.
+func normalizeTunnels(tunnels map[string]string) (map[string]string, error) {
+	normalized := map[string]string{}
+	labels := map[string]string{}
+	for iface, label := range tunnels {
+		iface = strings.TrimSpace(iface)
+		if iface == "" || iface == "wan" || iface == "wan6" || !tunnelLinePattern.MatchString(iface+": 0 0") {
+			return nil, fmt.Errorf("can't track interface '%s' as a tunnel", iface)
+		}
+		label = strings.TrimSpace(label)
+		if label == "" {
+			label = iface
+		}
+		if !tunnelLabelPattern.MatchString(label) {
+			return nil, fmt.Errorf("invalid label '%s' for %s, expected letters, digits, '.', '_' or '-'", label, iface)
+		}
+		if other, ok := labels[label]; ok {
+			return nil, fmt.Errorf("%s and %s are both labelled '%s'", other, iface, label)
+		}
+		labels[label] = iface
+		normalized[iface] = label
+	}
+	return normalized, nil
+}
+
+// parseTunnelStats returns the counters of the tunnels in data, keyed by
+// interface. A tunnel without a line, e.g. because it is down, is left out.
+func parseTunnelStats(data string, tunnels map[string]string) (map[string]WANStats, error) {
+	if len(tunnels) == 0 {
+		return nil, nil
+	}
+	found := map[string]WANStats{}
+	for _, match := range tunnelLinePattern.FindAllStringSubmatch(data, -1) {
+		if _, ok := tunnels[match[1]]; !ok {
+			continue
+		}
+		rxBytes, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s RX bytes: %w", match[1], err)
+		}
+		txBytes, err := strconv.ParseInt(match[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s TX bytes: %w", match[1], err)
+		}
+		found[match[1]] = WANStats{RXBytes: rxBytes, TXBytes: txBytes}
+	}
+	return found, nil
+}
+
+// tunnelUpdates returns the readings of a router's tunnels, sorted by
+// interface, and their entity ids.
+func tunnelUpdates(routerIP string, urls RouterConfig, tunnels map[string]WANStats) ([]TrafficUpdate, []string) {
+	var ifaces []string
+	for iface := range tunnels {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+
+	var updates []TrafficUpdate
+	var ids []string
+	for _, iface := range ifaces {
+		id := tunnelID(urls.tunnels[iface])
+		stats := tunnels[iface]
+		debugf("%s: %s (%s) %+v\n", routerIP, id, iface, stats)
+		snapshots.addWAN(routerIP, id, stats)
+		updates = append(updates, TrafficUpdate{EntityID: id, Source: routerIP, RXBytes: stats.RXBytes, TXBytes: stats.TXBytes, ResetPolicy: urls.ResetPolicy, Offset: urls.offsetFor(id)})
+		ids = append(ids, id)
+	}
+	return updates, ids
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTunnelStatsMixedOutput(t *testing.T) {
+	data := "wan: 1000 500\nwg0: 300 100\n  tun0: 50 20\nwan6: 10 5\nwg1: 7 7\n"
+	tunnels, err := normalizeTunnels(map[string]string{"wg0": "vpn", "tun0": ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunnels["wg0"] != "vpn" || tunnels["tun0"] != "tun0" {
+		t.Errorf("normalizeTunnels = %v, want wg0 labelled vpn and tun0 labelled tun0", tunnels)
+	}
+
+	got, err := parseTunnelStats(data, tunnels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]WANStats{"wg0": {RXBytes: 300, TXBytes: 100}, "tun0": {RXBytes: 50, TXBytes: 20}}
+	if len(got) != len(want) || got["wg0"] != want["wg0"] || got["tun0"] != want["tun0"] {
+		t.Errorf("parseTunnelStats = %v, want %v (wg1 isn't tracked)", got, want)
+	}
+
+	// The tunnel lines don't disturb the WAN parsers.
+	wan, err := parseWANStats(data, nil)
+	if err != nil || *wan != (WANStats{RXBytes: 1000, TXBytes: 500}) {
+		t.Errorf("parseWANStats = %v, %v", wan, err)
+	}
+	wan6, err := parseWAN6Stats(data)
+	if err != nil || wan6 == nil || *wan6 != (WANStats{RXBytes: 10, TXBytes: 5}) {
+		t.Errorf("parseWAN6Stats = %v, %v", wan6, err)
+	}
+}
+
+func TestNormalizeTunnelsRejects(t *testing.T) {
+	for _, tunnels := range []map[string]string{
+		{"wan": "x"},
+		{"wan6": ""},
+		{"wg0": "a b"},
+		{"wg0": "x", "tun0": "x"},
+		{"bad iface": ""},
+	} {
+		if _, err := normalizeTunnels(tunnels); err == nil {
+			t.Errorf("normalizeTunnels(%v) succeeded, want an error", tunnels)
+		}
+	}
+}
+
+func TestStoreWANExcludesTunnels(t *testing.T) {
+	db := openTestStatsDB(t)
+	cfg := Config{"r1": {WANStatsCommand: "true", Tunnels: map[string]string{"wg0": "vpn", "tun0": ""}, ExcludeTunnelsFromWAN: true}}
+	if err := validateConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	urls := cfg["r1"]
+	for _, c := range []struct{ wan, wg, tun WANStats }{
+		{WANStats{1000, 500}, WANStats{300, 100}, WANStats{50, 20}},
+		{WANStats{2000, 900}, WANStats{600, 200}, WANStats{150, 30}},
+	} {
+		result := &RouterResult{Router: "r1"}
+		wan := c.wan
+		storeWAN(result, db, urls, urls.wanIDs(MAIN_WAN_ID, "r1"), &wan, map[string]WANStats{"wg0": c.wg, "tun0": c.tun})
+		if !result.WAN || len(result.Errors) > 0 {
+			t.Fatalf("storeWAN: %+v", result)
+		}
+	}
+
+	// The baseline is the whole counter; the second cycle's WAN increment
+	// of 1000/400 loses the tunnels' 400/110.
+	if rx, tx := monthlyTotals(t, db, MAIN_WAN_ID); rx != 1000+600 || tx != 500+290 {
+		t.Errorf("WAN monthly = %d/%d, want 1600/790", rx, tx)
+	}
+	if rx, tx := monthlyTotals(t, db, tunnelID("vpn")); rx != 600 || tx != 200 {
+		t.Errorf("tunnel:vpn monthly = %d/%d, want 600/200", rx, tx)
+	}
+	if rx, tx := monthlyTotals(t, db, tunnelID("tun0")); rx != 150 || tx != 30 {
+		t.Errorf("tunnel:tun0 monthly = %d/%d, want 150/30", rx, tx)
+	}
+}
+
+func TestTunnelsAreNotClients(t *testing.T) {
+	db := openTestStatsDB(t)
+	client := "aa:bb:cc:dd:ee:ff"
+	for _, n := range []int64{1000, 1500} {
+		storeReadings(t, db,
+			TrafficUpdate{EntityID: client, Source: "r1", RXBytes: n, TXBytes: n},
+			TrafficUpdate{EntityID: tunnelID("vpn"), Source: "r1", RXBytes: 10 * n, TXBytes: 10 * n},
+		)
+	}
+
+	if err := updateTotalStats(db, &dbMutex, TOTAL_SOURCE_CLIENTS); err != nil {
+		t.Fatal(err)
+	}
+	if rx, tx := monthlyTotals(t, db, TOTAL_ID); rx != 1500 || tx != 1500 {
+		t.Errorf("%s from clients = %d/%d, want 1500/1500", TOTAL_ID, rx, tx)
+	}
+
+	loads, err := queryRouterLoad(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loads) != 1 || loads[0].Clients != 1 || loads[0].RXBytes != 1500 {
+		t.Errorf("queryRouterLoad = %+v, want only the client's 1500 bytes received", loads)
+	}
+
+	usage, err := queryTagUsage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || usage[0].Tag != UNTAGGED_TAG || usage[0].Entities != 1 {
+		t.Errorf("queryTagUsage = %+v, want only the client untagged", usage)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// UBUS_ANONYMOUS_SESSION is the session id rpcd accepts for objects that are
+// exposed without logging in.
+const UBUS_ANONYMOUS_SESSION = "00000000000000000000000000000000"
+
+type ubusRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int           `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type ubusResponse struct {
+	Result []json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type ubusInterfaceStatus struct {
+	Statistics *struct {
+		RXBytes int64 `json:"rx_bytes"`
+		TXBytes int64 `json:"tx_bytes"`
+	} `json:"statistics"`
+}
+
+type ubusAssocList struct {
+	Results []struct {
+		MAC string `json:"mac"`
+		RX  struct {
+			Bytes int64 `json:"bytes"`
+		} `json:"rx"`
+		TX struct {
+			Bytes int64 `json:"bytes"`
+		} `json:"tx"`
+		ConnectedTime *int64 `json:"connected_time"`
+		Signal        *int   `json:"signal"`
+		Noise         *int   `json:"noise"`
+	} `json:"results"`
+}
+
+// fetchUbus issues a single JSON-RPC "call" against an OpenWRT ubus HTTP
+// endpoint (usually http://<router>/ubus) and returns the raw response body.
+// A router with ubus_username calls with its logged-in session, logging in
+// again once if rpcd says the session is gone.
+func fetchUbus(urls RouterConfig, url, object, method string, args interface{}) (string, error) {
+	if url == "" {
+		return "", ErrURLEmpty
+	}
+	if urls.UbusUsername == "" {
+		session := urls.UbusSession
+		if session == "" {
+			session = UBUS_ANONYMOUS_SESSION
+		}
+		return callUbus(urls, url, session, object, method, args)
+	}
+
+	session := ubusSessionFor(urls, url)
+	for attempt := 0; ; attempt++ {
+		id, err := session.get(urls, url)
+		if err != nil {
+			return "", err
+		}
+		data, err := callUbus(urls, url, id, object, method, args)
+		if err != nil || !ubusAccessDenied(data) || attempt > 0 {
+			if err == nil {
+				session.touch(id)
+			}
+			return data, err
+		}
+		debugf("%s: ubus session for %s was rejected, logging in again.\n", urls.name, urls.UbusUsername)
+		session.expire(id)
+	}
+}
+
+// callUbus posts one call with session and returns the raw response body.
+func callUbus(urls RouterConfig, url, session, object, method string, args interface{}) (string, error) {
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+
+	body, err := json.Marshal(ubusRequest{
+		JSONRPC: "2.0",
+		ID:      1,
+		Method:  "call",
+		Params:  []interface{}{session, object, method, args},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error encoding ubus request for %s %s: %w", object, method, err)
+	}
+
+	req, cancel, err := newRouterRequest(urls, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := routerHTTPClient(urls, url).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error calling ubus %s %s at %s: %w", object, method, url, err)
+	}
+	defer resp.Body.Close()
+	logRedirect(url, resp)
+
+	if resp.StatusCode != http.StatusOK {
+		recordResponse(urls.name, urls.endpoint, FetchResult{StatusCode: resp.StatusCode})
+		return "", fmt.Errorf("HTTP error calling ubus %s %s at %s: %d - %s", object, method, url, resp.StatusCode, resp.Status)
+	}
+
+	bodyBytes, err := readLimited(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading ubus response from %s: %w", url, err)
+	}
+	recordResponse(urls.name, urls.endpoint, FetchResult{StatusCode: resp.StatusCode, Size: int64(len(bodyBytes))})
+
+	return string(bodyBytes), nil
+}
+
+// ubusResult unwraps a JSON-RPC response into the object returned by the
+// called method. ubus replies with result [status] or [status, object]; a
+// non-zero status is an error.
+func ubusResult(data string) (json.RawMessage, error) {
+	var resp ubusResponse
+	if err := json.Unmarshal([]byte(data), &resp); err != nil {
+		return nil, fmt.Errorf("invalid ubus response: %w", err)
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("ubus error %d: %s", resp.Error.Code, resp.Error.Message)
+	}
+	if len(resp.Result) == 0 {
+		return nil, fmt.Errorf("ubus response has no result")
+	}
+
+	var status int
+	if err := json.Unmarshal(resp.Result[0], &status); err != nil {
+		return nil, fmt.Errorf("invalid ubus status: %w", err)
+	}
+	if status == UBUS_STATUS_PERMISSION_DENIED {
+		return nil, fmt.Errorf("ubus call failed with status %d: permission denied", status)
+	}
+	if status != 0 {
+		return nil, fmt.Errorf("ubus call failed with status %d", status)
+	}
+	if len(resp.Result) < 2 {
+		return nil, nil
+	}
+	return resp.Result[1], nil
+}
+
+func parseUbusWANStats(data string) (*WANStats, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	result, err := ubusResult(data)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+
+	var status ubusInterfaceStatus
+	if err := json.Unmarshal(result, &status); err != nil {
+		return nil, fmt.Errorf("error decoding ubus interface status: %w", err)
+	}
+	if status.Statistics == nil {
+		return nil, fmt.Errorf("ubus interface status has no statistics")
+	}
+
+	return &WANStats{
+		RXBytes: status.Statistics.RXBytes,
+		TXBytes: status.Statistics.TXBytes,
+	}, nil
+}
+
+func parseUbusAssocList(data string) ([]ClientStats, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	result, err := ubusResult(data)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+
+	var list ubusAssocList
+	if err := json.Unmarshal(result, &list); err != nil {
+		return nil, fmt.Errorf("error decoding ubus assoclist: %w", err)
+	}
+
+	var clients []ClientStats
+	for _, entry := range list.Results {
+		macAddress, ok := normalizeMAC(entry.MAC)
+		if !ok {
+			debugf("Warning: Skipping ubus assoclist entry with invalid MAC address: '%s'\n", entry.MAC)
+			continue
+		}
+		client := ClientStats{
+			MACAddress: macAddress,
+			RXBytes:    entry.RX.Bytes,
+			TXBytes:    entry.TX.Bytes,
+		}
+		if entry.ConnectedTime != nil {
+			client.ConnectedTime = *entry.ConnectedTime
+			client.HasConnectedTime = true
+		}
+		if entry.Signal != nil {
+			client.Signal, client.HasSignal = *entry.Signal, true
+		}
+		if entry.Noise != nil {
+			client.Noise, client.HasNoise = *entry.Noise, true
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+func fetchUbusWANStats(urls RouterConfig) (*WANStats, error) {
+	data, err := fetchUbus(urls, urls.WANStatsURL, "network.interface.wan", "status", nil)
+	if err != nil {
+		return nil, err
+	}
+	wan, err := parseUbusWANStats(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ubus WAN stats: %w", err)
+	}
+	return wan, nil
+}
+
+func fetchUbusWiFiStats(urls RouterConfig) ([]ClientStats, error) {
+	if urls.APStatsURL == "" {
+		return nil, ErrURLEmpty
+	}
+
+	var clients []ClientStats
+	for i, device := range urls.UbusWiFiDevices {
+		if i > 0 {
+			urls.pause()
+		}
+		data, err := fetchUbus(urls, urls.APStatsURL, "iwinfo", "assoclist", map[string]string{"device": device})
+		if err != nil {
+			return nil, err
+		}
+		deviceClients, err := parseUbusAssocList(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing ubus assoclist for %s: %w", device, err)
+		}
+		clients = append(clients, deviceClients...)
+	}
+	return clients, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// UBUS_STATUS_PERMISSION_DENIED is the ubus status rpcd returns for a
+	// call the session may not make, including one whose session expired,
+	// and for a login with the wrong password.
+	UBUS_STATUS_PERMISSION_DENIED = 6
+
+	// UBUS_ACCESS_DENIED_CODE is the JSON-RPC error uhttpd returns for a
+	// session id rpcd doesn't know.
+	UBUS_ACCESS_DENIED_CODE = -32002
+
+	// UBUS_SESSION_MARGIN is how long before its expiry a session is
+	// replaced rather than used, so a call doesn't race the timeout.
+	UBUS_SESSION_MARGIN = 5 * time.Second
+)
+
+// ubusSession is the rpcd session the collector holds on one router's ubus
+// endpoint. It is logged in on the first call and kept across cycles; rpcd
+// extends a session each time it is used, so it only runs out when the
+// router goes unqueried for its timeout or reboots.
+type ubusSession struct {
+	mutex       sync.Mutex
+	id          string
+	credentials string
+	timeout     time.Duration
+	expires     time.Time
+}
+
+var (
+	ubusSessionsMutex sync.Mutex
+	ubusSessions      = map[string]*ubusSession{}
+)
+
+type ubusLoginResult struct {
+	Session string `json:"ubus_rpc_session"`
+	Timeout int64  `json:"timeout"`
+	Expires int64  `json:"expires"`
+}
+
+// ubusSessionFor returns the session for a router's ubus url, keyed so that
+// routers, and a router's endpoints, never share one.
+func ubusSessionFor(urls RouterConfig, url string) *ubusSession {
+	key := urls.name + " " + url + " " + urls.UbusUsername
+
+	ubusSessionsMutex.Lock()
+	defer ubusSessionsMutex.Unlock()
+
+	session, ok := ubusSessions[key]
+	if !ok {
+		session = &ubusSession{}
+		ubusSessions[key] = session
+	}
+	return session
+}
+
+// get returns the session id, logging in when there is none yet, it is
+// about to expire or the configured password changed. The lock is held
+// during the login, so concurrent calls wait for one login.
+func (s *ubusSession) get(urls RouterConfig, url string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	credentials := urls.UbusUsername + "\x00" + urls.UbusPassword
+	if s.id != "" && s.credentials == credentials && (s.expires.IsZero() || time.Now().Add(UBUS_SESSION_MARGIN).Before(s.expires)) {
+		return s.id, nil
+	}
+	s.id = ""
+
+	data, err := callUbus(urls, url, UBUS_ANONYMOUS_SESSION, "session", "login", map[string]string{
+		"username": urls.UbusUsername,
+		"password": urls.UbusPassword,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error logging in to ubus as %s: %w", urls.UbusUsername, err)
+	}
+	result, err := ubusResult(data)
+	if err != nil {
+		return "", fmt.Errorf("error logging in to ubus as %s: %w", urls.UbusUsername, err)
+	}
+	var login ubusLoginResult
+	if result != nil {
+		if err := json.Unmarshal(result, &login); err != nil {
+			return "", fmt.Errorf("error decoding ubus login for %s: %w", urls.UbusUsername, err)
+		}
+	}
+	if login.Session == "" {
+		return "", fmt.Errorf("ubus login as %s returned no session", urls.UbusUsername)
+	}
+
+	// A fresh session has expires equal to timeout; both are seconds and
+	// either may be missing, in which case only a rejected call ends it.
+	s.id, s.credentials = login.Session, credentials
+	s.timeout = time.Duration(login.Timeout) * time.Second
+	s.expires = time.Time{}
+	if login.Expires > 0 {
+		s.expires = time.Now().Add(time.Duration(login.Expires) * time.Second)
+	} else if s.timeout > 0 {
+		s.expires = time.Now().Add(s.timeout)
+	}
+	debugf("%s: logged in to ubus as %s, session expires in %ds.\n", urls.name, urls.UbusUsername, login.Expires)
+	return s.id, nil
+}
+
+// touch notes that id was just used, which restarts its timeout in rpcd.
+func (s *ubusSession) touch(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.id == id && s.timeout > 0 {
+		s.expires = time.Now().Add(s.timeout)
+	}
+}
+
+// expire forgets id if it is still the session's, so the next get logs in.
+func (s *ubusSession) expire(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.id == id {
+		s.id = ""
+	}
+}
+
+// ubusAccessDenied reports whether a response says the session can't make
+// the call: unknown to rpcd, expired, or lacking the permission.
+func ubusAccessDenied(data string) bool {
+	var resp ubusResponse
+	if err := json.Unmarshal([]byte(data), &resp); err != nil {
+		return false
+	}
+	if resp.Error != nil {
+		return resp.Error.Code == UBUS_ACCESS_DENIED_CODE
+	}
+	var status int
+	return len(resp.Result) > 0 && json.Unmarshal(resp.Result[0], &status) == nil && status == UBUS_STATUS_PERMISSION_DENIED
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeUbus is a router's ubus JSON-RPC endpoint that accepts the password
+// "secret" and forgets its sessions when it reboots.
+type fakeUbus struct {
+	mutex    sync.Mutex
+	logins   int
+	calls    int
+	sessions map[string]bool
+}
+
+func (u *fakeUbus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req ubusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	session, object := req.Params[0].(string), req.Params[1].(string)
+	if object == "session" {
+		args := req.Params[3].(map[string]interface{})
+		if args["password"] != "secret" {
+			fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":[6]}`)
+			return
+		}
+		u.logins++
+		id := fmt.Sprintf("session%d", u.logins)
+		u.sessions[id] = true
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":[0,{"ubus_rpc_session":"%s","timeout":300,"expires":300}]}`, id)
+		return
+	}
+	u.calls++
+	if !u.sessions[session] {
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"error":{"code":-32002,"message":"Access denied"}}`)
+		return
+	}
+	fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":[0,{"statistics":{"rx_bytes":5,"tx_bytes":6}}]}`)
+}
+
+func (u *fakeUbus) reboot() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.sessions = map[string]bool{}
+}
+
+func (u *fakeUbus) counts() (logins, calls int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.logins, u.calls
+}
+
+func TestUbusSessionExpiry(t *testing.T) {
+	ubus := &fakeUbus{sessions: map[string]bool{}}
+	server := httptest.NewServer(ubus)
+	defer server.Close()
+	urls := RouterConfig{Format: FORMAT_UBUS, WANStatsURL: server.URL, UbusUsername: "netstats", UbusPassword: "secret", name: "r1"}
+
+	fetch := func(when string) {
+		t.Helper()
+		if wan, err := fetchUbusWANStats(urls); err != nil || wan.RXBytes != 5 || wan.TXBytes != 6 {
+			t.Fatalf("%s: fetchUbusWANStats = %+v, %v", when, wan, err)
+		}
+	}
+	expect := func(when string, wantLogins, wantCalls int) {
+		t.Helper()
+		if logins, calls := ubus.counts(); logins != wantLogins || calls != wantCalls {
+			t.Errorf("%s: %d logins and %d calls, want %d and %d", when, logins, calls, wantLogins, wantCalls)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		fetch("fresh session")
+	}
+	expect("fresh session", 1, 3)
+
+	// The router forgets the session: the call is denied, and retried once
+	// after logging in again.
+	ubus.reboot()
+	fetch("after a reboot")
+	expect("after a reboot", 2, 5)
+
+	// A session about to expire is renewed before it is used.
+	session := ubusSessionFor(urls, server.URL)
+	session.mutex.Lock()
+	session.expires = session.expires.Add(-299e9)
+	session.mutex.Unlock()
+	fetch("near expiry")
+	expect("near expiry", 3, 6)
+
+	wrong := urls
+	wrong.UbusPassword = "wrong"
+	if _, err := fetchUbusWANStats(wrong); err == nil {
+		t.Error("fetch with the wrong password succeeded")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// UNIX_URL_PREFIX marks a URL served over a Unix domain socket, for running
+// on the router itself. The socket path is followed by the HTTP path after
+// a colon, as in nginx's proxy_pass:
+//
+//	unix:///var/run/uhttpd.sock:/cgi-bin/totalwifi.cgi
+//
+// Without the colon the request is for "/".
+const UNIX_URL_PREFIX = "unix://"
+
+// UNIX_REQUEST_HOST is the host of requests sent over a socket. Nothing
+// resolves it; it only fills the request line and Host header.
+const UNIX_REQUEST_HOST = "localhost"
+
+var (
+	unixClientsMutex sync.Mutex
+	unixClients      = map[string]*http.Client{}
+)
+
+// splitUnixURL returns the socket path of a unix:// URL and the http:// URL
+// to request over it. ok is false for any other URL.
+func splitUnixURL(raw string) (socketPath, requestURL string, ok bool) {
+	if !strings.HasPrefix(raw, UNIX_URL_PREFIX) {
+		return "", "", false
+	}
+	socketPath = strings.TrimPrefix(raw, UNIX_URL_PREFIX)
+	path := "/"
+	if i := strings.Index(socketPath, ":"); i >= 0 {
+		socketPath, path = socketPath[:i], socketPath[i+1:]
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	return socketPath, "http://" + UNIX_REQUEST_HOST + path, true
+}
+
+// validateUnixURL checks that a unix:// URL names an absolute socket path.
+// Other URLs are left to the HTTP client.
+func validateUnixURL(raw string) error {
+	socketPath, _, ok := splitUnixURL(raw)
+	if ok && !strings.HasPrefix(socketPath, "/") {
+		return fmt.Errorf("invalid URL '%s': socket path must be absolute", raw)
+	}
+	return nil
+}
+
+// requestURL is the URL actually requested for a configured one.
+func requestURL(raw string) string {
+	if _, target, ok := splitUnixURL(raw); ok {
+		return target
+	}
+	return raw
+}
+
+// unixHTTPClient returns the client for a socket: every connection dials
+// socketPath, whatever the request's host. Proxies don't apply.
+func unixHTTPClient(socketPath string) *http.Client {
+	unixClientsMutex.Lock()
+	defer unixClientsMutex.Unlock()
+
+	if client, ok := unixClients[socketPath]; ok {
+		return client
+	}
+	client := newHTTPClient(nil, nil)
+	var dialer net.Dialer
+	client.Transport.(*http.Transport).DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+	unixClients[socketPath] = client
+	return client
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchDataUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "stats.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/cgi-bin/totalwifi.cgi", http.StatusFound)
+			return
+		}
+		if r.Header.Get("X-Test") != "yes" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("path=" + r.URL.RequestURI()))
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	urls := RouterConfig{Headers: map[string]string{"X-Test": "yes"}}
+	for _, tc := range []struct{ url, want string }{
+		{"unix://" + socketPath + ":/cgi-bin/totalwifi.cgi?x=1", "path=/cgi-bin/totalwifi.cgi?x=1"},
+		{"unix://" + socketPath, "path=/"},
+		// Redirects stay on the socket.
+		{"unix://" + socketPath + ":/old", "path=/cgi-bin/totalwifi.cgi"},
+	} {
+		if got, err := fetchData(urls, tc.url); err != nil || got != tc.want {
+			t.Errorf("fetchData(%s) = %q, %v; want %q", tc.url, got, err, tc.want)
+		}
+	}
+
+	tcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("tcp")) }))
+	defer tcp.Close()
+	if got, err := fetchData(RouterConfig{}, tcp.URL); err != nil || got != "tcp" {
+		t.Errorf("fetchData over TCP = %q, %v", got, err)
+	}
+}
+
+func TestValidateUnixURL(t *testing.T) {
+	if err := validateUnixURL("unix://relative.sock"); err == nil {
+		t.Error("relative socket path accepted")
+	}
+	if err := validateUnixURL("http://192.168.1.1/cgi-bin/totalwifi.cgi"); err != nil {
+		t.Errorf("HTTP URL rejected: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// databaseFileSize is the space a database takes on disk, counting its WAL
+// file if it has one.
+func databaseFileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if wal, err := os.Stat(path + "-wal"); err == nil {
+		size += wal.Size()
+	}
+	return size, nil
+}
+
+// vacuumDB rebuilds the database at path so the pages freed by deletions and
+// pruning are returned to the file system, and returns the bytes reclaimed.
+// In WAL mode the rebuilt pages pass through the WAL, so it is checkpointed
+// and truncated afterwards. dbMutex is held throughout so none of our own
+// writers run in the middle; other processes wait on SQLite's lock.
+func vacuumDB(path string) (int64, error) {
+	before, err := databaseFileSize(path)
+	if err != nil {
+		return 0, fmt.Errorf("error reading size of %s: %w", path, err)
+	}
+
+	db, err := connectDB(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if _, err := db.Exec("VACUUM"); err != nil {
+		return 0, fmt.Errorf("error vacuuming %s: %w", path, err)
+	}
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return 0, fmt.Errorf("error checkpointing %s: %w", path, err)
+	}
+
+	after, err := databaseFileSize(path)
+	if err != nil {
+		return 0, fmt.Errorf("error reading size of %s: %w", path, err)
+	}
+	fmt.Printf("Vacuumed %s: %s reclaimed (%s to %s).\n", path, humanizeBytes(before-after), humanizeBytes(before), humanizeBytes(after))
+	return before - after, nil
+}
+
+// vacuumDatabases vacuums both databases, or the one file in single-database
+// mode. In-memory databases have no file to shrink and are skipped.
+func vacuumDatabases() error {
+	paths := []string{*statsDBPath}
+	if *dhcpDBPath != *statsDBPath {
+		paths = append(paths, *dhcpDBPath)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			debugf("Not vacuuming %s: %v\n", path, err)
+			continue
+		}
+		if _, err := vacuumDB(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startVacuumSchedule vacuums the databases every interval until the process
+// exits. It waits for any running cycle to finish first, so a vacuum never
+// lands between a cycle's writes. It does nothing when interval is not
+// positive.
+func startVacuumSchedule(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			cycleLock <- struct{}{}
+			err := vacuumDatabases()
+			<-cycleLock
+			if err != nil {
+				fmt.Printf("Scheduled vacuum failed: %v\n", err)
+			}
+		}
+	}()
+}
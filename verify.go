@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+type verifyResult struct {
+	Router   string
+	Endpoint string
+	Status   string
+	Records  int
+	Detail   string
+}
+
+// verifyRouter fetches and parses each of the router's configured endpoints
+// once. Disabled endpoints and those with neither a URL nor a command are
+// reported as SKIP.
+func verifyRouter(routerIP string, urls RouterConfig) []verifyResult {
+	check := func(endpoint, url, command string, fetch func() (int, error)) verifyResult {
+		result := verifyResult{Router: routerIP, Endpoint: endpoint, Detail: url}
+		if url == "" {
+			result.Detail = command
+		}
+		if urls.CombinedURL != "" {
+			result.Detail = urls.CombinedURL
+		}
+		if urls.disabled[endpoint] {
+			result.Status = "SKIP"
+			result.Detail = "disabled"
+			return result
+		}
+		if !urls.endpointEnabled(endpoint) {
+			result.Status = "SKIP"
+			result.Detail = "no URL configured"
+			return result
+		}
+		n, err := fetch()
+		if err != nil {
+			result.Status = "FAIL"
+			result.Detail = err.Error()
+			return result
+		}
+		result.Status = "PASS"
+		result.Records = n
+		return result
+	}
+
+	return []verifyResult{
+		check("wifi", urls.APStatsURL, urls.APStatsCommand, func() (int, error) {
+			clients, _, err := collectWiFiStats(routerIP, urls)
+			return len(clients), err
+		}),
+		check("wan", urls.WANStatsURL, urls.WANStatsCommand, func() (int, error) {
+			wan, wan6, tunnels, err := collectWANStats(routerIP, urls)
+			if err != nil {
+				return 0, err
+			}
+			if wan == nil && wan6 == nil {
+				return 0, fmt.Errorf("empty WAN response")
+			}
+			records := 0
+			if wan != nil {
+				records++
+			}
+			if wan6 != nil {
+				records++
+			}
+			return records + len(tunnels), nil
+		}),
+		check("dhcp", urls.DHCPLeasesURL, urls.DHCPLeasesCommand, func() (int, error) {
+			data, err := fetchEndpoint(urls, "dhcp")
+			if err != nil {
+				return 0, err
+			}
+			leases, prefixes, _, err := parseLeases(urls, data)
+			return len(leases) + len(prefixes), err
+		}),
+	}
+}
+
+// runVerify checks every configured router and prints a PASS/FAIL table. It
+// never opens the databases and returns the process exit code: 1 if any
+// endpoint failed.
+func runVerify() int {
+	routers, err := loadRouters()
+	if err != nil {
+		fmt.Printf("Failed to load configuration: %v\n", err)
+		return 1
+	}
+	if len(routers) == 0 {
+		fmt.Println("No routers configured.")
+		return 1
+	}
+
+	routerIPs := make([]string, 0, len(routers))
+	for routerIP := range routers {
+		routerIPs = append(routerIPs, routerIP)
+	}
+	sort.Strings(routerIPs)
+
+	var results []verifyResult
+	for _, routerIP := range routerIPs {
+		results = append(results, verifyRouter(routerIP, routers[routerIP])...)
+	}
+
+	failed := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTER\tENDPOINT\tSTATUS\tRECORDS\tDETAIL")
+	for _, result := range results {
+		if result.Status == "FAIL" {
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", result.Router, result.Endpoint, result.Status, result.Records, result.Detail)
+	}
+	tw.Flush()
+
+	if failed > 0 {
+		fmt.Printf("%d endpoint(s) failed.\n", failed)
+		return 1
+	}
+	fmt.Println("All configured endpoints passed.")
+	return 0
+}
@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+// Build metadata, set at link time:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("router_stats_go %s (commit %s, built %s)", version, commit, buildDate)
+}
@@ -0,0 +1,44 @@
+package main
+
+import "sync"
+
+// warmupTracker counts each entity's readings since the collector started,
+// or since its counter last reset or became a new baseline, so the first
+// -warmup-cycles of them can be kept out of the totals. It lives in memory
+// on purpose: a restart is one of the things warm-up is for.
+type warmupTracker struct {
+	mutex sync.Mutex
+	seen  map[string]int
+}
+
+var entityWarmup = &warmupTracker{seen: map[string]int{}}
+
+// warmingUp reports whether a reading of id falls within the first cycles
+// readings. restarted says the reading starts a new count: a baseline or a
+// counter reset.
+func (w *warmupTracker) warmingUp(id string, restarted bool, cycles int) bool {
+	if cycles <= 0 {
+		return false
+	}
+	if restarted {
+		return true
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.seen[id] < cycles
+}
+
+// observe counts committed readings. Like uploadDetector.observe it runs
+// after the commit, so a batch that is retried isn't counted twice.
+func (w *warmupTracker) observe(increments []trafficIncrement) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, increment := range increments {
+		if increment.Baseline || increment.Reset {
+			w.seen[increment.EntityID] = 1
+		} else {
+			w.seen[increment.EntityID]++
+		}
+	}
+}
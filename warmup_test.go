@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestWarmupSuppression(t *testing.T) {
+	oldCycles, oldWarmup := *warmupCycles, entityWarmup
+	defer func() { *warmupCycles, entityWarmup = oldCycles, oldWarmup }()
+	*warmupCycles = 2
+	entityWarmup = &warmupTracker{seen: map[string]int{}}
+
+	db := openTestStatsDB(t)
+	for _, bytes := range []int64{1000, 1500, 2000, 2600, 10, 500, 900} {
+		storeReadings(t, db, TrafficUpdate{EntityID: MAIN_WAN_ID, Source: "r1", RXBytes: bytes, TXBytes: bytes})
+	}
+
+	// The baseline and the next reading are suppressed, 500 and 600 count,
+	// then the reset to 10 and the 490 after it are suppressed and 400
+	// counts.
+	var rx, last int64
+	if err := db.QueryRow("SELECT rx_bytes FROM alltime_stats WHERE id = ?", MAIN_WAN_ID).Scan(&rx); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT rx_bytes FROM cumulative_stats WHERE id = ?", MAIN_WAN_ID).Scan(&last); err != nil {
+		t.Fatal(err)
+	}
+	if rx != 1500 || last != 900 {
+		t.Errorf("counted %d up to reading %d, want 1500 up to 900", rx, last)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lease lifecycle events sent to -lease-webhook.
+const (
+	LEASE_EVENT_NEW     = "new"
+	LEASE_EVENT_RENEWED = "renewed"
+	LEASE_EVENT_EXPIRED = "expired"
+
+	WEBHOOK_ATTEMPTS   = 3
+	WEBHOOK_QUEUE_SIZE = 256
+)
+
+type LeaseEvent struct {
+	Event        string `json:"event"`
+	MACAddress   string `json:"mac"`
+	IPAddress    string `json:"ip"`
+	Hostname     string `json:"hostname"`
+	LeaseEndTime int64  `json:"lease_end_time"`
+	Timestamp    string `json:"timestamp"`
+}
+
+// webhook POSTs JSON messages to a URL from a background goroutine, so a
+// slow or unreachable receiver never holds up a collection cycle. name
+// ("Lease", "Anomaly") labels its log lines, and headers are added to every
+// request, e.g. for authentication.
+type webhook struct {
+	name    string
+	url     string
+	headers http.Header
+	client  *http.Client
+	queue   chan webhookMessage
+}
+
+// webhookMessage is an encoded event and a short description for the log.
+type webhookMessage struct {
+	body        []byte
+	description string
+}
+
+// leaseEvents is nil unless -lease-webhook is set; sending to a nil webhook
+// does nothing.
+var leaseEvents *webhook
+
+func newWebhook(name, url string) *webhook {
+	h := &webhook{
+		name:   name,
+		url:    url,
+		client: &http.Client{Timeout: FETCH_TIMEOUT},
+		queue:  make(chan webhookMessage, WEBHOOK_QUEUE_SIZE),
+	}
+	go h.run()
+	return h
+}
+
+// send queues LeaseEvents for delivery.
+func (h *webhook) send(events []LeaseEvent) {
+	for _, event := range events {
+		h.enqueue(event, fmt.Sprintf("%s event (%s)", event.Event, event.MACAddress))
+	}
+}
+
+// enqueue encodes event and queues it. When the queue is full the event is
+// dropped and logged rather than waited on.
+func (h *webhook) enqueue(event interface{}, description string) {
+	if h == nil {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("Error encoding %s webhook event: %v\n", strings.ToLower(h.name), err)
+		return
+	}
+	select {
+	case h.queue <- webhookMessage{body: body, description: description}:
+	default:
+		fmt.Printf("%s webhook queue full, dropping %s.\n", h.name, description)
+	}
+}
+
+func (h *webhook) run() {
+	for message := range h.queue {
+		h.deliver(message)
+	}
+}
+
+// deliver POSTs one message, trying up to WEBHOOK_ATTEMPTS times with a
+// growing pause in between.
+func (h *webhook) deliver(message webhookMessage) {
+	for attempt := 1; attempt <= WEBHOOK_ATTEMPTS; attempt++ {
+		err := h.post(message.body)
+		if err == nil {
+			debugf("Sent %s to the %s webhook.\n", message.description, strings.ToLower(h.name))
+			return
+		}
+		fmt.Printf("%s webhook attempt %d/%d for %s failed: %v\n", h.name, attempt, WEBHOOK_ATTEMPTS, message.description, err)
+		if attempt < WEBHOOK_ATTEMPTS {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+	}
+}
+
+func (h *webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range h.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// leaseChangeEvent compares a parsed lease with the stored row, if any, and
+// returns the event it represents: new for an unknown MAC, renewed when the
+// lease end time moved forward. Infinite leases (end time 0) never renew.
+func leaseChangeEvent(lease DHCPLease, stored bool, storedEnd int64, timestamp string) (LeaseEvent, bool) {
+	event := LeaseEvent{
+		MACAddress:   lease.MACAddress,
+		IPAddress:    lease.IPAddress,
+		Hostname:     lease.Hostname,
+		LeaseEndTime: lease.LeaseEndTime,
+		Timestamp:    timestamp,
+	}
+	switch {
+	case !stored:
+		event.Event = LEASE_EVENT_NEW
+	case storedEnd != 0 && lease.LeaseEndTime > storedEnd:
+		event.Event = LEASE_EVENT_RENEWED
+	default:
+		return event, false
+	}
+	return event, true
+}
+
+// notifyExpiredLeases sends an expired event for every stored lease whose
+// end time has passed since the last check, and marks it so the event fires
+// once. A later renewal clears the mark.
+func notifyExpiredLeases(db *sql.DB, mutex *sync.Mutex, now time.Time) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for expired leases: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT mac_address, COALESCE(ip_address, ''), COALESCE(hostname, ''), lease_end_time
+		FROM dhcp_leases
+		WHERE lease_end_time != 0 AND lease_end_time <= ? AND expired_notified = 0
+	`, now.Unix())
+	if err != nil {
+		return fmt.Errorf("error querying expired leases: %w", err)
+	}
+	timestamp := displayTime(now)
+	var events []LeaseEvent
+	for rows.Next() {
+		event := LeaseEvent{Event: LEASE_EVENT_EXPIRED, Timestamp: timestamp}
+		if err := rows.Scan(&event.MACAddress, &event.IPAddress, &event.Hostname, &event.LeaseEndTime); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning expired leases: %w", err)
+		}
+		events = append(events, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error querying expired leases: %w", err)
+	}
+
+	for _, event := range events {
+		if _, err := tx.Exec("UPDATE dhcp_leases SET expired_notified = 1 WHERE mac_address = ?", event.MACAddress); err != nil {
+			return fmt.Errorf("error marking lease for %s expired: %w", event.MACAddress, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	leaseEvents.send(events)
+	cycleRecords.addLeaseEvents(events)
+	return nil
+}
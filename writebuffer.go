@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// What a heldWrite holds.
+const (
+	WRITE_CLIENTS  = "clients"
+	WRITE_UNPARSED = "unparsed"
+	WRITE_WAN      = "wan"
+	WRITE_LEASES   = "leases"
+)
+
+// heldWrite is one router's readings or leases from one cycle, held by
+// -flush-every or queued for -single-writer. kind is one of the WRITE_
+// constants.
+type heldWrite struct {
+	router  string
+	kind    string
+	updates []TrafficUpdate
+	leases  []DHCPLease
+}
+
+// endpoint is the endpoint whose store stage the write decides.
+func (w heldWrite) endpoint() string {
+	switch w.kind {
+	case WRITE_WAN:
+		return "wan"
+	case WRITE_LEASES:
+		return "dhcp"
+	}
+	return "wifi"
+}
+
+// writeBuffer keeps the traffic readings and DHCP leases of each cycle in
+// memory and writes them only every Nth cycle, to spare the flash storage
+// of low-power routers. The readings are replayed in the order they were
+// taken, each with its own time, so counter resets and history rows come
+// out as if they had been written at once; only the write is delayed.
+// Anything still held is lost if the process dies without shutting down.
+type writeBuffer struct {
+	mutex  sync.Mutex
+	every  int
+	cycles int
+	held   []heldWrite
+}
+
+// pendingWrites is nil unless -flush-every is above 1; a nil buffer holds
+// nothing and every cycle writes.
+var pendingWrites *writeBuffer
+
+func newWriteBuffer(every int) *writeBuffer {
+	return &writeBuffer{every: every}
+}
+
+// due counts a cycle and reports whether it is one that writes, i.e. every
+// Nth since the last.
+func (b *writeBuffer) due() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.cycles++
+	if b.cycles < b.every {
+		return false
+	}
+	b.cycles = 0
+	return true
+}
+
+// holdUpdates keeps a router's readings of kind for the next flush, stamped
+// with the time they were read. It reports false when there is no buffer
+// and the caller should write them itself.
+func (b *writeBuffer) holdUpdates(router, kind string, updates []TrafficUpdate) bool {
+	if b == nil {
+		return false
+	}
+	now := time.Now()
+	held := make([]TrafficUpdate, len(updates))
+	for i, u := range updates {
+		if u.ReadAt.IsZero() {
+			u.ReadAt = now
+		}
+		held[i] = u
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.held = append(b.held, heldWrite{router: router, kind: kind, updates: held})
+	return true
+}
+
+// holdLeases keeps a router's leases for the next flush, like holdUpdates.
+func (b *writeBuffer) holdLeases(router string, leases []DHCPLease) bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.held = append(b.held, heldWrite{router: router, kind: WRITE_LEASES, leases: leases})
+	return true
+}
+
+// heldBefore reports whether any held reading was taken before t, e.g. in
+// the previous billing period.
+func (b *writeBuffer) heldBefore(t time.Time) bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, write := range b.held {
+		for _, u := range write.updates {
+			if u.ReadAt.Before(t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// size returns the number of readings and leases held.
+func (b *writeBuffer) size() (updates, leases int) {
+	if b == nil {
+		return 0, 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, write := range b.held {
+		updates += len(write.updates)
+		leases += len(write.leases)
+	}
+	return updates, leases
+}
+
+// flush writes everything held, in order (see storeWrites). Writes for a
+// database that is nil, i.e. that couldn't be opened, stay held for the
+// next flush.
+func (b *writeBuffer) flush(connStats, connDHCP *sql.DB) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	var flushing, kept []heldWrite
+	for _, write := range b.held {
+		if (write.updates != nil && connStats == nil) || (write.leases != nil && connDHCP == nil) {
+			kept = append(kept, write)
+		} else {
+			flushing = append(flushing, write)
+		}
+	}
+	b.held = kept
+	b.mutex.Unlock()
+
+	if len(kept) > 0 {
+		fmt.Printf("Warning: Keeping %d held writes until their database is available.\n", len(kept))
+	}
+
+	updates, leases := 0, 0
+	for _, write := range flushing {
+		updates += len(write.updates)
+		leases += len(write.leases)
+	}
+	for _, result := range storeWrites(flushing, connStats, connDHCP) {
+		for _, message := range result.Errors {
+			fmt.Println(message)
+		}
+	}
+	debugf("Flushed %d held readings and %d leases.\n", updates, leases)
+}
+
+// storeWrites writes writes in order and returns, per router in order of
+// appearance, what was stored as the router's processing would have
+// recorded it. The readings go in one transaction, or write by write with
+// storeClientUpdates' one-by-one fallback if that fails.
+func storeWrites(writes []heldWrite, connStats, connDHCP *sql.DB) []*RouterResult {
+	var results []*RouterResult
+	byRouter := map[string]*RouterResult{}
+	var updates []TrafficUpdate
+	for _, write := range writes {
+		if byRouter[write.router] == nil {
+			byRouter[write.router] = &RouterResult{Router: write.router}
+			results = append(results, byRouter[write.router])
+		}
+		updates = append(updates, write.updates...)
+	}
+	batched := len(updates) == 0 || updateTrafficStatsBatch(connStats, &dbMutex, updates) == nil
+
+	for _, write := range writes {
+		result := byRouter[write.router]
+		if write.kind == WRITE_LEASES {
+			storeLeases(result, connStats, connDHCP, write.leases)
+			continue
+		}
+		stored := len(write.updates)
+		if !batched {
+			stored = storeClientUpdates(result, connStats, write.updates)
+		}
+		switch write.kind {
+		case WRITE_CLIENTS:
+			result.Clients += stored
+		case WRITE_WAN:
+			result.WAN = result.WAN || stored > 0
+		}
+		result.endpoint(write.endpoint()).stored(stored == len(write.updates))
+	}
+	return results
+}
+
+// flushPendingWrites opens the databases and flushes whatever is held, for
+// shutdown.
+func flushPendingWrites() {
+	updates, leases := pendingWrites.size()
+	if updates == 0 && leases == 0 {
+		return
+	}
+	connStats, connDHCP, err := openCycleDBs()
+	if err != nil {
+		fmt.Printf("Error flushing %d held readings and %d leases, they are lost: %v\n", updates, leases, err)
+		return
+	}
+	if connStats != nil {
+		defer connStats.Close()
+	}
+	if connDHCP != nil && connDHCP != connStats {
+		defer connDHCP.Close()
+	}
+	pendingWrites.flush(connStats, connDHCP)
+	fmt.Printf("Flushed %d held readings and %d leases.\n", updates, leases)
+}
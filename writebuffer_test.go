@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteBufferDue(t *testing.T) {
+	var none *writeBuffer
+	if !none.due() || none.holdUpdates("r1", WRITE_CLIENTS, nil) || none.holdLeases("r1", nil) {
+		t.Fatal("nil buffer held writes")
+	}
+
+	b := newWriteBuffer(3)
+	for cycle, want := range []bool{false, false, true, false, false, true} {
+		if got := b.due(); got != want {
+			t.Errorf("cycle %d: due = %v, want %v", cycle+1, got, want)
+		}
+	}
+}
+
+func TestWriteBufferFlushOnShutdown(t *testing.T) {
+	dir := t.TempDir()
+	oldStats, oldDHCP, oldPending := *statsDBPath, *dhcpDBPath, pendingWrites
+	defer func() { *statsDBPath, *dhcpDBPath, pendingWrites = oldStats, oldDHCP, oldPending }()
+	*statsDBPath = filepath.Join(dir, "network_stats.db")
+	*dhcpDBPath = filepath.Join(dir, "dhcp_leases.db")
+
+	b := newWriteBuffer(3)
+	pendingWrites = b
+	const mac = "aa:bb:cc:dd:ee:01"
+	first := time.Now().Add(-time.Hour)
+	b.holdUpdates("r1", WRITE_CLIENTS, []TrafficUpdate{{EntityID: mac, Source: "r1", RXBytes: 100, TXBytes: 10, ReadAt: first}})
+	b.holdUpdates("r1", WRITE_CLIENTS, []TrafficUpdate{{EntityID: mac, Source: "r1", RXBytes: 150, TXBytes: 15, ReadAt: first.Add(30 * time.Minute)}})
+	b.holdUpdates("r1", WRITE_CLIENTS, []TrafficUpdate{{EntityID: mac, Source: "r1", RXBytes: 180, TXBytes: 25}})
+	b.holdLeases("r1", []DHCPLease{{MACAddress: mac, IPAddress: "10.0.0.2", Hostname: "laptop"}})
+	if updates, leases := b.size(); updates != 3 || leases != 1 {
+		t.Fatalf("buffer holds %d readings and %d leases, want 3 and 1", updates, leases)
+	}
+	if !b.heldBefore(first.Add(time.Minute)) || b.heldBefore(first.Add(-time.Minute)) {
+		t.Error("heldBefore doesn't go by the oldest held reading")
+	}
+
+	flushPendingWrites()
+	if updates, leases := b.size(); updates != 0 || leases != 0 {
+		t.Fatalf("buffer still holds %d readings and %d leases after the flush", updates, leases)
+	}
+
+	db, err := connectDB(*statsDBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if rx, tx := monthlyTotals(t, db, mac); rx != 180 || tx != 25 {
+		t.Errorf("monthly totals = %d/%d, want 180/25", rx, tx)
+	}
+	// Held readings keep the time they were taken.
+	var oldest string
+	if err := db.QueryRow("SELECT MIN(timestamp) FROM traffic_history").Scan(&oldest); err != nil {
+		t.Fatal(err)
+	}
+	if oldest != storedTime(first) {
+		t.Errorf("oldest history row at %s, want %s", oldest, storedTime(first))
+	}
+
+	dhcp, err := connectDB(*dhcpDBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dhcp.Close()
+	var leases int
+	if err := dhcp.QueryRow("SELECT COUNT(*) FROM dhcp_leases").Scan(&leases); err != nil {
+		t.Fatal(err)
+	}
+	if leases != 1 {
+		t.Errorf("%d leases stored, want 1", leases)
+	}
+
+	// Writes for a database that couldn't be opened stay held.
+	b.holdUpdates("r1", WRITE_CLIENTS, []TrafficUpdate{{EntityID: mac, Source: "r1", RXBytes: 200}})
+	b.flush(nil, dhcp)
+	if updates, _ := b.size(); updates != 1 {
+		t.Errorf("buffer holds %d readings after a flush without the stats database, want 1", updates)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+)
+
+// WRITER_COMMIT_READINGS is how many readings -single-writer holds before
+// committing ahead of the end of the cycle, which bounds its memory on a
+// large fleet. Producers wait while it commits.
+const WRITER_COMMIT_READINGS = 5000
+
+// recordWriter is -single-writer: one goroutine per cycle that owns the
+// cycle's database connections. Router goroutines only fetch and parse and
+// send their readings and leases over a buffered channel, blocking while it
+// is full, instead of taking dbMutex around a transaction each. The writer
+// commits everything at the end of the cycle in router order, so the order
+// of writes doesn't depend on which router answered first, and reports the
+// outcome per router for the cycle's summary. Delegated prefixes and the
+// cycle's upkeep are still written directly.
+type recordWriter struct {
+	connStats *sql.DB
+	connDHCP  *sql.DB
+	writes    chan heldWrite
+	quit      chan struct{}
+	done      chan struct{}
+
+	// Senders hold closing for reading while they queue, so stop can't
+	// drain the queue between a sender's check of closed and its send.
+	closing sync.RWMutex
+	closed  bool
+
+	// Only touched by the writer goroutine, and by stop after it is done.
+	held     []heldWrite
+	readings int
+	results  map[string]*RouterResult
+}
+
+func startRecordWriter(connStats, connDHCP *sql.DB, queue int) *recordWriter {
+	w := &recordWriter{
+		connStats: connStats,
+		connDHCP:  connDHCP,
+		writes:    make(chan heldWrite, queue),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+		results:   map[string]*RouterResult{},
+	}
+	go w.run()
+	return w
+}
+
+// send queues a router's write, waiting while the queue is full. It reports
+// false when there is no writer, or the cycle is over and its router was
+// abandoned, and the caller should write it itself.
+func (w *recordWriter) send(write heldWrite) bool {
+	if w == nil {
+		return false
+	}
+	w.closing.RLock()
+	defer w.closing.RUnlock()
+	if w.closed {
+		return false
+	}
+	select {
+	case w.writes <- write:
+		return true
+	default:
+	}
+	// The writer keeps draining until stop, which waits for us.
+	debugf("%s: waiting for the writer, %d writes queued.\n", write.router, len(w.writes))
+	w.writes <- write
+	return true
+}
+
+func (w *recordWriter) run() {
+	defer close(w.done)
+	for {
+		select {
+		case write := <-w.writes:
+			w.hold(write)
+		case <-w.quit:
+			for {
+				select {
+				case write := <-w.writes:
+					w.hold(write)
+				default:
+					w.commit()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *recordWriter) hold(write heldWrite) {
+	w.held = append(w.held, write)
+	w.readings += len(write.updates)
+	if w.readings >= WRITER_COMMIT_READINGS {
+		debugf("Writer holds %d readings, committing early.\n", w.readings)
+		w.commit()
+	}
+}
+
+// commit writes what is held, router by router in address order and each
+// router's writes in the order they were sent.
+func (w *recordWriter) commit() {
+	if len(w.held) == 0 {
+		return
+	}
+	sort.SliceStable(w.held, func(i, j int) bool { return w.held[i].router < w.held[j].router })
+	for _, result := range storeWrites(w.held, w.connStats, w.connDHCP) {
+		if previous, ok := w.results[result.Router]; ok {
+			previous.mergeStored(*result)
+		} else {
+			w.results[result.Router] = result
+		}
+	}
+	w.held, w.readings = nil, 0
+}
+
+// stop commits whatever is still queued once the cycle's routers are done,
+// and returns what was stored for each router.
+func (w *recordWriter) stop() map[string]*RouterResult {
+	if w == nil {
+		return nil
+	}
+	w.closing.Lock()
+	w.closed = true
+	w.closing.Unlock()
+	close(w.quit)
+	<-w.done
+	return w.results
+}
+
+// mergeStored adds the outcome of the router's writes, made by the writer
+// after the router finished, to r.
+func (r *RouterResult) mergeStored(stored RouterResult) {
+	r.Clients += stored.Clients
+	r.WAN = r.WAN || stored.WAN
+	r.Leases += stored.Leases
+	r.Errors = append(r.Errors, stored.Errors...)
+	for category, n := range stored.ErrorCounts {
+		if r.ErrorCounts == nil {
+			r.ErrorCounts = map[string]int{}
+		}
+		r.ErrorCounts[category] += n
+	}
+	for name, e := range stored.Endpoints {
+		if e.Store != STAGE_SKIPPED {
+			r.endpoint(name).stored(e.Store == STAGE_OK)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// routerWrites returns the client readings a router with clients clients
+// sends in one cycle, each at rx and tx bytes.
+func routerWrites(router string, index, clients int, rx, tx int64) []TrafficUpdate {
+	updates := make([]TrafficUpdate, 0, clients)
+	for c := 0; c < clients; c++ {
+		mac := fmt.Sprintf("aa:bb:%02x:%02x:%02x:%02x", index/256, index%256, c/256, c%256)
+		updates = append(updates, TrafficUpdate{EntityID: mac, Source: router, RXBytes: rx, TXBytes: tx})
+	}
+	return updates
+}
+
+func TestRecordWriter(t *testing.T) {
+	db := openTestStatsDB(t)
+	dhcp := openTestDHCPDB(t)
+
+	var none *recordWriter
+	if none.send(heldWrite{router: "10.0.0.1"}) || none.stop() != nil {
+		t.Fatal("nil writer accepted a write")
+	}
+
+	// A queue of one keeps the routers waiting on the writer.
+	w := startRecordWriter(db, dhcp, 1)
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			router := fmt.Sprintf("10.0.0.%d", r)
+			writes := []heldWrite{
+				{router: router, kind: WRITE_CLIENTS, updates: routerWrites(router, r, 20, 100, 10)},
+				{router: router, kind: WRITE_WAN, updates: []TrafficUpdate{{EntityID: MAIN_WAN_ID + ":" + router, Source: router, RXBytes: 5, TXBytes: 5}}},
+				{router: router, kind: WRITE_LEASES, leases: []DHCPLease{{MACAddress: fmt.Sprintf("aa:bb:00:%02x:00:00", r), IPAddress: "10.1.0.1", Hostname: "host"}}},
+			}
+			for _, write := range writes {
+				if !w.send(write) {
+					t.Errorf("%s: writer refused a write before stop", router)
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	stored := w.stop()
+	if len(stored) != 8 {
+		t.Fatalf("writer stored %d routers, want 8", len(stored))
+	}
+	for router, result := range stored {
+		if result.Clients != 20 || !result.WAN || result.Leases != 1 || len(result.Errors) != 0 {
+			t.Errorf("%s: stored %+v", router, result)
+		}
+		for _, endpoint := range []string{"wifi", "wan", "dhcp"} {
+			if result.Endpoints[endpoint].Store != STAGE_OK {
+				t.Errorf("%s: %s store stage is %v", router, endpoint, result.Endpoints[endpoint].Store)
+			}
+		}
+	}
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM monthly_stats").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 8*21 {
+		t.Errorf("monthly_stats has %d rows, want %d", rows, 8*21)
+	}
+
+	if w.send(heldWrite{router: "10.0.0.1", kind: WRITE_CLIENTS}) {
+		t.Error("writer accepted a write after stop")
+	}
+}
+
+// TestRecordWriterStopWhileSending stops the writer while routers are still
+// sending: every write it accepted must be stored, and none may be lost.
+func TestRecordWriterStopWhileSending(t *testing.T) {
+	db := openTestStatsDB(t)
+	dhcp := openTestDHCPDB(t)
+
+	w := startRecordWriter(db, dhcp, 1)
+	accepted := make([]bool, 16)
+	var wg sync.WaitGroup
+	for r := range accepted {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			router := fmt.Sprintf("10.0.1.%d", r)
+			accepted[r] = w.send(heldWrite{router: router, kind: WRITE_CLIENTS, updates: routerWrites(router, r, 1, 100, 10)})
+		}(r)
+	}
+	stored := w.stop()
+	wg.Wait()
+
+	for r, ok := range accepted {
+		router := fmt.Sprintf("10.0.1.%d", r)
+		if _, found := stored[router]; ok != found {
+			t.Errorf("%s: accepted %v but stored %v", router, ok, found)
+		}
+	}
+}
+
+// benchmarkWrites times one cycle's client writes from routers routers of
+// 30 clients each, either through the single writer or each router in its
+// own transaction.
+func benchmarkWrites(b *testing.B, routers int, single bool) {
+	db := openTestStatsDB(b)
+	dhcp := openTestDHCPDB(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var w *recordWriter
+		if single {
+			w = startRecordWriter(db, dhcp, 64)
+		}
+		var wg sync.WaitGroup
+		for r := 0; r < routers; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				router := fmt.Sprintf("10.0.%d.1", r)
+				updates := routerWrites(router, r, 30, int64(100*(i+1)), int64(10*(i+1)))
+				if !w.send(heldWrite{router: router, kind: WRITE_CLIENTS, updates: updates}) {
+					storeClientUpdates(&RouterResult{Router: router}, db, updates)
+				}
+			}(r)
+		}
+		wg.Wait()
+		w.stop()
+	}
+}
+
+func BenchmarkWritesPerRouter50(b *testing.B)    { benchmarkWrites(b, 50, false) }
+func BenchmarkWritesSingleWriter50(b *testing.B) { benchmarkWrites(b, 50, true) }